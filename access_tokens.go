@@ -0,0 +1,235 @@
+package main
+
+// this file deals with personal access tokens
+//
+// scripts and bots act on someone's behalf with a token the user creates
+// through /api/tokens, sent as "Authorization: Bearer upn_...". A token
+// carries scopes, and is only good for the routes listed in
+// accessTokenRoutes, with the scope named there. Everything else, including
+// managing tokens, needs a real login. Only a hash of the token is stored.
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+)
+
+const (
+	accessTokenPrefix = "upn_"
+
+	scopeRead   = "read"
+	scopeSubmit = "submit"
+	scopeVote   = "vote"
+
+	// last_used_at is only written this often, not on every request
+	accessTokenTouchEvery = time.Minute
+
+	accessTokenColumns = `token_id, user_id, name, scopes, token_hash, created_at, expires_at, last_used_at, revoked`
+)
+
+var (
+	ErrInvalidScopes       = errors.New("scopes must be some of read, submit and vote")
+	ErrInvalidAccessToken  = errors.New("invalid, expired or revoked access token")
+	ErrAccessTokenNotFound = errors.New("access token not found")
+
+	accessTokenScopes = map[string]bool{
+		scopeRead:   true,
+		scopeSubmit: true,
+		scopeVote:   true,
+	}
+
+	// routes access tokens may be used on, and the scope each needs
+	accessTokenRoutes = map[string]string{
+		"/api/links":             scopeRead,
+		"/api/link/:id":          scopeRead,
+		"/api/link/new":          scopeSubmit,
+		"/api/link/upvote":       scopeVote,
+		"/api/link/downvote":     scopeVote,
+		"/api/radio/now_playing": scopeRead,
+		"/api/radio/queue":       scopeRead,
+
+		v2Prefix + "/links":             scopeRead,
+		v2Prefix + "/link/:id":          scopeRead,
+		v2Prefix + "/link/new":          scopeSubmit,
+		v2Prefix + "/link/upvote":       scopeVote,
+		v2Prefix + "/link/downvote":     scopeVote,
+		v2Prefix + "/radio/now_playing": scopeRead,
+		v2Prefix + "/radio/queue":       scopeRead,
+	}
+)
+
+// scanAccessToken reads a row of accessTokenColumns
+func scanAccessToken(row interface{ Scan(...interface{}) error }) (*AccessToken, error) {
+	t := &AccessToken{}
+	var scopes string
+	err := row.Scan(&t.TokenID, &t.UserID, &t.Name, &scopes, &t.TokenHash,
+		&t.CreatedAt, &t.ExpiresAt, &t.LastUsedAt, &t.Revoked)
+	t.Scopes = splitList(scopes)
+	return t, err
+}
+
+func isAccessToken(raw string) bool {
+	return strings.HasPrefix(raw, accessTokenPrefix)
+}
+
+func hasScope(t *AccessToken, scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateAccessToken returns the new token, which is never shown again, and its details.
+// A ttl of 0 makes a token which doesn't expire.
+func (s *ServiceImpl) CreateAccessToken(userID, name string, scopes []string, ttl time.Duration) (string, *AccessToken, error) {
+	if len(scopes) == 0 {
+		return "", nil, ErrInvalidScopes
+	}
+	for _, scope := range scopes {
+		if !accessTokenScopes[scope] {
+			return "", nil, ErrInvalidScopes
+		}
+	}
+
+	now := time.Now()
+	raw := accessTokenPrefix + newRandomToken()
+	t := &AccessToken{
+		UserID:    userID,
+		Name:      name,
+		Scopes:    scopes,
+		TokenHash: hashToken(raw),
+		CreatedAt: now.Unix(),
+	}
+	if ttl > 0 {
+		t.ExpiresAt = now.Add(ttl).Unix()
+	}
+	tokenID, err := s.accessTokenRepo.CreateAccessToken(*t)
+	if err != nil {
+		return "", nil, err
+	}
+	t.TokenID = tokenID
+	s.audit(userID, auditAccessTokenCreate, userTarget(userID), nil, t)
+	return raw, t, nil
+}
+
+func (s *ServiceImpl) ListAccessTokens(userID string) []AccessToken {
+	return s.accessTokenRepo.ListAccessTokens(userID)
+}
+
+// RevokeAccessTokens revokes one token of the user, or all of them if tokenID is 0
+func (s *ServiceImpl) RevokeAccessTokens(actor, userID string, tokenID int64) error {
+	n, err := s.accessTokenRepo.RevokeAccessTokens(userID, tokenID)
+	if err != nil {
+		return err
+	}
+	if n == 0 && tokenID != 0 {
+		return ErrAccessTokenNotFound
+	}
+	if n > 0 {
+		s.audit(actor, auditAccessTokenRevoke, userTarget(userID), nil,
+			map[string]int64{"token_id": tokenID, "revoked": n})
+	}
+	return nil
+}
+
+// AuthenticateAccessToken returns the token raw stands for, if it is still good
+func (s *ServiceImpl) AuthenticateAccessToken(raw string) (*AccessToken, error) {
+	t := s.accessTokenRepo.GetAccessTokenByHash(hashToken(raw))
+	now := time.Now().Unix()
+	if t == nil || t.Revoked || (t.ExpiresAt > 0 && t.ExpiresAt <= now) {
+		return nil, ErrInvalidAccessToken
+	}
+	if now-t.LastUsedAt >= int64(accessTokenTouchEvery/time.Second) {
+		s.accessTokenRepo.TouchAccessToken(t.TokenID, now)
+	}
+	return t, nil
+}
+
+// useAccessToken authenticates a request made with an access token. Like a JWT,
+// the token's claims end up in the context under "user", without any roles.
+func useAccessToken(c echo.Context, raw string) error {
+	scope, ok := accessTokenRoutes[c.Path()]
+	if !ok {
+		return echo.NewHTTPError(http.StatusForbidden, "access tokens can't be used here")
+	}
+	t, err := service.AuthenticateAccessToken(raw)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+	}
+	if !hasScope(t, scope) {
+		return echo.NewHTTPError(http.StatusForbidden, "access token lacks the "+scope+" scope")
+	}
+
+	c.Set("user", &jwt.Token{
+		Valid: true,
+		Claims: jwt.MapClaims{
+			"user_id":  t.UserID,
+			"token_id": t.TokenID,
+		},
+	})
+	return nil
+}
+
+func accessTokensHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, echo.Map{
+		"tokens": service.ListAccessTokens(getUserIDFromContext(c)),
+	})
+}
+
+func createAccessTokenHandler(c echo.Context) error {
+	form := struct {
+		Name      string `form:"name"`
+		Scopes    string `form:"scopes"`
+		ExpiresIn int64  `form:"expires_in"`
+	}{}
+	if err := c.Bind(&form); err != nil || form.Name == "" || form.ExpiresIn < 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"message": "Missing name, or invalid expires_in",
+		})
+	}
+
+	raw, t, err := service.CreateAccessToken(getUserIDFromContext(c), form.Name,
+		splitList(form.Scopes), time.Duration(form.ExpiresIn)*time.Second)
+	if err == ErrInvalidScopes {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"message": err.Error(),
+		})
+	}
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"token":   raw,
+		"details": t,
+	})
+}
+
+func revokeAccessTokenHandler(c echo.Context) error {
+	tokenID, err := strconv.ParseInt(c.FormValue("token_id"), 10, 64)
+	if err != nil || tokenID <= 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"message": "Missing token_id",
+		})
+	}
+
+	userID := getUserIDFromContext(c)
+	err = service.RevokeAccessTokens(userID, userID, tokenID)
+	if err == ErrAccessTokenNotFound {
+		return c.JSON(http.StatusNotFound, echo.Map{
+			"message": err.Error(),
+		})
+	}
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"message": "Done",
+	})
+}
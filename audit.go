@@ -0,0 +1,176 @@
+package main
+
+// this file deals with the audit log
+// every mutating action goes through ServiceImpl.audit, which appends
+// an entry with the actor, the node it happened on, and before/after snapshots
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	auditLinkSubmit        = "link.submit"
+	auditLinkUpdate        = "link.update"
+	auditLinkApprove       = "link.approve"
+	auditLinkReject        = "link.reject"
+	auditLinkRemove        = "link.remove"
+	auditLinkExpire        = "link.expire"
+	auditLinkArchive       = "link.archive"
+	auditVoteChange        = "vote.change"
+	auditSkipVote          = "vote.skip"
+	auditUserLogin         = "user.login"
+	auditUserLogout        = "user.logout"
+	auditUserRevokeTokens  = "user.revoke_tokens"
+	auditTokenReuse        = "token.reuse"
+	auditIdentityLink      = "identity.link"
+	auditGuestCreate       = "guest.create"
+	auditGuestUpgrade      = "guest.upgrade"
+	auditRateLimitSet      = "rate_limit.set"
+	auditAccessTokenCreate = "access_token.create"
+	auditAccessTokenRevoke = "access_token.revoke"
+	auditRoleGrant         = "role.grant"
+	auditRoleRevoke        = "role.revoke"
+	auditLeaderChange      = "cluster.leader_change"
+	auditWebhookCreate     = "webhook.create"
+	auditWebhookUpdate     = "webhook.update"
+	auditWebhookDelete     = "webhook.delete"
+	auditWebhookRedeliver  = "webhook.redeliver"
+	auditChatDelete        = "chat.delete"
+	auditChatMute          = "chat.mute"
+	auditChatUnmute        = "chat.unmute"
+	auditImport            = "station.import"
+
+	// actor for changes made by the radio engine itself
+	auditActorSystem = "system"
+
+	defaultAuditPageSize int64 = 50
+	maxAuditPageSize     int64 = 500
+)
+
+func linkTarget(linkID int64) string {
+	return fmt.Sprintf("link:%d", linkID)
+}
+
+func userTarget(userID string) string {
+	return "user:" + userID
+}
+
+func nodeTarget(nodeID string) string {
+	return "node:" + nodeID
+}
+
+func webhookTarget(webhookID int64) string {
+	return fmt.Sprintf("webhook:%d", webhookID)
+}
+
+func chatTarget(messageID int64) string {
+	return fmt.Sprintf("chat:%d", messageID)
+}
+
+// snapshot turns whatever was changed into JSON for the audit log
+func snapshot(v interface{}) json.RawMessage {
+	if v == nil {
+		return json.RawMessage("null")
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Println("failed to snapshot for audit", err)
+		return json.RawMessage("null")
+	}
+	return b
+}
+
+func (s *ServiceImpl) audit(actor, action, target string, before, after interface{}) {
+	if s.auditRepo == nil {
+		return
+	}
+	entry := AuditEntry{
+		Actor:     actor,
+		NodeID:    s.nodeID,
+		Action:    action,
+		Target:    target,
+		Before:    snapshot(before),
+		After:     snapshot(after),
+		CreatedAt: time.Now().Unix(),
+	}
+	if err := s.auditRepo.AppendAudit(entry); err != nil {
+		log.Println("failed to append audit entry", action, target, err)
+	}
+}
+
+func (f *AuditFilter) normalize() {
+	if f.Limit <= 0 {
+		f.Limit = defaultAuditPageSize
+	}
+	if f.Limit > maxAuditPageSize {
+		f.Limit = maxAuditPageSize
+	}
+}
+
+// buildAuditListQuery returns the query and its arguments for a filter,
+// written with `?` placeholders like buildLinkListQuery
+func buildAuditListQuery(f AuditFilter) (string, []interface{}) {
+	f.normalize()
+
+	where := make([]string, 0)
+	args := make([]interface{}, 0)
+
+	if f.Actor != "" {
+		where = append(where, "actor = ?")
+		args = append(args, f.Actor)
+	}
+	if f.Action != "" {
+		where = append(where, "action = ?")
+		args = append(args, f.Action)
+	}
+	if f.Target != "" {
+		where = append(where, "target = ?")
+		args = append(args, f.Target)
+	}
+	if f.Since > 0 {
+		where = append(where, "created_at >= ?")
+		args = append(args, f.Since)
+	}
+	if f.Until > 0 {
+		where = append(where, "created_at < ?")
+		args = append(args, f.Until)
+	}
+	if f.Before > 0 {
+		where = append(where, "audit_id < ?")
+		args = append(args, f.Before)
+	}
+	args = append(args, f.Limit)
+
+	query := `
+	  select audit_id, actor, node_id, action, target, before, after, created_at
+	  from audit_log`
+	if len(where) > 0 {
+		query += "\n\t  where " + strings.Join(where, " and ")
+	}
+	query += "\n\t  order by audit_id desc\n\t  limit ?"
+	return query, args
+}
+
+func scanAuditRows(rows *sql.Rows) ([]AuditEntry, error) {
+	defer rows.Close()
+
+	entries := make([]AuditEntry, 0)
+	for rows.Next() {
+		var e AuditEntry
+		var before, after string
+		err := rows.Scan(&e.AuditID, &e.Actor, &e.NodeID, &e.Action, &e.Target,
+			&before, &after, &e.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		e.Before = json.RawMessage(before)
+		e.After = json.RawMessage(after)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,344 @@
+package main
+
+// this file lets listeners talk about what's playing
+//
+// a message is said about the link playing at the time, nothing can be said
+// while the radio is idle. Messages are stored, then handed to the ChatHub,
+// which sends them to the other nodes and to every listener of the chat topic
+// on /api/stream and /api/ws, see chat_hub.go. Moderators can delete messages
+// and mute users, for a while or until they are unmuted. Messages past the
+// -chatretention horizon are deleted by the retention job.
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	maxChatMessageLength = 500
+
+	defaultChatPage int64 = 50
+	maxChatPage     int64 = 200
+
+	chatColumns     = `message_id, link_id, user_id, text, created_at`
+	chatMuteColumns = `user_id, muted_by, reason, muted_at, expires_at`
+)
+
+var (
+	ErrChatMessageNotFound = errors.New("chat message not found")
+	ErrChatMuteNotFound    = errors.New("user is not muted")
+	ErrInvalidChatMessage  = errors.New("a chat message must have between 1 and 500 characters")
+	ErrInvalidMuteDuration = errors.New("duration must be 0 or more seconds")
+	ErrMuted               = errors.New("you are muted in the chat")
+	ErrNothingPlaying      = errors.New("nothing is playing, the chat is about the song playing")
+)
+
+// scanChatMessage reads a row of chatColumns
+func scanChatMessage(row interface{ Scan(...interface{}) error }) (*ChatMessage, error) {
+	m := &ChatMessage{}
+	err := row.Scan(&m.MessageID, &m.LinkID, &m.UserID, &m.Text, &m.CreatedAt)
+	return m, err
+}
+
+func scanChatMessages(rows *sql.Rows) []ChatMessage {
+	defer rows.Close()
+
+	messages := make([]ChatMessage, 0)
+	for rows.Next() {
+		m, err := scanChatMessage(rows)
+		if err != nil {
+			log.Fatal(err)
+		}
+		messages = append(messages, *m)
+	}
+	return messages
+}
+
+// scanChatMute reads a row of chatMuteColumns
+func scanChatMute(row interface{ Scan(...interface{}) error }) (*ChatMute, error) {
+	m := &ChatMute{}
+	err := row.Scan(&m.UserID, &m.MutedBy, &m.Reason, &m.MutedAt, &m.ExpiresAt)
+	return m, err
+}
+
+func scanChatMutes(rows *sql.Rows) []ChatMute {
+	defer rows.Close()
+
+	mutes := make([]ChatMute, 0)
+	for rows.Next() {
+		m, err := scanChatMute(rows)
+		if err != nil {
+			log.Fatal(err)
+		}
+		mutes = append(mutes, *m)
+	}
+	return mutes
+}
+
+// buildChatListQuery returns the query and its arguments for a filter,
+// written with `?` placeholders like buildAuditListQuery
+func buildChatListQuery(f ChatFilter) (string, []interface{}) {
+	where := make([]string, 0)
+	args := make([]interface{}, 0)
+
+	if f.LinkID > 0 {
+		where = append(where, "link_id = ?")
+		args = append(args, f.LinkID)
+	}
+	if f.Before > 0 {
+		where = append(where, "message_id < ?")
+		args = append(args, f.Before)
+	}
+	args = append(args, f.Limit)
+
+	query := `select ` + chatColumns + ` from chat_messages`
+	if len(where) > 0 {
+		query += "\n\t  where " + strings.Join(where, " and ")
+	}
+	query += "\n\t  order by message_id desc\n\t  limit ?"
+	return query, args
+}
+
+// isActive tells if the mute still keeps the user quiet at now
+func (m ChatMute) isActive(now int64) bool {
+	return m.ExpiresAt == 0 || m.ExpiresAt > now
+}
+
+// PostChatMessage stores what a user said while linkID plays
+func (s *ServiceImpl) PostChatMessage(userID string, linkID int64, text string) (*ChatMessage, error) {
+	if linkID == 0 {
+		return nil, ErrNothingPlaying
+	}
+	text = strings.TrimSpace(text)
+	if text == "" || utf8.RuneCountInString(text) > maxChatMessageLength {
+		return nil, ErrInvalidChatMessage
+	}
+	now := time.Now().Unix()
+	if mute := s.chatRepo.GetChatMute(userID); mute != nil && mute.isActive(now) {
+		return nil, ErrMuted
+	}
+
+	m := &ChatMessage{LinkID: linkID, UserID: userID, Text: text, CreatedAt: now}
+	messageID, err := s.chatRepo.AddChatMessage(*m)
+	if err != nil {
+		return nil, err
+	}
+	m.MessageID = messageID
+	return m, nil
+}
+
+func (s *ServiceImpl) ListChatMessages(filter ChatFilter) []ChatMessage {
+	if filter.Limit <= 0 {
+		filter.Limit = defaultChatPage
+	}
+	if filter.Limit > maxChatPage {
+		filter.Limit = maxChatPage
+	}
+	return s.chatRepo.ListChatMessages(filter)
+}
+
+func (s *ServiceImpl) DeleteChatMessage(actor string, messageID int64, reason string) (*ChatMessage, error) {
+	m := s.chatRepo.GetChatMessage(messageID)
+	if m == nil {
+		return nil, ErrChatMessageNotFound
+	}
+	if err := s.chatRepo.DeleteChatMessage(messageID); err != nil {
+		return nil, err
+	}
+	s.audit(actor, auditChatDelete, chatTarget(messageID), m, map[string]string{"reason": reason})
+	return m, nil
+}
+
+// MuteChatUser keeps a user from saying anything for d, or until unmuted when d is 0
+func (s *ServiceImpl) MuteChatUser(actor, userID string, d time.Duration, reason string) (*ChatMute, error) {
+	if d < 0 {
+		return nil, ErrInvalidMuteDuration
+	}
+	now := time.Now()
+	mute := &ChatMute{UserID: userID, MutedBy: actor, Reason: reason, MutedAt: now.Unix()}
+	if d > 0 {
+		mute.ExpiresAt = now.Add(d).Unix()
+	}
+	before := s.chatRepo.GetChatMute(userID)
+	if err := s.chatRepo.SetChatMute(*mute); err != nil {
+		return nil, err
+	}
+	s.audit(actor, auditChatMute, userTarget(userID), before, mute)
+	return mute, nil
+}
+
+func (s *ServiceImpl) UnmuteChatUser(actor, userID string) error {
+	mute := s.chatRepo.GetChatMute(userID)
+	if mute == nil || !mute.isActive(time.Now().Unix()) {
+		return ErrChatMuteNotFound
+	}
+	if err := s.chatRepo.DeleteChatMute(userID); err != nil {
+		return err
+	}
+	s.audit(actor, auditChatUnmute, userTarget(userID), mute, nil)
+	return nil
+}
+
+func (s *ServiceImpl) ListChatMutes() []ChatMute {
+	return s.chatRepo.ListChatMutes(time.Now().Unix())
+}
+
+func (s *ServiceImpl) PruneChatMessages(createdBefore time.Time) error {
+	return s.chatRepo.DeleteChatMessages(createdBefore.Unix())
+}
+
+func (s *ServiceImpl) PruneChatMutes(now time.Time) error {
+	return s.chatRepo.DeleteExpiredChatMutes(now.Unix())
+}
+
+// withAuthors fills in who said each message
+func withAuthors(messages []ChatMessage) []ChatMessage {
+	for i, m := range messages {
+		u := users.get(m.UserID)
+		messages[i].FirstName, messages[i].LastName = u.FirstName, u.LastName
+	}
+	return messages
+}
+
+// sayInChat posts a message about the song playing, and hands it to every listener
+func sayInChat(userID, text string) (*ChatMessage, error) {
+	var linkID int64
+	if radio != nil {
+		if nowPlaying := radio.state().nowPlaying; nowPlaying != nil {
+			linkID = nowPlaying.LinkID
+		}
+	}
+	m, err := service.PostChatMessage(userID, linkID, text)
+	if err != nil {
+		return nil, err
+	}
+	m = &withAuthors([]ChatMessage{*m})[0]
+	chats.Post(chatEvent{Kind: chatTopic, Message: *m})
+	return m, nil
+}
+
+// deleteFromChat deletes a message, and takes it back from every listener
+func deleteFromChat(actor string, messageID int64, reason string) error {
+	m, err := service.DeleteChatMessage(actor, messageID, reason)
+	if err != nil {
+		return err
+	}
+	chats.Post(chatEvent{Kind: chatDeletedEvent, Message: ChatMessage{MessageID: m.MessageID, LinkID: m.LinkID}})
+	return nil
+}
+
+// chatErrorStatus is the status to answer a failed chat request with, 0 for internal errors
+func chatErrorStatus(err error) int {
+	switch err {
+	case ErrInvalidChatMessage, ErrInvalidMuteDuration:
+		return http.StatusBadRequest
+	case ErrMuted:
+		return http.StatusForbidden
+	case ErrChatMessageNotFound, ErrChatMuteNotFound:
+		return http.StatusNotFound
+	case ErrNothingPlaying:
+		return http.StatusConflict
+	}
+	return 0
+}
+
+func chatResponse(c echo.Context, data interface{}, err error) error {
+	if err == nil {
+		return c.JSON(http.StatusOK, data)
+	}
+	if status := chatErrorStatus(err); status != 0 {
+		return c.JSON(status, echo.Map{
+			"message": err.Error(),
+		})
+	}
+	return err
+}
+
+// chatHandler lists messages, the newest first, about link_id or any link
+func chatHandler(c echo.Context) error {
+	var filter ChatFilter
+	intParams := map[string]*int64{
+		"link_id": &filter.LinkID,
+		"before":  &filter.Before,
+		"limit":   &filter.Limit,
+	}
+	for name, dst := range intParams {
+		if v := c.QueryParam(name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, echo.Map{
+					"message": "Invalid " + name,
+				})
+			}
+			*dst = n
+		}
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{
+		"messages": withAuthors(service.ListChatMessages(filter)),
+	})
+}
+
+func sayInChatHandler(c echo.Context) error {
+	text := c.FormValue("text")
+	if text == "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"message": "Missing text",
+		})
+	}
+	m, err := sayInChat(getUserIDFromContext(c), text)
+	return chatResponse(c, m, err)
+}
+
+func deleteChatMessageHandler(c echo.Context) error {
+	messageID, err := strconv.ParseInt(c.FormValue("message_id"), 10, 64)
+	if err != nil || messageID <= 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"message": "Missing message_id",
+		})
+	}
+	err = deleteFromChat(getUserIDFromContext(c), messageID, c.FormValue("reason"))
+	return chatResponse(c, echo.Map{"message": "Done"}, err)
+}
+
+func chatMutesHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, echo.Map{
+		"mutes": service.ListChatMutes(),
+	})
+}
+
+// muteChatUserHandler mutes user_id for duration seconds, or until unmuted when it is missing
+func muteChatUserHandler(c echo.Context) error {
+	form := struct {
+		UserID   string `form:"user_id"`
+		Duration int64  `form:"duration"`
+		Reason   string `form:"reason"`
+	}{}
+	if err := c.Bind(&form); err != nil || form.UserID == "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"message": "Missing user_id",
+		})
+	}
+	mute, err := service.MuteChatUser(getUserIDFromContext(c), form.UserID,
+		time.Duration(form.Duration)*time.Second, form.Reason)
+	return chatResponse(c, mute, err)
+}
+
+func unmuteChatUserHandler(c echo.Context) error {
+	userID := c.FormValue("user_id")
+	if userID == "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"message": "Missing user_id",
+		})
+	}
+	err := service.UnmuteChatUser(getUserIDFromContext(c), userID)
+	return chatResponse(c, echo.Map{"message": "Done"}, err)
+}
@@ -0,0 +1,180 @@
+package main
+
+// this file hands the chat to every listener, behind whichever node
+//
+// each node keeps the latest messages in a ChatHub, loaded from the database
+// on startup. Something said or deleted on a node is applied to its hub and
+// broadcast to the other nodes, which apply it to theirs, see shareChat.
+// Listeners get the backlog when they connect, then every event as it comes.
+// Chat events have no id: a reconnecting listener gets the backlog again,
+// and tells messages it has already seen by their message_id.
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	// the topic of the chat, and the event of a message said
+	chatTopic = "chat"
+	// the event of a message a moderator deleted
+	chatDeletedEvent = "chatDeleted"
+
+	// messages a listener gets on connecting
+	chatBacklogSize = 50
+	// events kept for listeners who are catching up
+	chatEventsKept = 200
+)
+
+// chatEvent is a message said, or deleted, on some node
+type chatEvent struct {
+	Kind    string      `json:"kind"`
+	Message ChatMessage `json:"message"`
+
+	seq int64
+}
+
+// data is what listeners are sent, deleted messages are only named
+func (e chatEvent) data() interface{} {
+	if e.Kind == chatDeletedEvent {
+		return echo.Map{
+			"message_id": e.Message.MessageID,
+			"link_id":    e.Message.LinkID,
+		}
+	}
+	return e.Message
+}
+
+// ChatHub keeps the latest messages, and wakes the listeners when there are more
+type ChatHub struct {
+	seq int64
+	// the latest messages and events, oldest first
+	backlog []ChatMessage
+	events  []chatEvent
+
+	listeners map[chan struct{}]bool
+	mutex     *sync.Mutex
+
+	// publish sends an event to the other nodes, if set
+	publish func(e chatEvent)
+}
+
+func NewChatHub() *ChatHub {
+	return &ChatHub{
+		backlog:   make([]ChatMessage, 0),
+		events:    make([]chatEvent, 0),
+		listeners: make(map[chan struct{}]bool),
+		mutex:     &sync.Mutex{},
+	}
+}
+
+// Load starts the backlog with messages from the database, the newest first
+func (h *ChatHub) Load(messages []ChatMessage) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.backlog = make([]ChatMessage, 0, len(messages))
+	for i := len(messages) - 1; i >= 0; i-- {
+		h.backlog = append(h.backlog, messages[i])
+	}
+}
+
+// Post applies an event which happened on this node, and tells the other nodes
+func (h *ChatHub) Post(e chatEvent) {
+	h.Apply(e)
+	if h.publish != nil {
+		go h.publish(e)
+	}
+}
+
+// Apply records an event from any node, and wakes the listeners
+func (h *ChatHub) Apply(e chatEvent) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	switch e.Kind {
+	case chatTopic:
+		for _, m := range h.backlog {
+			if m.MessageID == e.Message.MessageID {
+				return
+			}
+		}
+		h.backlog = append(h.backlog, e.Message)
+		if len(h.backlog) > chatBacklogSize {
+			h.backlog = h.backlog[len(h.backlog)-chatBacklogSize:]
+		}
+	case chatDeletedEvent:
+		for i, m := range h.backlog {
+			if m.MessageID == e.Message.MessageID {
+				h.backlog = append(h.backlog[:i:i], h.backlog[i+1:]...)
+				break
+			}
+		}
+	default:
+		log.Println("unknown chat event", e.Kind)
+		return
+	}
+
+	h.seq++
+	e.seq = h.seq
+	h.events = append(h.events, e)
+	if len(h.events) > chatEventsKept {
+		h.events = h.events[len(h.events)-chatEventsKept:]
+	}
+	for l := range h.listeners {
+		select {
+		case l <- struct{}{}:
+		default:
+			// already woken up
+		}
+	}
+}
+
+// Backlog returns the latest messages, oldest first, and the seq they are current as of
+func (h *ChatHub) Backlog() ([]ChatMessage, int64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return append([]ChatMessage{}, h.backlog...), h.seq
+}
+
+// Since returns the events after seq, oldest first. A listener who fell
+// further behind than chatEventsKept misses some.
+func (h *ChatHub) Since(seq int64) []chatEvent {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	events := make([]chatEvent, 0)
+	for _, e := range h.events {
+		if e.seq > seq {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+func (h *ChatHub) listen() chan struct{} {
+	l := make(chan struct{}, 1)
+	h.mutex.Lock()
+	h.listeners[l] = true
+	h.mutex.Unlock()
+	return l
+}
+
+func (h *ChatHub) unlisten(l chan struct{}) {
+	h.mutex.Lock()
+	delete(h.listeners, l)
+	h.mutex.Unlock()
+}
+
+// writeChatEvent writes an SSE event without an id, see above
+func writeChatEvent(w http.ResponseWriter, event string, value interface{}) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		log.Println("failed to marshal", event, "for a stream", err)
+		return
+	}
+	fmt.Fprint(w, "event: ", event, "\ndata: ", string(raw), "\n\n")
+}
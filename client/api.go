@@ -0,0 +1,467 @@
+package client
+
+// one method per route of the API, grouped like the tags of openapi.json
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"time"
+)
+
+func setIf(v url.Values, key, value string) {
+	if value != "" {
+		v.Set(key, value)
+	}
+}
+
+func setIfPositive(v url.Values, key string, value int64) {
+	if value > 0 {
+		v.Set(key, itoa(value))
+	}
+}
+
+// Health checks the node is up
+func (c *Client) Health(ctx context.Context) error {
+	return c.get(ctx, "/health", nil, nil)
+}
+
+// Cluster tells what the node knows about the cluster, and who leads it
+func (c *Client) Cluster(ctx context.Context) (*ClusterStatus, error) {
+	var status ClusterStatus
+	if err := c.get(ctx, "/cluster", nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// auth
+
+// Login logs in with a Google ID token, and starts using the access token
+func (c *Client) Login(ctx context.Context, idToken string) (*Tokens, error) {
+	return c.useTokens(c.postTokens(ctx, "/login", url.Values{"id_token": {idToken}}))
+}
+
+// Guest starts a guest session, and starts using its access token
+func (c *Client) Guest(ctx context.Context) (*Tokens, error) {
+	return c.useTokens(c.postTokens(ctx, "/guest", nil))
+}
+
+// Refresh swaps a refresh token for a new pair, and starts using the new access token
+func (c *Client) Refresh(ctx context.Context, refreshToken string) (*Tokens, error) {
+	return c.useTokens(c.postTokens(ctx, "/token/refresh", url.Values{"refresh_token": {refreshToken}}))
+}
+
+func (c *Client) postTokens(ctx context.Context, path string, form url.Values) (*Tokens, error) {
+	var t Tokens
+	if err := c.post(ctx, path, form, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (c *Client) useTokens(t *Tokens, err error) (*Tokens, error) {
+	if err == nil {
+		c.Token = t.Token
+	}
+	return t, err
+}
+
+func (c *Client) Logout(ctx context.Context) error {
+	return c.post(ctx, "/logout", nil, nil)
+}
+
+func (c *Client) LogoutEverywhere(ctx context.Context) error {
+	return c.post(ctx, "/logout/everywhere", nil, nil)
+}
+
+// StreamTicket gets a ticket good for opening a stream within a minute
+func (c *Client) StreamTicket(ctx context.Context) (*StreamTicket, error) {
+	var t StreamTicket
+	if err := c.post(ctx, "/stream_ticket", nil, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (c *Client) OIDCProviders(ctx context.Context) ([]string, error) {
+	var out struct {
+		Providers []string `json:"providers"`
+	}
+	err := c.get(ctx, "/oidc/providers", nil, &out)
+	return out.Providers, err
+}
+
+// OIDCLoginURL is where to send a browser to log in with a provider
+func (c *Client) OIDCLoginURL(provider string) string {
+	return c.url("/oidc/"+url.PathEscape(provider)+"/login", nil)
+}
+
+func (c *Client) Identities(ctx context.Context) ([]Identity, error) {
+	var out struct {
+		Identities []Identity `json:"identities"`
+	}
+	err := c.get(ctx, "/identities", nil, &out)
+	return out.Identities, err
+}
+
+// tokens
+
+func (c *Client) AccessTokens(ctx context.Context) ([]AccessToken, error) {
+	var out struct {
+		Tokens []AccessToken `json:"tokens"`
+	}
+	err := c.get(ctx, "/tokens", nil, &out)
+	return out.Tokens, err
+}
+
+// CreateAccessToken creates a personal access token, expiresIn is in seconds, 0 for no expiry
+func (c *Client) CreateAccessToken(ctx context.Context, name string, scopes []string, expiresIn int64) (*NewAccessToken, error) {
+	var t NewAccessToken
+	form := url.Values{
+		"name":       {name},
+		"scopes":     {strings.Join(scopes, ",")},
+		"expires_in": {itoa(expiresIn)},
+	}
+	if err := c.post(ctx, "/tokens", form, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (c *Client) RevokeAccessToken(ctx context.Context, tokenID int64) error {
+	return c.post(ctx, "/tokens/revoke", url.Values{"token_id": {itoa(tokenID)}}, nil)
+}
+
+// links
+
+func (c *Client) ListLinks(ctx context.Context, f LinkFilter) (*LinkPage, error) {
+	query := url.Values{}
+	setIf(query, "submitted_by", f.SubmittedBy)
+	setIf(query, "channel", f.Channel)
+	setIf(query, "state", f.State)
+	setIf(query, "sort", f.Sort)
+	setIf(query, "cursor", f.Cursor)
+	setIfPositive(query, "from", f.From)
+	setIfPositive(query, "to", f.To)
+	setIfPositive(query, "min_votes", f.MinVotes)
+	setIfPositive(query, "limit", f.Limit)
+
+	var page LinkPage
+	if err := c.get(ctx, "/links", query, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+func (c *Client) Link(ctx context.Context, linkID int64) (*Link, error) {
+	var l Link
+	if err := c.get(ctx, "/link/"+itoa(linkID), nil, &l); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// Submit adds a link to the station, dedicatedTo may be empty
+func (c *Client) Submit(ctx context.Context, link, dedicatedTo string) (*Link, error) {
+	var l Link
+	form := url.Values{"url": {link}}
+	setIf(form, "dedicated_to", dedicatedTo)
+	if err := c.post(ctx, "/link/new", form, &l); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+func (c *Client) Upvote(ctx context.Context, linkID int64) error {
+	return c.post(ctx, "/link/upvote", url.Values{"link_id": {itoa(linkID)}}, nil)
+}
+
+func (c *Client) Downvote(ctx context.Context, linkID int64) error {
+	return c.post(ctx, "/link/downvote", url.Values{"link_id": {itoa(linkID)}}, nil)
+}
+
+// Skip votes to skip the song playing
+func (c *Client) Skip(ctx context.Context, linkID int64) (*SkipTally, error) {
+	var t SkipTally
+	if err := c.post(ctx, "/link/skip", url.Values{"link_id": {itoa(linkID)}}, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// radio
+
+func (c *Client) NowPlaying(ctx context.Context) (*NowPlaying, error) {
+	var np NowPlaying
+	if err := c.get(ctx, "/radio/now_playing", nil, &np); err != nil {
+		return nil, err
+	}
+	return &np, nil
+}
+
+func (c *Client) Queue(ctx context.Context) (*Queue, error) {
+	var q Queue
+	if err := c.get(ctx, "/radio/queue", nil, &q); err != nil {
+		return nil, err
+	}
+	return &q, nil
+}
+
+// chat
+
+// Chat returns messages, the newest first
+func (c *Client) Chat(ctx context.Context, f ChatFilter) ([]ChatMessage, error) {
+	query := url.Values{}
+	setIfPositive(query, "link_id", f.LinkID)
+	setIfPositive(query, "before", f.Before)
+	setIfPositive(query, "limit", f.Limit)
+
+	var out struct {
+		Messages []ChatMessage `json:"messages"`
+	}
+	err := c.get(ctx, "/chat", query, &out)
+	return out.Messages, err
+}
+
+// Say posts a message about the song playing
+func (c *Client) Say(ctx context.Context, text string) (*ChatMessage, error) {
+	var m ChatMessage
+	if err := c.post(ctx, "/chat", url.Values{"text": {text}}, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// notifications
+
+func (c *Client) Notifications(ctx context.Context) ([]Notification, error) {
+	var out struct {
+		Notifications []Notification `json:"notifications"`
+	}
+	err := c.get(ctx, "/notifications", nil, &out)
+	return out.Notifications, err
+}
+
+// ReadNotifications marks notifications up to upTo read, all of them when upTo is 0
+func (c *Client) ReadNotifications(ctx context.Context, upTo int64) error {
+	form := url.Values{}
+	setIfPositive(form, "up_to", upTo)
+	return c.post(ctx, "/notifications/read", form, nil)
+}
+
+// moderation
+
+func (c *Client) PendingLinks(ctx context.Context, cursor string) (*LinkPage, error) {
+	query := url.Values{}
+	setIf(query, "cursor", cursor)
+	var page LinkPage
+	if err := c.get(ctx, "/moderation/pending", query, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+func (c *Client) Approve(ctx context.Context, linkID int64) (*Link, error) {
+	return c.moderate(ctx, "approve", linkID, "")
+}
+
+func (c *Client) Reject(ctx context.Context, linkID int64, reason string) (*Link, error) {
+	return c.moderate(ctx, "reject", linkID, reason)
+}
+
+func (c *Client) Remove(ctx context.Context, linkID int64, reason string) (*Link, error) {
+	return c.moderate(ctx, "remove", linkID, reason)
+}
+
+func (c *Client) moderate(ctx context.Context, action string, linkID int64, reason string) (*Link, error) {
+	var l Link
+	form := url.Values{"link_id": {itoa(linkID)}}
+	setIf(form, "reason", reason)
+	if err := c.post(ctx, "/moderation/"+action, form, &l); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+func (c *Client) DeleteChatMessage(ctx context.Context, messageID int64, reason string) error {
+	form := url.Values{"message_id": {itoa(messageID)}}
+	setIf(form, "reason", reason)
+	return c.post(ctx, "/moderation/chat/delete", form, nil)
+}
+
+func (c *Client) ChatMutes(ctx context.Context) ([]ChatMute, error) {
+	var out struct {
+		Mutes []ChatMute `json:"mutes"`
+	}
+	err := c.get(ctx, "/moderation/chat/mutes", nil, &out)
+	return out.Mutes, err
+}
+
+// Mute keeps a user out of the chat for d, or until unmuted when d is 0
+func (c *Client) Mute(ctx context.Context, userID string, d time.Duration, reason string) (*ChatMute, error) {
+	form := url.Values{"user_id": {userID}}
+	setIfPositive(form, "duration", int64(d/time.Second))
+	setIf(form, "reason", reason)
+	var m ChatMute
+	if err := c.post(ctx, "/moderation/chat/mute", form, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (c *Client) Unmute(ctx context.Context, userID string) error {
+	return c.post(ctx, "/moderation/chat/unmute", url.Values{"user_id": {userID}}, nil)
+}
+
+// admin
+
+func (c *Client) AuditLog(ctx context.Context, f AuditFilter) ([]AuditEntry, error) {
+	query := url.Values{}
+	setIf(query, "actor", f.Actor)
+	setIf(query, "action", f.Action)
+	setIf(query, "target", f.Target)
+	setIfPositive(query, "from", f.From)
+	setIfPositive(query, "to", f.To)
+	setIfPositive(query, "before", f.Before)
+	setIfPositive(query, "limit", f.Limit)
+
+	var out struct {
+		Entries []AuditEntry `json:"entries"`
+	}
+	err := c.get(ctx, "/admin/audit", query, &out)
+	return out.Entries, err
+}
+
+func (c *Client) UserRoles(ctx context.Context, userID string) (*UserRoles, error) {
+	var r UserRoles
+	if err := c.get(ctx, "/admin/roles", url.Values{"user_id": {userID}}, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (c *Client) RoleHolders(ctx context.Context, role string) ([]RoleGrant, error) {
+	var out struct {
+		Grants []RoleGrant `json:"grants"`
+	}
+	err := c.get(ctx, "/admin/roles", url.Values{"role": {role}}, &out)
+	return out.Grants, err
+}
+
+func (c *Client) GrantRole(ctx context.Context, userID, role string) (*UserRoles, error) {
+	return c.changeRole(ctx, "grant", userID, role)
+}
+
+func (c *Client) RevokeRole(ctx context.Context, userID, role string) (*UserRoles, error) {
+	return c.changeRole(ctx, "revoke", userID, role)
+}
+
+func (c *Client) changeRole(ctx context.Context, action, userID, role string) (*UserRoles, error) {
+	var r UserRoles
+	form := url.Values{"user_id": {userID}, "role": {role}}
+	if err := c.post(ctx, "/admin/roles/"+action, form, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// RevokeUserTokens ends every session of a user and revokes their access tokens
+func (c *Client) RevokeUserTokens(ctx context.Context, userID string) error {
+	return c.post(ctx, "/admin/users/revoke_tokens", url.Values{"user_id": {userID}}, nil)
+}
+
+func (c *Client) RateLimits(ctx context.Context) ([]RateRule, error) {
+	var out struct {
+		Rules []RateRule `json:"rules"`
+	}
+	err := c.get(ctx, "/admin/rate_limits", nil, &out)
+	return out.Rules, err
+}
+
+func (c *Client) SetRateLimit(ctx context.Context, rule RateRule) (*RateRule, error) {
+	var r RateRule
+	form := url.Values{
+		"endpoint": {rule.Endpoint},
+		"scope":    {rule.Scope},
+		"capacity": {itoa(rule.Capacity)},
+		"period":   {itoa(rule.Period)},
+	}
+	if err := c.post(ctx, "/admin/rate_limits", form, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// webhooks
+
+func (c *Client) Webhooks(ctx context.Context) ([]Webhook, error) {
+	var out struct {
+		Webhooks []Webhook `json:"webhooks"`
+	}
+	err := c.get(ctx, "/admin/webhooks", nil, &out)
+	return out.Webhooks, err
+}
+
+func (c *Client) CreateWebhook(ctx context.Context, endpoint string, events []string) (*NewWebhook, error) {
+	var w NewWebhook
+	form := url.Values{
+		"url":    {endpoint},
+		"events": {strings.Join(events, ",")},
+	}
+	if err := c.post(ctx, "/admin/webhooks", form, &w); err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+// UpdateWebhook changes the URL or the events of a webhook, an empty one stays as it is
+func (c *Client) UpdateWebhook(ctx context.Context, webhookID int64, endpoint string, events []string) (*Webhook, error) {
+	form := url.Values{"webhook_id": {itoa(webhookID)}}
+	setIf(form, "url", endpoint)
+	setIf(form, "events", strings.Join(events, ","))
+	return c.changeWebhook(ctx, "update", form)
+}
+
+func (c *Client) PauseWebhook(ctx context.Context, webhookID int64) (*Webhook, error) {
+	return c.changeWebhook(ctx, "pause", url.Values{"webhook_id": {itoa(webhookID)}})
+}
+
+func (c *Client) ResumeWebhook(ctx context.Context, webhookID int64) (*Webhook, error) {
+	return c.changeWebhook(ctx, "resume", url.Values{"webhook_id": {itoa(webhookID)}})
+}
+
+func (c *Client) changeWebhook(ctx context.Context, action string, form url.Values) (*Webhook, error) {
+	var w Webhook
+	if err := c.post(ctx, "/admin/webhooks/"+action, form, &w); err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+func (c *Client) DeleteWebhook(ctx context.Context, webhookID int64) error {
+	return c.post(ctx, "/admin/webhooks/delete", url.Values{"webhook_id": {itoa(webhookID)}}, nil)
+}
+
+func (c *Client) WebhookDeliveries(ctx context.Context, f DeliveryFilter) ([]WebhookDelivery, error) {
+	query := url.Values{}
+	setIfPositive(query, "webhook_id", f.WebhookID)
+	setIf(query, "status", f.Status)
+	setIfPositive(query, "before", f.Before)
+	setIfPositive(query, "limit", f.Limit)
+
+	var out struct {
+		Deliveries []WebhookDelivery `json:"deliveries"`
+	}
+	err := c.get(ctx, "/admin/webhooks/deliveries", query, &out)
+	return out.Deliveries, err
+}
+
+// Redeliver sends a delivery again, whatever became of it before
+func (c *Client) Redeliver(ctx context.Context, deliveryID int64) (*WebhookDelivery, error) {
+	var d WebhookDelivery
+	if err := c.post(ctx, "/admin/webhooks/redeliver", url.Values{"delivery_id": {itoa(deliveryID)}}, &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
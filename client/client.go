@@ -0,0 +1,139 @@
+// Package client talks to the upnext radio API, see openapi.json for the routes.
+//
+//	c := client.New("http://localhost:8080")
+//	tokens, err := c.Guest(ctx)
+//	queue, err := c.Queue(ctx)
+//
+// Calls which need a user are made with Token, an access token from a login
+// or a personal access token. Failed calls return an *APIError.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+type Client struct {
+	// e.g. http://localhost:8080, without /api
+	BaseURL    string
+	HTTPClient *http.Client
+	// sent as a bearer token when set
+	Token string
+}
+
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: http.DefaultClient,
+	}
+}
+
+// APIError is a response the API refused a call with
+type APIError struct {
+	StatusCode int
+	Message    string `json:"message"`
+	// seconds to wait, when rate limited
+	RetryAfter int64 `json:"retry_after"`
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("upnext: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("upnext: %d %s", e.StatusCode, e.Message)
+}
+
+func (c *Client) url(path string, query url.Values) string {
+	u := c.BaseURL + "/api" + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return c.HTTPClient
+}
+
+func (c *Client) newRequest(ctx context.Context, method, path string, query, form url.Values) (*http.Request, error) {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequest(method, c.url(path, query), body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	return req, nil
+}
+
+// do makes a call and decodes the JSON it returns into out, unless out is nil
+func (c *Client) do(ctx context.Context, method, path string, query, form url.Values, out interface{}) error {
+	req, err := c.newRequest(ctx, method, path, query, form)
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return apiError(resp, raw)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(bytes.NewReader(raw)).Decode(out)
+}
+
+func apiError(resp *http.Response, raw []byte) *APIError {
+	e := &APIError{}
+	if json.Unmarshal(raw, e) != nil {
+		// a few routes answer in plain text
+		e.Message = strings.TrimSpace(string(raw))
+	}
+	e.StatusCode = resp.StatusCode
+	if e.RetryAfter == 0 {
+		e.RetryAfter, _ = strconv.ParseInt(resp.Header.Get("Retry-After"), 10, 64)
+	}
+	return e
+}
+
+func (c *Client) get(ctx context.Context, path string, query url.Values, out interface{}) error {
+	return c.do(ctx, http.MethodGet, path, query, nil, out)
+}
+
+func (c *Client) post(ctx context.Context, path string, form url.Values, out interface{}) error {
+	if form == nil {
+		form = url.Values{}
+	}
+	return c.do(ctx, http.MethodPost, path, nil, form, out)
+}
+
+func itoa(i int64) string {
+	return strconv.FormatInt(i, 10)
+}
@@ -0,0 +1,268 @@
+package client
+
+// the payloads of the API, as described by the schemas in openapi.json
+
+import "encoding/json"
+
+type Link struct {
+	LinkID      int64  `json:"link_id"`
+	URL         string `json:"url"`
+	VideoID     string `json:"video_id"`
+	Title       string `json:"title"`
+	ChannelName string `json:"channel_name"`
+	// seconds
+	Duration    int64  `json:"duration"`
+	SubmittedBy string `json:"submitted_by"`
+	DedicatedTo string `json:"dedicated_to"`
+	TotalVotes  int64  `json:"total_votes"`
+	MyVote      int64  `json:"my_vote"`
+	IsExpired   bool   `json:"is_expired"`
+	State       string `json:"state"`
+	StateReason string `json:"state_reason"`
+	CreatedAt   int64  `json:"created_at"`
+	PlayedAt    int64  `json:"played_at"`
+}
+
+type LinkPage struct {
+	Links      []Link `json:"links"`
+	NextCursor string `json:"next_cursor"`
+}
+
+// LinkFilter narrows down ListLinks, zero values don't filter
+type LinkFilter struct {
+	SubmittedBy string
+	Channel     string
+	State       string
+	// newest, oldest or votes
+	Sort   string
+	Cursor string
+	// unix seconds
+	From     int64
+	To       int64
+	MinVotes int64
+	Limit    int64
+}
+
+type Tokens struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresAt    int64  `json:"expires_at"`
+}
+
+type Submitter struct {
+	FirstName string `json:"firstname"`
+	LastName  string `json:"lastname"`
+}
+
+// NowPlaying is also what nowPlaying events carry, without PlayerTime
+type NowPlaying struct {
+	// idle or running
+	State       string    `json:"state"`
+	Link        *Link     `json:"link"`
+	SubmittedBy Submitter `json:"submitted_by"`
+	DedicatedTo string    `json:"dedicated_to"`
+	MyVote      int64     `json:"my_vote"`
+	PlayerTime  int64     `json:"player_time"`
+}
+
+type Queue struct {
+	Links []Link `json:"links"`
+	// your votes by link_id
+	Votes map[int64]int64 `json:"votes"`
+}
+
+// Dedication is who the song playing is dedicated to, and by whom
+type Dedication struct {
+	LinkID      int64     `json:"link_id"`
+	Title       string    `json:"title"`
+	DedicatedTo string    `json:"dedicated_to"`
+	SubmittedBy Submitter `json:"submitted_by"`
+}
+
+type SkipTally struct {
+	LinkID int64 `json:"link_id"`
+	Votes  int64 `json:"votes"`
+	Needed int64 `json:"needed"`
+}
+
+type Notification struct {
+	NotificationID int64  `json:"notification_id"`
+	UserID         string `json:"user_id"`
+	Kind           string `json:"kind"`
+	LinkID         int64  `json:"link_id"`
+	Message        string `json:"message"`
+	Read           bool   `json:"read"`
+	CreatedAt      int64  `json:"created_at"`
+}
+
+type AuditEntry struct {
+	AuditID   int64           `json:"audit_id"`
+	Actor     string          `json:"actor"`
+	NodeID    string          `json:"node_id"`
+	Action    string          `json:"action"`
+	Target    string          `json:"target"`
+	Before    json.RawMessage `json:"before"`
+	After     json.RawMessage `json:"after"`
+	CreatedAt int64           `json:"created_at"`
+}
+
+// AuditFilter narrows down AuditLog, zero values don't filter
+type AuditFilter struct {
+	Actor  string
+	Action string
+	Target string
+	From   int64
+	To     int64
+	// older than this audit_id
+	Before int64
+	Limit  int64
+}
+
+type RoleGrant struct {
+	UserID    string `json:"user_id"`
+	Role      string `json:"role"`
+	GrantedBy string `json:"granted_by"`
+	GrantedAt int64  `json:"granted_at"`
+}
+
+type UserRoles struct {
+	UserID string   `json:"user_id"`
+	Roles  []string `json:"roles"`
+}
+
+type AccessToken struct {
+	TokenID   int64    `json:"token_id"`
+	UserID    string   `json:"user_id"`
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	CreatedAt int64    `json:"created_at"`
+	// 0 for tokens which don't expire
+	ExpiresAt  int64 `json:"expires_at"`
+	LastUsedAt int64 `json:"last_used_at"`
+	Revoked    bool  `json:"revoked"`
+}
+
+// NewAccessToken is a token just created, Token is never shown again
+type NewAccessToken struct {
+	Token   string      `json:"token"`
+	Details AccessToken `json:"details"`
+}
+
+type RateRule struct {
+	Endpoint string `json:"endpoint"`
+	// user, ip or global
+	Scope    string `json:"scope"`
+	Capacity int64  `json:"capacity"`
+	Period   int64  `json:"period"`
+}
+
+type Webhook struct {
+	WebhookID int64    `json:"webhook_id"`
+	URL       string   `json:"url"`
+	Events    []string `json:"events"`
+	Active    bool     `json:"active"`
+	CreatedBy string   `json:"created_by"`
+	CreatedAt int64    `json:"created_at"`
+}
+
+type NewWebhook struct {
+	// signs the deliveries, shown only this once
+	Secret  string  `json:"secret"`
+	Details Webhook `json:"details"`
+}
+
+type WebhookDelivery struct {
+	DeliveryID int64           `json:"delivery_id"`
+	WebhookID  int64           `json:"webhook_id"`
+	Event      string          `json:"event"`
+	Payload    json.RawMessage `json:"payload"`
+	// pending, delivered or failed
+	Status        string `json:"status"`
+	Attempts      int64  `json:"attempts"`
+	NextAttemptAt int64  `json:"next_attempt_at"`
+	LastAttemptAt int64  `json:"last_attempt_at"`
+	ResponseCode  int64  `json:"response_code"`
+	LastError     string `json:"last_error"`
+	CreatedAt     int64  `json:"created_at"`
+	DeliveredAt   int64  `json:"delivered_at"`
+}
+
+// DeliveryFilter narrows down WebhookDeliveries, zero values don't filter
+type DeliveryFilter struct {
+	WebhookID int64
+	Status    string
+	// older than this delivery_id
+	Before int64
+	Limit  int64
+}
+
+// ChatMessage was said while LinkID was playing
+type ChatMessage struct {
+	MessageID int64  `json:"message_id"`
+	LinkID    int64  `json:"link_id"`
+	UserID    string `json:"user_id"`
+	FirstName string `json:"firstname"`
+	LastName  string `json:"lastname"`
+	Text      string `json:"text"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// ChatDeleted names a message a moderator deleted, the data of chatDeleted events
+type ChatDeleted struct {
+	MessageID int64 `json:"message_id"`
+	LinkID    int64 `json:"link_id"`
+}
+
+// ChatFilter narrows down Chat, zero values don't filter
+type ChatFilter struct {
+	LinkID int64
+	// older than this message_id
+	Before int64
+	Limit  int64
+}
+
+type ChatMute struct {
+	UserID  string `json:"user_id"`
+	MutedBy string `json:"muted_by"`
+	Reason  string `json:"reason"`
+	MutedAt int64  `json:"muted_at"`
+	// 0 until unmuted
+	ExpiresAt int64 `json:"expires_at"`
+}
+
+type Identity struct {
+	Provider string `json:"provider"`
+	Subject  string `json:"subject"`
+	UserID   string `json:"user_id"`
+	Email    string `json:"email"`
+	LinkedAt int64  `json:"linked_at"`
+}
+
+type StreamTicket struct {
+	Ticket    string `json:"ticket"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+type ClusterPeer struct {
+	NodeID   string `json:"node_id"`
+	APIURL   string `json:"api_url"`
+	Priority int64  `json:"priority"`
+	LastSeen int64  `json:"last_seen"`
+}
+
+type ClusterStatus struct {
+	NodeID string `json:"node_id"`
+	APIURL string `json:"api_url"`
+	// leader, follower or candidate
+	Role     string `json:"role"`
+	Priority int64  `json:"priority"`
+	// whether the last election has settled
+	Elected   bool          `json:"elected"`
+	LeaderID  string        `json:"leader_id"`
+	LeaderURL string        `json:"leader_url"`
+	Peers     []ClusterPeer `json:"peers"`
+	SharedMem struct {
+		Version   int64 `json:"version"`
+		UpdatedAt int64 `json:"updated_at"`
+	} `json:"shared_mem"`
+}
@@ -0,0 +1,172 @@
+package client
+
+// this file follows /api/stream
+//
+// Stream keeps a connection open and hands every event to a callback. When
+// the connection drops it reconnects after the delay the server asked for,
+// sending the id of the last event back so only what changed since comes again.
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the events of /api/stream
+const (
+	TopicNowPlaying = "nowPlaying"
+	TopicQueue      = "queue"
+	TopicPlayerTime = "playerTime"
+	TopicDedication = "dedication"
+	TopicMyLinks    = "myLinks"
+	TopicChat       = "chat"
+	// the other event of the chat topic
+	EventChatDeleted = "chatDeleted"
+)
+
+const defaultStreamRetry = time.Second * 3
+
+// Event is one event of a stream, Name is its topic
+type Event struct {
+	// empty for myLinks and the chat, which are sent again after reconnecting
+	ID   string
+	Name string
+	Data json.RawMessage
+}
+
+// Decode unmarshals the data of an event, see the x-events of /api/stream
+// for what each topic carries: NowPlaying, Queue, int64, *Dedication, []Link,
+// ChatMessage or ChatDeleted
+func (e Event) Decode(v interface{}) error {
+	return json.Unmarshal(e.Data, v)
+}
+
+type StreamOptions struct {
+	// all of them when empty, myLinks only for users
+	Topics []string
+	// resume after this event
+	LastEventID string
+	// don't send Token, get only what everyone can see
+	Anonymous bool
+}
+
+// Stream calls handler with every event until ctx is done or handler returns
+// an error, which Stream then returns. Responses other than 200 end it too,
+// as an *APIError, except for 5xx which are retried like dropped connections.
+func (c *Client) Stream(ctx context.Context, opts StreamOptions, handler func(Event) error) error {
+	lastEventID := opts.LastEventID
+	retry := defaultStreamRetry
+	for {
+		err := c.streamOnce(ctx, opts, &lastEventID, &retry, handler)
+		if stop, ok := err.(streamStop); ok {
+			return stop.err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(retry):
+		}
+	}
+}
+
+// streamStop wraps the errors which shouldn't be retried
+type streamStop struct {
+	err error
+}
+
+func (s streamStop) Error() string {
+	return s.err.Error()
+}
+
+func (c *Client) streamOnce(ctx context.Context, opts StreamOptions, lastEventID *string,
+	retry *time.Duration, handler func(Event) error) error {
+	query := url.Values{}
+	if len(opts.Topics) > 0 {
+		query.Set("topics", strings.Join(opts.Topics, ","))
+	}
+	// streams can't take the token itself, it is swapped for a ticket on every connect
+	if c.Token != "" && !opts.Anonymous {
+		ticket, err := c.StreamTicket(ctx)
+		if err != nil {
+			if e, ok := err.(*APIError); ok && e.StatusCode < 500 {
+				return streamStop{err}
+			}
+			return err
+		}
+		query.Set("ticket", ticket.Ticket)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, c.url("/stream", query), nil)
+	if err != nil {
+		return streamStop{err}
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "text/event-stream")
+	if *lastEventID != "" {
+		req.Header.Set("Last-Event-ID", *lastEventID)
+	}
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		raw, _ := ioutil.ReadAll(resp.Body)
+		e := apiError(resp, raw)
+		if e.StatusCode < 500 {
+			return streamStop{e}
+		}
+		return e
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	var e Event
+	var data []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			// a blank line ends an event, comments and retry: lines leave it without data
+			if len(data) > 0 {
+				e.Data = json.RawMessage(strings.Join(data, "\n"))
+				if e.ID != "" {
+					*lastEventID = e.ID
+				}
+				if err := handler(e); err != nil {
+					return streamStop{err}
+				}
+			}
+			e, data = Event{}, nil
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		field, value := line, ""
+		if i := strings.Index(line, ":"); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "id":
+			e.ID = value
+		case "event":
+			e.Name = value
+		case "data":
+			data = append(data, value)
+		case "retry":
+			if ms, err := strconv.ParseInt(value, 10, 64); err == nil && ms > 0 {
+				*retry = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+	if ctx.Err() != nil {
+		return streamStop{ctx.Err()}
+	}
+	return scanner.Err()
+}
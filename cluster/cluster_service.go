@@ -23,10 +23,20 @@ type ClusterService struct {
 	biggestBullySoFar      int
 	IsLeader               bool
 	leaderElected          bool
+	// who sent biggestBullySoFar, and who won the last election
+	biggestBully string
+	leaderID     string
+
+	peers           map[string]*PeerStatus
+	lastHeartbeatAt time.Time
+	status          Status
+	statusMutex     *sync.RWMutex
 
 	SwitchMode chan bool
 
 	Shm       *SharedMem
+	topics    *topics
+	elections *counts
 	interrupt chan interface{}
 }
 
@@ -44,9 +54,14 @@ func NewClusterService(clusterUrl, discoveryUrl string, me NodeInfoT, authToken
 		IsLeader:               false,
 		leaderElected:          false,
 
+		peers:       make(map[string]*PeerStatus),
+		statusMutex: &sync.RWMutex{},
+
 		SwitchMode: make(chan bool),
 
 		Shm:       NewSharedMem(),
+		topics:    newTopics(),
+		elections: newCounts(),
 		interrupt: make(chan interface{}, 1),
 	}
 }
@@ -61,8 +76,13 @@ func (this *ClusterService) manageIncomingMessages(parentwg *sync.WaitGroup) {
 	defer ticker.Stop()
 
 	for {
+		this.publishStatus()
 		select {
 		case t := <-ticker.C:
+			if t.After(this.lastHeartbeatAt.Add(heartbeatEvery)) {
+				this.heartbeat()
+				this.lastHeartbeatAt = t
+			}
 			if t.After(this.lastBulliedAt.Add(this.idleTimeToBecomeLeader)) &&
 				!this.leaderElected {
 				if !this.IsLeader &&
@@ -70,12 +90,23 @@ func (this *ClusterService) manageIncomingMessages(parentwg *sync.WaitGroup) {
 					// the second condition makes sure the if part comes are at the required time
 
 					this.IsLeader = true
+					this.leaderID = this.meshNet.me.NodeID
+					this.elections.add(ElectionWon)
+					this.publishStatus()
 					this.SwitchMode <- this.IsLeader
 					log.Println("I proclaim myself as a leader.", this.IsLeader)
 
 				} else {
 					// let's wait for the right time to come, or someone is already the leader
 					this.leaderElected = true
+					if this.IsLeader {
+						this.leaderID = this.meshNet.me.NodeID
+						this.elections.add(ElectionWon)
+					} else {
+						this.leaderID = this.biggestBully
+						this.elections.add(ElectionLost)
+					}
+					this.publishStatus()
 					this.SwitchMode <- this.IsLeader
 					log.Println("Someone else is perhaps the leader.", this.IsLeader)
 				}
@@ -87,8 +118,13 @@ func (this *ClusterService) manageIncomingMessages(parentwg *sync.WaitGroup) {
 			this.handleSoldierDown(nodeID)
 
 		case msg := <-this.meshNet.commonIncomingChan:
+			this.meshNet.received.add(string(msg.MsgType))
+			this.sawPeer(msg.NodeID)
 
 			switch msg.MsgType {
+			case helloMsg:
+				this.handleHelloMsg(msg)
+
 			case bullyMsg:
 				this.handleBullyMsg(msg)
 
@@ -98,13 +134,17 @@ func (this *ClusterService) manageIncomingMessages(parentwg *sync.WaitGroup) {
 				// log.Println("shm update received ", evt["Mem"].(map[string]interface{}))
 				var ts time.Time
 				json.Unmarshal([]byte(evt["Ts"].(string)), &ts)
+				version, _ := evt["Version"].(float64)
 				// if ts.After(this.Shm.LastUpdatedAt) {
-				this.Shm.Update(evt["Mem"].(map[string]interface{}))
+				this.Shm.Update(evt["Mem"].(map[string]interface{}), int64(version))
 				// }
 				// this.Shm.WriteVar(evt["Varname"].(string), evt["Value"], false) // not master
 				// log.Println("updated", evt["Varname"], " to ", evt["Value"], " from ", msg.NodeID)
 				// this.Shm.Update(newMem)
 
+			case topicMsg:
+				this.handleTopicMsg(msg)
+
 			default:
 			}
 
@@ -145,11 +185,17 @@ func (this *ClusterService) handleBroadcasts() {
 
 func (this *ClusterService) handleSoldierDown(nodeID string) {
 	log.Println("solider down ", nodeID)
+	delete(this.peers, nodeID)
+	if nodeID == this.leaderID {
+		this.leaderID = ""
+	}
 
 	// if I'm the leader, I don't care if someone is down
 	if !this.IsLeader {
 		log.Println("leader election restarts")
+		this.elections.add(ElectionRestarted)
 		this.biggestBullySoFar = -1
+		this.biggestBully = ""
 		this.leaderElected = false
 		this.lastBulliedAt = time.Now()
 		this.bullyOthers()
@@ -160,6 +206,9 @@ func (this *ClusterService) handleSoldierDown(nodeID string) {
 
 func (this *ClusterService) handleBullyMsg(msg Message) {
 	var val int = int(msg.Content.(float64))
+	if peer, ok := this.peers[msg.NodeID]; ok {
+		peer.Priority = val
+	}
 
 	if val == this.meshNet.me.Priority {
 		newPrio := rand.Intn(100)
@@ -173,9 +222,11 @@ func (this *ClusterService) handleBullyMsg(msg Message) {
 		this.bullyOthers()
 	} else {
 		this.biggestBullySoFar = val
+		this.biggestBully = msg.NodeID
 		this.lastBulliedAt = time.Now()
 		this.IsLeader = false
 		this.leaderElected = false
+		this.leaderID = ""
 		log.Println(this.meshNet.me.Priority, " bullied by ", msg.NodeID, " with val ", val, " : ", this.biggestBullySoFar)
 	}
 }
@@ -183,6 +234,7 @@ func (this *ClusterService) handleBullyMsg(msg Message) {
 func (this *ClusterService) bullyOthers() {
 	this.IsLeader = false
 	this.leaderElected = false
+	this.leaderID = ""
 	this.lastBulliedAt = time.Now()
 	this.broadcastChan <- Message{
 		NodeID:  this.meshNet.me.NodeID,
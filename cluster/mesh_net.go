@@ -16,6 +16,8 @@ type NodeInfoT struct {
 	URL      string `json:"url"`
 	NodeID   string `json:"node_id"`
 	Priority int    `json:"priority"`
+	// where the node serves its API, for routing clients to the leader
+	APIURL string `json:"api_url,omitempty"`
 }
 
 type MessageType string
@@ -24,6 +26,9 @@ const (
 	bullyMsg     MessageType = "bullyMsg"
 	shmMsg       MessageType = "shmMsg"
 	heartbeatMsg MessageType = "heartbeatMsg"
+	topicMsg     MessageType = "topicMsg"
+	// introduces a node to a new peer, with its NodeInfoT
+	helloMsg MessageType = "helloMsg"
 )
 
 type Message struct {
@@ -55,6 +60,10 @@ type MeshNetwork struct {
 	interruptConnChan    map[string](chan interface{})
 	interruptServiceChan chan interface{}
 	soldierDown          chan string
+
+	// messages by MessageType
+	sent     *counts
+	received *counts
 }
 
 func NewMeshNetwork(me NodeInfoT, authToken string) *MeshNetwork {
@@ -74,6 +83,9 @@ func NewMeshNetwork(me NodeInfoT, authToken string) *MeshNetwork {
 		interruptConnChan:    make(map[string](chan interface{}), 5),
 		interruptServiceChan: make(chan interface{}, 10),
 		soldierDown:          make(chan string, 10),
+
+		sent:     newCounts(),
+		received: newCounts(),
 	}
 }
 
@@ -136,6 +148,7 @@ func (this *MeshNetwork) setupOutgoingToSingleNode(node NodeInfoT, wg *sync.Wait
 				log.Println("failed to send message to ", nodeID, " err:", err)
 				return
 			}
+			this.sent.add(string(msg.MsgType))
 
 		// signalled to interrupt
 		case <-this.interruptConnChan[nodeID]:
@@ -240,6 +253,7 @@ func (this *MeshNetwork) handleIncomingConn(w http.ResponseWriter, r *http.Reque
 				log.Println("sender failed to send message to", nodeID, " err:", err)
 				return
 			}
+			this.sent.add(string(msg.MsgType))
 
 		case <-this.interruptConnChan[nodeID]:
 			return
@@ -251,9 +265,15 @@ func (this *MeshNetwork) openChannelsForNewNode(nodeID string) {
 	this.chanMutex.Lock()
 	// don't create channels with 0 buffer size
 	// https://stackoverflow.com/a/39919463/5163807
-	this.outgoingChan[nodeID] = make(chan Message, 1)
+	// room for the hello and the bullying below, before the sender starts
+	this.outgoingChan[nodeID] = make(chan Message, 2)
 	this.interruptConnChan[nodeID] = make(chan interface{}, 1)
 
+	this.outgoingChan[nodeID] <- Message{
+		MsgType: helloMsg,
+		NodeID:  this.me.NodeID,
+		Content: this.me,
+	}
 	// mandatory bullying
 	this.outgoingChan[nodeID] <- Message{
 		MsgType: bullyMsg,
@@ -0,0 +1,68 @@
+package cluster
+
+// this file counts what the node does in the cluster, for monitoring
+
+import (
+	"sync"
+)
+
+const (
+	ElectionWon       = "won"
+	ElectionLost      = "lost"
+	ElectionRestarted = "restarted"
+)
+
+type Metrics struct {
+	// peers connected over the mesh right now
+	Peers int
+	// elections by how they ended for this node
+	Elections map[string]int64
+	// messages by MessageType
+	Sent     map[string]int64
+	Received map[string]int64
+}
+
+// counts are counters which any goroutine may add to
+type counts struct {
+	n     map[string]int64
+	mutex *sync.Mutex
+}
+
+func newCounts() *counts {
+	return &counts{
+		n:     make(map[string]int64),
+		mutex: &sync.Mutex{},
+	}
+}
+
+func (c *counts) add(key string) {
+	c.mutex.Lock()
+	c.n[key]++
+	c.mutex.Unlock()
+}
+
+func (c *counts) snapshot() map[string]int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	n := make(map[string]int64, len(c.n))
+	for key, count := range c.n {
+		n[key] = count
+	}
+	return n
+}
+
+// Metrics returns the counters of this node
+func (this *ClusterService) Metrics() Metrics {
+	return Metrics{
+		Peers:     this.meshNet.peerCount(),
+		Elections: this.elections.snapshot(),
+		Sent:      this.meshNet.sent.snapshot(),
+		Received:  this.meshNet.received.snapshot(),
+	}
+}
+
+func (this *MeshNetwork) peerCount() int {
+	this.chanMutex.Lock()
+	defer this.chanMutex.Unlock()
+	return len(this.outgoingChan)
+}
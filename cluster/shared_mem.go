@@ -6,14 +6,17 @@ import (
 )
 
 type UpdateEvent struct {
-	Ts  time.Time
-	Mem interface{}
+	Ts      time.Time
+	Mem     interface{}
+	Version int64
 }
 
 type SharedMem struct {
 	Shm           map[string]interface{}
 	LastUpdatedAt time.Time
-	ShmLock       *sync.Mutex
+	// counts the leader's writes, peers take it from the updates they receive
+	Version int64
+	ShmLock *sync.Mutex
 
 	// UpdateChan notifies the receiver that some update has happened
 	// whicn can be trasmitted to concerned nodes
@@ -35,12 +38,14 @@ func NewSharedMem() *SharedMem {
 func (this *SharedMem) WriteVar(varname string, value interface{}, isMaster bool) {
 	this.ShmLock.Lock()
 	this.Shm[varname] = value
-	this.ShmLock.Unlock()
-
+	this.Version++
+	this.LastUpdatedAt = time.Now()
 	evt := UpdateEvent{
-		Ts:  time.Now(),
-		Mem: this.Shm,
+		Ts:      this.LastUpdatedAt,
+		Mem:     this.Shm,
+		Version: this.Version,
 	}
+	this.ShmLock.Unlock()
 
 	if isMaster {
 		this.MasterChan <- evt
@@ -49,7 +54,7 @@ func (this *SharedMem) WriteVar(varname string, value interface{}, isMaster bool
 	}
 }
 
-func (this *SharedMem) Update(newmem map[string]interface{}) {
+func (this *SharedMem) Update(newmem map[string]interface{}, version int64) {
 	this.ShmLock.Lock()
 	for k := range this.Shm {
 		delete(this.Shm, k)
@@ -57,10 +62,18 @@ func (this *SharedMem) Update(newmem map[string]interface{}) {
 	for varname, value := range newmem {
 		this.Shm[varname] = value
 	}
+	this.Version = version
 	this.LastUpdatedAt = time.Now()
 	this.ShmLock.Unlock()
 }
 
+// Stats returns the version of the shared memory, and when it last changed
+func (this *SharedMem) Stats() (int64, time.Time) {
+	this.ShmLock.Lock()
+	defer this.ShmLock.Unlock()
+	return this.Version, this.LastUpdatedAt
+}
+
 func (this *SharedMem) ReadVar(varname string) interface{} {
 	if value, exists := this.Shm[varname]; exists {
 		return value
@@ -0,0 +1,120 @@
+package cluster
+
+// this file keeps track of what the node knows about the cluster,
+// so it can be reported without touching the election loop
+
+import (
+	"time"
+)
+
+const (
+	RoleLeader    = "leader"
+	RoleFollower  = "follower"
+	RoleCandidate = "candidate"
+
+	// how often nodes tell their peers they are alive
+	heartbeatEvery = time.Second * 5
+)
+
+type PeerStatus struct {
+	NodeID   string
+	APIURL   string
+	Priority int
+	LastSeen time.Time
+}
+
+type Status struct {
+	NodeID   string
+	APIURL   string
+	Priority int
+	Role     string
+	// whether the last election has settled
+	Elected   bool
+	LeaderID  string
+	LeaderURL string
+	Peers     []PeerStatus
+
+	ShmVersion   int64
+	ShmUpdatedAt time.Time
+}
+
+// Status returns the latest snapshot of the cluster as this node sees it
+func (this *ClusterService) Status() Status {
+	this.statusMutex.RLock()
+	defer this.statusMutex.RUnlock()
+
+	status := this.status
+	status.Peers = append([]PeerStatus(nil), this.status.Peers...)
+	status.ShmVersion, status.ShmUpdatedAt = this.Shm.Stats()
+	return status
+}
+
+// publishStatus snapshots the election state, it must only be called
+// from manageIncomingMessages which owns that state
+func (this *ClusterService) publishStatus() {
+	me := this.meshNet.me
+	status := Status{
+		NodeID:   me.NodeID,
+		APIURL:   me.APIURL,
+		Priority: me.Priority,
+		Role:     RoleCandidate,
+		Elected:  this.leaderElected,
+		LeaderID: this.leaderID,
+		Peers:    make([]PeerStatus, 0, len(this.peers)),
+	}
+	if this.IsLeader {
+		status.Role = RoleLeader
+	} else if this.leaderElected {
+		status.Role = RoleFollower
+	}
+
+	if this.leaderID == me.NodeID {
+		status.LeaderURL = me.APIURL
+	}
+	for _, peer := range this.peers {
+		status.Peers = append(status.Peers, *peer)
+		if peer.NodeID == this.leaderID {
+			status.LeaderURL = peer.APIURL
+		}
+	}
+
+	this.statusMutex.Lock()
+	this.status = status
+	this.statusMutex.Unlock()
+}
+
+func (this *ClusterService) sawPeer(nodeID string) {
+	if nodeID == "" || nodeID == this.meshNet.me.NodeID {
+		return
+	}
+	peer, ok := this.peers[nodeID]
+	if !ok {
+		peer = &PeerStatus{NodeID: nodeID}
+		this.peers[nodeID] = peer
+	}
+	peer.LastSeen = time.Now()
+}
+
+func (this *ClusterService) handleHelloMsg(msg Message) {
+	peer, ok := this.peers[msg.NodeID]
+	if !ok {
+		return
+	}
+	info, ok := msg.Content.(map[string]interface{})
+	if !ok {
+		return
+	}
+	if apiURL, ok := info["api_url"].(string); ok {
+		peer.APIURL = apiURL
+	}
+	if priority, ok := info["priority"].(float64); ok {
+		peer.Priority = int(priority)
+	}
+}
+
+func (this *ClusterService) heartbeat() {
+	this.broadcastChan <- Message{
+		NodeID:  this.meshNet.me.NodeID,
+		MsgType: heartbeatMsg,
+	}
+}
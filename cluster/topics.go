@@ -0,0 +1,73 @@
+package cluster
+
+// this file lets the application send its own messages to every peer
+// messages are grouped by topic, and each topic has at most one handler
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+)
+
+type topicMessage struct {
+	Topic   string          `json:"topic"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// TopicHandler receives a payload broadcast by the node nodeID
+type TopicHandler func(nodeID string, payload json.RawMessage)
+
+type topics struct {
+	handlers map[string]TopicHandler
+	mutex    *sync.RWMutex
+}
+
+func newTopics() *topics {
+	return &topics{
+		handlers: make(map[string]TopicHandler),
+		mutex:    &sync.RWMutex{},
+	}
+}
+
+// Subscribe registers the handler for messages on topic
+func (this *ClusterService) Subscribe(topic string, handler TopicHandler) {
+	this.topics.mutex.Lock()
+	this.topics.handlers[topic] = handler
+	this.topics.mutex.Unlock()
+}
+
+// Broadcast sends payload to every connected peer, but not to this node
+func (this *ClusterService) Broadcast(topic string, payload interface{}) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	this.broadcastChan <- Message{
+		MsgType: topicMsg,
+		NodeID:  this.meshNet.me.NodeID,
+		Content: topicMessage{Topic: topic, Payload: b},
+	}
+	return nil
+}
+
+func (this *ClusterService) handleTopicMsg(msg Message) {
+	// Content was decoded into a map along with the rest of the message
+	raw, err := json.Marshal(msg.Content)
+	if err != nil {
+		log.Println("bad topic message from", msg.NodeID, err)
+		return
+	}
+	var tm topicMessage
+	if err = json.Unmarshal(raw, &tm); err != nil {
+		log.Println("bad topic message from", msg.NodeID, err)
+		return
+	}
+
+	this.topics.mutex.RLock()
+	handler, ok := this.topics.handlers[tm.Topic]
+	this.topics.mutex.RUnlock()
+	if ok {
+		// handlers may be slow, don't hold up the mesh
+		go handler(msg.NodeID, tm.Payload)
+	}
+}
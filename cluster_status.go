@@ -0,0 +1,99 @@
+package main
+
+// this file reports the state of the cluster, for operators and load balancers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/himanshub16/upnext-backend/cluster"
+	"github.com/labstack/echo"
+)
+
+// clusterNode is this node's membership of the cluster, nil when
+// the router runs without one
+var clusterNode *cluster.ClusterService
+
+// clusterStatus is what this node knows about the cluster. Without a
+// cluster the node only knows which mode its radio is in
+func clusterStatus() cluster.Status {
+	if clusterNode != nil {
+		return clusterNode.Status()
+	}
+
+	status := cluster.Status{
+		NodeID: nodeID,
+		Role:   cluster.RoleCandidate,
+		Peers:  []cluster.PeerStatus{},
+	}
+	if radio == nil {
+		return status
+	}
+	switch radio.state().radioType {
+	case masterRadio:
+		status.Role = cluster.RoleLeader
+		status.Elected = true
+		status.LeaderID = nodeID
+	case peerRadio:
+		status.Role = cluster.RoleFollower
+		status.Elected = true
+	}
+	if radio.shm != nil {
+		status.ShmVersion, status.ShmUpdatedAt = radio.shm.Stats()
+	}
+	return status
+}
+
+// unixOrNil keeps times which were never set out of responses
+func unixOrNil(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.Unix()
+}
+
+func clusterStatusJSON(status cluster.Status) echo.Map {
+	peers := make([]echo.Map, 0, len(status.Peers))
+	for _, peer := range status.Peers {
+		peers = append(peers, echo.Map{
+			"node_id":   peer.NodeID,
+			"api_url":   peer.APIURL,
+			"priority":  peer.Priority,
+			"last_seen": unixOrNil(peer.LastSeen),
+		})
+	}
+
+	return echo.Map{
+		"node_id":    status.NodeID,
+		"api_url":    status.APIURL,
+		"role":       status.Role,
+		"priority":   status.Priority,
+		"elected":    status.Elected,
+		"leader_id":  status.LeaderID,
+		"leader_url": status.LeaderURL,
+		"peers":      peers,
+		"shared_mem": echo.Map{
+			"version":    status.ShmVersion,
+			"updated_at": unixOrNil(status.ShmUpdatedAt),
+		},
+	}
+}
+
+func clusterHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, clusterStatusJSON(clusterStatus()))
+}
+
+// tellIfLeader answers 200 on the leader only, so load balancers can send
+// writes there, and names the leader when it knows it
+func tellIfLeader(c echo.Context) error {
+	status := clusterStatus()
+	code, message := http.StatusExpectationFailed, "I am not the leader"
+	if status.Role == cluster.RoleLeader {
+		code, message = http.StatusOK, "I am the leader"
+	}
+	return c.JSON(code, echo.Map{
+		"message":    message,
+		"leader_id":  status.LeaderID,
+		"leader_url": status.LeaderURL,
+	})
+}
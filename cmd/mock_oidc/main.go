@@ -0,0 +1,30 @@
+package main
+
+// a tiny OpenID Connect provider to try the OIDC login against locally,
+// see the oidcmock package
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"github.com/himanshub16/upnext-backend/oidcmock"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:9999", "address to listen on")
+	issuer := flag.String("issuer", "", "issuer URL, defaults to http://<addr>")
+	sub := flag.String("sub", "alice", "subject of the logged in user")
+	domain := flag.String("domain", "example.com", "domain of the users' email")
+	flag.Parse()
+
+	if *issuer == "" {
+		*issuer = "http://" + *addr
+	}
+	m, err := oidcmock.New(*issuer, *sub, *domain)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("mock OIDC issuer", m.URL, "listening on", *addr)
+	log.Fatal(http.ListenAndServe(*addr, m.Handler()))
+}
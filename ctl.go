@@ -0,0 +1,404 @@
+package main
+
+// this file implements upnextctl - the admin command line tool
+// it is the same binary as the server, invoked under the name upnextctl
+//
+//   upnextctl export [-o station.jsonl]
+//   upnextctl import [-i station.jsonl] [-dry-run]
+//   upnextctl openapi-check [-spec openapi.json]
+//
+// export and import work against whatever DB_URL points to,
+// openapi-check compares the routes with the OpenAPI document and needs no database
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	ctlName       = "upnextctl"
+	exportVersion = 1
+
+	recordHeader = "header"
+	recordUser   = "user"
+	recordLink   = "link"
+	recordVote   = "vote"
+	recordPlay   = "play"
+
+	// stands for a link found in the archive, which imports leave as it is
+	archivedLinkID = -1
+)
+
+// exportRecord is a single line of an export file
+type exportRecord struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+type exportHeader struct {
+	Version    int   `json:"version"`
+	ExportedAt int64 `json:"exported_at"`
+}
+
+type playRecord struct {
+	LinkID   int64 `json:"link_id"`
+	PlayedAt int64 `json:"played_at"`
+}
+
+type importReport struct {
+	Created   map[string]int `json:"created"`
+	Updated   map[string]int `json:"updated"`
+	Unchanged map[string]int `json:"unchanged"`
+	Conflicts []string       `json:"conflicts"`
+}
+
+func isCtlInvocation() bool {
+	return filepath.Base(os.Args[0]) == ctlName
+}
+
+func runCtl(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: upnextctl <export|import|openapi-check> [flags]")
+		os.Exit(2)
+	}
+
+	if args[0] == "openapi-check" {
+		fs := flag.NewFlagSet("openapi-check", flag.ExitOnError)
+		spec := fs.String("spec", openAPIFile, "OpenAPI document to check")
+		fs.Parse(args[1:])
+
+		if !checkOpenAPI(NewHTTPRouter(nil, nil), *spec) {
+			os.Exit(1)
+		}
+		fmt.Println(*spec, "matches the routes")
+		return
+	}
+
+	s := prepareWebService()
+	if s.userRepo == nil {
+		log.Fatal("DB_URL is not set or not supported")
+	}
+	defer s.close()
+
+	switch args[0] {
+	case "export":
+		fs := flag.NewFlagSet("export", flag.ExitOnError)
+		out := fs.String("o", "-", "File to write the export to")
+		fs.Parse(args[1:])
+
+		w, closeFn := openCtlFile(*out, false)
+		defer closeFn()
+		if err := exportStation(s, w); err != nil {
+			log.Fatal("export failed: ", err)
+		}
+
+	case "import":
+		fs := flag.NewFlagSet("import", flag.ExitOnError)
+		in := fs.String("i", "-", "File to read the export from")
+		dryRun := fs.Bool("dry-run", false, "Report what would change without writing")
+		fs.Parse(args[1:])
+
+		f, closeFn := openCtlFile(*in, true)
+		defer closeFn()
+		report, err := importStation(s, f, *dryRun)
+		if err != nil {
+			log.Fatal("import failed: ", err)
+		}
+		if !*dryRun {
+			s.audit(ctlName, auditImport, *in, nil, report)
+		}
+		b, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(b))
+
+	default:
+		fmt.Fprintln(os.Stderr, "unknown command", args[0])
+		os.Exit(2)
+	}
+}
+
+func openCtlFile(name string, read bool) (*os.File, func()) {
+	if name == "-" {
+		if read {
+			return os.Stdin, func() {}
+		}
+		return os.Stdout, func() {}
+	}
+
+	var f *os.File
+	var err error
+	if read {
+		f, err = os.Open(name)
+	} else {
+		f, err = os.Create(name)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return f, func() { f.Close() }
+}
+
+func writeRecord(enc *json.Encoder, recordType string, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return enc.Encode(exportRecord{Type: recordType, Data: b})
+}
+
+// exportStation writes users, links, votes and play history in that order,
+// so an import can resolve every reference by the time it reads it.
+// Archived links and votes are exported along with the rest.
+func exportStation(s *ServiceImpl, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	header := exportHeader{Version: exportVersion, ExportedAt: time.Now().Unix()}
+	if err := writeRecord(enc, recordHeader, header); err != nil {
+		return err
+	}
+
+	for _, u := range s.userRepo.AllUsers() {
+		if err := writeRecord(enc, recordUser, u); err != nil {
+			return err
+		}
+	}
+
+	links := s.linkRepo.AllLinks()
+	for _, l := range links {
+		if err := writeRecord(enc, recordLink, l); err != nil {
+			return err
+		}
+	}
+
+	for _, v := range s.voteRepo.AllVotes() {
+		if err := writeRecord(enc, recordVote, v); err != nil {
+			return err
+		}
+	}
+
+	for _, l := range links {
+		if l.PlayedAt == 0 {
+			continue
+		}
+		if err := writeRecord(enc, recordPlay, playRecord{LinkID: l.LinkID, PlayedAt: l.PlayedAt}); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+// importStation reads an export and merges it into the configured database.
+// Users are matched on user_id and links on (video_id, submitted_by, created_at),
+// so running the same import twice changes nothing the second time.
+func importStation(s *ServiceImpl, r io.Reader, dryRun bool) (*importReport, error) {
+	report := &importReport{
+		Created:   make(map[string]int),
+		Updated:   make(map[string]int),
+		Unchanged: make(map[string]int),
+		Conflicts: make([]string, 0),
+	}
+
+	// exported link_id -> link_id in this database
+	// new links get 0 during a dry run since they are never inserted,
+	// and links already archived here get archivedLinkID
+	linkIDs := make(map[int64]int64)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var rec exportRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+
+		if lineNo == 1 && rec.Type != recordHeader {
+			return nil, errors.New("missing export header")
+		}
+
+		var err error
+		switch rec.Type {
+		case recordHeader:
+			var h exportHeader
+			if err = json.Unmarshal(rec.Data, &h); err == nil && h.Version != exportVersion {
+				err = fmt.Errorf("unsupported export version %d", h.Version)
+			}
+		case recordUser:
+			var u User
+			if err = json.Unmarshal(rec.Data, &u); err == nil {
+				importUser(s, u, dryRun, report)
+			}
+		case recordLink:
+			var l Link
+			if err = json.Unmarshal(rec.Data, &l); err == nil {
+				importLink(s, l, dryRun, report, linkIDs)
+			}
+		case recordVote:
+			var v Vote
+			if err = json.Unmarshal(rec.Data, &v); err == nil {
+				importVote(s, v, dryRun, report, linkIDs)
+			}
+		case recordPlay:
+			var p playRecord
+			if err = json.Unmarshal(rec.Data, &p); err == nil {
+				importPlay(s, p, dryRun, report, linkIDs)
+			}
+		default:
+			report.Conflicts = append(report.Conflicts,
+				fmt.Sprintf("line %d: unknown record type %q", lineNo, rec.Type))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+	}
+	return report, scanner.Err()
+}
+
+func importUser(s *ServiceImpl, u User, dryRun bool, report *importReport) {
+	existing := s.userRepo.GetUserByID(u.UserID)
+	switch {
+	case existing == nil:
+		report.Created[recordUser]++
+	case *existing == u:
+		report.Unchanged[recordUser]++
+		return
+	default:
+		report.Updated[recordUser]++
+		report.Conflicts = append(report.Conflicts,
+			fmt.Sprintf("user %s differs from the existing one and will be overwritten", u.UserID))
+	}
+	if !dryRun {
+		s.userRepo.CreateOrUpdateUser(u)
+	}
+}
+
+func importLink(s *ServiceImpl, l Link, dryRun bool, report *importReport, linkIDs map[int64]int64) {
+	exportedID := l.LinkID
+	if l.State == "" {
+		// exported before links had states
+		switch {
+		case l.PlayedAt > 0:
+			l.State = linkPlayed
+		case l.IsExpired:
+			l.State = linkExpired
+		default:
+			l.State = linkQueued
+		}
+	}
+
+	if existing := s.linkRepo.FindLink(l.VideoID, l.SubmittedBy, l.CreatedAt); existing != nil {
+		linkIDs[exportedID] = existing.LinkID
+		if existing.State == l.State {
+			report.Unchanged[recordLink]++
+			return
+		}
+		report.Updated[recordLink]++
+		report.Conflicts = append(report.Conflicts,
+			fmt.Sprintf("link %d is %s here and %s in the export",
+				existing.LinkID, existing.State, l.State))
+		if !dryRun {
+			existing.State = l.State
+			existing.StateReason = l.StateReason
+			existing.IsExpired = l.IsExpired
+			s.linkRepo.UpdateLink(*existing)
+		}
+		return
+	}
+	if s.linkRepo.FindArchivedLink(l.VideoID, l.SubmittedBy, l.CreatedAt) != nil {
+		linkIDs[exportedID] = archivedLinkID
+		report.Unchanged[recordLink]++
+		return
+	}
+
+	report.Created[recordLink]++
+	if dryRun {
+		linkIDs[exportedID] = 0
+		return
+	}
+	l.LinkID = 0
+	l.TotalVotes = 0
+	l.MyVote = 0
+	linkIDs[exportedID] = s.linkRepo.InsertLink(l)
+}
+
+func importVote(s *ServiceImpl, v Vote, dryRun bool, report *importReport, linkIDs map[int64]int64) {
+	linkID, ok := linkIDs[v.LinkID]
+	if !ok {
+		report.Conflicts = append(report.Conflicts,
+			fmt.Sprintf("vote by %s refers to unknown link %d", v.UserID, v.LinkID))
+		return
+	}
+	if linkID == archivedLinkID {
+		report.Unchanged[recordVote]++
+		return
+	}
+
+	if linkID != 0 {
+		if existing := s.voteRepo.GetVote(linkID, v.UserID); existing != nil {
+			if existing.Score == v.Score {
+				report.Unchanged[recordVote]++
+				return
+			}
+			report.Updated[recordVote]++
+			report.Conflicts = append(report.Conflicts,
+				fmt.Sprintf("vote by %s on link %d is %d here and %d in the export",
+					v.UserID, linkID, existing.Score, v.Score))
+		} else {
+			report.Created[recordVote]++
+		}
+	} else {
+		report.Created[recordVote]++
+	}
+
+	if !dryRun {
+		s.voteRepo.MarkVote(linkID, v.UserID, int64(v.Score))
+	}
+}
+
+func importPlay(s *ServiceImpl, p playRecord, dryRun bool, report *importReport, linkIDs map[int64]int64) {
+	linkID, ok := linkIDs[p.LinkID]
+	if !ok {
+		report.Conflicts = append(report.Conflicts,
+			fmt.Sprintf("play at %d refers to unknown link %d", p.PlayedAt, p.LinkID))
+		return
+	}
+	if linkID == archivedLinkID {
+		report.Unchanged[recordPlay]++
+		return
+	}
+	if linkID == 0 {
+		report.Created[recordPlay]++
+		return
+	}
+
+	l, err := s.linkRepo.GetLinkByID(linkID)
+	if err != nil {
+		report.Conflicts = append(report.Conflicts,
+			fmt.Sprintf("cannot load link %d: %v", linkID, err))
+		return
+	}
+	if l.PlayedAt == p.PlayedAt {
+		report.Unchanged[recordPlay]++
+		return
+	}
+	report.Updated[recordPlay]++
+	if !dryRun {
+		// only the play time, the link's state came with the link itself
+		l.PlayedAt = p.PlayedAt
+		s.linkRepo.UpdateLink(*l)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// stationOf describes the links and votes of a database by what survives an
+// export, link IDs aside
+func stationOf(s *ServiceImpl) (map[string]Link, map[string]int) {
+	links := make(map[string]Link)
+	keys := make(map[int64]string)
+	for _, l := range s.linkRepo.AllLinks() {
+		key := fmt.Sprint(l.VideoID, "/", l.SubmittedBy, "/", l.CreatedAt)
+		keys[l.LinkID] = key
+		l.LinkID, l.TotalVotes = 0, 0
+		links[key] = l
+	}
+	votes := make(map[string]int)
+	for _, v := range s.voteRepo.AllVotes() {
+		votes[keys[v.LinkID]+" by "+v.UserID] = v.Score
+	}
+	return links, votes
+}
+
+func TestExportImportKeepsArchive(t *testing.T) {
+	src := testService(t, "ctlsrc.db")
+	src.userRepo.CreateOrUpdateUser(User{UserID: "submitter", FirstName: "Sub"})
+	now := time.Now().Unix()
+	old := Link{VideoID: "aaaaaaaaaaa", SubmittedBy: "submitter", State: linkPlayed,
+		IsExpired: true, CreatedAt: now - 3600*24*60, PlayedAt: now - 3600*24*59}
+	old.LinkID = src.linkRepo.InsertLink(old)
+	queued := testLink(src, "bbbbbbbbbbb", linkQueued)
+	for _, v := range []Vote{
+		{UserID: "alice", LinkID: old.LinkID, Score: 1},
+		{UserID: "bob", LinkID: old.LinkID, Score: -1},
+		{UserID: "alice", LinkID: queued.LinkID, Score: 1},
+	} {
+		src.voteRepo.MarkVote(v.LinkID, v.UserID, int64(v.Score))
+	}
+	nlinks, nvotes, err := src.linkRepo.ArchivePlayedLinks(now - 3600*24*30)
+	if err != nil || nlinks != 1 || nvotes != 2 {
+		t.Fatal("archived", nlinks, "links and", nvotes, "votes", err)
+	}
+	wantLinks, wantVotes := stationOf(src)
+
+	var export bytes.Buffer
+	if err = exportStation(src, &export); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := testService(t, "ctldst.db")
+	if _, err = importStation(dst, bytes.NewReader(export.Bytes()), false); err != nil {
+		t.Fatal(err)
+	}
+	gotLinks, gotVotes := stationOf(dst)
+	if len(gotLinks) != len(wantLinks) || len(gotVotes) != len(wantVotes) {
+		t.Fatal("imported", len(gotLinks), "links and", len(gotVotes), "votes, exported",
+			len(wantLinks), "and", len(wantVotes))
+	}
+	for key, want := range wantLinks {
+		if got := gotLinks[key]; got != want {
+			t.Errorf("link %s came back as %+v, was %+v", key, got, want)
+		}
+	}
+	for key, want := range wantVotes {
+		if got, ok := gotVotes[key]; !ok || got != want {
+			t.Errorf("vote on %s came back as %d, was %d", key, got, want)
+		}
+	}
+
+	// the archive is already in the source, importing there again changes nothing
+	report, err := importStation(src, bytes.NewReader(export.Bytes()), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Created) > 0 || len(report.Updated) > 0 || len(report.Conflicts) > 0 {
+		t.Errorf("re-import changed the source: %+v", report)
+	}
+}
+
+func TestImportKeepsLinkStates(t *testing.T) {
+	src := testService(t, "ctlsrc.db")
+	now := time.Now().Unix()
+	// cut short while playing, so it has a play without being played
+	removed := Link{VideoID: "ccccccccccc", SubmittedBy: "submitter", State: linkRemoved,
+		IsExpired: true, CreatedAt: now - 600, PlayedAt: now - 300}
+	removed.LinkID = src.linkRepo.InsertLink(removed)
+	unavailable := testLink(src, "ddddddddddd", linkUnavailable)
+
+	var export bytes.Buffer
+	if err := exportStation(src, &export); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := testService(t, "ctldst.db")
+	if _, err := importStation(dst, bytes.NewReader(export.Bytes()), false); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := stationOf(dst)
+	for _, l := range []Link{removed, unavailable} {
+		key := fmt.Sprint(l.VideoID, "/", l.SubmittedBy, "/", l.CreatedAt)
+		if got[key].State != l.State {
+			t.Errorf("%s link came back %s", l.State, got[key].State)
+		}
+	}
+
+	// a link whose state moved on since the export is updated, not unchanged
+	l, _ := src.linkRepo.GetLinkByID(unavailable.LinkID)
+	l.State = linkQueued
+	src.linkRepo.UpdateLink(*l)
+	for _, dryRun := range []bool{true, false} {
+		report, err := importStation(src, bytes.NewReader(export.Bytes()), dryRun)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Updated[recordLink] != 1 || len(report.Conflicts) != 1 {
+			t.Errorf("dry run %v reported %+v", dryRun, report)
+		}
+		want := linkUnavailable
+		if dryRun {
+			want = linkQueued
+		}
+		if l, _ = src.linkRepo.GetLinkByID(unavailable.LinkID); l.State != want {
+			t.Errorf("dry run %v left the link %s, want %s", dryRun, l.State, want)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+// this file describes the radio to one listener, the same way over REST,
+// SSE and the WebSocket
+//
+// the radio's links are shared by everyone. A listener is told their own
+// vote on top, along with who submitted the song playing and who it is
+// dedicated to. Its total is kept live by the radio, see ReorderQueue.
+// Submitters are looked up through a cache, so a song change doesn't cost a
+// query per listener.
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	// how long the name of a submitter is remembered
+	userCacheTTL = time.Minute * 5
+	// past this many users, the stale ones are dropped
+	userCacheSize = 10000
+)
+
+type cachedUser struct {
+	user      User
+	fetchedAt time.Time
+}
+
+// userCache remembers users for a while, unknown ones too
+type userCache struct {
+	ttl   time.Duration
+	users map[string]cachedUser
+	mutex *sync.Mutex
+}
+
+func newUserCache(ttl time.Duration) *userCache {
+	return &userCache{
+		ttl:   ttl,
+		users: make(map[string]cachedUser),
+		mutex: &sync.Mutex{},
+	}
+}
+
+// get never returns nil, users it can't find have nothing but their ID
+func (c *userCache) get(userID string) User {
+	now := time.Now()
+	c.mutex.Lock()
+	cached, ok := c.users[userID]
+	c.mutex.Unlock()
+	if ok && now.Sub(cached.fetchedAt) < c.ttl {
+		return cached.user
+	}
+
+	user := User{UserID: userID}
+	if u := service.GetUserByID(userID); u != nil {
+		user = *u
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.users) > userCacheSize {
+		for id, cached := range c.users {
+			if now.Sub(cached.fetchedAt) >= c.ttl {
+				delete(c.users, id)
+			}
+		}
+	}
+	c.users[userID] = cachedUser{user: user, fetchedAt: now}
+	return user
+}
+
+func submitterOf(l Link) echo.Map {
+	from := users.get(l.SubmittedBy)
+	return echo.Map{
+		"firstname": from.FirstName,
+		"lastname":  from.LastName,
+	}
+}
+
+// describeNowPlaying tells a listener about the song playing, anonymous
+// listeners have no vote of their own
+func describeNowPlaying(nowPlaying *Link, userID string) echo.Map {
+	if nowPlaying == nil {
+		return echo.Map{
+			"state": "idle",
+			"link":  nil,
+		}
+	}
+
+	// the radio's copy is everyone's
+	link := *nowPlaying
+	link.MyVote = 0
+	if userID != "" {
+		link.MyVote = service.GetVotesForUser([]Link{link}, userID)[link.LinkID]
+	}
+
+	return echo.Map{
+		"state":        "running",
+		"link":         &link,
+		"submitted_by": submitterOf(link),
+		"dedicated_to": link.DedicatedTo,
+		"my_vote":      link.MyVote,
+	}
+}
+
+// nowPlayingFeed describes the song playing to one listener of a hook, which
+// hears about it every tick. It is only described again once it, its votes
+// or the listener changed
+type nowPlayingFeed struct {
+	raw    []byte
+	userID string
+	last   echo.Map
+}
+
+func (f *nowPlayingFeed) describe(nowPlaying *Link, userID string) echo.Map {
+	raw, err := json.Marshal(nowPlaying)
+	if err != nil || f.last == nil || userID != f.userID || !bytes.Equal(raw, f.raw) {
+		f.raw, f.userID = raw, userID
+		f.last = describeNowPlaying(nowPlaying, userID)
+	}
+	return f.last
+}
+
+// dedicationOf says who the song playing is dedicated to, and by whom
+func dedicationOf(nowPlaying interface{}) interface{} {
+	l, ok := nowPlaying.(*Link)
+	if !ok || l == nil || l.DedicatedTo == "" {
+		return nil
+	}
+	return echo.Map{
+		"link_id":      l.LinkID,
+		"title":        l.Title,
+		"dedicated_to": l.DedicatedTo,
+		"submitted_by": submitterOf(*l),
+	}
+}
+
+// queueWithVotes fills in the user's votes on a copy of the queue, which every
+// listener shares; anonymous listeners have none
+func queueWithVotes(queue []Link, userID string) echo.Map {
+	links := append([]Link{}, queue...)
+	votes := make(map[int64]int64)
+	if userID != "" {
+		votes = service.GetVotesForUser(links, userID)
+	}
+
+	for i, l := range links {
+		if vote, ok := votes[l.LinkID]; ok {
+			links[i].MyVote = vote
+		} else {
+			links[i].MyVote = 0
+		}
+	}
+
+	return echo.Map{
+		"links": links,
+		"votes": votes,
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestQueueWithVotesIsPerListener(t *testing.T) {
+	s := testService(t, "enrichtest.db")
+	first := testLink(s, "aaaaaaaaaaa", linkQueued)
+	second := testLink(s, "bbbbbbbbbbb", linkQueued)
+	for _, v := range []Vote{
+		{UserID: "alice", LinkID: first.LinkID, Score: 1},
+		{UserID: "bob", LinkID: first.LinkID, Score: -1},
+		{UserID: "bob", LinkID: second.LinkID, Score: 1},
+	} {
+		if err := s.Vote(v.LinkID, v.UserID, int64(v.Score)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the queue the radio hands to every listener
+	queue := []Link{first, second}
+	alice := queueWithVotes(queue, "alice")["links"].([]Link)
+	bob := queueWithVotes(queue, "bob")["links"].([]Link)
+
+	if alice[0].MyVote != 1 || alice[1].MyVote != 0 {
+		t.Error("alice's votes show as", alice[0].MyVote, alice[1].MyVote)
+	}
+	if bob[0].MyVote != -1 || bob[1].MyVote != 1 {
+		t.Error("bob's votes show as", bob[0].MyVote, bob[1].MyVote)
+	}
+	if queue[0].MyVote != 0 || queue[1].MyVote != 0 {
+		t.Error("the shared queue was changed", queue)
+	}
+}
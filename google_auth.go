@@ -0,0 +1,249 @@
+package main
+
+// this file verifies Google ID tokens presented on login
+//
+// the token's signature is checked against Google's JWKS, which is cached
+// for as long as Google says it may be, and refetched early when a token
+// is signed with a key we haven't seen yet (Google rotates them regularly).
+// Audience, issuer and expiry are checked before any claim is trusted.
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	defaultGoogleJWKSURL = "https://www.googleapis.com/oauth2/v3/certs"
+	defaultGoogleIssuers = "accounts.google.com,https://accounts.google.com"
+
+	// used when the JWKS response doesn't say how long to cache it
+	defaultJWKSMaxAge = time.Hour
+	// don't refetch more often than this when asked for an unknown kid
+	minJWKSRefetch = time.Minute
+	// after a failed fetch, keep serving the cached keys this long before trying again
+	jwksRetryAfter   = time.Minute
+	jwksFetchTimeout = time.Second * 10
+)
+
+var (
+	ErrInvalidIDToken      = errors.New("invalid ID token")
+	ErrGoogleLoginDisabled = errors.New("google login is not configured")
+
+	maxAgeRe = regexp.MustCompile(`max-age=(\d+)`)
+)
+
+// jwksCache holds the RSA keys published at a JWKS URL, by kid
+type jwksCache struct {
+	url    string
+	client *http.Client
+
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+	expiresAt time.Time
+	// closed when the fetch in flight is over, nil when there is none
+	refreshing chan struct{}
+	mutex      *sync.Mutex
+}
+
+func newJWKSCache(url string) *jwksCache {
+	return &jwksCache{
+		url:    url,
+		client: &http.Client{Timeout: jwksFetchTimeout},
+		keys:   make(map[string]*rsa.PublicKey),
+		mutex:  &sync.Mutex{},
+	}
+}
+
+// key returns the key a token was signed with. A known key is served right
+// away, even while the keys are being refetched; an unknown one waits for the
+// fetch, which is shared by everyone asking in the meantime.
+func (c *jwksCache) key(kid string) (*rsa.PublicKey, error) {
+	c.mutex.Lock()
+	now := time.Now()
+	k, known := c.keys[kid]
+	done := c.refreshing
+	if now.After(c.expiresAt) || (!known && now.Sub(c.fetchedAt) > minJWKSRefetch) {
+		done = c.refresh(now)
+	}
+	c.mutex.Unlock()
+
+	if known {
+		return k, nil
+	}
+	if done != nil {
+		<-done
+	}
+
+	c.mutex.Lock()
+	k, known = c.keys[kid]
+	c.mutex.Unlock()
+	if known {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// refresh fetches the keys in the background, unless a fetch is already in
+// flight, and returns a channel closed once it is over. It is called with the
+// mutex held.
+func (c *jwksCache) refresh(now time.Time) chan struct{} {
+	if c.refreshing != nil {
+		return c.refreshing
+	}
+	c.fetchedAt = now
+	done := make(chan struct{})
+	c.refreshing = done
+
+	go func() {
+		keys, maxAge, err := c.fetch()
+		c.mutex.Lock()
+		if err != nil {
+			log.Println("failed to fetch JWKS from", c.url, err)
+			// keep using what we have, Google publishes keys well before using them
+			c.expiresAt = now.Add(jwksRetryAfter)
+		} else {
+			c.keys = keys
+			c.expiresAt = now.Add(maxAge)
+		}
+		c.refreshing = nil
+		c.mutex.Unlock()
+		close(done)
+	}()
+	return done
+}
+
+// fetch reads the keys at the JWKS URL, and how long they may be cached
+func (c *jwksCache) fetch() (map[string]*rsa.PublicKey, time.Duration, error) {
+	resp, err := c.client.Get(c.url)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	body := struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}{}
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, 0, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range body.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+		if err1 != nil || err2 != nil {
+			log.Println("skipping malformed JWKS key", k.Kid)
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	maxAge := defaultJWKSMaxAge
+	if m := maxAgeRe.FindStringSubmatch(resp.Header.Get("Cache-Control")); m != nil {
+		if secs, err := strconv.Atoi(m[1]); err == nil {
+			maxAge = time.Duration(secs) * time.Second
+		}
+	}
+	return keys, maxAge, nil
+}
+
+type GoogleVerifier struct {
+	jwks *jwksCache
+	// client IDs of the frontends allowed to log in
+	audiences []string
+	issuers   map[string]bool
+}
+
+func NewGoogleVerifier(jwksURL string, audiences, issuers []string) *GoogleVerifier {
+	v := &GoogleVerifier{
+		jwks:      newJWKSCache(jwksURL),
+		audiences: audiences,
+		issuers:   make(map[string]bool),
+	}
+	for _, iss := range issuers {
+		v.issuers[iss] = true
+	}
+	if len(audiences) == 0 {
+		log.Println("GOOGLE_CLIENT_IDS is not set, nobody will be able to log in")
+	}
+	return v
+}
+
+// Verify checks an ID token and returns the user it was issued for
+func (v *GoogleVerifier) Verify(idToken string) (*User, error) {
+	if len(v.audiences) == 0 {
+		return nil, ErrGoogleLoginDisabled
+	}
+
+	token, err := jwt.Parse(idToken, func(t *jwt.Token) (interface{}, error) {
+		if t.Method != jwt.SigningMethodRS256 {
+			return nil, fmt.Errorf("unexpected signing method %v", t.Header["alg"])
+		}
+		kid, _ := t.Header["kid"].(string)
+		return v.jwks.key(kid)
+	})
+	if err != nil {
+		// this also covers expired tokens
+		log.Println("rejected ID token", err)
+		return nil, ErrInvalidIDToken
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+	if _, ok := claims["exp"]; !ok {
+		return nil, ErrInvalidIDToken
+	}
+	if iss, _ := claims["iss"].(string); !v.issuers[iss] {
+		log.Println("rejected ID token from issuer", iss)
+		return nil, ErrInvalidIDToken
+	}
+	audienceOK := false
+	for _, aud := range v.audiences {
+		if claims.VerifyAudience(aud, true) {
+			audienceOK = true
+			break
+		}
+	}
+	if !audienceOK {
+		log.Println("rejected ID token for audience", claims["aud"])
+		return nil, ErrInvalidIDToken
+	}
+
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return nil, ErrInvalidIDToken
+	}
+	u := &User{UserID: sub}
+	u.FirstName, _ = claims["given_name"].(string)
+	u.LastName, _ = claims["family_name"].(string)
+	// some tokens carry email_verified as a string
+	if verified := claims["email_verified"]; verified == true || verified == "true" {
+		u.Email, _ = claims["email"].(string)
+	}
+	return u, nil
+}
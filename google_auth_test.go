@@ -0,0 +1,39 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestJWKSCacheBacksOffAfterAFailedFetch(t *testing.T) {
+	var fetches int32
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer jwks.Close()
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an expired cache, with the key we fetched before the outage
+	c := newJWKSCache(jwks.URL)
+	c.keys["old"] = &priv.PublicKey
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.key("new"); err == nil {
+			t.Fatal("expected an unknown key to fail while the JWKS URL is down")
+		}
+	}
+	if k, err := c.key("old"); err != nil || k != &priv.PublicKey {
+		t.Fatal("expected the cached key to be served during the outage, got", k, err)
+	}
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Fatal("expected a single fetch during the outage, got", n)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+// this file deals with guests
+//
+// visitors without an account can start a guest session with POST /api/guest.
+// A guest is a user whose ID starts with "guest:"; the session is signed like
+// any other and lives on the device which asked for it, refresh token and all.
+// Guests can listen, and when the station allows it, vote. Guest votes are
+// kept in their own table and count in bulk: every guestWeight of them on a
+// link add up to one vote of the "guests" pool user, so a crowd of throwaway
+// sessions can't outvote the regulars. A daily cap limits each guest further.
+//
+// When a guest logs in with Google, their votes move to the account, unless
+// the account already voted on the same link.
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/google/uuid"
+	"github.com/labstack/echo"
+)
+
+const (
+	guestIDPrefix = "guest:"
+	// the user the guest votes on a link are cast as
+	guestPoolUserID = "guests"
+)
+
+var (
+	ErrGuestVotingDisabled = errors.New("guests can't vote on this station")
+	ErrGuestVoteCapReached = errors.New("guests can't vote any more today")
+)
+
+// GuestPolicy is what guests may do on the station
+type GuestPolicy struct {
+	CanVote bool
+	// how many guest votes count as one account vote
+	VotesPerVote int64
+	// votes, or changes of vote, a guest may make per day, 0 for no cap
+	DailyVotes int64
+}
+
+func isGuest(userID string) bool {
+	return strings.HasPrefix(userID, guestIDPrefix)
+}
+
+// startOfDay is when the daily cap resets, midnight UTC
+func startOfDay(t time.Time) int64 {
+	y, m, d := t.UTC().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Unix()
+}
+
+// CreateGuest starts a guest session, and returns the guest's ID
+// along with the session's refresh token and ID
+func (s *ServiceImpl) CreateGuest() (string, string, string, error) {
+	u, _ := uuid.NewRandom()
+	guestID := guestIDPrefix + u.String()
+	refreshToken, sessionID, err := s.CreateSession(guestID)
+	if err != nil {
+		return "", "", "", err
+	}
+	s.audit(guestID, auditGuestCreate, userTarget(guestID), nil, nil)
+	return guestID, refreshToken, sessionID, nil
+}
+
+func (s *ServiceImpl) guestVote(linkID int64, guestID string, score int64) error {
+	if !s.guests.CanVote {
+		return ErrGuestVotingDisabled
+	}
+	now := time.Now()
+	before := s.guestRepo.GetGuestVote(linkID, guestID)
+	if before != nil && before.Score == score {
+		return nil
+	}
+	// changing a vote cast today doesn't use up another one
+	today := startOfDay(now)
+	if s.guests.DailyVotes > 0 && (before == nil || before.CreatedAt < today) &&
+		s.guestRepo.CountGuestVotesSince(guestID, today) >= s.guests.DailyVotes {
+		return ErrGuestVoteCapReached
+	}
+
+	after := GuestVote{UserID: guestID, LinkID: linkID, Score: score, CreatedAt: now.Unix()}
+	if err := s.guestRepo.SetGuestVote(after); err != nil {
+		return err
+	}
+	s.audit(guestID, auditVoteChange, linkTarget(linkID), before, after)
+	return s.updateGuestPool(linkID)
+}
+
+// updateGuestPool recasts the pooled vote of all guests on a link
+func (s *ServiceImpl) updateGuestPool(linkID int64) error {
+	perVote := s.guests.VotesPerVote
+	if perVote < 1 {
+		perVote = 1
+	}
+	return s.voteRepo.MarkVote(linkID, guestPoolUserID, s.guestRepo.GuestVoteTotal(linkID)/perVote)
+}
+
+func (s *ServiceImpl) guestVotesFor(links []Link, guestID string) map[int64]int64 {
+	wanted := make(map[int64]bool)
+	for _, l := range links {
+		wanted[l.LinkID] = true
+	}
+	votes := make(map[int64]int64)
+	for _, v := range s.guestRepo.GetGuestVotes(guestID) {
+		if wanted[v.LinkID] {
+			votes[v.LinkID] = v.Score
+		}
+	}
+	return votes
+}
+
+// UpgradeGuest hands a guest's votes over to the account they logged in with,
+// and ends the guest's sessions
+func (s *ServiceImpl) UpgradeGuest(guestID, userID string) error {
+	if !isGuest(guestID) || isGuest(userID) {
+		return nil
+	}
+	votes := s.guestRepo.GetGuestVotes(guestID)
+	merged := 0
+	for _, v := range votes {
+		if s.voteRepo.GetVote(v.LinkID, userID) == nil {
+			err := s.Vote(v.LinkID, userID, v.Score)
+			if err == ErrLinkNotFound || err == ErrLinkNotVotable {
+				// the link played or went away since, the vote is moot
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			merged++
+		}
+	}
+	if err := s.guestRepo.DeleteGuestVotes(guestID); err != nil {
+		return err
+	}
+	for _, v := range votes {
+		if err := s.updateGuestPool(v.LinkID); err != nil {
+			return err
+		}
+	}
+	if err := s.revoke(guestID, ""); err != nil {
+		return err
+	}
+	s.audit(userID, auditGuestUpgrade, userTarget(userID), nil, map[string]interface{}{
+		"guest_id":     guestID,
+		"votes_merged": merged,
+	})
+	return nil
+}
+
+// requireAccount keeps guests out, it goes after requireJWT
+func requireAccount(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if isGuest(getUserIDFromContext(c)) {
+			return echo.NewHTTPError(http.StatusForbidden, "Sign in to do this")
+		}
+		return next(c)
+	}
+}
+
+// guestFromRequest returns the guest a request comes from, if any,
+// reading the token from the Authorization header or the cookie
+func guestFromRequest(c echo.Context) string {
+	if userID := userFromRequest(c); isGuest(userID) {
+		return userID
+	}
+	return ""
+}
+
+// userFromRequest returns who is logged in on a route without requireJWT, if anyone
+func userFromRequest(c echo.Context) string {
+	raw := strings.TrimPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+	if raw == "" {
+		cookie, err := c.Cookie(authCookieName)
+		if err != nil {
+			return ""
+		}
+		raw = cookie.Value
+	}
+
+	userID, _ := parseAccessToken(raw)["user_id"].(string)
+	return userID
+}
+
+// parseAccessToken returns the claims of a JWT we issued on login,
+// or nil when it is invalid, revoked or a stream ticket
+func parseAccessToken(raw string) jwt.MapClaims {
+	token, err := keyring.Parse(raw)
+	if err != nil || !token.Valid || isStreamTicket(token) {
+		return nil
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	if service.IsTokenRevoked(claims) {
+		return nil
+	}
+	return claims
+}
+
+func guestHandler(c echo.Context) error {
+	guestID, refreshToken, sessionID, err := service.CreateGuest()
+	if err != nil {
+		return err
+	}
+	return issueTokens(c, guestID, sessionID, refreshToken)
+}
+
+// upgradeGuest is called on login, a failed merge doesn't fail the login
+func upgradeGuest(c echo.Context, userID string) {
+	if guestID := guestFromRequest(c); guestID != "" {
+		if err := service.UpgradeGuest(guestID, userID); err != nil {
+			log.Println("failed to merge guest", guestID, "into", userID, err)
+		}
+	}
+}
@@ -9,64 +9,152 @@ import (
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/middleware"
 	"log"
+	"math"
 	"net/http"
+	"os"
 	"strconv"
 	"time"
 )
 
 var (
-	// TODO move this secret to environment
-	jwtSecret = []byte("secret")
-	service   Service
-	radio     *Radio
+	keyring *Keyring
+	service Service
+	radio   *Radio
+	streams *StreamHub
+	chats   *ChatHub
+	users   *userCache
 )
 
 func NewHTTPRouter(_service Service, _radio *Radio) *echo.Echo {
 	service = _service
 	radio = _radio
+	keyring = NewKeyringFromEnv()
+	users = newUserCache(userCacheTTL)
+	streams = NewStreamHub()
+	if radio != nil {
+		streams.Watch(radio)
+	}
+	chats = NewChatHub()
+	if service != nil {
+		chats.Load(withAuthors(service.ListChatMessages(ChatFilter{Limit: chatBacklogSize})))
+	}
 
 	r := echo.New()
+	r.HTTPErrorHandler = httpErrorHandler(r)
+	r.Use(measureRequests)
 	r.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
 		Format: "method=${method}, uri=${uri}, status=${status}\n",
 	}))
+	r.GET("/metrics", metricsHandler, requireMetricsToken(os.Getenv("METRICS_TOKEN")))
 	// router := echo.New()
 	router := r.Group("/api")
 	router.File("/test_subscribe", "index.html")
+	router.File("/openapi.json", openAPIFile)
 	router.GET("/isLeader", tellIfLeader)
+	router.GET("/cluster", clusterHandler)
 	router.GET("/health", healthCheckHandler)
 	router.POST("/login", loginHandler)
+	router.POST("/guest", guestHandler, rateLimit(rateEndpointGuest))
+	router.GET("/oidc/providers", oidcProvidersHandler)
+	router.GET("/oidc/:provider/login", oidcLoginHandler)
+	router.GET("/oidc/:provider/callback", oidcCallbackHandler)
+	router.GET("/identities", identitiesHandler, requireJWT, requireAccount)
+	router.POST("/token/refresh", refreshTokenHandler)
+	router.POST("/logout", logoutHandler, requireJWT)
+	router.POST("/logout/everywhere", logoutEverywhereHandler, requireJWT)
 	router.GET("/subscribe", subscribeToUpdatesHandler)
+	router.GET("/ws", wsHandler)
+	router.GET("/stream", streamHandler)
 
-	// this is placed here because it uses cookies instead of JWT
+	router.GET("/links", listLinksHandler, requireJWT)
+
+	// streams take the JWT from a cookie or a stream ticket, see stream_auth.go
 	router.GET("/link/by_me", linksByMeHandler)
+	router.POST("/stream_ticket", streamTicketHandler, requireJWT)
 
 	linkGroup := router.Group("/link")
-	linkGroup.Use(middleware.JWT(jwtSecret))
+	linkGroup.Use(requireJWT)
 	{
 		linkGroup.GET("/:id", linkByIdHandler)
 		// linkGroup.GET("/by_me", linksByMeHandler)
-		linkGroup.POST("/new", newLinkHandler)
-		linkGroup.POST("/upvote", upvoteLinkHandler)
-		linkGroup.POST("/downvote", downvoteLinkHandler)
+		linkGroup.POST("/new", newLinkHandler, requireAccount, rateLimit(rateEndpointSubmit))
+		linkGroup.POST("/upvote", upvoteLinkHandler, rateLimit(rateEndpointVote))
+		linkGroup.POST("/downvote", downvoteLinkHandler, rateLimit(rateEndpointVote))
+		linkGroup.POST("/skip", skipLinkHandler, requireAccount, rateLimit(rateEndpointVote))
 	}
 
 	radioGroup := router.Group("/radio")
-	radioGroup.Use(middleware.JWT(jwtSecret))
+	radioGroup.Use(requireJWT)
 	{
 		radioGroup.GET("/now_playing", radioGetNowPlayingHandler)
 		radioGroup.GET("/queue", radioGetQueueHandler)
 	}
 
+	chatGroup := router.Group("/chat")
+	chatGroup.Use(requireJWT)
+	{
+		chatGroup.GET("", chatHandler)
+		chatGroup.POST("", sayInChatHandler, requireAccount, rateLimit(rateEndpointChat))
+	}
+
+	tokenGroup := router.Group("/tokens")
+	tokenGroup.Use(requireJWT, requireAccount)
+	{
+		tokenGroup.GET("", accessTokensHandler)
+		tokenGroup.POST("", createAccessTokenHandler)
+		tokenGroup.POST("/revoke", revokeAccessTokenHandler)
+	}
+
+	notificationGroup := router.Group("/notifications")
+	notificationGroup.Use(requireJWT, requireAccount)
+	{
+		notificationGroup.GET("", notificationsHandler)
+		notificationGroup.POST("/read", readNotificationsHandler)
+	}
+
+	moderationGroup := router.Group("/moderation")
+	moderationGroup.Use(requireJWT, requireRole(roleModerator))
+	{
+		moderationGroup.GET("/pending", pendingLinksHandler)
+		moderationGroup.POST("/approve", approveLinkHandler)
+		moderationGroup.POST("/reject", rejectLinkHandler)
+		moderationGroup.POST("/remove", removeLinkHandler)
+		moderationGroup.GET("/chat/mutes", chatMutesHandler)
+		moderationGroup.POST("/chat/delete", deleteChatMessageHandler)
+		moderationGroup.POST("/chat/mute", muteChatUserHandler)
+		moderationGroup.POST("/chat/unmute", unmuteChatUserHandler)
+	}
+
+	adminGroup := router.Group("/admin")
+	adminGroup.Use(requireJWT, requireRole(roleAdmin))
+	{
+		adminGroup.GET("/audit", auditLogHandler)
+		adminGroup.GET("/roles", rolesHandler)
+		adminGroup.POST("/roles/grant", grantRoleHandler)
+		adminGroup.POST("/roles/revoke", revokeRoleHandler)
+		adminGroup.POST("/users/revoke_tokens", revokeUserTokensHandler)
+		adminGroup.GET("/rate_limits", rateLimitsHandler)
+		adminGroup.POST("/rate_limits", setRateLimitHandler)
+		adminGroup.GET("/webhooks", webhooksHandler)
+		adminGroup.POST("/webhooks", createWebhookHandler)
+		adminGroup.POST("/webhooks/update", updateWebhookHandler)
+		adminGroup.POST("/webhooks/pause", pauseWebhookHandler)
+		adminGroup.POST("/webhooks/resume", resumeWebhookHandler)
+		adminGroup.POST("/webhooks/delete", deleteWebhookHandler)
+		adminGroup.GET("/webhooks/deliveries", webhookDeliveriesHandler)
+		adminGroup.POST("/webhooks/redeliver", redeliverWebhookHandler)
+	}
+
+	registerV2(r)
+
 	// return router
 	return r
 }
 
+// subscribeToUpdatesHandler streams radio updates.
+// Anonymous listeners get them too, just without their own votes.
 func subscribeToUpdatesHandler(c echo.Context) error {
-	cookie, err := c.Cookie("userid")
-	if err != nil {
-		return c.String(http.StatusUnauthorized, "Missing cookie userid")
-	}
-	userID := cookie.Value
+	userID := streamUserID(c)
 
 	var hookType HookType = HookType(c.QueryParam("hooktype"))
 	if len(hookType) == 0 {
@@ -84,15 +172,13 @@ func subscribeToUpdatesHandler(c echo.Context) error {
 	}
 
 	id, hookChan := radio.RegisterHook(hookType)
-	defer radio.DeregisterHook(hookType, id)
+	defer radio.ReleaseHook(hookType, id, hookChan)
 	log.Println("client connected with id", id, "for", hookType)
+	sseSubscribers.Inc("subscribe", string(hookType))
+	defer sseSubscribers.Add(-1, "subscribe", string(hookType))
+	feed := &nowPlayingFeed{}
 
 	notifyCloseChan := w.(http.CloseNotifier).CloseNotify()
-	go func() {
-		<-notifyCloseChan
-		radio.DeregisterHook(hookType, id)
-		log.Println("HTTP connection closed")
-	}()
 
 	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
 	w.Header().Set("Cache-Control", "no-cache")
@@ -100,28 +186,25 @@ func subscribeToUpdatesHandler(c echo.Context) error {
 	w.Header().Set("Transfer-Encoding", "chunked")
 
 	for {
-		state, open := <-hookChan
+		var state interface{}
+		open := true
+		// return once the listener leaves, so the deferred cleanup runs
+		select {
+		case state, open = <-hookChan:
+		case <-notifyCloseChan:
+			log.Println("HTTP connection closed")
+			open = false
+		}
 		log.Println("sse handler got ", state)
 		if !open {
 			break
 		}
 
-		if hookType == queueHook {
-			links := state.([]Link)
-			votes := service.GetVotesForUser(links, userID)
-
-			for i, l := range links {
-				if vote, ok := votes[l.LinkID]; ok {
-					links[i].MyVote = vote
-				} else {
-					links[i].MyVote = 0
-				}
-			}
-
-			state = echo.Map{
-				"links": links,
-				"votes": votes,
-			}
+		switch hookType {
+		case queueHook:
+			state = queueWithVotes(state.([]Link), userID)
+		case nowPlayingHook:
+			state = feed.describe(state.(*Link), userID)
 		}
 
 		msg, err := json.Marshal(state)
@@ -145,6 +228,45 @@ func linkByIdHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, l)
 }
 
+func listLinksHandler(c echo.Context) error {
+	filter := LinkFilter{
+		SubmittedBy: c.QueryParam("submitted_by"),
+		ChannelName: c.QueryParam("channel"),
+		State:       c.QueryParam("state"),
+		Sort:        c.QueryParam("sort"),
+		Cursor:      c.QueryParam("cursor"),
+	}
+
+	intParams := map[string]*int64{
+		"from":      &filter.CreatedAfter,
+		"to":        &filter.CreatedBefore,
+		"min_votes": &filter.MinVotes,
+		"limit":     &filter.Limit,
+	}
+	for name, dst := range intParams {
+		if v := c.QueryParam(name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, echo.Map{
+					"message": "Invalid " + name,
+				})
+			}
+			*dst = n
+		}
+	}
+
+	page, err := service.ListLinks(filter)
+	if err == ErrInvalidCursor || err == ErrInvalidFilter {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"message": err.Error(),
+		})
+	}
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, page)
+}
+
 func linksByMeHandler(c echo.Context) error {
 	// this one is ReST based
 	// userID := getUserIDFromContext(c)
@@ -152,11 +274,10 @@ func linksByMeHandler(c echo.Context) error {
 	// return c.JSON(http.StatusOK, links)
 
 	// this implementation uses SSE
-	cookie, err := c.Cookie("userid")
-	if err != nil {
-		return c.String(http.StatusUnauthorized, "Missing cookie userid")
+	userID := streamUserID(c)
+	if userID == "" {
+		return c.String(http.StatusUnauthorized, "Missing or invalid token")
 	}
-	userID := cookie.Value
 
 	var w http.ResponseWriter = c.Response().Writer
 	f, ok := w.(http.Flusher)
@@ -193,26 +314,121 @@ func linksByMeHandler(c echo.Context) error {
 	return nil
 }
 
+// loginHandler exchanges a Google ID token for our own JWT
 func loginHandler(c echo.Context) error {
-	u := User{}
-	if err := c.Bind(&u); err != nil {
+	idToken := c.FormValue("id_token")
+	if idToken == "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"message": "Missing id_token",
+		})
+	}
+
+	u, err := service.LoginWithGoogle(idToken)
+	switch err {
+	case nil:
+	case ErrInvalidIDToken:
+		return c.JSON(http.StatusUnauthorized, echo.Map{
+			"message": err.Error(),
+		})
+	case ErrGoogleLoginDisabled:
+		return c.JSON(http.StatusServiceUnavailable, echo.Map{
+			"message": err.Error(),
+		})
+	default:
+		return err
+	}
+
+	upgradeGuest(c, u.UserID)
+	refreshToken, sessionID, err := service.CreateSession(u.UserID)
+	if err != nil {
 		return err
 	}
-	// I shouldn't be doing this
-	u.UserID = c.FormValue("user_id")
-	service.CreateOrUpdateUser(u)
+	return issueTokens(c, u.UserID, sessionID, refreshToken)
+}
 
-	token := jwt.New(jwt.SigningMethodHS256)
-	claims := token.Claims.(jwt.MapClaims)
-	claims["user_id"] = u.UserID
-	claims["exp"] = time.Now().Add(time.Hour * 72).Unix()
-	t, err := token.SignedString(jwtSecret)
+// issueTokens responds with a fresh access token for the session, along with its refresh token
+func issueTokens(c echo.Context, userID, sessionID, refreshToken string) error {
+	tokens, err := newTokens(c, userID, sessionID, refreshToken)
+	if err == ErrCannotSign {
+		return c.JSON(http.StatusServiceUnavailable, echo.Map{
+			"message": err.Error(),
+		})
+	}
 	if err != nil {
 		return err
 	}
+	return c.JSON(http.StatusOK, tokens)
+}
+
+// newTokens signs an access token for the session and sets the cookie with it
+func newTokens(c echo.Context, userID, sessionID, refreshToken string) (echo.Map, error) {
+	t, expires, err := signAccessToken(userID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	setAuthCookie(c, t, expires)
+
+	return echo.Map{
+		"token":         t,
+		"refresh_token": refreshToken,
+		"expires_at":    expires.Unix(),
+	}, nil
+}
+
+// signAccessToken makes an access token for the session, and says when it expires
+func signAccessToken(userID, sessionID string) (string, time.Time, error) {
+	now := time.Now()
+	expires := now.Add(accessTokenTTL)
+	t, err := keyring.Sign(jwt.MapClaims{
+		"user_id": userID,
+		"sid":     sessionID,
+		"roles":   service.GetRoles(userID),
+		"iat":     issuedAt(now),
+		"exp":     expires.Unix(),
+	})
+	return t, expires, err
+}
+
+func refreshTokenHandler(c echo.Context) error {
+	refreshToken := c.FormValue("refresh_token")
+	if refreshToken == "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"message": "Missing refresh_token",
+		})
+	}
+
+	next, old, err := service.RefreshSession(refreshToken)
+	if err == ErrInvalidRefreshToken {
+		return c.JSON(http.StatusUnauthorized, echo.Map{
+			"message": err.Error(),
+		})
+	}
+	if err != nil {
+		return err
+	}
+	return issueTokens(c, old.UserID, old.SessionID, next)
+}
+
+func logoutHandler(c echo.Context) error {
+	claims := c.Get("user").(*jwt.Token).Claims.(jwt.MapClaims)
+	sessionID, _ := claims["sid"].(string)
+	if err := service.Logout(getUserIDFromContext(c), sessionID); err != nil {
+		return err
+	}
+	clearAuthCookie(c)
+	return c.JSON(http.StatusOK, echo.Map{
+		"message": "Done",
+	})
+}
 
+func logoutEverywhereHandler(c echo.Context) error {
+	userID := getUserIDFromContext(c)
+	if err := service.LogoutEverywhere(userID, userID); err != nil {
+		return err
+	}
+	clearAuthCookie(c)
 	return c.JSON(http.StatusOK, echo.Map{
-		"token": t,
+		"message": "Done",
 	})
 }
 
@@ -246,10 +462,36 @@ func downvoteLinkHandler(c echo.Context) error {
 		})
 	}
 	userID := getUserIDFromContext(c)
-	service.Vote(form.LinkID, userID, -1)
-	return c.JSON(http.StatusOK, echo.Map{
-		"message": "Done",
-	})
+	return voteResponse(c, service.Vote(form.LinkID, userID, -1))
+}
+
+func voteResponse(c echo.Context, err error) error {
+	if err == nil {
+		return c.JSON(http.StatusOK, echo.Map{
+			"message": "Done",
+		})
+	}
+	if status := voteErrorStatus(err); status != 0 {
+		return c.JSON(status, echo.Map{
+			"message": err.Error(),
+		})
+	}
+	return err
+}
+
+// voteErrorStatus is the status to answer a failed vote with, 0 for unexpected errors
+func voteErrorStatus(err error) int {
+	switch err {
+	case ErrGuestVotingDisabled, ErrSkipVotingDisabled:
+		return http.StatusForbidden
+	case ErrGuestVoteCapReached:
+		return http.StatusTooManyRequests
+	case ErrLinkNotFound:
+		return http.StatusNotFound
+	case ErrNotPlaying, ErrLinkNotVotable:
+		return http.StatusConflict
+	}
+	return 0
 }
 
 func upvoteLinkHandler(c echo.Context) error {
@@ -263,106 +505,249 @@ func upvoteLinkHandler(c echo.Context) error {
 	}
 	userID := getUserIDFromContext(c)
 	log.Println(form.LinkID)
-	service.Vote(form.LinkID, userID, +1)
-	return c.JSON(http.StatusOK, echo.Map{
-		"message": "Done",
-	})
+	return voteResponse(c, service.Vote(form.LinkID, userID, +1))
 }
 
-func healthCheckHandler(c echo.Context) error {
-	message := c.QueryParam("message")
-	service.Test(message)
-	return c.String(http.StatusOK, "I am up and running!")
+func notificationsHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, echo.Map{
+		"notifications": service.GetNotifications(getUserIDFromContext(c)),
+	})
 }
 
-func getUserIDFromContext(c echo.Context) string {
-	return c.Get("user").(*jwt.Token).Claims.(jwt.MapClaims)["user_id"].(string)
+// readNotificationsHandler marks notifications up to up_to as read,
+// or all of them when up_to is missing
+func readNotificationsHandler(c echo.Context) error {
+	form := struct {
+		UpTo int64 `form:"up_to"`
+	}{}
+	if err := c.Bind(&form); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"message": "Invalid up_to",
+		})
+	}
+	if form.UpTo <= 0 {
+		form.UpTo = math.MaxInt64
+	}
+	if err := service.MarkNotificationsRead(getUserIDFromContext(c), form.UpTo); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"message": "Done",
+	})
 }
 
-// TODO implement this using SSE
-func radioGetNowPlayingHandler(c echo.Context) error {
-	if radio.nowPlaying == nil {
+// rolesHandler lists the roles of user_id, or the holders of role
+func rolesHandler(c echo.Context) error {
+	if userID := c.QueryParam("user_id"); userID != "" {
 		return c.JSON(http.StatusOK, echo.Map{
-			"state":       "idle",
-			"link":        nil,
-			"player_time": 0,
+			"user_id": userID,
+			"roles":   service.GetRoles(userID),
 		})
 	}
 
-	userID := getUserIDFromContext(c)
-	links := []Link{*radio.nowPlaying}
-	votes := service.GetVotesForUser(links, userID)
-
-	linkIDs := make([]int64, len(links))
-	for i, l := range links {
-		linkIDs[i] = l.LinkID
+	grants, err := service.ListRoleHolders(c.QueryParam("role"))
+	if err == ErrInvalidRole {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"message": "Missing user_id, or invalid role",
+		})
+	}
+	if err != nil {
+		return err
 	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"grants": grants,
+	})
+}
 
-	totalVotes := service.GetTotalVoteForLinks(linkIDs)
+func grantRoleHandler(c echo.Context) error {
+	return changeRole(c, service.GrantRole)
+}
 
-	for i, l := range links {
-		if score, ok := totalVotes[l.LinkID]; ok {
-			links[i].TotalVotes = score
-		} else {
-			links[i].TotalVotes = 0
-		}
-	}
+func revokeRoleHandler(c echo.Context) error {
+	return changeRole(c, service.RevokeRole)
+}
 
-	var myVote int64
-	if len(votes) == 0 {
-		myVote = 0
-	} else {
-		myVote = votes[radio.nowPlaying.LinkID]
+func changeRole(c echo.Context, action func(actor, userID, role string) error) error {
+	form := struct {
+		UserID string `form:"user_id"`
+		Role   string `form:"role"`
+	}{}
+	if err := c.Bind(&form); err != nil || form.UserID == "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"message": "Missing user_id",
+		})
 	}
 
-	user := service.GetUserByID(radio.nowPlaying.SubmittedBy)
+	err := action(getUserIDFromContext(c), form.UserID, form.Role)
+	switch err {
+	case nil:
+		return c.JSON(http.StatusOK, echo.Map{
+			"user_id": form.UserID,
+			"roles":   service.GetRoles(form.UserID),
+		})
+	case ErrInvalidRole:
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"message": err.Error(),
+		})
+	case ErrRoleNotGranted:
+		return c.JSON(http.StatusNotFound, echo.Map{
+			"message": err.Error(),
+		})
+	case ErrLastAdmin:
+		return c.JSON(http.StatusConflict, echo.Map{
+			"message": err.Error(),
+		})
+	}
+	return err
+}
 
+// revokeUserTokensHandler logs a user out everywhere and revokes their
+// access tokens, say when they are banned
+func revokeUserTokensHandler(c echo.Context) error {
+	userID := c.FormValue("user_id")
+	if userID == "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"message": "Missing user_id",
+		})
+	}
+	actor := getUserIDFromContext(c)
+	if err := service.LogoutEverywhere(actor, userID); err != nil {
+		return err
+	}
+	if err := service.RevokeAccessTokens(actor, userID, 0); err != nil {
+		return err
+	}
 	return c.JSON(http.StatusOK, echo.Map{
-		"state": "running",
-		"link":  radio.nowPlaying,
-		"submitted_by": echo.Map{
-			"firstname": user.FirstName,
-			"lastname":  user.LastName,
-		},
-		"my_vote":     myVote,
-		"player_time": radio.playerCurTimeSec,
+		"message": "Done",
 	})
 }
 
-// TODO implement this using SSE
-func radioGetQueueHandler(c echo.Context) error {
-	links := radio.queue
-	userID := getUserIDFromContext(c)
-	votes := service.GetVotesForUser(links, userID)
+func auditLogHandler(c echo.Context) error {
+	filter := AuditFilter{
+		Actor:  c.QueryParam("actor"),
+		Action: c.QueryParam("action"),
+		Target: c.QueryParam("target"),
+	}
 
-	for i, l := range links {
-		if vote, ok := votes[l.LinkID]; ok {
-			links[i].MyVote = vote
-		} else {
-			links[i].MyVote = 0
+	intParams := map[string]*int64{
+		"from":   &filter.Since,
+		"to":     &filter.Until,
+		"before": &filter.Before,
+		"limit":  &filter.Limit,
+	}
+	for name, dst := range intParams {
+		if v := c.QueryParam(name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, echo.Map{
+					"message": "Invalid " + name,
+				})
+			}
+			*dst = n
 		}
 	}
 
+	entries, err := service.ListAudit(filter)
+	if err != nil {
+		return err
+	}
 	return c.JSON(http.StatusOK, echo.Map{
-		"links": links,
-		"votes": votes,
+		"entries": entries,
 	})
 }
 
-func tellIfLeader(c echo.Context) error {
-	switch radio.radioType {
-	case masterRadio:
-		return c.JSON(http.StatusExpectationFailed, echo.Map{
-			"message": "I am not the leader",
+func pendingLinksHandler(c echo.Context) error {
+	page, err := service.ListLinks(LinkFilter{
+		State:  string(linkPending),
+		Sort:   linkSortOldest,
+		Cursor: c.QueryParam("cursor"),
+	})
+	if err == ErrInvalidCursor {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"message": err.Error(),
 		})
-		// return c.JSON(http.StatusOK, echo.Map{
-		// 	"message": "I am the leader",
-		// })
+	}
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, page)
+}
 
-	case peerRadio:
-		return c.JSON(http.StatusExpectationFailed, echo.Map{
-			"message": "I am not the leader",
+func approveLinkHandler(c echo.Context) error {
+	return moderateLink(c, false, func(linkID int64, moderatorID, _ string) (*Link, error) {
+		return service.ApproveLink(linkID, moderatorID)
+	})
+}
+
+func rejectLinkHandler(c echo.Context) error {
+	return moderateLink(c, true, service.RejectLink)
+}
+
+func removeLinkHandler(c echo.Context) error {
+	return moderateLink(c, true, service.RemoveLink)
+}
+
+func moderateLink(c echo.Context, needsReason bool,
+	action func(linkID int64, moderatorID, reason string) (*Link, error)) error {
+
+	form := struct {
+		LinkID int64  `form:"link_id" validate:"required"`
+		Reason string `form:"reason"`
+	}{}
+	if err := c.Bind(&form); err != nil || form.LinkID == 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"message": "Missing link_id",
 		})
 	}
-	return nil
+	if needsReason && form.Reason == "" {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"message": "Missing reason",
+		})
+	}
+
+	link, err := action(form.LinkID, getUserIDFromContext(c), form.Reason)
+	switch err {
+	case nil:
+		return c.JSON(http.StatusOK, link)
+	case ErrLinkNotFound:
+		return c.JSON(http.StatusNotFound, echo.Map{
+			"message": err.Error(),
+		})
+	case ErrInvalidTransition:
+		return c.JSON(http.StatusConflict, echo.Map{
+			"message": err.Error(),
+		})
+	}
+	return err
+}
+
+func healthCheckHandler(c echo.Context) error {
+	message := c.QueryParam("message")
+	service.Test(message)
+	return c.String(http.StatusOK, "I am up and running!")
+}
+
+func getUserIDFromContext(c echo.Context) string {
+	return c.Get("user").(*jwt.Token).Claims.(jwt.MapClaims)["user_id"].(string)
+}
+
+// TODO implement this using SSE
+func radioGetNowPlayingHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, nowPlayingWithVotes(getUserIDFromContext(c)))
+}
+
+// nowPlayingWithVotes describes the song playing to the user, with how far into it the radio is
+func nowPlayingWithVotes(userID string) echo.Map {
+	s := radio.state()
+	np := describeNowPlaying(s.nowPlaying, userID)
+	np["player_time"] = 0
+	if s.nowPlaying != nil {
+		np["player_time"] = s.playerTime
+	}
+	return np
+}
+
+// TODO implement this using SSE
+func radioGetQueueHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, queueWithVotes(radio.state().queue, getUserIDFromContext(c)))
 }
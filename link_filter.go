@@ -0,0 +1,179 @@
+package main
+
+// this file builds the listing query for links
+// both repositories share it, so it is written with `?` placeholders
+// which the postgres repository rebinds before executing
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	linkSortNewest = "newest"
+	linkSortOldest = "oldest"
+	linkSortVotes  = "votes"
+
+	defaultLinkPageSize int64 = 20
+	maxLinkPageSize     int64 = 100
+)
+
+var (
+	ErrInvalidCursor = errors.New("invalid cursor")
+	ErrInvalidFilter = errors.New("invalid filter")
+)
+
+// a cursor remembers the sort key and link_id of the last link on a page
+type linkCursor struct {
+	key    int64
+	linkID int64
+}
+
+func encodeLinkCursor(c linkCursor) string {
+	raw := fmt.Sprintf("%d:%d", c.key, c.linkID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeLinkCursor(s string) (*linkCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	parts := strings.SplitN(string(raw), ":", 2)
+	if len(parts) != 2 {
+		return nil, ErrInvalidCursor
+	}
+	key, err1 := strconv.ParseInt(parts[0], 10, 64)
+	linkID, err2 := strconv.ParseInt(parts[1], 10, 64)
+	if err1 != nil || err2 != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &linkCursor{key: key, linkID: linkID}, nil
+}
+
+// normalize fills in defaults and rejects values we don't understand
+func (f *LinkFilter) normalize() error {
+	if f.State != "" && !IsValidLinkState(LinkState(f.State)) {
+		return ErrInvalidFilter
+	}
+
+	switch f.Sort {
+	case "":
+		f.Sort = linkSortNewest
+	case linkSortNewest, linkSortOldest, linkSortVotes:
+	default:
+		return ErrInvalidFilter
+	}
+
+	if f.Limit <= 0 {
+		f.Limit = defaultLinkPageSize
+	}
+	if f.Limit > maxLinkPageSize {
+		f.Limit = maxLinkPageSize
+	}
+	return nil
+}
+
+// sortKey returns the value of the column the page is sorted on
+func (f *LinkFilter) sortKey(l Link) int64 {
+	if f.Sort == linkSortVotes {
+		return l.TotalVotes
+	}
+	return l.CreatedAt
+}
+
+// buildLinkListQuery returns the query and its arguments for a filter.
+// One extra row is requested so the caller can tell if there is a next page.
+func buildLinkListQuery(f LinkFilter) (string, []interface{}, error) {
+	if err := f.normalize(); err != nil {
+		return "", nil, err
+	}
+
+	inner := make([]string, 0)
+	outer := make([]string, 0)
+	args := make([]interface{}, 0)
+
+	if f.SubmittedBy != "" {
+		inner = append(inner, "l.submitted_by = ?")
+		args = append(args, f.SubmittedBy)
+	}
+	if f.ChannelName != "" {
+		inner = append(inner, "l.channel_name = ?")
+		args = append(args, f.ChannelName)
+	}
+	if f.State != "" {
+		inner = append(inner, "l.state = ?")
+		args = append(args, f.State)
+	}
+	if f.CreatedAfter > 0 {
+		inner = append(inner, "l.created_at >= ?")
+		args = append(args, f.CreatedAfter)
+	}
+	if f.CreatedBefore > 0 {
+		inner = append(inner, "l.created_at < ?")
+		args = append(args, f.CreatedBefore)
+	}
+
+	if f.MinVotes != 0 {
+		outer = append(outer, "t.total_votes >= ?")
+		args = append(args, f.MinVotes)
+	}
+
+	var sortCol, dir, cmp string
+	switch f.Sort {
+	case linkSortNewest:
+		sortCol, dir, cmp = "t.created_at", "desc", "<"
+	case linkSortOldest:
+		sortCol, dir, cmp = "t.created_at", "asc", ">"
+	case linkSortVotes:
+		sortCol, dir, cmp = "t.total_votes", "desc", "<"
+	}
+
+	if f.Cursor != "" {
+		c, err := decodeLinkCursor(f.Cursor)
+		if err != nil {
+			return "", nil, err
+		}
+		outer = append(outer, fmt.Sprintf("(%s %s ? or (%s = ? and t.link_id %s ?))",
+			sortCol, cmp, sortCol, cmp))
+		args = append(args, c.key, c.key, c.linkID)
+	}
+	args = append(args, f.Limit+1)
+
+	query := `
+	  select t.link_id, t.video_id, t.url, t.title, t.channel_name, t.duration,
+		t.submitted_by, t.dedicated_to, t.is_expired, t.state, t.state_reason, t.created_at,
+		t.played_at, t.total_votes
+	  from (
+		select l.link_id, l.video_id, l.url, l.title, l.channel_name, l.duration,
+		  l.submitted_by, l.dedicated_to, l.is_expired, l.state, l.state_reason, l.created_at,
+		  coalesce(l.played_at, 0) as played_at,
+		  (select coalesce(sum(score), 0) from votes as v where v.link_id = l.link_id) as total_votes
+		from links as l`
+	if len(inner) > 0 {
+		query += "\n\t\twhere " + strings.Join(inner, " and ")
+	}
+	query += "\n\t  ) as t"
+	if len(outer) > 0 {
+		query += "\n\t  where " + strings.Join(outer, " and ")
+	}
+	query += fmt.Sprintf("\n\t  order by %s %s, t.link_id %s\n\t  limit ?", sortCol, dir, dir)
+
+	return query, args, nil
+}
+
+// pageOfLinks trims the extra row fetched by buildLinkListQuery
+// and computes the cursor for the next page
+func pageOfLinks(f LinkFilter, links []Link) *LinkPage {
+	f.normalize()
+	page := &LinkPage{Links: links}
+	if int64(len(links)) > f.Limit {
+		page.Links = links[:f.Limit]
+		last := page.Links[len(page.Links)-1]
+		page.NextCursor = encodeLinkCursor(linkCursor{key: f.sortKey(last), linkID: last.LinkID})
+	}
+	return page
+}
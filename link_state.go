@@ -0,0 +1,86 @@
+package main
+
+// this file defines the lifecycle of a link
+//
+//   pending -> queued -> playing -> played
+//      |         |         |
+//      v         v         v
+//   rejected  removed / unavailable / expired
+//
+// pending links can also be removed or expire before a moderator gets to them
+
+import (
+	"errors"
+	"log"
+)
+
+type LinkState string
+
+const (
+	// waiting for a moderator, only on moderated stations
+	linkPending LinkState = "pending"
+	// approved and eligible for the queue
+	linkQueued  LinkState = "queued"
+	linkPlaying LinkState = "playing"
+	linkPlayed  LinkState = "played"
+	// taken down by a moderator after it was approved
+	linkRemoved  LinkState = "removed"
+	linkRejected LinkState = "rejected"
+	// the video can't be played anymore
+	linkUnavailable LinkState = "unavailable"
+	// never made it to the top
+	linkExpired LinkState = "expired"
+)
+
+// why a song was played when the leader playing it went away
+const interruptedByLeaderChange = "interrupted by a leader change"
+
+var (
+	ErrLinkNotFound      = errors.New("link not found")
+	ErrInvalidTransition = errors.New("invalid link state transition")
+	ErrLinkNotVotable    = errors.New("the link can't be voted on anymore")
+)
+
+var linkTransitions = map[LinkState][]LinkState{
+	linkPending: {linkQueued, linkRejected, linkRemoved, linkExpired},
+	linkQueued:  {linkPlaying, linkRemoved, linkUnavailable, linkExpired},
+	linkPlaying: {linkPlayed, linkRemoved, linkUnavailable},
+	// the rest are final
+	linkPlayed:      {},
+	linkRemoved:     {},
+	linkRejected:    {},
+	linkUnavailable: {},
+	linkExpired:     {},
+}
+
+func IsValidLinkState(state LinkState) bool {
+	_, ok := linkTransitions[state]
+	return ok
+}
+
+// isFinal tells whether a link is done with, votes on it don't count anymore
+func (s LinkState) isFinal() bool {
+	return len(linkTransitions[s]) == 0
+}
+
+func (s LinkState) canMoveTo(to LinkState) bool {
+	for _, allowed := range linkTransitions[s] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Transition moves the link to a new state, recording why.
+// IsExpired is kept in sync for clients which don't know about states yet.
+func (l *Link) Transition(to LinkState, reason string) error {
+	if !l.State.canMoveTo(to) {
+		log.Println("link", l.LinkID, "cannot move from", l.State, "to", to)
+		return ErrInvalidTransition
+	}
+	l.State = to
+	l.StateReason = reason
+	l.IsExpired = to != linkPending && to != linkQueued
+	return nil
+}
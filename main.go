@@ -4,6 +4,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"github.com/google/uuid"
 	"github.com/himanshub16/upnext-backend/cluster"
@@ -12,6 +13,7 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"time"
 )
@@ -19,21 +21,50 @@ import (
 var (
 	runDs        bool
 	apiUrl       string
+	publicUrl    string
 	discoUrl     string
 	clusterUrl   string
 	nodeID       string
 	authToken    string
 	electionOnly bool
+	moderated    bool
+	moderators   string
+	admins       string
+	staleAfter   time.Duration
+	archiveAfter time.Duration
+	retainEvery  time.Duration
+	webhookEvery time.Duration
+	chatAfter    time.Duration
+	proxies      string
+	guestVotes   bool
+	guestWeight  int64
 	wg           sync.WaitGroup
+
+	guestDailyVotes int64
+	skipVotes       int64
 )
 
 func parseFlags() {
 	flag.BoolVar(&runDs, "runds", false, "Run discovery service")
 	flag.StringVar(&apiUrl, "apiurl", "127.0.0.1:3000", "URL for ReST API")
+	flag.StringVar(&publicUrl, "publicurl", "", "URL other nodes and load balancers reach the ReST API at, defaults to http://<apiurl>")
 	flag.StringVar(&discoUrl, "discourl", "127.0.0.1:4000", "URL for cluster discovery")
 	flag.StringVar(&clusterUrl, "clusterurl", "ws://127.0.0.1:5000", "URL for cluster service to start")
 	flag.StringVar(&authToken, "authtoken", "secrettoken", "Auth token for cluster nodes")
 	flag.BoolVar(&electionOnly, "electiononly", false, "Demo election process")
+	flag.BoolVar(&moderated, "moderated", false, "New submissions wait for a moderator's approval")
+	flag.StringVar(&moderators, "moderators", "", "Comma separated user IDs to make moderators on startup")
+	flag.StringVar(&admins, "admins", "", "Comma separated user IDs to make admins on startup")
+	flag.DurationVar(&staleAfter, "staleafter", time.Hour*24, "Expire links which haven't played this long after submission, 0 to keep them")
+	flag.DurationVar(&archiveAfter, "archiveafter", time.Hour*24*30, "Archive links played this long ago along with their votes, 0 to keep them")
+	flag.DurationVar(&retainEvery, "retainevery", time.Minute*10, "How often the leader expires and archives links")
+	flag.DurationVar(&chatAfter, "chatretention", time.Hour*24*7, "Delete chat messages this old, 0 to keep them")
+	flag.DurationVar(&webhookEvery, "webhookevery", time.Second*2, "How often the leader sends the webhook deliveries which are due, 0 to send none")
+	flag.StringVar(&proxies, "trustedproxies", "127.0.0.1,::1", "Comma separated IPs and CIDRs of the proxies whose X-Real-IP and X-Forwarded-For are believed")
+	flag.BoolVar(&guestVotes, "guestvotes", false, "Let guests vote")
+	flag.Int64Var(&guestWeight, "guestweight", 3, "How many guest votes count as one vote of a signed in user")
+	flag.Int64Var(&guestDailyVotes, "guestdailyvotes", 20, "Votes a guest may cast per day, 0 for no cap")
+	flag.Int64Var(&skipVotes, "skipvotes", 0, "Listeners who must vote to skip a song before it is skipped, 0 to turn skipping off")
 
 	u, _ := uuid.NewUUID()
 	nodeID = u.String()
@@ -43,10 +74,21 @@ func parseFlags() {
 
 func prepareWebService() *ServiceImpl {
 	var (
-		userRepo UserRepository
-		linkRepo LinkRepository
-		voteRepo VoteRepository
-		testRepo TestRepository
+		userRepo  UserRepository
+		linkRepo  LinkRepository
+		voteRepo  VoteRepository
+		testRepo  TestRepository
+		auditRepo AuditRepository
+		notifRepo NotificationRepository
+		roleRepo  RoleRepository
+		tokenRepo TokenRepository
+		guestRepo GuestRepository
+		rateRepo  RateLimitRepository
+		patRepo   AccessTokenRepository
+		idRepo    IdentityRepository
+		skipRepo  SkipVoteRepository
+		hookRepo  WebhookRepository
+		chatRepo  ChatRepository
 
 		pgdb     *PostgresRepository
 		sqlitedb *SQLiteRepository
@@ -62,28 +104,152 @@ func prepareWebService() *ServiceImpl {
 			linkRepo = sqlitedb
 			voteRepo = sqlitedb
 			testRepo = sqlitedb
+			auditRepo = sqlitedb
+			notifRepo = sqlitedb
+			roleRepo = sqlitedb
+			tokenRepo = sqlitedb
+			guestRepo = sqlitedb
+			rateRepo = sqlitedb
+			patRepo = sqlitedb
+			idRepo = sqlitedb
+			skipRepo = sqlitedb
+			hookRepo = sqlitedb
+			chatRepo = sqlitedb
 
 		case "postgres":
-			pgdb = NewPostgresRepository(dbUrl)
+			pgdb = NewPostgresRepository(dbUrl, splitList(os.Getenv("DB_REPLICA_URLS")))
 			userRepo = pgdb
 			linkRepo = pgdb
 			voteRepo = pgdb
 			testRepo = pgdb
+			auditRepo = pgdb
+			notifRepo = pgdb
+			roleRepo = pgdb
+			tokenRepo = pgdb
+			guestRepo = pgdb
+			rateRepo = pgdb
+			patRepo = pgdb
+			idRepo = pgdb
+			skipRepo = pgdb
+			hookRepo = pgdb
+			chatRepo = pgdb
 		}
 	}
 	service := &ServiceImpl{
-		userRepo: userRepo,
-		linkRepo: linkRepo,
-		voteRepo: voteRepo,
-		testRepo: testRepo,
+		userRepo:  userRepo,
+		linkRepo:  linkRepo,
+		voteRepo:  voteRepo,
+		testRepo:  testRepo,
+		auditRepo: auditRepo,
+
+		notificationRepo: notifRepo,
+		roleRepo:         roleRepo,
+		tokenRepo:        tokenRepo,
+		guestRepo:        guestRepo,
+		rateLimitRepo:    rateRepo,
+		accessTokenRepo:  patRepo,
+		identityRepo:     idRepo,
+		skipVoteRepo:     skipRepo,
+		webhookRepo:      hookRepo,
+		chatRepo:         chatRepo,
+
+		revoked:       NewRevocationList(),
+		rateRuleCache: newRateRuleCache(),
+
+		google: NewGoogleVerifier(
+			envOr("GOOGLE_JWKS_URL", defaultGoogleJWKSURL),
+			splitList(os.Getenv("GOOGLE_CLIENT_IDS")),
+			splitList(envOr("GOOGLE_ISSUERS", defaultGoogleIssuers)),
+		),
+		oidc: LoadOIDCProviders(os.Getenv("OIDC_PROVIDERS_FILE")),
+
+		nodeID:    nodeID,
+		moderated: moderated,
+		guests: GuestPolicy{
+			CanVote:      guestVotes,
+			VotesPerVote: guestWeight,
+			DailyVotes:   guestDailyVotes,
+		},
+		skipVotes: skipVotes,
+	}
+
+	// backends which need a build tag register themselves in optionalBackends
+	if u, err := url.Parse(dbUrl); err == nil {
+		if open, ok := optionalBackends[u.Scheme]; ok {
+			open(u, service)
+		}
 	}
+	service.meterRepositories()
 	return service
 }
 
+// shareRevocations tells the other nodes about tokens revoked here, and the other way round
+func shareRevocations(c *cluster.ClusterService, service *ServiceImpl) {
+	c.Subscribe(revocationTopic, func(from string, payload json.RawMessage) {
+		var r Revocation
+		if err := json.Unmarshal(payload, &r); err != nil {
+			log.Println("bad revocation from", from, err)
+			return
+		}
+		service.revoked.Add(r)
+	})
+	service.revoked.publish = func(r Revocation) {
+		if err := c.Broadcast(revocationTopic, r); err != nil {
+			log.Println("failed to broadcast revocation", err)
+		}
+	}
+	service.WatchRevocations()
+}
+
+// shareChat sends the chat said here to the other nodes, and the other way round
+func shareChat(c *cluster.ClusterService, h *ChatHub) {
+	c.Subscribe(chatTopic, func(from string, payload json.RawMessage) {
+		var e chatEvent
+		if err := json.Unmarshal(payload, &e); err != nil {
+			log.Println("bad chat event from", from, err)
+			return
+		}
+		h.Apply(e)
+	})
+	h.publish = func(e chatEvent) {
+		if err := c.Broadcast(chatTopic, e); err != nil {
+			log.Println("failed to broadcast chat", err)
+		}
+	}
+}
+
+func envOr(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// splitList splits a comma separated list, dropping empty items
+func splitList(list string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func main() {
+	if isCtlInvocation() {
+		runCtl(os.Args[1:])
+		return
+	}
+
 	parseFlags()
 	rand.Seed(time.Now().UnixNano())
 
+	var err error
+	if trustedProxies, err = parseProxies(proxies); err != nil {
+		log.Fatal("invalid -trustedproxies ", err)
+	}
+
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt)
 
@@ -91,15 +257,31 @@ func main() {
 		NodeID:   nodeID,
 		URL:      clusterUrl,
 		Priority: rand.Intn(100),
+		APIURL:   publicUrl,
+	}
+	if me.APIURL == "" {
+		me.APIURL = "http://" + apiUrl
 	}
 	log.Println("starting cluster at ", clusterUrl)
 	log.Println("This is me : ", me)
 
 	service := prepareWebService()
+	service.BootstrapRoles(map[string][]string{
+		roleAdmin:     splitList(admins),
+		roleModerator: splitList(moderators),
+	})
 	c := cluster.NewClusterService(clusterUrl, discoUrl, me, authToken)
+	clusterNode = c
+	shareRevocations(c, service)
 	r := NewRadio(service, c.Shm)
 	log.Println(r.shm, r.nowPlaying)
 	apiRouter := NewHTTPRouter(service, r)
+	if !checkOpenAPI(apiRouter, openAPIFile) {
+		log.Println(openAPIFile, "is out of date, run upnextctl openapi-check")
+	}
+	shareChat(c, chats)
+	retention := NewRetentionJob(service, staleAfter, archiveAfter, chatAfter, retainEvery)
+	webhooks := NewWebhookDispatcher(service, webhookEvery)
 
 	go c.Start()
 	go apiRouter.Start(apiUrl)
@@ -107,6 +289,8 @@ func main() {
 		select {
 		case <-interrupt:
 			c.Shutdown()
+			retention.Shutdown()
+			webhooks.Shutdown()
 			if !electionOnly {
 				r.Shutdown()
 				apiRouter.Shutdown(context.Background())
@@ -114,7 +298,10 @@ func main() {
 			}
 		case isLeader := <-c.SwitchMode:
 			log.Println("isLeader > ", isLeader)
+			service.RecordLeaderChange(isLeader)
 			if !electionOnly {
+				retention.SwitchMode(isLeader)
+				webhooks.SwitchMode(isLeader)
 				if isLeader {
 					r.SwitchMode(masterRadio)
 					// apiRouter.Shutdown(context.Background())
@@ -0,0 +1,347 @@
+package main
+
+// this file serves /metrics, in the Prometheus text format
+//
+// there is no client library, the few kinds of metrics needed are here:
+// counters, gauges and histograms with labels, and metrics read from
+// elsewhere (the cluster, the radio) when they are scraped.
+// Every node has its own, scrape each of them rather than the load balancer.
+// They are only served to scrapers presenting METRICS_TOKEN as a bearer token.
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/himanshub16/upnext-backend/cluster"
+	"github.com/labstack/echo"
+)
+
+const (
+	counterMetric   = "counter"
+	gaugeMetric     = "gauge"
+	histogramMetric = "histogram"
+)
+
+// seconds, from a quick database query up to a slow YouTube call
+var latencyBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var (
+	httpRequests = newMetric(counterMetric, "upnext_http_requests_total",
+		"HTTP requests served, by route and status", "method", "route", "status")
+	httpDuration = newMetric(histogramMetric, "upnext_http_request_duration_seconds",
+		"Time taken to serve HTTP requests, streams aside", "method", "route")
+	sseSubscribers = newMetric(gaugeMetric, "upnext_sse_subscribers",
+		"Listeners connected over SSE, by endpoint and hook type", "endpoint", "hook")
+	broadcastDuration = newMetric(histogramMetric, "upnext_broadcast_duration_seconds",
+		"Time taken by broadcastUpdate to hand an update to every hook", "hook")
+	youtubeRequests = newMetric(counterMetric, "upnext_youtube_requests_total",
+		"Calls to the YouTube Data API", "call")
+	youtubeErrors = newMetric(counterMetric, "upnext_youtube_errors_total",
+		"Calls to the YouTube Data API which failed", "call")
+	dbDuration = newMetric(histogramMetric, "upnext_db_query_duration_seconds",
+		"Time taken by repository methods", "method")
+
+	clusterPeers = newMetricFunc(gaugeMetric, "upnext_cluster_peers",
+		"Peers connected over the mesh", nil, func() []sample {
+			if clusterNode == nil {
+				return nil
+			}
+			return []sample{{value: float64(clusterNode.Metrics().Peers)}}
+		})
+	clusterLeader = newMetricFunc(gaugeMetric, "upnext_cluster_leader",
+		"1 on the leader, 0 elsewhere", nil, func() []sample {
+			leader := 0.0
+			if clusterStatus().Role == cluster.RoleLeader {
+				leader = 1
+			}
+			return []sample{{value: leader}}
+		})
+	clusterElections = newMetricFunc(counterMetric, "upnext_cluster_elections_total",
+		"Elections this node took part in, by how they ended for it: won, lost or restarted", []string{"outcome"},
+		func() []sample {
+			if clusterNode == nil {
+				return nil
+			}
+			return countSamples(clusterNode.Metrics().Elections)
+		})
+	clusterMessagesSent = newMetricFunc(counterMetric, "upnext_cluster_messages_sent_total",
+		"Messages sent to peers, by MessageType", []string{"type"}, func() []sample {
+			if clusterNode == nil {
+				return nil
+			}
+			return countSamples(clusterNode.Metrics().Sent)
+		})
+	clusterMessagesReceived = newMetricFunc(counterMetric, "upnext_cluster_messages_received_total",
+		"Messages received from peers, by MessageType", []string{"type"}, func() []sample {
+			if clusterNode == nil {
+				return nil
+			}
+			return countSamples(clusterNode.Metrics().Received)
+		})
+)
+
+// allMetrics are served in this order
+var allMetrics = []metricWriter{
+	httpRequests, httpDuration, sseSubscribers, broadcastDuration,
+	youtubeRequests, youtubeErrors, dbDuration,
+	clusterPeers, clusterLeader, clusterElections, clusterMessagesSent, clusterMessagesReceived,
+}
+
+type metricWriter interface {
+	writeTo(b *bytes.Buffer)
+}
+
+type series struct {
+	labels []string
+	value  float64
+	// histograms only, counts per bucket, not cumulative
+	buckets []uint64
+	count   uint64
+}
+
+// Metric is a family of counters, gauges or histograms told apart by their labels
+type Metric struct {
+	kind   string
+	name   string
+	help   string
+	labels []string
+
+	series map[string]*series
+	mutex  *sync.Mutex
+}
+
+func newMetric(kind, name, help string, labels ...string) *Metric {
+	return &Metric{
+		kind:   kind,
+		name:   name,
+		help:   help,
+		labels: labels,
+		series: make(map[string]*series),
+		mutex:  &sync.Mutex{},
+	}
+}
+
+// get returns the series for the label values, the caller must hold the mutex
+func (m *Metric) get(labels []string) *series {
+	if len(labels) != len(m.labels) {
+		panic(fmt.Sprintf("%s takes %d labels, got %d", m.name, len(m.labels), len(labels)))
+	}
+	key := strings.Join(labels, "\x00")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labels: append([]string(nil), labels...)}
+		if m.kind == histogramMetric {
+			s.buckets = make([]uint64, len(latencyBuckets)+1)
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+func (m *Metric) Inc(labels ...string) {
+	m.Add(1, labels...)
+}
+
+// Add adds to a counter or a gauge, only gauges may go down
+func (m *Metric) Add(delta float64, labels ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.get(labels).value += delta
+}
+
+// Observe records a value of a histogram
+func (m *Metric) Observe(value float64, labels ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	s := m.get(labels)
+	s.buckets[sort.SearchFloat64s(latencyBuckets, value)]++
+	s.value += value
+	s.count++
+}
+
+// Since observes the time elapsed since start, in seconds. Use it as
+// defer m.Since(time.Now(), labels...)
+func (m *Metric) Since(start time.Time, labels ...string) {
+	m.Observe(time.Since(start).Seconds(), labels...)
+}
+
+func (m *Metric) writeTo(b *bytes.Buffer) {
+	writeHeader(b, m.kind, m.name, m.help)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := m.series[key]
+		if m.kind != histogramMetric {
+			writeSample(b, m.name, m.labels, s.labels, s.value)
+			continue
+		}
+		labels := append(append([]string(nil), m.labels...), "le")
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += s.buckets[i]
+			writeSample(b, m.name+"_bucket", labels, append(s.labels, formatFloat(bound)), float64(cumulative))
+		}
+		writeSample(b, m.name+"_bucket", labels, append(s.labels, "+Inf"), float64(s.count))
+		writeSample(b, m.name+"_sum", m.labels, s.labels, s.value)
+		writeSample(b, m.name+"_count", m.labels, s.labels, float64(s.count))
+	}
+}
+
+type sample struct {
+	labels []string
+	value  float64
+}
+
+// MetricFunc is a counter or a gauge kept elsewhere, read when scraped
+type MetricFunc struct {
+	kind    string
+	name    string
+	help    string
+	labels  []string
+	collect func() []sample
+}
+
+func newMetricFunc(kind, name, help string, labels []string, collect func() []sample) *MetricFunc {
+	return &MetricFunc{kind: kind, name: name, help: help, labels: labels, collect: collect}
+}
+
+func (m *MetricFunc) writeTo(b *bytes.Buffer) {
+	writeHeader(b, m.kind, m.name, m.help)
+	samples := m.collect()
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].labels, "\x00") < strings.Join(samples[j].labels, "\x00")
+	})
+	for _, s := range samples {
+		writeSample(b, m.name, m.labels, s.labels, s.value)
+	}
+}
+
+// countSamples turns counts keyed by a single label into samples
+func countSamples(counts map[string]int64) []sample {
+	samples := make([]sample, 0, len(counts))
+	for label, count := range counts {
+		samples = append(samples, sample{labels: []string{label}, value: float64(count)})
+	}
+	return samples
+}
+
+func writeHeader(b *bytes.Buffer, kind, name, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeSample(b *bytes.Buffer, name string, labelNames, labelValues []string, value float64) {
+	b.WriteString(name)
+	if len(labelNames) > 0 {
+		b.WriteByte('{')
+		for i, label := range labelNames {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(b, "%s=\"%s\"", label, escapeLabel(labelValues[i]))
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(formatFloat(value))
+	b.WriteByte('\n')
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// streamingRoutes stay open for as long as listeners do, timing them says nothing
+var streamingRoutes = map[string]bool{
+	"/api/subscribe": true,
+	"/api/stream":    true,
+	"/api/ws":        true,
+}
+
+// measureRequests counts requests by the route which served them, so
+// /api/link/7 and /api/link/8 are both /api/link/:id
+func measureRequests(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		if err := next(c); err != nil {
+			// the status isn't known until the error is handled
+			c.Error(err)
+		}
+
+		route := routeOf(c)
+		method := c.Request().Method
+		httpRequests.Inc(method, route, strconv.Itoa(c.Response().Status))
+		if !streamingRoutes[route] {
+			httpDuration.Since(start, method, route)
+		}
+		return nil
+	}
+}
+
+var (
+	knownRoutes     map[string]bool
+	knownRoutesOnce sync.Once
+)
+
+// routeOf returns the route a request matched, echo leaves the path
+// as requested when none did, which would make a series per URL
+func routeOf(c echo.Context) string {
+	knownRoutesOnce.Do(func() {
+		knownRoutes = make(map[string]bool)
+		for _, r := range c.Echo().Routes() {
+			knownRoutes[r.Path] = true
+		}
+	})
+	if !knownRoutes[c.Path()] {
+		return "unmatched"
+	}
+	return c.Path()
+}
+
+// requireMetricsToken lets through scrapers sending token as a bearer token.
+// Without a token metrics are off.
+func requireMetricsToken(token string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if token == "" {
+				return echo.ErrNotFound
+			}
+			given := strings.TrimPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				return echo.ErrUnauthorized
+			}
+			return next(c)
+		}
+	}
+}
+
+func metricsHandler(c echo.Context) error {
+	b := &bytes.Buffer{}
+	for _, m := range allMetrics {
+		m.writeTo(b)
+	}
+	return c.Blob(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", b.Bytes())
+}
@@ -1,19 +1,24 @@
 // this file defines the data structures to be used throught
 package main
 
+import "encoding/json"
+
 type Link struct {
-	LinkID      int64  `json:"link_id"`
-	URL         string `json:"url"`
-	VideoID     string `json:"video_id"`
-	Title       string `json:"title"`
-	ChannelName string `json:"channel_name"`
-	Duration    int64  `json:"duration"`
-	SubmittedBy string `json:"submitted_by"`
-	DedicatedTo string `json:"dedicated_to"`
-	TotalVotes  int64  `json:"total_votes"`
-	MyVote int64 `json:"my_vote"`
-	IsExpired   bool   `json:"is_expired"`
-	CreatedAt   int64  `json:"created_at"`
+	LinkID      int64     `json:"link_id"`
+	URL         string    `json:"url"`
+	VideoID     string    `json:"video_id"`
+	Title       string    `json:"title"`
+	ChannelName string    `json:"channel_name"`
+	Duration    int64     `json:"duration"`
+	SubmittedBy string    `json:"submitted_by"`
+	DedicatedTo string    `json:"dedicated_to"`
+	TotalVotes  int64     `json:"total_votes"`
+	MyVote      int64     `json:"my_vote"`
+	IsExpired   bool      `json:"is_expired"`
+	State       LinkState `json:"state"`
+	StateReason string    `json:"state_reason"`
+	CreatedAt   int64     `json:"created_at"`
+	PlayedAt    int64     `json:"played_at"`
 }
 
 type Vote struct {
@@ -22,9 +27,218 @@ type Vote struct {
 	Score  int    `json:"score"`
 }
 
+// GuestVote is kept apart from votes, guest votes only count in bulk
+type GuestVote struct {
+	UserID    string `json:"user_id"`
+	LinkID    int64  `json:"link_id"`
+	Score     int64  `json:"score"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// SkipTally counts the votes to skip a link against those needed
+type SkipTally struct {
+	LinkID int64 `json:"link_id"`
+	Votes  int64 `json:"votes"`
+	Needed int64 `json:"needed"`
+}
+
+// RateRule lets Capacity requests through per Period seconds, with bursts up to Capacity
+type RateRule struct {
+	Endpoint string `json:"endpoint"`
+	// user, ip or global
+	Scope    string `json:"scope"`
+	Capacity int64  `json:"capacity"`
+	Period   int64  `json:"period"`
+}
+
+// RateBucket is a token bucket, UpdatedAt is in milliseconds
+type RateBucket struct {
+	Key       string
+	Tokens    float64
+	UpdatedAt int64
+}
+
 type User struct {
 	UserID    string `json:"user_id"`
 	FirstName string `json:"firstname"`
 	LastName  string `json:"lastname"`
 	Email     string `json:"email"`
 }
+
+// LinkFilter narrows down a listing of links.
+// Zero values mean "don't filter on this field".
+type LinkFilter struct {
+	SubmittedBy   string
+	ChannelName   string
+	State         string
+	CreatedAfter  int64
+	CreatedBefore int64
+	MinVotes      int64
+	Sort          string
+	Cursor        string
+	Limit         int64
+}
+
+type LinkPage struct {
+	Links      []Link `json:"links"`
+	NextCursor string `json:"next_cursor"`
+}
+
+// AuditEntry records a single mutating action.
+// Before and After hold JSON snapshots of the affected object.
+type AuditEntry struct {
+	AuditID   int64           `json:"audit_id"`
+	Actor     string          `json:"actor"`
+	NodeID    string          `json:"node_id"`
+	Action    string          `json:"action"`
+	Target    string          `json:"target"`
+	Before    json.RawMessage `json:"before"`
+	After     json.RawMessage `json:"after"`
+	CreatedAt int64           `json:"created_at"`
+}
+
+type AuditFilter struct {
+	Actor  string
+	Action string
+	Target string
+	Since  int64
+	Until  int64
+	// only entries older than this audit_id, for paging backwards
+	Before int64
+	Limit  int64
+}
+
+// Notification tells a user about something that happened to their links
+type Notification struct {
+	NotificationID int64  `json:"notification_id"`
+	UserID         string `json:"user_id"`
+	Kind           string `json:"kind"`
+	LinkID         int64  `json:"link_id"`
+	Message        string `json:"message"`
+	Read           bool   `json:"read"`
+	CreatedAt      int64  `json:"created_at"`
+}
+
+// Identity links an account at an OpenID Connect provider to a user
+type Identity struct {
+	Provider string `json:"provider"`
+	Subject  string `json:"subject"`
+	UserID   string `json:"user_id"`
+	Email    string `json:"email"`
+	LinkedAt int64  `json:"linked_at"`
+}
+
+// RoleGrant gives a user a role beyond listening
+type RoleGrant struct {
+	UserID    string `json:"user_id"`
+	Role      string `json:"role"`
+	GrantedBy string `json:"granted_by"`
+	GrantedAt int64  `json:"granted_at"`
+}
+
+// AccessToken is a personal access token, used by scripts and bots
+// instead of a JWT. Like refresh tokens, only its hash is stored.
+type AccessToken struct {
+	TokenID   int64    `json:"token_id"`
+	UserID    string   `json:"user_id"`
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	TokenHash string   `json:"-"`
+	CreatedAt int64    `json:"created_at"`
+	// 0 for tokens which don't expire
+	ExpiresAt  int64 `json:"expires_at"`
+	LastUsedAt int64 `json:"last_used_at"`
+	Revoked    bool  `json:"revoked"`
+}
+
+// Webhook sends the station events it lists to URL, signed with Secret
+type Webhook struct {
+	WebhookID int64    `json:"webhook_id"`
+	URL       string   `json:"url"`
+	Events    []string `json:"events"`
+	Secret    string   `json:"-"`
+	Active    bool     `json:"active"`
+	CreatedBy string   `json:"created_by"`
+	CreatedAt int64    `json:"created_at"`
+}
+
+// WebhookDelivery is one event on its way to one webhook. The deliveries
+// are the log admins look at and the queue the leader sends from.
+type WebhookDelivery struct {
+	DeliveryID int64           `json:"delivery_id"`
+	WebhookID  int64           `json:"webhook_id"`
+	Event      string          `json:"event"`
+	Payload    json.RawMessage `json:"payload"`
+	// pending, delivered or failed
+	Status        string `json:"status"`
+	Attempts      int64  `json:"attempts"`
+	NextAttemptAt int64  `json:"next_attempt_at"`
+	LastAttemptAt int64  `json:"last_attempt_at"`
+	// status code of the last response, 0 when there was none
+	ResponseCode int64  `json:"response_code"`
+	LastError    string `json:"last_error"`
+	CreatedAt    int64  `json:"created_at"`
+	DeliveredAt  int64  `json:"delivered_at"`
+}
+
+type WebhookDeliveryFilter struct {
+	// every webhook when 0
+	WebhookID int64
+	Status    string
+	// only deliveries older than this delivery_id, for paging backwards
+	Before int64
+	Limit  int64
+}
+
+// ChatMessage is something a listener said while LinkID was playing
+type ChatMessage struct {
+	MessageID int64  `json:"message_id"`
+	LinkID    int64  `json:"link_id"`
+	UserID    string `json:"user_id"`
+	// who said it, filled in from the users when served
+	FirstName string `json:"firstname"`
+	LastName  string `json:"lastname"`
+	Text      string `json:"text"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+type ChatFilter struct {
+	// every link when 0
+	LinkID int64
+	// only messages older than this message_id, for paging backwards
+	Before int64
+	Limit  int64
+}
+
+// ChatMute keeps a user from saying anything in the chat
+type ChatMute struct {
+	UserID  string `json:"user_id"`
+	MutedBy string `json:"muted_by"`
+	Reason  string `json:"reason"`
+	MutedAt int64  `json:"muted_at"`
+	// 0 for mutes which last until the user is unmuted
+	ExpiresAt int64 `json:"expires_at"`
+}
+
+// RefreshToken is stored by its hash, the token itself only ever goes to the client.
+// Every refresh uses up the token and issues a new one in the same session.
+type RefreshToken struct {
+	TokenHash string
+	UserID    string
+	SessionID string
+	IssuedAt  int64
+	ExpiresAt int64
+	Used      bool
+	Revoked   bool
+}
+
+// Revocation rejects the access tokens of one session, or when SessionID is empty,
+// every access token of the user issued before RevokedAt
+type Revocation struct {
+	SessionID string `json:"session_id"`
+	UserID    string `json:"user_id"`
+	// in milliseconds, a user can log in again within the second they logged out everywhere
+	RevokedAt int64 `json:"revoked_at"`
+	// after this every access token it covers has expired anyway
+	ExpiresAt int64 `json:"expires_at"`
+}
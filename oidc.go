@@ -0,0 +1,502 @@
+package main
+
+// this file logs users in with any OpenID Connect provider
+//
+// providers are listed in the JSON file at OIDC_PROVIDERS_FILE:
+//
+//   [
+//     {
+//       "name": "corp",
+//       "issuer": "https://idp.example.com",
+//       "client_id": "upnext",
+//       "client_secret": "optional, for confidential clients",
+//       "redirect_url": "https://radio.example.com/api/oidc/corp/callback",
+//       "scopes": ["openid", "email", "profile"]
+//     }
+//   ]
+//
+// Endpoints and keys come from the issuer's discovery document. Login uses
+// the authorization code flow with PKCE: /api/oidc/:provider/login sends the
+// browser to the provider, with the state, nonce and code verifier kept in a
+// short-lived signed cookie, so the callback can land on any node.
+//
+// An account at a provider (an Identity) belongs to one user. The first login
+// with it makes a new user, unless the browser is already signed in, in which
+// case the identity is linked to that user instead.
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/google/uuid"
+	"github.com/labstack/echo"
+)
+
+const (
+	oidcDiscoveryPath = "/.well-known/openid-configuration"
+	oidcTimeout       = time.Second * 10
+
+	// the login in progress, between /login and /callback
+	oidcCookieName = "upnext_oidc"
+	oidcCookiePath = "/api/oidc"
+	oidcLoginTTL   = time.Minute * 10
+	// value of the "typ" claim in the cookie
+	oidcLoginType = "oidc"
+)
+
+var (
+	ErrUnknownProvider = errors.New("unknown login provider")
+	ErrOIDCExchange    = errors.New("the login provider refused the authorization code")
+	ErrIdentityLinked  = errors.New("this identity is linked to another user")
+
+	providerNameRe = regexp.MustCompile(`^[a-z0-9_-]+$`)
+)
+
+type OIDCProviderConfig struct {
+	Name         string   `json:"name"`
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	RedirectURL  string   `json:"redirect_url"`
+	Scopes       []string `json:"scopes"`
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type OIDCProvider struct {
+	config OIDCProviderConfig
+	client *http.Client
+
+	// both set on first use
+	discovery *oidcDiscovery
+	jwks      *jwksCache
+	mutex     *sync.Mutex
+}
+
+// LoadOIDCProviders reads the providers in path, an empty path means none
+func LoadOIDCProviders(path string) map[string]*OIDCProvider {
+	providers := make(map[string]*OIDCProvider)
+	if path == "" {
+		return providers
+	}
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatal("failed to read OIDC providers from ", path, " ", err)
+	}
+	var configs []OIDCProviderConfig
+	if err = json.Unmarshal(raw, &configs); err != nil {
+		log.Fatal("failed to parse OIDC providers in ", path, " ", err)
+	}
+	for _, c := range configs {
+		if !providerNameRe.MatchString(c.Name) || c.Issuer == "" || c.ClientID == "" || c.RedirectURL == "" {
+			log.Fatalf("OIDC provider %q needs a lowercase name, issuer, client_id and redirect_url", c.Name)
+		}
+		if len(c.Scopes) == 0 {
+			c.Scopes = []string{"openid", "email", "profile"}
+		}
+		providers[c.Name] = &OIDCProvider{
+			config: c,
+			client: &http.Client{Timeout: oidcTimeout},
+			mutex:  &sync.Mutex{},
+		}
+	}
+	log.Println("loaded", len(providers), "OIDC providers")
+	return providers
+}
+
+// discover fetches the discovery document, until it succeeds once
+func (p *OIDCProvider) discover() (*oidcDiscovery, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	resp, err := p.client.Get(strings.TrimSuffix(p.config.Issuer, "/") + oidcDiscoveryPath)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery failed with %s", resp.Status)
+	}
+	d := &oidcDiscovery{}
+	if err = json.NewDecoder(resp.Body).Decode(d); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(d.Issuer, "/") != strings.TrimSuffix(p.config.Issuer, "/") {
+		return nil, fmt.Errorf("discovery document is for issuer %q", d.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("discovery document lacks an endpoint")
+	}
+	p.discovery = d
+	p.jwks = newJWKSCache(d.JWKSURI)
+	return d, nil
+}
+
+// pkceChallenge derives the S256 code challenge from a verifier
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthURL is where the browser goes to log in at the provider
+func (p *OIDCProvider) AuthURL(state, nonce, verifier string) (string, error) {
+	d, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.ClientID},
+		"redirect_uri":          {p.config.RedirectURL},
+		"scope":                 {strings.Join(p.config.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {pkceChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// Exchange trades an authorization code for the ID token
+func (p *OIDCProvider) Exchange(code, verifier string) (string, error) {
+	d, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"client_id":     {p.config.ClientID},
+		"code_verifier": {verifier},
+	}
+	if p.config.ClientSecret != "" {
+		form.Set("client_secret", p.config.ClientSecret)
+	}
+
+	resp, err := p.client.PostForm(d.TokenEndpoint, form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Println("OIDC token endpoint of", p.config.Name, "answered", resp.Status)
+		return "", ErrOIDCExchange
+	}
+	body := struct {
+		IDToken string `json:"id_token"`
+	}{}
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.IDToken == "" {
+		return "", ErrOIDCExchange
+	}
+	return body.IDToken, nil
+}
+
+// Verify checks an ID token issued to us for the login started with nonce,
+// and returns the identity and user it describes
+func (p *OIDCProvider) Verify(idToken, nonce string) (*Identity, *User, error) {
+	d, err := p.discover()
+	if err != nil {
+		return nil, nil, err
+	}
+	token, err := jwt.Parse(idToken, func(t *jwt.Token) (interface{}, error) {
+		if t.Method != jwt.SigningMethodRS256 {
+			return nil, fmt.Errorf("unexpected signing method %v", t.Header["alg"])
+		}
+		kid, _ := t.Header["kid"].(string)
+		return p.jwks.key(kid)
+	})
+	if err != nil {
+		log.Println("rejected ID token from", p.config.Name, err)
+		return nil, nil, ErrInvalidIDToken
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+	iss, _ := claims["iss"].(string)
+	sub, _ := claims["sub"].(string)
+	gotNonce, _ := claims["nonce"].(string)
+	if _, ok := claims["exp"]; !ok || iss != d.Issuer || sub == "" || gotNonce != nonce ||
+		!audienceContains(claims["aud"], p.config.ClientID) {
+		log.Println("rejected ID token from", p.config.Name, "for its claims")
+		return nil, nil, ErrInvalidIDToken
+	}
+
+	identity := &Identity{Provider: p.config.Name, Subject: sub}
+	u := &User{}
+	u.FirstName, _ = claims["given_name"].(string)
+	u.LastName, _ = claims["family_name"].(string)
+	if u.FirstName == "" {
+		u.FirstName, _ = claims["name"].(string)
+	}
+	if verified := claims["email_verified"]; verified == true || verified == "true" {
+		u.Email, _ = claims["email"].(string)
+		identity.Email = u.Email
+	}
+	return identity, u, nil
+}
+
+// audienceContains checks the aud claim, which may be a string or a list
+func audienceContains(aud interface{}, clientID string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == clientID
+	case []interface{}:
+		for _, a := range aud {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *ServiceImpl) OIDCProviders() []string {
+	names := make([]string, 0, len(s.oidc))
+	for name := range s.oidc {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *ServiceImpl) OIDCAuthURL(provider, state, nonce, verifier string) (string, error) {
+	p, ok := s.oidc[provider]
+	if !ok {
+		return "", ErrUnknownProvider
+	}
+	return p.AuthURL(state, nonce, verifier)
+}
+
+// LoginWithOIDC finishes a login at provider. The identity is linked to linkTo
+// when it is new and linkTo is set, otherwise to a new user.
+func (s *ServiceImpl) LoginWithOIDC(provider, code, verifier, nonce, linkTo string) (*User, error) {
+	p, ok := s.oidc[provider]
+	if !ok {
+		return nil, ErrUnknownProvider
+	}
+	idToken, err := p.Exchange(code, verifier)
+	if err != nil {
+		return nil, err
+	}
+	identity, claimed, err := p.Verify(idToken, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	if existing := s.identityRepo.GetIdentity(identity.Provider, identity.Subject); existing != nil {
+		if linkTo != "" && linkTo != existing.UserID {
+			return nil, ErrIdentityLinked
+		}
+		identity = existing
+	} else {
+		identity.UserID = linkTo
+		if identity.UserID == "" {
+			u, _ := uuid.NewRandom()
+			identity.UserID = u.String()
+		}
+		identity.LinkedAt = time.Now().Unix()
+		if err = s.identityRepo.AddIdentity(*identity); err != nil {
+			return nil, err
+		}
+		s.audit(identity.UserID, auditIdentityLink, userTarget(identity.UserID), nil, identity)
+	}
+
+	// the provider fills in what we don't know about the user yet
+	u := s.userRepo.GetUserByID(identity.UserID)
+	if u == nil {
+		u = &User{UserID: identity.UserID}
+	}
+	if u.FirstName == "" && u.LastName == "" {
+		u.FirstName, u.LastName = claimed.FirstName, claimed.LastName
+	}
+	if u.Email == "" {
+		u.Email = claimed.Email
+	}
+	if err = s.Login(*u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (s *ServiceImpl) ListIdentities(userID string) []Identity {
+	return s.identityRepo.ListIdentities(userID)
+}
+
+func setOIDCCookie(c echo.Context, value string, maxAge int) {
+	c.SetCookie(&http.Cookie{
+		Name:     oidcCookieName,
+		Value:    value,
+		Path:     oidcCookiePath,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   c.IsTLS(),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// oidcLoginFromCookie returns the claims of the login in progress at provider, if any
+func oidcLoginFromCookie(c echo.Context, provider string) jwt.MapClaims {
+	cookie, err := c.Cookie(oidcCookieName)
+	if err != nil {
+		return nil
+	}
+	token, err := keyring.Parse(cookie.Value)
+	if err != nil || !token.Valid {
+		return nil
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	if claims["typ"] != oidcLoginType || claims["provider"] != provider {
+		return nil
+	}
+	return claims
+}
+
+func oidcProvidersHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, echo.Map{
+		"providers": service.OIDCProviders(),
+	})
+}
+
+// oidcLoginHandler sends the browser to the provider to log in
+func oidcLoginHandler(c echo.Context) error {
+	provider := c.Param("provider")
+	state, nonce, verifier := newRandomToken(), newRandomToken(), newRandomToken()
+
+	authURL, err := service.OIDCAuthURL(provider, state, nonce, verifier)
+	if err == ErrUnknownProvider {
+		return c.JSON(http.StatusNotFound, echo.Map{
+			"message": err.Error(),
+		})
+	}
+	if err != nil {
+		log.Println("OIDC provider", provider, "is unavailable", err)
+		return c.JSON(http.StatusBadGateway, echo.Map{
+			"message": "The login provider is unavailable",
+		})
+	}
+
+	login, err := keyring.Sign(jwt.MapClaims{
+		"typ":      oidcLoginType,
+		"provider": provider,
+		"state":    state,
+		"nonce":    nonce,
+		"verifier": verifier,
+		"exp":      time.Now().Add(oidcLoginTTL).Unix(),
+	})
+	if err == ErrCannotSign {
+		return c.JSON(http.StatusServiceUnavailable, echo.Map{
+			"message": err.Error(),
+		})
+	}
+	if err != nil {
+		return err
+	}
+	setOIDCCookie(c, login, int(oidcLoginTTL/time.Second))
+	return c.Redirect(http.StatusFound, authURL)
+}
+
+// oidcCallbackHandler is where the provider sends the browser back to. The
+// tokens go to FRONTEND_URL in the fragment when it is set, or are the response.
+func oidcCallbackHandler(c echo.Context) error {
+	provider := c.Param("provider")
+	login := oidcLoginFromCookie(c, provider)
+	setOIDCCookie(c, "", -1)
+
+	if refused := c.QueryParam("error"); refused != "" {
+		return c.JSON(http.StatusUnauthorized, echo.Map{
+			"message": "The login provider refused the login: " + refused,
+		})
+	}
+	code := c.QueryParam("code")
+	if login == nil || code == "" || login["state"] != c.QueryParam("state") {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"message": "The login expired or is invalid, try again",
+		})
+	}
+	verifier, _ := login["verifier"].(string)
+	nonce, _ := login["nonce"].(string)
+
+	// a logged in user is linking another identity
+	linkTo := userFromRequest(c)
+	if isGuest(linkTo) {
+		linkTo = ""
+	}
+
+	u, err := service.LoginWithOIDC(provider, code, verifier, nonce, linkTo)
+	switch err {
+	case nil:
+	case ErrUnknownProvider:
+		return c.JSON(http.StatusNotFound, echo.Map{
+			"message": err.Error(),
+		})
+	case ErrInvalidIDToken, ErrOIDCExchange:
+		return c.JSON(http.StatusUnauthorized, echo.Map{
+			"message": err.Error(),
+		})
+	case ErrIdentityLinked:
+		return c.JSON(http.StatusConflict, echo.Map{
+			"message": err.Error(),
+		})
+	default:
+		return err
+	}
+
+	upgradeGuest(c, u.UserID)
+	refreshToken, sessionID, err := service.CreateSession(u.UserID)
+	if err != nil {
+		return err
+	}
+	frontend := os.Getenv("FRONTEND_URL")
+	if frontend == "" {
+		return issueTokens(c, u.UserID, sessionID, refreshToken)
+	}
+
+	t, expires, err := signAccessToken(u.UserID, sessionID)
+	if err != nil {
+		return err
+	}
+	setAuthCookie(c, t, expires)
+	fragment := url.Values{
+		"token":         {t},
+		"refresh_token": {refreshToken},
+		"expires_at":    {strconv.FormatInt(expires.Unix(), 10)},
+	}
+	return c.Redirect(http.StatusFound, frontend+"#"+fragment.Encode())
+}
+
+func identitiesHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, echo.Map{
+		"identities": service.ListIdentities(getUserIDFromContext(c)),
+	})
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/himanshub16/upnext-backend/cluster"
+	"github.com/himanshub16/upnext-backend/oidcmock"
+)
+
+const oidcTestDB = "oidctest.db"
+
+// oidcTestServers runs the mock issuer and the API against it, with a
+// provider named mock
+func oidcTestServers(t *testing.T) *httptest.Server {
+	idp := httptest.NewUnstartedServer(nil)
+	issuer, err := oidcmock.New("http://"+idp.Listener.Addr().String(), "alice", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.Config.Handler = issuer.Handler()
+	idp.Start()
+	t.Cleanup(idp.Close)
+
+	api := httptest.NewUnstartedServer(nil)
+	providers, err := json.Marshal([]OIDCProviderConfig{{
+		Name:        "mock",
+		Issuer:      issuer.URL,
+		ClientID:    "upnext",
+		RedirectURL: "http://" + api.Listener.Addr().String() + "/api/oidc/mock/callback",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	providersFile := filepath.Join(t.TempDir(), "oidc.json")
+	if err = ioutil.WriteFile(providersFile, providers, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("OIDC_PROVIDERS_FILE", providersFile)
+	t.Cleanup(func() {
+		os.Unsetenv("OIDC_PROVIDERS_FILE")
+	})
+
+	s := testService(t, oidcTestDB)
+	api.Config.Handler = NewHTTPRouter(s, NewRadio(s, cluster.NewSharedMem()))
+	api.Start()
+	t.Cleanup(api.Close)
+	return api
+}
+
+// oidcLogin starts a login at the API and approves it at the issuer, and
+// returns the browser along with where the issuer sends it back to
+func oidcLogin(t *testing.T, api *httptest.Server) (*http.Client, *url.URL, *url.URL) {
+	jar, _ := cookiejar.New(nil)
+	browser := &http.Client{
+		Jar: jar,
+		// every hop is checked on its own
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	authorize := redirectOf(t, browser, api.URL+"/api/oidc/mock/login")
+	q := authorize.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" ||
+		q.Get("state") == "" || q.Get("nonce") == "" {
+		t.Fatal("login doesn't use PKCE:", authorize)
+	}
+	callback := redirectOf(t, browser, authorize.String())
+	if callback.Query().Get("code") == "" || callback.Query().Get("state") != q.Get("state") {
+		t.Fatal("issuer sent back", callback)
+	}
+	return browser, authorize, callback
+}
+
+func redirectOf(t *testing.T, browser *http.Client, to string) *url.URL {
+	res, err := browser.Get(to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusFound {
+		t.Fatal(to, "answered", res.Status)
+	}
+	where, err := res.Location()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return where
+}
+
+func getStatus(t *testing.T, browser *http.Client, to string) (int, []byte) {
+	res, err := browser.Get(to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	return res.StatusCode, body
+}
+
+func TestOIDCLogin(t *testing.T) {
+	api := oidcTestServers(t)
+
+	browser, _, callback := oidcLogin(t, api)
+	status, body := getStatus(t, browser, callback.String())
+	if status != http.StatusOK {
+		t.Fatal("callback answered", status, string(body))
+	}
+	tokens := struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}{}
+	if err := json.Unmarshal(body, &tokens); err != nil || tokens.Token == "" || tokens.RefreshToken == "" {
+		t.Fatal("callback issued no tokens", string(body))
+	}
+
+	// the session works, and belongs to the identity at the issuer
+	req, _ := http.NewRequest(http.MethodGet, api.URL+"/api/identities", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.Token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	identities := struct {
+		Identities []Identity `json:"identities"`
+	}{}
+	if err = json.NewDecoder(res.Body).Decode(&identities); err != nil {
+		t.Fatal(err)
+	}
+	if len(identities.Identities) != 1 || identities.Identities[0].Provider != "mock" ||
+		identities.Identities[0].Subject != "alice" || identities.Identities[0].Email != "alice@example.com" {
+		t.Fatal("unexpected identities", identities.Identities)
+	}
+
+	// a login finishes once
+	if status, _ = getStatus(t, browser, callback.String()); status == http.StatusOK {
+		t.Fatal("the callback could be replayed")
+	}
+}
+
+func TestOIDCLoginBadState(t *testing.T) {
+	api := oidcTestServers(t)
+
+	browser, _, callback := oidcLogin(t, api)
+	q := callback.Query()
+	q.Set("state", "forged")
+	callback.RawQuery = q.Encode()
+	if status, body := getStatus(t, browser, callback.String()); status != http.StatusBadRequest {
+		t.Fatal("callback with a bad state answered", status, string(body))
+	}
+}
+
+func TestOIDCLoginBadVerifier(t *testing.T) {
+	api := oidcTestServers(t)
+
+	browser, authorize, callback := oidcLogin(t, api)
+	// the same login, but with a verifier which doesn't match the challenge
+	login, err := keyring.Sign(jwt.MapClaims{
+		"typ":      oidcLoginType,
+		"provider": "mock",
+		"state":    authorize.Query().Get("state"),
+		"nonce":    authorize.Query().Get("nonce"),
+		"verifier": "not-the-verifier",
+		"exp":      time.Now().Add(oidcLoginTTL).Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiURL, _ := url.Parse(api.URL + oidcCookiePath)
+	browser.Jar.SetCookies(apiURL, []*http.Cookie{{Name: oidcCookieName, Value: login, Path: oidcCookiePath}})
+
+	if status, body := getStatus(t, browser, callback.String()); status != http.StatusUnauthorized {
+		t.Fatal("callback with a bad verifier answered", status, string(body))
+	}
+}
@@ -0,0 +1,193 @@
+// Package oidcmock is a tiny OpenID Connect provider, to try the OIDC login
+// against locally and to test it.
+//
+// It logs everyone in without asking, as its Sub unless the login URL has
+// ?login_hint=someone, and checks the PKCE verifier like a real provider.
+// Keys are made up by New.
+package oidcmock
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const keyID = "mock"
+
+type authRequest struct {
+	clientID    string
+	redirectURI string
+	nonce       string
+	challenge   string
+	sub         string
+	expires     time.Time
+}
+
+// Issuer is the provider at URL, its users have email addresses at Domain
+type Issuer struct {
+	URL    string
+	Domain string
+	Sub    string
+
+	key   *rsa.PrivateKey
+	codes map[string]authRequest
+	mutex sync.Mutex
+}
+
+func New(issuerURL, sub, domain string) (*Issuer, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	return &Issuer{
+		URL:    issuerURL,
+		Domain: domain,
+		Sub:    sub,
+		key:    key,
+		codes:  make(map[string]authRequest),
+	}, nil
+}
+
+// Handler serves discovery, the keys, and the authorize and token endpoints
+func (m *Issuer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", m.discoveryHandler)
+	mux.HandleFunc("/jwks", m.jwksHandler)
+	mux.HandleFunc("/authorize", m.authorizeHandler)
+	mux.HandleFunc("/token", m.tokenHandler)
+	return mux
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (m *Issuer) discoveryHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                m.URL,
+		"authorization_endpoint":                m.URL + "/authorize",
+		"token_endpoint":                        m.URL + "/token",
+		"jwks_uri":                              m.URL + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (m *Issuer) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	pub := m.key.PublicKey
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": keyID,
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+// authorizeHandler approves every login straight away
+func (m *Issuer) authorizeHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || q.Get("redirect_uri") == "" || q.Get("response_type") != "code" ||
+		q.Get("client_id") == "" || q.Get("code_challenge") == "" || q.Get("code_challenge_method") != "S256" {
+		http.Error(w, "bad authorization request", http.StatusBadRequest)
+		return
+	}
+
+	req := authRequest{
+		clientID:    q.Get("client_id"),
+		redirectURI: q.Get("redirect_uri"),
+		nonce:       q.Get("nonce"),
+		challenge:   q.Get("code_challenge"),
+		sub:         m.Sub,
+		expires:     time.Now().Add(time.Minute),
+	}
+	if hint := q.Get("login_hint"); hint != "" {
+		req.sub = hint
+	}
+	code := randomString()
+	m.mutex.Lock()
+	m.codes[code] = req
+	m.mutex.Unlock()
+
+	back := redirect.Query()
+	back.Set("code", code)
+	back.Set("state", q.Get("state"))
+	redirect.RawQuery = back.Encode()
+	log.Println("logged in", req.sub, "for", req.clientID)
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (m *Issuer) tokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.ParseForm() != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+	code := r.PostForm.Get("code")
+	m.mutex.Lock()
+	req, ok := m.codes[code]
+	// codes are good for one exchange
+	delete(m.codes, code)
+	m.mutex.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || time.Now().After(req.expires) ||
+		req.clientID != r.PostForm.Get("client_id") ||
+		req.redirectURI != r.PostForm.Get("redirect_uri") ||
+		req.challenge != base64.RawURLEncoding.EncodeToString(sum[:]) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":            m.URL,
+		"aud":            req.clientID,
+		"sub":            req.sub,
+		"nonce":          req.nonce,
+		"email":          req.sub + "@" + m.Domain,
+		"email_verified": true,
+		"given_name":     req.sub,
+		"family_name":    "Mock",
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+	})
+	token.Header["kid"] = keyID
+	idToken, err := token.SignedString(m.key)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
@@ -0,0 +1,119 @@
+package main
+
+// this file keeps openapi.json honest
+//
+// the document is maintained by hand and served at /api/openapi.json.
+// openAPIDrift compares its paths with the routes the router really has,
+// the server logs the difference at startup, and `go test` and
+// `upnextctl openapi-check` fail on it, so CI catches a route added without
+// documenting it.
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+const openAPIFile = "openapi.json"
+
+var openAPIMethods = []string{
+	http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete,
+}
+
+type openAPIDoc struct {
+	Paths map[string]map[string]json.RawMessage `json:"paths"`
+}
+
+// openAPIPath turns /api/link/:id into /api/link/{id}
+func openAPIPath(path string) string {
+	parts := strings.Split(path, "/")
+	for i, part := range parts {
+		if strings.HasPrefix(part, ":") {
+			parts[i] = "{" + part[1:] + "}"
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// routeKeys lists the routes of a router as "METHOD /path"
+func routeKeys(e *echo.Echo) map[string]bool {
+	keys := make(map[string]bool)
+	for _, r := range e.Routes() {
+		// Group.Use registers catch-all routes of its own
+		if strings.Contains(r.Name, "(*Group).Use") {
+			continue
+		}
+		keys[r.Method+" "+openAPIPath(r.Path)] = true
+	}
+	return keys
+}
+
+// specKeys lists the operations of an OpenAPI document as "METHOD /path"
+func specKeys(spec []byte) (map[string]bool, error) {
+	var doc openAPIDoc
+	if err := json.Unmarshal(spec, &doc); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]bool)
+	for path, ops := range doc.Paths {
+		for _, method := range openAPIMethods {
+			if _, ok := ops[strings.ToLower(method)]; ok {
+				keys[method+" "+path] = true
+			}
+		}
+	}
+	return keys, nil
+}
+
+// openAPIDrift returns the routes missing from the spec, and the operations
+// of the spec the router doesn't have
+func openAPIDrift(e *echo.Echo, spec []byte) (undocumented, unrouted []string, err error) {
+	documented, err := specKeys(spec)
+	if err != nil {
+		return nil, nil, err
+	}
+	routed := routeKeys(e)
+
+	undocumented = make([]string, 0)
+	for key := range routed {
+		if !documented[key] {
+			undocumented = append(undocumented, key)
+		}
+	}
+	unrouted = make([]string, 0)
+	for key := range documented {
+		if !routed[key] {
+			unrouted = append(unrouted, key)
+		}
+	}
+	sort.Strings(undocumented)
+	sort.Strings(unrouted)
+	return undocumented, unrouted, nil
+}
+
+// checkOpenAPI reports the drift between a router and a spec file,
+// and tells whether there was none
+func checkOpenAPI(e *echo.Echo, specFile string) bool {
+	spec, err := ioutil.ReadFile(specFile)
+	if err != nil {
+		log.Println("failed to read the OpenAPI document", err)
+		return false
+	}
+	undocumented, unrouted, err := openAPIDrift(e, spec)
+	if err != nil {
+		log.Println("failed to parse the OpenAPI document", err)
+		return false
+	}
+	for _, key := range undocumented {
+		log.Printf("route %s is missing from %s", key, specFile)
+	}
+	for _, key := range unrouted {
+		log.Printf("%s documents %s, which isn't routed", specFile, key)
+	}
+	return len(undocumented) == 0 && len(unrouted) == 0
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+// TestOpenAPIMatchesRoutes fails when a route is added, moved or removed
+// without updating openapi.json
+func TestOpenAPIMatchesRoutes(t *testing.T) {
+	spec, err := ioutil.ReadFile(openAPIFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	undocumented, unrouted, err := openAPIDrift(NewHTTPRouter(nil, nil), spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range undocumented {
+		t.Errorf("route %s is missing from %s", key, openAPIFile)
+	}
+	for _, key := range unrouted {
+		t.Errorf("%s documents %s, which isn't routed", openAPIFile, key)
+	}
+	if len(undocumented) > 0 || len(unrouted) > 0 {
+		t.Fatal(openAPIFile, "is out of date")
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+// this file routes read-only postgres queries to read replicas
+//
+// replicas are health checked in the background and picked round-robin.
+// If none is healthy, or a query on one fails, the primary answers instead.
+// A user who just wrote something reads from the primary for a while,
+// so they always see their own votes and submissions. Replicas further
+// behind than that are left out until they catch up.
+//
+// Who wrote recently is only known to the node they wrote through, so the
+// load balancer has to keep sending a user to the same node (ip_hash in
+// nginx-load-balancer.conf).
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	replicaHealthCheckEvery = time.Second * 5
+	replicaPingTimeout      = time.Second * 2
+	// how long a user keeps reading from the primary after a write,
+	// and so how far behind a replica may be
+	readYourWritesWindow = time.Second * 10
+)
+
+// replicaLagQuery is how many seconds of writes a replica has yet to apply,
+// 0 when it applied everything it received
+const replicaLagQuery = `SELECT CASE
+	WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+	ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)
+END`
+
+type pgReplica struct {
+	url     string
+	db      *sqlx.DB
+	healthy int32
+}
+
+func (rep *pgReplica) isHealthy() bool {
+	return atomic.LoadInt32(&rep.healthy) == 1
+}
+
+func (rep *pgReplica) setHealthy(healthy bool, err error) {
+	var v int32
+	if healthy {
+		v = 1
+	}
+	if atomic.SwapInt32(&rep.healthy, v) != v {
+		log.Println("replica", rep.url, "healthy:", healthy, "err:", err)
+	}
+}
+
+type pgReplicaPool struct {
+	replicas []*pgReplica
+	next     uint32
+
+	// user_id -> time of their last write
+	recentWriters      map[string]time.Time
+	recentWritersMutex *sync.Mutex
+
+	interrupt chan interface{}
+}
+
+func newPgReplicaPool(urls []string) *pgReplicaPool {
+	pool := &pgReplicaPool{
+		replicas:           make([]*pgReplica, 0),
+		recentWriters:      make(map[string]time.Time),
+		recentWritersMutex: &sync.Mutex{},
+		interrupt:          make(chan interface{}, 1),
+	}
+
+	for _, u := range urls {
+		db, err := sqlx.Open("postgres", u)
+		if err != nil {
+			log.Println("ignoring replica", u, "err:", err)
+			continue
+		}
+		pool.replicas = append(pool.replicas, &pgReplica{url: u, db: db})
+	}
+
+	if len(pool.replicas) > 0 {
+		pool.checkHealth()
+		go pool.healthChecker()
+	}
+	return pool
+}
+
+func (pool *pgReplicaPool) healthChecker() {
+	ticker := time.NewTicker(replicaHealthCheckEvery)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			pool.checkHealth()
+			pool.forgetOldWriters()
+		case <-pool.interrupt:
+			return
+		}
+	}
+}
+
+func (pool *pgReplicaPool) checkHealth() {
+	for _, rep := range pool.replicas {
+		done := make(chan error, 1)
+		go func(rep *pgReplica) {
+			var lag float64
+			err := rep.db.QueryRow(replicaLagQuery).Scan(&lag)
+			if err == nil && time.Duration(lag*float64(time.Second)) > readYourWritesWindow {
+				err = fmt.Errorf("%.0fs behind the primary", lag)
+			}
+			done <- err
+		}(rep)
+
+		select {
+		case err := <-done:
+			rep.setHealthy(err == nil, err)
+		case <-time.After(replicaPingTimeout):
+			rep.setHealthy(false, nil)
+		}
+	}
+}
+
+func (pool *pgReplicaPool) forgetOldWriters() {
+	pool.recentWritersMutex.Lock()
+	defer pool.recentWritersMutex.Unlock()
+
+	for userID, at := range pool.recentWriters {
+		if time.Since(at) > readYourWritesWindow {
+			delete(pool.recentWriters, userID)
+		}
+	}
+}
+
+// wrote remembers that a user changed something on the primary
+func (pool *pgReplicaPool) wrote(userID string) {
+	if len(pool.replicas) == 0 || userID == "" {
+		return
+	}
+	pool.recentWritersMutex.Lock()
+	pool.recentWriters[userID] = time.Now()
+	pool.recentWritersMutex.Unlock()
+}
+
+// pick returns a healthy replica to read from on behalf of a user,
+// or nil when the read has to go to the primary
+func (pool *pgReplicaPool) pick(userID string) *pgReplica {
+	if len(pool.replicas) == 0 {
+		return nil
+	}
+
+	if userID != "" {
+		pool.recentWritersMutex.Lock()
+		at, ok := pool.recentWriters[userID]
+		pool.recentWritersMutex.Unlock()
+		if ok && time.Since(at) < readYourWritesWindow {
+			return nil
+		}
+	}
+
+	n := uint32(len(pool.replicas))
+	start := atomic.AddUint32(&pool.next, 1)
+	for i := uint32(0); i < n; i++ {
+		rep := pool.replicas[(start+i)%n]
+		if rep.isHealthy() {
+			return rep
+		}
+	}
+	return nil
+}
+
+func (pool *pgReplicaPool) close() {
+	if len(pool.replicas) > 0 {
+		// every repository interface closes the same pool
+		select {
+		case pool.interrupt <- true:
+		default:
+		}
+	}
+	for _, rep := range pool.replicas {
+		rep.db.Close()
+	}
+}
+
+// readQuery runs a read-only query on a replica, falling back to the primary
+func (r *PostgresRepository) readQuery(userID, query string, args ...interface{}) (*sql.Rows, error) {
+	if rep := r.replicas.pick(userID); rep != nil {
+		rows, err := rep.db.Query(query, args...)
+		if err == nil {
+			return rows, nil
+		}
+		rep.setHealthy(false, err)
+	}
+	return r.db.Query(query, args...)
+}
+
+// readQueryRow is readQuery for queries returning at most one row
+func (r *PostgresRepository) readQueryRow(userID, query string, args ...interface{}) *sql.Row {
+	if rep := r.replicas.pick(userID); rep != nil {
+		row := rep.db.QueryRow(query, args...)
+		err := row.Err()
+		if err == nil {
+			return row
+		}
+		rep.setHealthy(false, err)
+	}
+	return r.db.QueryRow(query, args...)
+}
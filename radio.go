@@ -44,7 +44,24 @@ type Radio struct {
 	queueHooks           map[uuid.UUID](chan interface{})
 	queueHooksMutex      *sync.Mutex
 
+	// the link leading the queue, to tell webhooks when another one does
+	queueTopID int64
+
+	// guards the mode, queue, nowPlaying and player time, which the engine
+	// changes while handlers read them, see state; and running and stopped
+	stateMutex *sync.RWMutex
+
 	interrupt chan interface{}
+	// closed once the engine running last has stopped
+	stopped chan struct{}
+}
+
+// radioState is a copy of what the radio is doing, safe to use anywhere
+type radioState struct {
+	radioType  RadioType
+	nowPlaying *Link
+	queue      []Link
+	playerTime uint64
 }
 
 func IsValidHookType(htype HookType) bool {
@@ -87,15 +104,27 @@ func NewRadio(__service Service, shm *cluster.SharedMem) *Radio {
 		playerTimeHooksMutex: &sync.Mutex{},
 		queueHooks:           make(map[uuid.UUID](chan interface{})),
 		queueHooksMutex:      &sync.Mutex{},
+		stateMutex:           &sync.RWMutex{},
 
 		interrupt: make(chan interface{}, 1),
 	}
 }
 
 func (r *Radio) MasterEngine() {
+	r.stateMutex.Lock()
 	r.nowPlaying = nil
 	r.playerCurTimeSec = 0
 	r.playerStartTimeSec = 0
+	// a node which was a peer knows the queue already, and the top hasn't changed
+	r.queueTopID = 0
+	if len(r.queue) > 0 {
+		r.queueTopID = r.queue[0].LinkID
+	}
+	r.stateMutex.Unlock()
+	// the previous leader may have gone away in the middle of a song
+	if n := _service.RecoverPlayingLinks(); n > 0 {
+		fmt.Println("finished", n, "links left playing")
+	}
 
 	ticker := time.NewTicker(time.Second * r.tickResSec)
 	defer ticker.Stop()
@@ -103,6 +132,7 @@ func (r *Radio) MasterEngine() {
 	for {
 		select {
 		case <-r.interrupt:
+			r.closeHooks()
 			return
 		case t := <-ticker.C:
 			r.singleIteration(t)
@@ -117,13 +147,15 @@ func (r *Radio) PeerEngine() {
 		select {
 		case t := <-ticker.C:
 			if t.After(r.shm.LastUpdatedAt) {
+				r.stateMutex.Lock()
 				r.updateStateFromShm()
+				s := r.stateLocked()
+				r.stateMutex.Unlock()
 				// fmt.Println("shm updated", r.nowPlaying, r.queue, r.playerCurTimeSec)
-				r.broadcastUpdate(nowPlayingHook, r.nowPlaying)
-				r.broadcastUpdate(queueHook, r.queue)
-				r.broadcastUpdate(playerTimeHook, r.playerCurTimeSec)
+				r.broadcastState(s)
 			}
 		case <-r.interrupt:
+			r.closeHooks()
 			return
 			// case v := <-r.shm.PeerChan:
 			// 	fmt.Println("radio got update to", v.Ts)
@@ -161,7 +193,55 @@ func (r *Radio) updateStateFromShm() {
 	}
 }
 
+// state returns a copy of what the radio is doing, the engine keeps changing its own
+func (r *Radio) state() radioState {
+	r.stateMutex.RLock()
+	defer r.stateMutex.RUnlock()
+	return r.stateLocked()
+}
+
+func (r *Radio) stateLocked() radioState {
+	s := radioState{
+		radioType:  r.radioType,
+		queue:      append([]Link{}, r.queue...),
+		playerTime: r.playerCurTimeSec,
+	}
+	if r.nowPlaying != nil {
+		nowPlaying := *r.nowPlaying
+		s.nowPlaying = &nowPlaying
+	}
+	return s
+}
+
+// broadcastState hands a copy of the state to the hooks, outside of the lock
+// as listeners may ask for the state themselves
+func (r *Radio) broadcastState(s radioState) {
+	r.broadcastUpdate(nowPlayingHook, s.nowPlaying)
+	r.broadcastUpdate(queueHook, s.queue)
+	r.broadcastUpdate(playerTimeHook, s.playerTime)
+}
+
 func (r *Radio) singleIteration(t time.Time) {
+	r.stateMutex.Lock()
+	r.advance(t)
+	s := r.stateLocked()
+	r.stateMutex.Unlock()
+	r.broadcastState(s)
+}
+
+// advance moves the radio on to t, with the state locked
+func (r *Radio) advance(t time.Time) {
+	// a moderator may have removed the song playing
+	if r.nowPlaying != nil {
+		if current, err := _service.GetLinkByID(r.nowPlaying.LinkID); err == nil && current.State != linkPlaying {
+			fmt.Println("link", r.nowPlaying.LinkID, "is", current.State, "and no longer playing")
+			r.stopNowPlaying()
+		}
+	}
+	if r.nowPlaying != nil && _service.ShouldSkip(r.nowPlaying.LinkID) {
+		fmt.Println("listeners skipped", r.nowPlaying.LinkID)
+		r.finishNowPlaying(skippedByListeners)
+	}
 
 	if len(r.queue) == 0 ||
 		t.After(r.nextQueueRefreshAt) {
@@ -171,17 +251,29 @@ func (r *Radio) singleIteration(t time.Time) {
 		}
 	} else if r.nowPlaying == nil ||
 		r.playerCurTimeSec > uint64(r.nowPlaying.Duration) {
-		// first set the current song as expired
-		r.nowPlaying = &r.queue[0]
-		r.playerStartTimeSec = uint64(t.Unix())
+		r.finishNowPlaying("")
+		next := r.queue[0]
 		r.queue = r.queue[1:len(r.queue)]
 
-		r.nowPlaying.IsExpired = true
-		_service.UpdateLink(*r.nowPlaying)
+		// a moderator may have removed the link since the queue was refreshed
+		if current, err := _service.GetLinkByID(next.LinkID); err != nil || current.State != linkQueued {
+			fmt.Println("skipping link", next.LinkID, "as it is no longer queued")
+		} else if next.Duration <= 0 {
+			next.Transition(linkUnavailable, "video has no playable duration")
+			_service.UpdateLink(next)
+		} else {
+			// first set the current song as playing
+			r.nowPlaying = &next
+			r.playerStartTimeSec = uint64(t.Unix())
 
-		// r.broadcastUpdate(nowPlayingHook, *r.nowPlaying)
-		r.shm.WriteVar(string(nowPlayingHook), *r.nowPlaying, true)
-		fmt.Println("now playing changed to", r.nowPlaying.LinkID)
+			r.nowPlaying.Transition(linkPlaying, "")
+			r.nowPlaying.PlayedAt = t.Unix()
+			_service.UpdateLink(*r.nowPlaying)
+
+			// r.broadcastUpdate(nowPlayingHook, *r.nowPlaying)
+			r.shm.WriteVar(string(nowPlayingHook), *r.nowPlaying, true)
+			fmt.Println("now playing changed to", r.nowPlaying.LinkID)
+		}
 
 		// r.curState.NowPlaying = *r.nowPlaying
 		// r.curState.PlayerCurTimeSec = r.playerCurTimeSec
@@ -191,6 +283,7 @@ func (r *Radio) singleIteration(t time.Time) {
 	}
 
 	r.ReorderQueue()
+	r.checkQueueTop()
 	// r.broadcastUpdate(queueHook, r.queue)
 	r.shm.WriteVar(string(queueHook), r.queue, true)
 
@@ -201,36 +294,59 @@ func (r *Radio) singleIteration(t time.Time) {
 		fmt.Println(t.Unix(), r.nowPlaying.LinkID, r.playerCurTimeSec)
 
 		if r.playerCurTimeSec > uint64(r.nowPlaying.Duration) {
-			r.nowPlaying = nil
+			r.finishNowPlaying("")
 		}
 	} else {
 		r.playerCurTimeSec = 1 << 30
 		// r.broadcastUpdate(playerTimeHook, r.playerCurTimeSec)
 		r.shm.WriteVar(string(playerTimeHook), r.playerCurTimeSec, true)
 	}
+}
+
+// finishNowPlaying marks the current song as played and clears it
+func (r *Radio) finishNowPlaying(reason string) {
+	if r.nowPlaying == nil {
+		return
+	}
+	if _, err := _service.FinishPlaying(r.nowPlaying.LinkID, reason); err != nil {
+		fmt.Println("failed to finish link", r.nowPlaying.LinkID, err)
+	}
+	r.stopNowPlaying()
+}
 
-	r.broadcastUpdate(nowPlayingHook, r.nowPlaying)
-	r.broadcastUpdate(queueHook, r.queue)
-	r.broadcastUpdate(playerTimeHook, r.playerCurTimeSec)
+// stopNowPlaying clears the current song, here and on the peers
+func (r *Radio) stopNowPlaying() {
+	_service.ClearSkipVotes(r.nowPlaying.LinkID)
+	r.nowPlaying = nil
+	r.shm.WriteVar(string(nowPlayingHook), nil, true)
 }
 
 func (r *Radio) Start() {
-	if r.radioType == masterRadio {
+	radioType := r.state().radioType
+	if radioType == masterRadio {
 		// start an asynchronous radio which manages player state with time
 		r.MasterEngine()
-	} else if r.radioType == peerRadio {
+	} else if radioType == peerRadio {
 		// just subscribe to whatever channel is available
 		r.PeerEngine()
 	}
 }
 
+// SwitchMode stops the engine running, if any, and starts the one for newMode
 func (r *Radio) SwitchMode(newMode RadioType) {
-	if r.running {
-		r.Shutdown()
-	}
+	r.Shutdown()
+
+	stopped := make(chan struct{})
+	r.stateMutex.Lock()
 	r.radioType = newMode
-	go r.Start()
 	r.running = true
+	r.stopped = stopped
+	r.stateMutex.Unlock()
+
+	go func() {
+		defer close(stopped)
+		r.Start()
+	}()
 }
 
 func (r *Radio) refreshQueue() int {
@@ -239,16 +355,37 @@ func (r *Radio) refreshQueue() int {
 	return len(r.queue)
 }
 
+// checkQueueTop tells the service when another link leads the queue
+func (r *Radio) checkQueueTop() {
+	if len(r.queue) == 0 {
+		r.queueTopID = 0
+		return
+	}
+	if top := r.queue[0]; top.LinkID != r.queueTopID {
+		r.queueTopID = top.LinkID
+		_service.QueueTopChanged(top)
+	}
+}
+
 func (r *Radio) ReorderQueue() {
-	// update total votes for all links in queue
+	// update total votes for all links in queue, and the song playing
 
 	linkIDs := make([]int64, len(r.queue))
 	for i, l := range r.queue {
 		linkIDs[i] = l.LinkID
 	}
+	if r.nowPlaying != nil {
+		linkIDs = append(linkIDs, r.nowPlaying.LinkID)
+	}
 
 	totalVotes := service.GetTotalVoteForLinks(linkIDs)
 
+	// listeners keep voting on the song playing, they see its total change
+	if r.nowPlaying != nil && r.nowPlaying.TotalVotes != totalVotes[r.nowPlaying.LinkID] {
+		r.nowPlaying.TotalVotes = totalVotes[r.nowPlaying.LinkID]
+		r.shm.WriteVar(string(nowPlayingHook), *r.nowPlaying, true)
+	}
+
 	for i, l := range r.queue {
 		if score, ok := totalVotes[l.LinkID]; ok {
 			r.queue[i].TotalVotes = score
@@ -263,40 +400,60 @@ func (r *Radio) ReorderQueue() {
 	})
 }
 
+// Shutdown stops the engine and waits for it. The engine closes the hooks
+// as it stops, since it may be broadcasting to them until then.
 func (r *Radio) Shutdown() {
-	// close engine
-	r.interrupt <- true
-
-	// clean and close all channels
-	for id := range r.nowPlayingHooks {
-		close(r.nowPlayingHooks[id])
-	}
-	for id := range r.queueHooks {
-		close(r.queueHooks[id])
-	}
-	for id := range r.playerTimeHooks {
-		close(r.playerTimeHooks[id])
+	r.stateMutex.Lock()
+	running, stopped := r.running, r.stopped
+	r.running = false
+	r.stateMutex.Unlock()
+
+	if running {
+		r.interrupt <- true
+		<-stopped
 	}
 }
 
-func (r *Radio) broadcastUpdate(htype HookType, msg interface{}) {
-	fmt.Println("update to broadcast ", htype)
+// hooks returns the hooks of a type and the mutex guarding them
+func (r *Radio) hooks(htype HookType) (map[uuid.UUID](chan interface{}), *sync.Mutex) {
 	switch htype {
 	case nowPlayingHook:
-		for id := range r.nowPlayingHooks {
-			// already a struct / can be marshalled to json
-			r.nowPlayingHooks[id] <- msg
-		}
+		return r.nowPlayingHooks, r.nowPlayingHooksMutex
 	case queueHook:
-		for id := range r.queueHooks {
-			// already a struct / can be marshalled to json
-			r.queueHooks[id] <- msg
-		}
-	case playerTimeHook:
-		for id := range r.playerTimeHooks {
-			// already a struct / can be marshalled to json
-			r.playerTimeHooks[id] <- msg
+		return r.queueHooks, r.queueHooksMutex
+	}
+	return r.playerTimeHooks, r.playerTimeHooksMutex
+}
+
+// closeHooks tells every listener the engine stopped
+func (r *Radio) closeHooks() {
+	for _, htype := range []HookType{nowPlayingHook, queueHook, playerTimeHook} {
+		hooks, mutex := r.hooks(htype)
+		mutex.Lock()
+		for id, c := range hooks {
+			close(c)
+			delete(hooks, id)
 		}
+		mutex.Unlock()
+	}
+}
+
+func (r *Radio) broadcastUpdate(htype HookType, msg interface{}) {
+	fmt.Println("update to broadcast ", htype)
+	defer broadcastDuration.Since(time.Now(), string(htype))
+
+	// listeners deregister while we send, so send to the ones there were
+	hooks, mutex := r.hooks(htype)
+	mutex.Lock()
+	listeners := make([]chan interface{}, 0, len(hooks))
+	for _, c := range hooks {
+		listeners = append(listeners, c)
+	}
+	mutex.Unlock()
+
+	for _, c := range listeners {
+		// already a struct / can be marshalled to json
+		c <- msg
 	}
 }
 
@@ -344,3 +501,22 @@ func (r *Radio) DeregisterHook(htype HookType, id uuid.UUID) {
 		defer r.playerTimeHooksMutex.Unlock()
 	}
 }
+
+// ReleaseHook deregisters a hook its listener stopped reading. The radio may be
+// in the middle of sending to it, so it is drained for a while.
+func (r *Radio) ReleaseHook(htype HookType, id uuid.UUID, c chan interface{}) {
+	r.DeregisterHook(htype, id)
+	go func() {
+		timeout := time.After(time.Second * 5)
+		for {
+			select {
+			case _, open := <-c:
+				if !open {
+					return
+				}
+			case <-timeout:
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/himanshub16/upnext-backend/cluster"
+)
+
+func TestRadioSwitchMode(t *testing.T) {
+	s := testService(t, "radiotest.db")
+	testLink(s, "aaaaaaaaaaa", linkQueued)
+	shm := cluster.NewSharedMem()
+	go func() {
+		// the cluster would send these to the peers
+		for range shm.MasterChan {
+		}
+	}()
+	r := NewRadio(s, shm)
+
+	for i := 0; i < 4; i++ {
+		mode := masterRadio
+		if i%2 == 1 {
+			mode = peerRadio
+		}
+		_, hook := r.RegisterHook(queueHook)
+		closed := make(chan struct{})
+		go func() {
+			// like a listener, which reads until the radio hangs up
+			for range hook {
+			}
+			close(closed)
+		}()
+		r.SwitchMode(mode)
+		time.Sleep(time.Millisecond * 1200)
+
+		// the engine broadcasts until it stops, and closes the hooks before Shutdown returns
+		r.Shutdown()
+		hooks, mutex := r.hooks(queueHook)
+		mutex.Lock()
+		left := len(hooks)
+		mutex.Unlock()
+		if left > 0 {
+			t.Fatal("hooks still open after the", mode, "engine stopped")
+		}
+		<-closed
+	}
+	if r.state().radioType != peerRadio {
+		t.Error("radio ended up as", r.state().radioType)
+	}
+}
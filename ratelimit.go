@@ -0,0 +1,336 @@
+package main
+
+// this file throttles the endpoints a script could hammer
+//
+// every limited endpoint has token buckets per user, per IP and one for
+// everybody (global). A request takes a token from each bucket that applies,
+// or when one of them is empty, none at all and is refused with 429 and
+// Retry-After. Someone over their own limit doesn't drain the others. The
+// buckets live in the database, so nodes sharing it share the limits, however
+// requests are spread across them.
+//
+// Requests are told apart by clientIP, which believes X-Real-IP and
+// X-Forwarded-For only from the proxies in -trustedproxies.
+//
+// Limits default to defaultRateRules. Admins can override them per endpoint
+// and scope, the overrides are stored in the database and picked up by every
+// node within rateRulesReloadEvery. A capacity of 0 turns a limit off.
+
+import (
+	"errors"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	rateEndpointSubmit = "link.new"
+	rateEndpointVote   = "link.vote"
+	rateEndpointGuest  = "guest.new"
+	rateEndpointChat   = "chat.new"
+
+	rateScopeUser   = "user"
+	rateScopeIP     = "ip"
+	rateScopeGlobal = "global"
+
+	rateRulesReloadEvery = time.Second * 30
+	// buckets idle this long are full, and can go
+	rateBucketIdleAfter = time.Hour * 24
+)
+
+var (
+	ErrInvalidRateRule = errors.New("invalid rate limit rule")
+
+	rateScopes = map[string]bool{
+		rateScopeUser:   true,
+		rateScopeIP:     true,
+		rateScopeGlobal: true,
+	}
+
+	// the proxies whose forwarded headers are believed, see clientIP
+	trustedProxies = make([]*net.IPNet, 0)
+
+	// submissions are the expensive ones, each costs YouTube quota
+	defaultRateRules = []RateRule{
+		{Endpoint: rateEndpointSubmit, Scope: rateScopeUser, Capacity: 5, Period: 60},
+		{Endpoint: rateEndpointSubmit, Scope: rateScopeIP, Capacity: 20, Period: 60},
+		{Endpoint: rateEndpointSubmit, Scope: rateScopeGlobal, Capacity: 100, Period: 60},
+		{Endpoint: rateEndpointVote, Scope: rateScopeUser, Capacity: 30, Period: 60},
+		{Endpoint: rateEndpointVote, Scope: rateScopeIP, Capacity: 120, Period: 60},
+		{Endpoint: rateEndpointGuest, Scope: rateScopeIP, Capacity: 10, Period: 3600},
+		{Endpoint: rateEndpointChat, Scope: rateScopeUser, Capacity: 5, Period: 10},
+		{Endpoint: rateEndpointChat, Scope: rateScopeIP, Capacity: 20, Period: 10},
+	}
+)
+
+func rateRuleKey(endpoint, scope string) string {
+	return endpoint + ":" + scope
+}
+
+// takeTokens refills the buckets for the time since they were last used, then
+// takes a token from each of them if none is empty. Along with the buckets it
+// returns 0, or when one was empty, how many milliseconds until none will be.
+func takeTokens(buckets []RateBucket, rules map[string]RateRule, now int64) ([]RateBucket, int64) {
+	var wait int64
+	for i, b := range buckets {
+		rule := rules[b.Key]
+		// tokens per millisecond
+		rate := float64(rule.Capacity) / float64(rule.Period*1000)
+		if elapsed := now - b.UpdatedAt; elapsed > 0 {
+			b.Tokens = math.Min(float64(rule.Capacity), b.Tokens+float64(elapsed)*rate)
+		}
+		b.UpdatedAt = now
+		buckets[i] = b
+
+		if b.Tokens < 1 {
+			if w := int64(math.Ceil((1 - b.Tokens) / rate)); w > wait {
+				wait = w
+			}
+		}
+	}
+	if wait > 0 {
+		return buckets, wait
+	}
+	for i := range buckets {
+		buckets[i].Tokens--
+	}
+	return buckets, 0
+}
+
+// rateBucketKeys returns the keys of the buckets in a stable order, the one
+// repositories lock them in
+func rateBucketKeys(rules map[string]RateRule) []string {
+	keys := make([]string, 0, len(rules))
+	for key := range rules {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// rateRuleCache holds the rules in effect, defaults merged with overrides
+type rateRuleCache struct {
+	rules    map[string]RateRule
+	loadedAt time.Time
+	mutex    *sync.Mutex
+}
+
+func newRateRuleCache() *rateRuleCache {
+	return &rateRuleCache{mutex: &sync.Mutex{}}
+}
+
+func (s *ServiceImpl) rateRules() map[string]RateRule {
+	cache := s.rateRuleCache
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if cache.rules == nil || time.Since(cache.loadedAt) > rateRulesReloadEvery {
+		rules := make(map[string]RateRule)
+		for _, rule := range defaultRateRules {
+			rules[rateRuleKey(rule.Endpoint, rule.Scope)] = rule
+		}
+		for _, rule := range s.rateLimitRepo.GetRateRules() {
+			rules[rateRuleKey(rule.Endpoint, rule.Scope)] = rule
+		}
+		cache.rules = rules
+		cache.loadedAt = time.Now()
+	}
+	return cache.rules
+}
+
+// RateLimit takes a token for a request to endpoint from every bucket that applies,
+// and returns how long to wait if any of them was empty, taking none then
+func (s *ServiceImpl) RateLimit(endpoint, userID, ip string) (time.Duration, error) {
+	rules := s.rateRules()
+	subjects := map[string]string{
+		rateScopeUser:   userID,
+		rateScopeIP:     ip,
+		rateScopeGlobal: "*",
+	}
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	buckets := make(map[string]RateRule)
+	for scope, subject := range subjects {
+		rule, ok := rules[rateRuleKey(endpoint, scope)]
+		if !ok || rule.Capacity == 0 || subject == "" {
+			continue
+		}
+		buckets[rateRuleKey(endpoint, scope)+":"+subject] = rule
+	}
+	if len(buckets) == 0 {
+		return 0, nil
+	}
+
+	wait, err := s.rateLimitRepo.TakeRateTokens(buckets, now)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(wait) * time.Millisecond, nil
+}
+
+// GetRateRules returns the rules in effect
+func (s *ServiceImpl) GetRateRules() []RateRule {
+	rules := make([]RateRule, 0)
+	for _, rule := range s.rateRules() {
+		rules = append(rules, rule)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		return rateRuleKey(rules[i].Endpoint, rules[i].Scope) < rateRuleKey(rules[j].Endpoint, rules[j].Scope)
+	})
+	return rules
+}
+
+func (s *ServiceImpl) SetRateRule(actor string, rule RateRule) error {
+	known := false
+	for _, d := range defaultRateRules {
+		known = known || d.Endpoint == rule.Endpoint
+	}
+	if !known || !rateScopes[rule.Scope] || rule.Capacity < 0 || (rule.Capacity > 0 && rule.Period <= 0) {
+		return ErrInvalidRateRule
+	}
+
+	before := s.rateRules()[rateRuleKey(rule.Endpoint, rule.Scope)]
+	if err := s.rateLimitRepo.SetRateRule(rule); err != nil {
+		return err
+	}
+	// reload on the next request here, other nodes catch up on their own
+	s.rateRuleCache.mutex.Lock()
+	s.rateRuleCache.rules = nil
+	s.rateRuleCache.mutex.Unlock()
+
+	s.audit(actor, auditRateLimitSet, "rate_limit:"+rateRuleKey(rule.Endpoint, rule.Scope), before, rule)
+	return nil
+}
+
+func (s *ServiceImpl) PruneRateBuckets(now time.Time) error {
+	return s.rateLimitRepo.DeleteIdleRateBuckets(now.Add(-rateBucketIdleAfter).UnixNano() / int64(time.Millisecond))
+}
+
+// retryAfter takes a token for a request, and returns how many seconds to wait
+// when there was none, or 0 to go ahead
+func retryAfter(endpoint, userID, ip string) int64 {
+	wait, err := service.RateLimit(endpoint, userID, ip)
+	if err != nil {
+		// better to let a few too many through than to fail every request
+		log.Println("rate limiting failed for", endpoint, err)
+		return 0
+	}
+	return int64(math.Ceil(wait.Seconds()))
+}
+
+// parseProxies parses a comma separated list of IPs and CIDRs
+func parseProxies(list string) ([]*net.IPNet, error) {
+	proxies := make([]*net.IPNet, 0)
+	for _, item := range splitList(list) {
+		if !strings.Contains(item, "/") {
+			if ip := net.ParseIP(item); ip != nil && ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP is the address a request comes from. Anybody can send forwarded
+// headers, so they are only believed from a trusted proxy: X-Real-IP as set
+// by nginx, or else the last address in X-Forwarded-For no trusted proxy added.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrustedProxy(host) {
+		return host
+	}
+	if ip := strings.TrimSpace(r.Header.Get(echo.HeaderXRealIP)); ip != "" {
+		return ip
+	}
+	forwarded := strings.Split(r.Header.Get(echo.HeaderXForwardedFor), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		if ip := strings.TrimSpace(forwarded[i]); ip != "" && !isTrustedProxy(ip) {
+			return ip
+		}
+	}
+	return host
+}
+
+// rateLimit throttles a route, it goes after requireJWT where there is one
+func rateLimit(endpoint string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			var userID string
+			if c.Get("user") != nil {
+				userID = getUserIDFromContext(c)
+			}
+
+			if seconds := retryAfter(endpoint, userID, clientIP(c.Request())); seconds > 0 {
+				c.Response().Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+				return echo.NewHTTPError(http.StatusTooManyRequests, echo.Map{
+					"message":     "Too many requests, try again later",
+					"retry_after": seconds,
+				})
+			}
+			return next(c)
+		}
+	}
+}
+
+func rateLimitsHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, echo.Map{
+		"rules": service.GetRateRules(),
+	})
+}
+
+func setRateLimitHandler(c echo.Context) error {
+	form := struct {
+		Endpoint string `form:"endpoint"`
+		Scope    string `form:"scope"`
+		Capacity int64  `form:"capacity"`
+		Period   int64  `form:"period"`
+	}{}
+	if err := c.Bind(&form); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"message": "Missing form data",
+		})
+	}
+
+	rule := RateRule{Endpoint: form.Endpoint, Scope: form.Scope, Capacity: form.Capacity, Period: form.Period}
+	err := service.SetRateRule(getUserIDFromContext(c), rule)
+	if err == ErrInvalidRateRule {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"message": err.Error(),
+		})
+	}
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, rule)
+}
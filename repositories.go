@@ -1,8 +1,15 @@
 package main
 
+import "net/url"
+
+// optionalBackends holds storage backends which are only compiled in
+// with a build tag, keyed by the scheme of DB_URL
+var optionalBackends = make(map[string]func(u *url.URL, s *ServiceImpl))
+
 type UserRepository interface {
 	CreateOrUpdateUser(user User) error
 	GetUserByID(userID string) *User
+	AllUsers() []User
 	close()
 }
 
@@ -10,15 +17,32 @@ type LinkRepository interface {
 	InsertLink(link Link) int64
 	GetLinkByID(id int64) (*Link, error)
 	GetAllLinks(limit int64) []Link
+	ListLinks(filter LinkFilter) (*LinkPage, error)
 	GetLinksByUser(userID string) []Link
+	// AllLinks returns every link, archived ones included
+	AllLinks() []Link
+	FindLink(videoID, submittedBy string, createdAt int64) *Link
+	// FindArchivedLink is FindLink for the links archive
+	FindArchivedLink(videoID, submittedBy string, createdAt int64) *Link
 	UpdateLink(link Link) error
+	// UpdateLinkIf updates the link only while its stored state is still state,
+	// and tells whether it did
+	UpdateLinkIf(link Link, state LinkState) (bool, error)
 	GetVotesForUser(linkIDs []int64, userID string) map[int64]int64
+	// StaleLinks returns pending and queued links created before createdBefore, oldest first
+	StaleLinks(createdBefore int64, limit int64) []Link
+	// ArchivePlayedLinks moves links played before playedBefore, and their votes,
+	// to the archive tables and returns how many of each were moved
+	ArchivePlayedLinks(playedBefore int64) (int64, int64, error)
 	close()
 }
 
 type VoteRepository interface {
 	MarkVote(linkID int64, userID string, score int64) error
 	TotalVoteForLinks(linkIDs []int64) map[int64]int64
+	// AllVotes returns every vote, archived ones included
+	AllVotes() []Vote
+	GetVote(linkID int64, userID string) *Vote
 	close()
 }
 
@@ -26,3 +50,130 @@ type TestRepository interface {
 	NewTest(message string) error
 	close()
 }
+
+// AuditRepository is append-only, there is no way to change past entries
+type AuditRepository interface {
+	AppendAudit(entry AuditEntry) error
+	ListAudit(filter AuditFilter) ([]AuditEntry, error)
+	close()
+}
+
+type NotificationRepository interface {
+	AddNotification(n Notification) error
+	GetNotifications(userID string, limit int64) []Notification
+	// MarkNotificationsRead marks notifications up to and including upTo as read
+	MarkNotificationsRead(userID string, upTo int64) error
+	close()
+}
+
+type RoleRepository interface {
+	GetRoles(userID string) []RoleGrant
+	ListRoleHolders(role string) []RoleGrant
+	GrantRole(grant RoleGrant) error
+	RevokeRole(userID, role string) error
+	close()
+}
+
+type TokenRepository interface {
+	InsertRefreshToken(t RefreshToken) error
+	GetRefreshToken(tokenHash string) *RefreshToken
+	// UseRefreshToken marks a token as used, and reports false if it already was
+	UseRefreshToken(tokenHash string) (bool, error)
+	// RevokeRefreshTokens revokes a session, or every session of the user if sessionID is empty
+	RevokeRefreshTokens(userID, sessionID string) error
+	AddRevocation(r Revocation) error
+	ActiveRevocations(now int64) []Revocation
+	DeleteExpiredTokens(now int64) error
+	close()
+}
+
+type GuestRepository interface {
+	SetGuestVote(v GuestVote) error
+	GetGuestVote(linkID int64, userID string) *GuestVote
+	GetGuestVotes(userID string) []GuestVote
+	// GuestVoteTotal sums the guest votes on a link
+	GuestVoteTotal(linkID int64) int64
+	// CountGuestVotesSince counts the votes a guest cast, or changed, since then
+	CountGuestVotesSince(userID string, since int64) int64
+	DeleteGuestVotes(userID string) error
+	close()
+}
+
+type RateLimitRepository interface {
+	// TakeRateTokens takes a token from each bucket, keyed by bucket key, and
+	// returns 0 or, when one is empty, how many milliseconds until none will
+	// be. Either every bucket gives a token or none does.
+	TakeRateTokens(buckets map[string]RateRule, now int64) (int64, error)
+	// DeleteIdleRateBuckets drops buckets unused since before, they are full anyway
+	DeleteIdleRateBuckets(before int64) error
+	GetRateRules() []RateRule
+	SetRateRule(rule RateRule) error
+	close()
+}
+
+type AccessTokenRepository interface {
+	CreateAccessToken(t AccessToken) (int64, error)
+	GetAccessTokenByHash(tokenHash string) *AccessToken
+	ListAccessTokens(userID string) []AccessToken
+	// RevokeAccessTokens revokes one of the user's tokens, or all of them if tokenID is 0,
+	// and returns how many were revoked
+	RevokeAccessTokens(userID string, tokenID int64) (int64, error)
+	TouchAccessToken(tokenID, usedAt int64) error
+	close()
+}
+
+// SkipVoteRepository holds votes to skip the song playing right now
+type SkipVoteRepository interface {
+	// AddSkipVote returns false when the user had voted to skip the link already
+	AddSkipVote(linkID int64, userID string, at int64) (bool, error)
+	CountSkipVotes(linkID int64) int64
+	DeleteSkipVotes(linkID int64) error
+	close()
+}
+
+type IdentityRepository interface {
+	GetIdentity(provider, subject string) *Identity
+	ListIdentities(userID string) []Identity
+	AddIdentity(identity Identity) error
+	close()
+}
+
+// WebhookRepository keeps the webhooks and the log of their deliveries
+type WebhookRepository interface {
+	CreateWebhook(w Webhook) (int64, error)
+	GetWebhook(webhookID int64) *Webhook
+	ListWebhooks() []Webhook
+	UpdateWebhook(w Webhook) error
+	// DeleteWebhook deletes the webhook along with its deliveries
+	DeleteWebhook(webhookID int64) error
+	AddWebhookDelivery(d WebhookDelivery) (int64, error)
+	GetWebhookDelivery(deliveryID int64) *WebhookDelivery
+	// ListWebhookDeliveries returns the newest deliveries first
+	ListWebhookDeliveries(filter WebhookDeliveryFilter) []WebhookDelivery
+	// DueWebhookDeliveries returns pending deliveries due by now, the oldest first
+	DueWebhookDeliveries(now, limit int64) []WebhookDelivery
+	UpdateWebhookDelivery(d WebhookDelivery) error
+	// DeleteWebhookDeliveries deletes finished deliveries created before then
+	DeleteWebhookDeliveries(createdBefore int64) error
+	close()
+}
+
+// ChatRepository keeps the station chat, and who is muted in it
+type ChatRepository interface {
+	AddChatMessage(m ChatMessage) (int64, error)
+	GetChatMessage(messageID int64) *ChatMessage
+	// ListChatMessages returns the newest messages first
+	ListChatMessages(filter ChatFilter) []ChatMessage
+	DeleteChatMessage(messageID int64) error
+	// DeleteChatMessages deletes messages created before then
+	DeleteChatMessages(createdBefore int64) error
+	// SetChatMute mutes a user, or changes how long they are muted for
+	SetChatMute(m ChatMute) error
+	GetChatMute(userID string) *ChatMute
+	// ListChatMutes returns the mutes in effect at now
+	ListChatMutes(now int64) []ChatMute
+	DeleteChatMute(userID string) error
+	// DeleteExpiredChatMutes deletes mutes which ran out before now
+	DeleteExpiredChatMutes(now int64) error
+	close()
+}
@@ -0,0 +1,1957 @@
+//go:build bolt
+// +build bolt
+
+package main
+
+// this file implements an embedded, pure-Go storage backend on top of bbolt
+// it is selected with DB_URL=bolt://path/to/station.db
+//
+// build with `go build -tags bolt`, bbolt is vendored with the other dependencies
+//
+// Everything is stored as JSON in buckets keyed by ID. Since there is no query
+// planner, the lookups the other backends get from indexes are kept in
+// secondary index buckets, updated in the same transaction as the data.
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltUsers  = []byte("users")
+	boltLinks  = []byte("links")
+	boltVotes  = []byte("votes")
+	boltAudit  = []byte("audit_log")
+	boltTest   = []byte("test")
+	boltTotals = []byte("vote_totals")
+
+	boltLinksArchive  = []byte("links_archive")
+	boltVotesArchive  = []byte("votes_archive")
+	boltNotifications = []byte("notifications")
+	// user_id \x00 role -> grant
+	boltUserRoles = []byte("user_roles")
+	// token_hash -> refresh token
+	boltRefreshTokens = []byte("refresh_tokens")
+	boltRevocations   = []byte("revocations")
+	// link_id \x00 user_id -> guest vote
+	boltGuestVotes = []byte("guest_votes")
+	// endpoint \x00 scope -> rule
+	boltRateRules   = []byte("rate_rules")
+	boltRateBuckets = []byte("rate_buckets")
+	// token_id -> access token, TokenHash included
+	boltAccessTokens = []byte("access_tokens")
+	// provider \x00 subject -> identity
+	boltIdentities = []byte("user_identities")
+	// link_id \x00 user_id -> created_at
+	boltSkipVotes = []byte("skip_votes")
+	// webhook_id -> webhook, Secret included
+	boltWebhooks          = []byte("webhooks")
+	boltWebhookDeliveries = []byte("webhook_deliveries")
+	// message_id -> chat message
+	boltChatMessages = []byte("chat_messages")
+	// user_id -> mute
+	boltChatMutes = []byte("chat_mutes")
+
+	// secondary indexes, values are empty unless noted
+	// user_id \x00 link_id -> score
+	boltVotesByUser = []byte("idx_votes_by_user")
+	// submitted_by \x00 link_id
+	boltLinksByUser = []byte("idx_links_by_user")
+	// state \x00 link_id
+	boltLinksByState = []byte("idx_links_by_state")
+	// video_id \x00 submitted_by \x00 created_at -> link_id
+	boltLinksByNaturalKey = []byte("idx_links_by_natural_key")
+	// user_id \x00 notification_id
+	boltNotificationsByUser = []byte("idx_notifications_by_user")
+	// user_id \x00 link_id
+	boltGuestVotesByUser = []byte("idx_guest_votes_by_user")
+	// token_hash -> token_id
+	boltAccessTokensByHash = []byte("idx_access_tokens_by_hash")
+	// next_attempt_at \x00 delivery_id, pending deliveries only
+	boltDueDeliveries = []byte("idx_webhook_deliveries_due")
+
+	boltBuckets = [][]byte{
+		boltUsers, boltLinks, boltVotes, boltAudit, boltTest, boltTotals,
+		boltLinksArchive, boltVotesArchive, boltNotifications, boltUserRoles,
+		boltRefreshTokens, boltRevocations, boltGuestVotes, boltRateRules, boltRateBuckets,
+		boltAccessTokens, boltIdentities, boltSkipVotes, boltWebhooks, boltWebhookDeliveries,
+		boltChatMessages, boltChatMutes,
+		boltVotesByUser, boltLinksByUser, boltLinksByState, boltLinksByNaturalKey,
+		boltNotificationsByUser, boltGuestVotesByUser, boltAccessTokensByHash, boltDueDeliveries,
+	}
+)
+
+func init() {
+	optionalBackends["bolt"] = func(u *url.URL, s *ServiceImpl) {
+		db := NewBoltRepository(u.Host + u.Path)
+		s.userRepo = db
+		s.linkRepo = db
+		s.voteRepo = db
+		s.testRepo = db
+		s.auditRepo = db
+		s.notificationRepo = db
+		s.roleRepo = db
+		s.tokenRepo = db
+		s.guestRepo = db
+		s.rateLimitRepo = db
+		s.accessTokenRepo = db
+		s.identityRepo = db
+		s.skipVoteRepo = db
+		s.webhookRepo = db
+		s.chatRepo = db
+	}
+}
+
+type BoltRepository struct {
+	db *bolt.DB
+}
+
+func itob(v int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(v))
+	return b
+}
+
+func btoi(b []byte) int64 {
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+// indexKey joins parts with \x00 so a prefix scan on the first parts works
+func indexKey(parts ...[]byte) []byte {
+	return bytes.Join(parts, []byte{0})
+}
+
+func voteKey(linkID int64, userID string) []byte {
+	return indexKey(itob(linkID), []byte(userID))
+}
+
+func naturalLinkKey(videoID, submittedBy string, createdAt int64) []byte {
+	return indexKey([]byte(videoID), []byte(submittedBy), itob(createdAt))
+}
+
+// scanPrefix calls fn for every key in b starting with prefix
+func scanPrefix(b *bolt.Bucket, prefix []byte, fn func(k, v []byte) error) error {
+	c := b.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *BoltRepository) CreateOrUpdateUser(user User) error {
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		b, err := json.Marshal(user)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltUsers).Put([]byte(user.UserID), b)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return err
+}
+
+func (r *BoltRepository) GetUserByID(userID string) *User {
+	var user *User
+	err := r.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltUsers).Get([]byte(userID))
+		if v == nil {
+			return nil
+		}
+		user = &User{}
+		return json.Unmarshal(v, user)
+	})
+	if err != nil {
+		log.Fatal("failed to find user", err)
+	}
+	return user
+}
+
+func (r *BoltRepository) AllUsers() []User {
+	users := make([]User, 0)
+	err := r.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltUsers).ForEach(func(_, v []byte) error {
+			u := User{}
+			if err := json.Unmarshal(v, &u); err != nil {
+				return err
+			}
+			users = append(users, u)
+			return nil
+		})
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return users
+}
+
+// putLink stores a link and keeps its index entries in sync with the old copy
+func putLink(tx *bolt.Tx, link Link, old *Link) error {
+	// these are computed, not stored
+	link.TotalVotes = 0
+	link.MyVote = 0
+
+	b, err := json.Marshal(link)
+	if err != nil {
+		return err
+	}
+	id := itob(link.LinkID)
+
+	byUser := tx.Bucket(boltLinksByUser)
+	byState := tx.Bucket(boltLinksByState)
+	byNaturalKey := tx.Bucket(boltLinksByNaturalKey)
+	if old != nil {
+		byUser.Delete(indexKey([]byte(old.SubmittedBy), id))
+		byState.Delete(indexKey([]byte(old.State), id))
+		byNaturalKey.Delete(naturalLinkKey(old.VideoID, old.SubmittedBy, old.CreatedAt))
+	}
+	if err = byUser.Put(indexKey([]byte(link.SubmittedBy), id), []byte{}); err != nil {
+		return err
+	}
+	if err = byState.Put(indexKey([]byte(link.State), id), []byte{}); err != nil {
+		return err
+	}
+	naturalKey := naturalLinkKey(link.VideoID, link.SubmittedBy, link.CreatedAt)
+	if byNaturalKey.Get(naturalKey) == nil {
+		if err = byNaturalKey.Put(naturalKey, id); err != nil {
+			return err
+		}
+	}
+
+	return tx.Bucket(boltLinks).Put(id, b)
+}
+
+// getLink loads a link along with its total votes
+func getLink(tx *bolt.Tx, linkID int64) (*Link, error) {
+	v := tx.Bucket(boltLinks).Get(itob(linkID))
+	if v == nil {
+		return nil, sql.ErrNoRows
+	}
+	l := &Link{}
+	if err := json.Unmarshal(v, l); err != nil {
+		return nil, err
+	}
+	l.TotalVotes = totalVotes(tx, linkID)
+	return l, nil
+}
+
+func totalVotes(tx *bolt.Tx, linkID int64) int64 {
+	if v := tx.Bucket(boltTotals).Get(itob(linkID)); v != nil {
+		return btoi(v)
+	}
+	return 0
+}
+
+// linksFromIndex loads every link referenced by index entries under prefix
+func linksFromIndex(tx *bolt.Tx, index, prefix []byte) ([]Link, error) {
+	links := make([]Link, 0)
+	err := scanPrefix(tx.Bucket(index), prefix, func(k, _ []byte) error {
+		l, err := getLink(tx, btoi(k[len(k)-8:]))
+		if err != nil {
+			return err
+		}
+		links = append(links, *l)
+		return nil
+	})
+	return links, err
+}
+
+func (r *BoltRepository) InsertLink(link Link) int64 {
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		seq, err := tx.Bucket(boltLinks).NextSequence()
+		if err != nil {
+			return err
+		}
+		link.LinkID = int64(seq)
+		return putLink(tx, link, nil)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return link.LinkID
+}
+
+func (r *BoltRepository) GetLinkByID(id int64) (*Link, error) {
+	var l *Link
+	err := r.db.View(func(tx *bolt.Tx) error {
+		var err error
+		l, err = getLink(tx, id)
+		return err
+	})
+	if err != nil {
+		return &Link{LinkID: id}, err
+	}
+	return l, nil
+}
+
+func (r *BoltRepository) AllLinks() []Link {
+	links := make([]Link, 0)
+	err := r.db.View(func(tx *bolt.Tx) error {
+		err := tx.Bucket(boltLinks).ForEach(func(_, v []byte) error {
+			l := Link{}
+			if err := json.Unmarshal(v, &l); err != nil {
+				return err
+			}
+			links = append(links, l)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltLinksArchive).ForEach(func(_, v []byte) error {
+			a := archivedLink{}
+			if err := json.Unmarshal(v, &a); err != nil {
+				return err
+			}
+			links = append(links, a.Link)
+			return nil
+		})
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].LinkID < links[j].LinkID
+	})
+	return links
+}
+
+func (r *BoltRepository) FindLink(videoID, submittedBy string, createdAt int64) *Link {
+	var l *Link
+	err := r.db.View(func(tx *bolt.Tx) error {
+		id := tx.Bucket(boltLinksByNaturalKey).Get(naturalLinkKey(videoID, submittedBy, createdAt))
+		if id == nil {
+			return nil
+		}
+		var err error
+		l, err = getLink(tx, btoi(id))
+		return err
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return l
+}
+
+// FindArchivedLink scans the archive, which has no natural key index
+func (r *BoltRepository) FindArchivedLink(videoID, submittedBy string, createdAt int64) *Link {
+	var l *Link
+	err := r.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltLinksArchive).ForEach(func(_, v []byte) error {
+			a := archivedLink{}
+			if err := json.Unmarshal(v, &a); err != nil {
+				return err
+			}
+			if l == nil && a.VideoID == videoID && a.SubmittedBy == submittedBy && a.CreatedAt == createdAt {
+				l = &a.Link
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return l
+}
+
+func (r *BoltRepository) GetLinksByUser(userID string) []Link {
+	links := make([]Link, 0)
+	err := r.db.View(func(tx *bolt.Tx) error {
+		all, err := linksFromIndex(tx, boltLinksByUser, indexKey([]byte(userID), nil))
+		if err != nil {
+			return err
+		}
+		for _, l := range all {
+			if l.IsExpired {
+				continue
+			}
+			if v := tx.Bucket(boltVotes).Get(voteKey(l.LinkID, l.SubmittedBy)); v != nil {
+				vote := Vote{}
+				json.Unmarshal(v, &vote)
+				l.MyVote = int64(vote.Score)
+			}
+			links = append(links, l)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return links
+}
+
+func (r *BoltRepository) UpdateLink(link Link) error {
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		old, err := getLink(tx, link.LinkID)
+		if err != nil {
+			return err
+		}
+		return putLink(tx, link, old)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return nil
+}
+
+func (r *BoltRepository) UpdateLinkIf(link Link, state LinkState) (bool, error) {
+	updated := false
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		old, err := getLink(tx, link.LinkID)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil || old.State != state {
+			return err
+		}
+		updated = true
+		return putLink(tx, link, old)
+	})
+	return updated, err
+}
+
+func (r *BoltRepository) GetAllLinks(limit int64) []Link {
+	links := make([]Link, 0)
+	err := r.db.View(func(tx *bolt.Tx) error {
+		queued, err := linksFromIndex(tx, boltLinksByState, indexKey([]byte(linkQueued), nil))
+		if int64(len(queued)) > limit {
+			queued = queued[:limit]
+		}
+		links = queued
+		return err
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return links
+}
+
+func matchesLinkFilter(f LinkFilter, l Link) bool {
+	switch {
+	case f.SubmittedBy != "" && l.SubmittedBy != f.SubmittedBy:
+	case f.ChannelName != "" && l.ChannelName != f.ChannelName:
+	case f.State != "" && string(l.State) != f.State:
+	case f.CreatedAfter > 0 && l.CreatedAt < f.CreatedAfter:
+	case f.CreatedBefore > 0 && l.CreatedAt >= f.CreatedBefore:
+	case f.MinVotes != 0 && l.TotalVotes < f.MinVotes:
+	default:
+		return true
+	}
+	return false
+}
+
+func (r *BoltRepository) ListLinks(filter LinkFilter) (*LinkPage, error) {
+	if err := filter.normalize(); err != nil {
+		return nil, err
+	}
+	var cursor *linkCursor
+	if filter.Cursor != "" {
+		var err error
+		if cursor, err = decodeLinkCursor(filter.Cursor); err != nil {
+			return nil, err
+		}
+	}
+
+	candidates := make([]Link, 0)
+	err := r.db.View(func(tx *bolt.Tx) error {
+		var err error
+		switch {
+		case filter.SubmittedBy != "":
+			candidates, err = linksFromIndex(tx, boltLinksByUser, indexKey([]byte(filter.SubmittedBy), nil))
+		case filter.State != "":
+			candidates, err = linksFromIndex(tx, boltLinksByState, indexKey([]byte(filter.State), nil))
+		default:
+			err = tx.Bucket(boltLinks).ForEach(func(k, _ []byte) error {
+				l, err := getLink(tx, btoi(k))
+				if err == nil {
+					candidates = append(candidates, *l)
+				}
+				return err
+			})
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ascending := filter.Sort == linkSortOldest
+	// before reports whether a sorts before b in the requested order
+	before := func(aKey, aID, bKey, bID int64) bool {
+		if aKey != bKey {
+			return (aKey < bKey) == ascending
+		}
+		return (aID < bID) == ascending
+	}
+
+	links := make([]Link, 0)
+	for _, l := range candidates {
+		if !matchesLinkFilter(filter, l) {
+			continue
+		}
+		if cursor != nil && !before(cursor.key, cursor.linkID, filter.sortKey(l), l.LinkID) {
+			continue
+		}
+		links = append(links, l)
+	}
+	sort.Slice(links, func(i, j int) bool {
+		return before(filter.sortKey(links[i]), links[i].LinkID, filter.sortKey(links[j]), links[j].LinkID)
+	})
+	if int64(len(links)) > filter.Limit+1 {
+		links = links[:filter.Limit+1]
+	}
+	return pageOfLinks(filter, links), nil
+}
+
+func (r *BoltRepository) GetVotesForUser(linkIds []int64, userID string) map[int64]int64 {
+	result := make(map[int64]int64)
+	err := r.db.View(func(tx *bolt.Tx) error {
+		byUser := tx.Bucket(boltVotesByUser)
+		for _, lid := range linkIds {
+			if v := byUser.Get(indexKey([]byte(userID), itob(lid))); v != nil {
+				result[lid] = btoi(v)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return result
+}
+
+func (r *BoltRepository) MarkVote(linkID int64, userID string, score int64) error {
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		votes := tx.Bucket(boltVotes)
+		key := voteKey(linkID, userID)
+
+		// keep the running total in step with the change in score
+		var previous int64
+		if v := votes.Get(key); v != nil {
+			old := Vote{}
+			if err := json.Unmarshal(v, &old); err != nil {
+				return err
+			}
+			previous = int64(old.Score)
+		}
+
+		b, err := json.Marshal(Vote{UserID: userID, LinkID: linkID, Score: int(score)})
+		if err != nil {
+			return err
+		}
+		if err = votes.Put(key, b); err != nil {
+			return err
+		}
+		if err = tx.Bucket(boltVotesByUser).Put(indexKey([]byte(userID), itob(linkID)), itob(score)); err != nil {
+			return err
+		}
+		return tx.Bucket(boltTotals).Put(itob(linkID), itob(totalVotes(tx, linkID)-previous+score))
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return nil
+}
+
+func (r *BoltRepository) TotalVoteForLinks(linkIDs []int64) map[int64]int64 {
+	result := make(map[int64]int64)
+	err := r.db.View(func(tx *bolt.Tx) error {
+		totals := tx.Bucket(boltTotals)
+		for _, lid := range linkIDs {
+			if v := totals.Get(itob(lid)); v != nil {
+				result[lid] = btoi(v)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return result
+}
+
+func (r *BoltRepository) AllVotes() []Vote {
+	votes := make([]Vote, 0)
+	err := r.db.View(func(tx *bolt.Tx) error {
+		err := tx.Bucket(boltVotes).ForEach(func(_, v []byte) error {
+			vote := Vote{}
+			if err := json.Unmarshal(v, &vote); err != nil {
+				return err
+			}
+			votes = append(votes, vote)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltVotesArchive).ForEach(func(_, v []byte) error {
+			a := archivedVote{}
+			if err := json.Unmarshal(v, &a); err != nil {
+				return err
+			}
+			votes = append(votes, a.Vote)
+			return nil
+		})
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return votes
+}
+
+func (r *BoltRepository) GetVote(linkID int64, userID string) *Vote {
+	var vote *Vote
+	err := r.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltVotes).Get(voteKey(linkID, userID))
+		if v == nil {
+			return nil
+		}
+		vote = &Vote{}
+		return json.Unmarshal(v, vote)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return vote
+}
+
+func (r *BoltRepository) AppendAudit(e AuditEntry) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltAudit)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		e.AuditID = int64(seq)
+		v, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		return b.Put(itob(e.AuditID), v)
+	})
+}
+
+func (r *BoltRepository) ListAudit(f AuditFilter) ([]AuditEntry, error) {
+	f.normalize()
+	entries := make([]AuditEntry, 0)
+	err := r.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltAudit).Cursor()
+
+		// walk backwards from the newest entry, or from just before f.Before
+		k, v := c.Last()
+		if f.Before > 0 {
+			if k, v = c.Seek(itob(f.Before)); k == nil {
+				k, v = c.Last()
+			}
+			for k != nil && btoi(k) >= f.Before {
+				k, v = c.Prev()
+			}
+		}
+
+		for ; k != nil && int64(len(entries)) < f.Limit; k, v = c.Prev() {
+			e := AuditEntry{}
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			switch {
+			case f.Actor != "" && e.Actor != f.Actor:
+			case f.Action != "" && e.Action != f.Action:
+			case f.Target != "" && e.Target != f.Target:
+			case f.Since > 0 && e.CreatedAt < f.Since:
+			case f.Until > 0 && e.CreatedAt >= f.Until:
+			default:
+				entries = append(entries, e)
+			}
+		}
+		return nil
+	})
+	return entries, err
+}
+
+func (r *BoltRepository) StaleLinks(createdBefore int64, limit int64) []Link {
+	links := make([]Link, 0)
+	err := r.db.View(func(tx *bolt.Tx) error {
+		for _, state := range []LinkState{linkPending, linkQueued} {
+			candidates, err := linksFromIndex(tx, boltLinksByState, indexKey([]byte(state), nil))
+			if err != nil {
+				return err
+			}
+			for _, l := range candidates {
+				if l.CreatedAt < createdBefore {
+					links = append(links, l)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sort.Slice(links, func(i, j int) bool {
+		if links[i].CreatedAt != links[j].CreatedAt {
+			return links[i].CreatedAt < links[j].CreatedAt
+		}
+		return links[i].LinkID < links[j].LinkID
+	})
+	if int64(len(links)) > limit {
+		links = links[:limit]
+	}
+	return links
+}
+
+// archivedLink is what goes into the links_archive bucket
+type archivedLink struct {
+	Link
+	ArchivedAt int64 `json:"archived_at"`
+}
+
+type archivedVote struct {
+	Vote
+	ArchivedAt int64 `json:"archived_at"`
+}
+
+func (r *BoltRepository) ArchivePlayedLinks(playedBefore int64) (int64, int64, error) {
+	var nlinks, nvotes int64
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		played, err := linksFromIndex(tx, boltLinksByState, indexKey([]byte(linkPlayed), nil))
+		if err != nil {
+			return err
+		}
+
+		archivedAt := time.Now().Unix()
+		votes := tx.Bucket(boltVotes)
+		for _, l := range played {
+			if l.PlayedAt <= 0 || l.PlayedAt >= playedBefore {
+				continue
+			}
+			id := itob(l.LinkID)
+
+			// collect the keys first, deleting while iterating a cursor skips entries
+			voteKeys := make([][]byte, 0)
+			err = scanPrefix(votes, indexKey(id, nil), func(k, v []byte) error {
+				vote := Vote{}
+				if err := json.Unmarshal(v, &vote); err != nil {
+					return err
+				}
+				b, err := json.Marshal(archivedVote{Vote: vote, ArchivedAt: archivedAt})
+				if err != nil {
+					return err
+				}
+				if err = tx.Bucket(boltVotesArchive).Put(k, b); err != nil {
+					return err
+				}
+				tx.Bucket(boltVotesByUser).Delete(indexKey([]byte(vote.UserID), id))
+				voteKeys = append(voteKeys, append([]byte{}, k...))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, k := range voteKeys {
+				if err = votes.Delete(k); err != nil {
+					return err
+				}
+			}
+			nvotes += int64(len(voteKeys))
+
+			b, err := json.Marshal(archivedLink{Link: l, ArchivedAt: archivedAt})
+			if err != nil {
+				return err
+			}
+			if err = tx.Bucket(boltLinksArchive).Put(id, b); err != nil {
+				return err
+			}
+			tx.Bucket(boltTotals).Delete(id)
+			tx.Bucket(boltLinksByUser).Delete(indexKey([]byte(l.SubmittedBy), id))
+			tx.Bucket(boltLinksByState).Delete(indexKey([]byte(l.State), id))
+			tx.Bucket(boltLinksByNaturalKey).Delete(naturalLinkKey(l.VideoID, l.SubmittedBy, l.CreatedAt))
+			if err = tx.Bucket(boltLinks).Delete(id); err != nil {
+				return err
+			}
+			nlinks++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return nlinks, nvotes, nil
+}
+
+func (r *BoltRepository) AddNotification(n Notification) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltNotifications)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		n.NotificationID = int64(seq)
+		v, err := json.Marshal(n)
+		if err != nil {
+			return err
+		}
+		if err = b.Put(itob(n.NotificationID), v); err != nil {
+			return err
+		}
+		return tx.Bucket(boltNotificationsByUser).Put(indexKey([]byte(n.UserID), itob(n.NotificationID)), []byte{})
+	})
+}
+
+// notificationIDs returns the IDs of a user's notifications, oldest first
+func notificationIDs(tx *bolt.Tx, userID string) [][]byte {
+	ids := make([][]byte, 0)
+	scanPrefix(tx.Bucket(boltNotificationsByUser), indexKey([]byte(userID), nil), func(k, _ []byte) error {
+		ids = append(ids, append([]byte{}, k[len(k)-8:]...))
+		return nil
+	})
+	return ids
+}
+
+func (r *BoltRepository) GetNotifications(userID string, limit int64) []Notification {
+	notifications := make([]Notification, 0)
+	err := r.db.View(func(tx *bolt.Tx) error {
+		ids := notificationIDs(tx, userID)
+		b := tx.Bucket(boltNotifications)
+		for i := len(ids) - 1; i >= 0 && int64(len(notifications)) < limit; i-- {
+			n := Notification{}
+			if err := json.Unmarshal(b.Get(ids[i]), &n); err != nil {
+				return err
+			}
+			notifications = append(notifications, n)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return notifications
+}
+
+func (r *BoltRepository) MarkNotificationsRead(userID string, upTo int64) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltNotifications)
+		for _, id := range notificationIDs(tx, userID) {
+			if btoi(id) > upTo {
+				break
+			}
+			n := Notification{}
+			if err := json.Unmarshal(b.Get(id), &n); err != nil {
+				return err
+			}
+			if n.Read {
+				continue
+			}
+			n.Read = true
+			v, err := json.Marshal(n)
+			if err != nil {
+				return err
+			}
+			if err = b.Put(id, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r *BoltRepository) GetRoles(userID string) []RoleGrant {
+	return r.roleGrants(func(g RoleGrant) bool { return g.UserID == userID })
+}
+
+func (r *BoltRepository) ListRoleHolders(role string) []RoleGrant {
+	return r.roleGrants(func(g RoleGrant) bool { return g.Role == role })
+}
+
+// roleGrants scans every grant, there are only ever a handful
+func (r *BoltRepository) roleGrants(match func(g RoleGrant) bool) []RoleGrant {
+	grants := make([]RoleGrant, 0)
+	err := r.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltUserRoles).ForEach(func(_, v []byte) error {
+			g := RoleGrant{}
+			if err := json.Unmarshal(v, &g); err != nil {
+				return err
+			}
+			if match(g) {
+				grants = append(grants, g)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return grants
+}
+
+func (r *BoltRepository) GrantRole(g RoleGrant) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltUserRoles)
+		key := indexKey([]byte(g.UserID), []byte(g.Role))
+		if b.Get(key) != nil {
+			return nil
+		}
+		v, err := json.Marshal(g)
+		if err != nil {
+			return err
+		}
+		return b.Put(key, v)
+	})
+}
+
+func (r *BoltRepository) RevokeRole(userID, role string) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltUserRoles).Delete(indexKey([]byte(userID), []byte(role)))
+	})
+}
+
+func (r *BoltRepository) InsertRefreshToken(t RefreshToken) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		v, err := json.Marshal(t)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltRefreshTokens).Put([]byte(t.TokenHash), v)
+	})
+}
+
+func (r *BoltRepository) GetRefreshToken(tokenHash string) *RefreshToken {
+	var t *RefreshToken
+	err := r.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltRefreshTokens).Get([]byte(tokenHash))
+		if v == nil {
+			return nil
+		}
+		t = &RefreshToken{}
+		return json.Unmarshal(v, t)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return t
+}
+
+func (r *BoltRepository) UseRefreshToken(tokenHash string) (bool, error) {
+	fresh := false
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltRefreshTokens)
+		v := b.Get([]byte(tokenHash))
+		if v == nil {
+			return nil
+		}
+		t := RefreshToken{}
+		if err := json.Unmarshal(v, &t); err != nil {
+			return err
+		}
+		if t.Used {
+			return nil
+		}
+		t.Used = true
+		fresh = true
+		v, err := json.Marshal(t)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(tokenHash), v)
+	})
+	return fresh, err
+}
+
+// RevokeRefreshTokens scans every token, like DeleteExpiredTokens does
+func (r *BoltRepository) RevokeRefreshTokens(userID, sessionID string) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltRefreshTokens)
+		revoked := make(map[string][]byte)
+		err := b.ForEach(func(k, v []byte) error {
+			t := RefreshToken{}
+			if err := json.Unmarshal(v, &t); err != nil {
+				return err
+			}
+			if t.UserID != userID || (sessionID != "" && t.SessionID != sessionID) {
+				return nil
+			}
+			t.Revoked = true
+			v, err := json.Marshal(t)
+			revoked[string(k)] = v
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		// buckets can't be written while iterating
+		for k, v := range revoked {
+			if err = b.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r *BoltRepository) AddRevocation(rev Revocation) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltRevocations)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		v, err := json.Marshal(rev)
+		if err != nil {
+			return err
+		}
+		return b.Put(itob(int64(seq)), v)
+	})
+}
+
+func (r *BoltRepository) ActiveRevocations(now int64) []Revocation {
+	revocations := make([]Revocation, 0)
+	err := r.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltRevocations).ForEach(func(_, v []byte) error {
+			rev := Revocation{}
+			if err := json.Unmarshal(v, &rev); err != nil {
+				return err
+			}
+			if rev.ExpiresAt > now {
+				revocations = append(revocations, rev)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return revocations
+}
+
+func (r *BoltRepository) DeleteExpiredTokens(now int64) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltRefreshTokens, boltRevocations} {
+			b := tx.Bucket(name)
+			expired := make([][]byte, 0)
+			err := b.ForEach(func(k, v []byte) error {
+				// both kinds have an ExpiresAt field
+				e := struct{ ExpiresAt int64 }{}
+				if err := json.Unmarshal(v, &e); err != nil {
+					return err
+				}
+				if e.ExpiresAt <= now {
+					expired = append(expired, append([]byte{}, k...))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, k := range expired {
+				if err = b.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (r *BoltRepository) SetGuestVote(v GuestVote) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if err = tx.Bucket(boltGuestVotes).Put(voteKey(v.LinkID, v.UserID), b); err != nil {
+			return err
+		}
+		return tx.Bucket(boltGuestVotesByUser).Put(indexKey([]byte(v.UserID), itob(v.LinkID)), []byte{})
+	})
+}
+
+func (r *BoltRepository) GetGuestVote(linkID int64, userID string) *GuestVote {
+	var v *GuestVote
+	err := r.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltGuestVotes).Get(voteKey(linkID, userID))
+		if b == nil {
+			return nil
+		}
+		v = &GuestVote{}
+		return json.Unmarshal(b, v)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return v
+}
+
+// guestVotesOf returns the votes of a guest, ordered by link ID
+func guestVotesOf(tx *bolt.Tx, userID string) ([]GuestVote, error) {
+	votes := make([]GuestVote, 0)
+	prefix := indexKey([]byte(userID), nil)
+	err := scanPrefix(tx.Bucket(boltGuestVotesByUser), prefix, func(k, _ []byte) error {
+		linkID := btoi(k[len(prefix):])
+		v := GuestVote{}
+		if err := json.Unmarshal(tx.Bucket(boltGuestVotes).Get(voteKey(linkID, userID)), &v); err != nil {
+			return err
+		}
+		votes = append(votes, v)
+		return nil
+	})
+	return votes, err
+}
+
+func (r *BoltRepository) GetGuestVotes(userID string) []GuestVote {
+	var votes []GuestVote
+	err := r.db.View(func(tx *bolt.Tx) error {
+		var err error
+		votes, err = guestVotesOf(tx, userID)
+		return err
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return votes
+}
+
+func (r *BoltRepository) GuestVoteTotal(linkID int64) int64 {
+	var total int64
+	err := r.db.View(func(tx *bolt.Tx) error {
+		return scanPrefix(tx.Bucket(boltGuestVotes), indexKey(itob(linkID), nil), func(_, b []byte) error {
+			v := GuestVote{}
+			if err := json.Unmarshal(b, &v); err != nil {
+				return err
+			}
+			total += v.Score
+			return nil
+		})
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return total
+}
+
+func (r *BoltRepository) CountGuestVotesSince(userID string, since int64) int64 {
+	var n int64
+	for _, v := range r.GetGuestVotes(userID) {
+		if v.CreatedAt >= since {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *BoltRepository) DeleteGuestVotes(userID string) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		votes, err := guestVotesOf(tx, userID)
+		if err != nil {
+			return err
+		}
+		for _, v := range votes {
+			if err = tx.Bucket(boltGuestVotes).Delete(voteKey(v.LinkID, userID)); err != nil {
+				return err
+			}
+			if err = tx.Bucket(boltGuestVotesByUser).Delete(indexKey([]byte(userID), itob(v.LinkID))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r *BoltRepository) TakeRateTokens(buckets map[string]RateRule, now int64) (int64, error) {
+	var wait int64
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltRateBuckets)
+		current := make([]RateBucket, 0, len(buckets))
+		for _, key := range rateBucketKeys(buckets) {
+			b := RateBucket{Key: key, Tokens: float64(buckets[key].Capacity), UpdatedAt: now}
+			if v := bucket.Get([]byte(key)); v != nil {
+				if err := json.Unmarshal(v, &b); err != nil {
+					return err
+				}
+			}
+			current = append(current, b)
+		}
+		current, wait = takeTokens(current, buckets, now)
+		for _, b := range current {
+			v, err := json.Marshal(b)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(b.Key), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return wait, err
+}
+
+func (r *BoltRepository) DeleteIdleRateBuckets(before int64) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltRateBuckets)
+		idle := make([][]byte, 0)
+		err := bucket.ForEach(func(k, v []byte) error {
+			b := RateBucket{}
+			if err := json.Unmarshal(v, &b); err != nil {
+				return err
+			}
+			if b.UpdatedAt < before {
+				idle = append(idle, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range idle {
+			if err = bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r *BoltRepository) GetRateRules() []RateRule {
+	rules := make([]RateRule, 0)
+	err := r.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltRateRules).ForEach(func(_, v []byte) error {
+			rule := RateRule{}
+			if err := json.Unmarshal(v, &rule); err != nil {
+				return err
+			}
+			rules = append(rules, rule)
+			return nil
+		})
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return rules
+}
+
+func (r *BoltRepository) SetRateRule(rule RateRule) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		v, err := json.Marshal(rule)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltRateRules).Put(indexKey([]byte(rule.Endpoint), []byte(rule.Scope)), v)
+	})
+}
+
+func (r *BoltRepository) GetIdentity(provider, subject string) *Identity {
+	var i *Identity
+	err := r.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltIdentities).Get(indexKey([]byte(provider), []byte(subject)))
+		if v == nil {
+			return nil
+		}
+		i = &Identity{}
+		return json.Unmarshal(v, i)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return i
+}
+
+// ListIdentities scans every identity, like roleGrants does
+func (r *BoltRepository) ListIdentities(userID string) []Identity {
+	identities := make([]Identity, 0)
+	err := r.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltIdentities).ForEach(func(_, v []byte) error {
+			i := Identity{}
+			if err := json.Unmarshal(v, &i); err != nil {
+				return err
+			}
+			if i.UserID == userID {
+				identities = append(identities, i)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return identities
+}
+
+func (r *BoltRepository) AddIdentity(i Identity) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltIdentities)
+		key := indexKey([]byte(i.Provider), []byte(i.Subject))
+		if b.Get(key) != nil {
+			return ErrIdentityLinked
+		}
+		v, err := json.Marshal(i)
+		if err != nil {
+			return err
+		}
+		return b.Put(key, v)
+	})
+}
+
+func (r *BoltRepository) AddSkipVote(linkID int64, userID string, at int64) (bool, error) {
+	added := false
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltSkipVotes)
+		if b.Get(voteKey(linkID, userID)) != nil {
+			return nil
+		}
+		added = true
+		return b.Put(voteKey(linkID, userID), itob(at))
+	})
+	return added, err
+}
+
+func (r *BoltRepository) CountSkipVotes(linkID int64) int64 {
+	var n int64
+	err := r.db.View(func(tx *bolt.Tx) error {
+		return scanPrefix(tx.Bucket(boltSkipVotes), indexKey(itob(linkID), nil), func(_, _ []byte) error {
+			n++
+			return nil
+		})
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return n
+}
+
+func (r *BoltRepository) DeleteSkipVotes(linkID int64) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltSkipVotes)
+		keys := make([][]byte, 0)
+		err := scanPrefix(b, indexKey(itob(linkID), nil), func(k, _ []byte) error {
+			keys = append(keys, append([]byte{}, k...))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err = b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// boltAccessToken keeps the hash, which AccessToken marks `json:"-"` so it
+// never reaches API responses. Don't store the plain AccessToken instead, the
+// hash would be silently dropped on write.
+type boltAccessToken struct {
+	AccessToken
+	TokenHash string `json:"token_hash"`
+}
+
+func getAccessToken(tx *bolt.Tx, id []byte) (*AccessToken, error) {
+	v := tx.Bucket(boltAccessTokens).Get(id)
+	if v == nil {
+		return nil, nil
+	}
+	b := boltAccessToken{}
+	if err := json.Unmarshal(v, &b); err != nil {
+		return nil, err
+	}
+	b.AccessToken.TokenHash = b.TokenHash
+	return &b.AccessToken, nil
+}
+
+func putAccessToken(tx *bolt.Tx, t AccessToken) error {
+	v, err := json.Marshal(boltAccessToken{AccessToken: t, TokenHash: t.TokenHash})
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(boltAccessTokens).Put(itob(t.TokenID), v)
+}
+
+func (r *BoltRepository) CreateAccessToken(t AccessToken) (int64, error) {
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		seq, err := tx.Bucket(boltAccessTokens).NextSequence()
+		if err != nil {
+			return err
+		}
+		t.TokenID = int64(seq)
+		if err = putAccessToken(tx, t); err != nil {
+			return err
+		}
+		return tx.Bucket(boltAccessTokensByHash).Put([]byte(t.TokenHash), itob(t.TokenID))
+	})
+	return t.TokenID, err
+}
+
+func (r *BoltRepository) GetAccessTokenByHash(tokenHash string) *AccessToken {
+	var t *AccessToken
+	err := r.db.View(func(tx *bolt.Tx) error {
+		id := tx.Bucket(boltAccessTokensByHash).Get([]byte(tokenHash))
+		if id == nil {
+			return nil
+		}
+		var err error
+		t, err = getAccessToken(tx, id)
+		return err
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return t
+}
+
+// userAccessTokens scans every token, a station only has a handful
+func userAccessTokens(tx *bolt.Tx, userID string) ([]AccessToken, error) {
+	tokens := make([]AccessToken, 0)
+	err := tx.Bucket(boltAccessTokens).ForEach(func(k, _ []byte) error {
+		t, err := getAccessToken(tx, k)
+		if err != nil {
+			return err
+		}
+		if t.UserID == userID {
+			tokens = append(tokens, *t)
+		}
+		return nil
+	})
+	return tokens, err
+}
+
+func (r *BoltRepository) ListAccessTokens(userID string) []AccessToken {
+	var tokens []AccessToken
+	err := r.db.View(func(tx *bolt.Tx) error {
+		var err error
+		tokens, err = userAccessTokens(tx, userID)
+		return err
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return tokens
+}
+
+func (r *BoltRepository) RevokeAccessTokens(userID string, tokenID int64) (int64, error) {
+	var n int64
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		tokens, err := userAccessTokens(tx, userID)
+		if err != nil {
+			return err
+		}
+		for _, t := range tokens {
+			if t.Revoked || (tokenID != 0 && t.TokenID != tokenID) {
+				continue
+			}
+			t.Revoked = true
+			if err = putAccessToken(tx, t); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+func (r *BoltRepository) TouchAccessToken(tokenID, usedAt int64) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		t, err := getAccessToken(tx, itob(tokenID))
+		if err != nil || t == nil {
+			return err
+		}
+		t.LastUsedAt = usedAt
+		return putAccessToken(tx, *t)
+	})
+}
+
+// boltWebhook keeps the secret, which Webhook marks `json:"-"` so it never
+// reaches API responses. Don't store the plain Webhook instead, the secret
+// would be silently dropped on write and deliveries signed with an empty key.
+type boltWebhook struct {
+	Webhook
+	Secret string `json:"secret"`
+}
+
+func getWebhook(tx *bolt.Tx, id []byte) (*Webhook, error) {
+	v := tx.Bucket(boltWebhooks).Get(id)
+	if v == nil {
+		return nil, nil
+	}
+	b := boltWebhook{}
+	if err := json.Unmarshal(v, &b); err != nil {
+		return nil, err
+	}
+	b.Webhook.Secret = b.Secret
+	return &b.Webhook, nil
+}
+
+func putWebhook(tx *bolt.Tx, w Webhook) error {
+	v, err := json.Marshal(boltWebhook{Webhook: w, Secret: w.Secret})
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(boltWebhooks).Put(itob(w.WebhookID), v)
+}
+
+func (r *BoltRepository) CreateWebhook(w Webhook) (int64, error) {
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		seq, err := tx.Bucket(boltWebhooks).NextSequence()
+		if err != nil {
+			return err
+		}
+		w.WebhookID = int64(seq)
+		return putWebhook(tx, w)
+	})
+	return w.WebhookID, err
+}
+
+func (r *BoltRepository) GetWebhook(webhookID int64) *Webhook {
+	var w *Webhook
+	err := r.db.View(func(tx *bolt.Tx) error {
+		var err error
+		w, err = getWebhook(tx, itob(webhookID))
+		return err
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return w
+}
+
+func (r *BoltRepository) ListWebhooks() []Webhook {
+	webhooks := make([]Webhook, 0)
+	err := r.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltWebhooks).ForEach(func(k, _ []byte) error {
+			w, err := getWebhook(tx, k)
+			if err != nil {
+				return err
+			}
+			webhooks = append(webhooks, *w)
+			return nil
+		})
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return webhooks
+}
+
+func (r *BoltRepository) UpdateWebhook(w Webhook) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		old, err := getWebhook(tx, itob(w.WebhookID))
+		if err != nil || old == nil {
+			return err
+		}
+		// the secret never changes
+		w.Secret = old.Secret
+		return putWebhook(tx, w)
+	})
+}
+
+func dueDeliveryKey(d WebhookDelivery) []byte {
+	return indexKey(itob(d.NextAttemptAt), itob(d.DeliveryID))
+}
+
+// putWebhookDelivery stores d, keeping the index of pending deliveries up to date
+func putWebhookDelivery(tx *bolt.Tx, d WebhookDelivery, old *WebhookDelivery) error {
+	due := tx.Bucket(boltDueDeliveries)
+	if old != nil && old.Status == deliveryPending {
+		if err := due.Delete(dueDeliveryKey(*old)); err != nil {
+			return err
+		}
+	}
+	v, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	if err = tx.Bucket(boltWebhookDeliveries).Put(itob(d.DeliveryID), v); err != nil {
+		return err
+	}
+	if d.Status == deliveryPending {
+		return due.Put(dueDeliveryKey(d), []byte{})
+	}
+	return nil
+}
+
+func getWebhookDelivery(tx *bolt.Tx, id []byte) (*WebhookDelivery, error) {
+	v := tx.Bucket(boltWebhookDeliveries).Get(id)
+	if v == nil {
+		return nil, nil
+	}
+	d := &WebhookDelivery{}
+	if err := json.Unmarshal(v, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// deleteWebhookDeliveries deletes every delivery match says so of
+func deleteWebhookDeliveries(tx *bolt.Tx, match func(d WebhookDelivery) bool) error {
+	b := tx.Bucket(boltWebhookDeliveries)
+	doomed := make([]WebhookDelivery, 0)
+	err := b.ForEach(func(_, v []byte) error {
+		d := WebhookDelivery{}
+		if err := json.Unmarshal(v, &d); err != nil {
+			return err
+		}
+		if match(d) {
+			doomed = append(doomed, d)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, d := range doomed {
+		if d.Status == deliveryPending {
+			if err = tx.Bucket(boltDueDeliveries).Delete(dueDeliveryKey(d)); err != nil {
+				return err
+			}
+		}
+		if err = b.Delete(itob(d.DeliveryID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *BoltRepository) DeleteWebhook(webhookID int64) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		err := deleteWebhookDeliveries(tx, func(d WebhookDelivery) bool {
+			return d.WebhookID == webhookID
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltWebhooks).Delete(itob(webhookID))
+	})
+}
+
+func (r *BoltRepository) AddWebhookDelivery(d WebhookDelivery) (int64, error) {
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		seq, err := tx.Bucket(boltWebhookDeliveries).NextSequence()
+		if err != nil {
+			return err
+		}
+		d.DeliveryID = int64(seq)
+		return putWebhookDelivery(tx, d, nil)
+	})
+	return d.DeliveryID, err
+}
+
+func (r *BoltRepository) GetWebhookDelivery(deliveryID int64) *WebhookDelivery {
+	var d *WebhookDelivery
+	err := r.db.View(func(tx *bolt.Tx) error {
+		var err error
+		d, err = getWebhookDelivery(tx, itob(deliveryID))
+		return err
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return d
+}
+
+func (r *BoltRepository) ListWebhookDeliveries(f WebhookDeliveryFilter) []WebhookDelivery {
+	deliveries := make([]WebhookDelivery, 0)
+	err := r.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltWebhookDeliveries).Cursor()
+		k, v := c.Last()
+		if f.Before > 0 {
+			// Seek lands on before itself or the first key after it
+			k, v = c.Seek(itob(f.Before))
+			if k == nil {
+				k, v = c.Last()
+			}
+			for k != nil && btoi(k) >= f.Before {
+				k, v = c.Prev()
+			}
+		}
+		for ; k != nil && int64(len(deliveries)) < f.Limit; k, v = c.Prev() {
+			d := WebhookDelivery{}
+			if err := json.Unmarshal(v, &d); err != nil {
+				return err
+			}
+			if (f.WebhookID > 0 && d.WebhookID != f.WebhookID) || (f.Status != "" && d.Status != f.Status) {
+				continue
+			}
+			deliveries = append(deliveries, d)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return deliveries
+}
+
+func (r *BoltRepository) DueWebhookDeliveries(now, limit int64) []WebhookDelivery {
+	deliveries := make([]WebhookDelivery, 0)
+	err := r.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltDueDeliveries).Cursor()
+		for k, _ := c.First(); k != nil && int64(len(deliveries)) < limit; k, _ = c.Next() {
+			if btoi(k[:8]) > now {
+				break
+			}
+			d, err := getWebhookDelivery(tx, k[len(k)-8:])
+			if err != nil {
+				return err
+			}
+			if d != nil {
+				deliveries = append(deliveries, *d)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return deliveries
+}
+
+func (r *BoltRepository) UpdateWebhookDelivery(d WebhookDelivery) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		old, err := getWebhookDelivery(tx, itob(d.DeliveryID))
+		if err != nil || old == nil {
+			return err
+		}
+		return putWebhookDelivery(tx, d, old)
+	})
+}
+
+func (r *BoltRepository) DeleteWebhookDeliveries(createdBefore int64) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		return deleteWebhookDeliveries(tx, func(d WebhookDelivery) bool {
+			return d.Status != deliveryPending && d.CreatedAt < createdBefore
+		})
+	})
+}
+
+func (r *BoltRepository) AddChatMessage(m ChatMessage) (int64, error) {
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltChatMessages)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		m.MessageID = int64(seq)
+		v, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		return b.Put(itob(m.MessageID), v)
+	})
+	return m.MessageID, err
+}
+
+func (r *BoltRepository) GetChatMessage(messageID int64) *ChatMessage {
+	var m *ChatMessage
+	err := r.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltChatMessages).Get(itob(messageID))
+		if v == nil {
+			return nil
+		}
+		m = &ChatMessage{}
+		return json.Unmarshal(v, m)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return m
+}
+
+func (r *BoltRepository) ListChatMessages(f ChatFilter) []ChatMessage {
+	messages := make([]ChatMessage, 0)
+	err := r.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltChatMessages).Cursor()
+		k, v := c.Last()
+		if f.Before > 0 {
+			// Seek lands on before itself or the first key after it
+			k, v = c.Seek(itob(f.Before))
+			if k == nil {
+				k, v = c.Last()
+			}
+			for k != nil && btoi(k) >= f.Before {
+				k, v = c.Prev()
+			}
+		}
+		for ; k != nil && int64(len(messages)) < f.Limit; k, v = c.Prev() {
+			m := ChatMessage{}
+			if err := json.Unmarshal(v, &m); err != nil {
+				return err
+			}
+			if f.LinkID > 0 && m.LinkID != f.LinkID {
+				continue
+			}
+			messages = append(messages, m)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return messages
+}
+
+func (r *BoltRepository) DeleteChatMessage(messageID int64) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltChatMessages).Delete(itob(messageID))
+	})
+}
+
+func (r *BoltRepository) DeleteChatMessages(createdBefore int64) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltChatMessages)
+		doomed := make([][]byte, 0)
+		// messages are stored in the order they were said
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			m := ChatMessage{}
+			if err := json.Unmarshal(v, &m); err != nil {
+				return err
+			}
+			if m.CreatedAt >= createdBefore {
+				break
+			}
+			doomed = append(doomed, k)
+		}
+		for _, k := range doomed {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r *BoltRepository) SetChatMute(m ChatMute) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		v, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltChatMutes).Put([]byte(m.UserID), v)
+	})
+}
+
+func (r *BoltRepository) GetChatMute(userID string) *ChatMute {
+	var m *ChatMute
+	err := r.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltChatMutes).Get([]byte(userID))
+		if v == nil {
+			return nil
+		}
+		m = &ChatMute{}
+		return json.Unmarshal(v, m)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return m
+}
+
+// chatMutes returns every mute match says so of
+func chatMutes(tx *bolt.Tx, match func(m ChatMute) bool) ([]ChatMute, error) {
+	mutes := make([]ChatMute, 0)
+	err := tx.Bucket(boltChatMutes).ForEach(func(_, v []byte) error {
+		m := ChatMute{}
+		if err := json.Unmarshal(v, &m); err != nil {
+			return err
+		}
+		if match(m) {
+			mutes = append(mutes, m)
+		}
+		return nil
+	})
+	return mutes, err
+}
+
+func (r *BoltRepository) ListChatMutes(now int64) []ChatMute {
+	var mutes []ChatMute
+	err := r.db.View(func(tx *bolt.Tx) error {
+		var err error
+		mutes, err = chatMutes(tx, func(m ChatMute) bool {
+			return m.isActive(now)
+		})
+		return err
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	sort.Slice(mutes, func(i, j int) bool {
+		if mutes[i].MutedAt != mutes[j].MutedAt {
+			return mutes[i].MutedAt < mutes[j].MutedAt
+		}
+		return mutes[i].UserID < mutes[j].UserID
+	})
+	return mutes
+}
+
+func (r *BoltRepository) DeleteChatMute(userID string) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltChatMutes).Delete([]byte(userID))
+	})
+}
+
+func (r *BoltRepository) DeleteExpiredChatMutes(now int64) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		expired, err := chatMutes(tx, func(m ChatMute) bool {
+			return !m.isActive(now)
+		})
+		if err != nil {
+			return err
+		}
+		for _, m := range expired {
+			if err = tx.Bucket(boltChatMutes).Delete([]byte(m.UserID)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r *BoltRepository) NewTest(message string) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltTest)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(strconv.FormatUint(seq, 10)), []byte(message))
+	})
+}
+
+func (r *BoltRepository) close() {
+	r.db.Close()
+}
+
+func NewBoltRepository(path string) *BoltRepository {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second * 5})
+	if err != nil {
+		log.Fatal("unable to open bolt database ", err)
+	}
+
+	// make sure the required buckets exist
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range boltBuckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal("failed to create buckets ", err)
+	}
+
+	return &BoltRepository{db: db}
+}
@@ -0,0 +1,513 @@
+package main
+
+// this file wraps the repositories to time their methods, for /metrics
+//
+// each method is timed as a whole, so one running a few queries in a
+// transaction counts once. The label is the method's name.
+
+import "time"
+
+// meterRepositories times every repository method the service calls,
+// whichever backend is behind it. Missing repositories stay missing
+func (s *ServiceImpl) meterRepositories() {
+	if s.userRepo != nil {
+		s.userRepo = meteredUserRepo{s.userRepo}
+	}
+	if s.linkRepo != nil {
+		s.linkRepo = meteredLinkRepo{s.linkRepo}
+	}
+	if s.voteRepo != nil {
+		s.voteRepo = meteredVoteRepo{s.voteRepo}
+	}
+	if s.testRepo != nil {
+		s.testRepo = meteredTestRepo{s.testRepo}
+	}
+	if s.auditRepo != nil {
+		s.auditRepo = meteredAuditRepo{s.auditRepo}
+	}
+	if s.notificationRepo != nil {
+		s.notificationRepo = meteredNotificationRepo{s.notificationRepo}
+	}
+	if s.roleRepo != nil {
+		s.roleRepo = meteredRoleRepo{s.roleRepo}
+	}
+	if s.tokenRepo != nil {
+		s.tokenRepo = meteredTokenRepo{s.tokenRepo}
+	}
+	if s.guestRepo != nil {
+		s.guestRepo = meteredGuestRepo{s.guestRepo}
+	}
+	if s.rateLimitRepo != nil {
+		s.rateLimitRepo = meteredRateLimitRepo{s.rateLimitRepo}
+	}
+	if s.accessTokenRepo != nil {
+		s.accessTokenRepo = meteredAccessTokenRepo{s.accessTokenRepo}
+	}
+	if s.identityRepo != nil {
+		s.identityRepo = meteredIdentityRepo{s.identityRepo}
+	}
+	if s.skipVoteRepo != nil {
+		s.skipVoteRepo = meteredSkipVoteRepo{s.skipVoteRepo}
+	}
+	if s.webhookRepo != nil {
+		s.webhookRepo = meteredWebhookRepo{s.webhookRepo}
+	}
+	if s.chatRepo != nil {
+		s.chatRepo = meteredChatRepo{s.chatRepo}
+	}
+}
+
+type meteredUserRepo struct {
+	UserRepository
+}
+
+func (m meteredUserRepo) CreateOrUpdateUser(user User) error {
+	defer dbDuration.Since(time.Now(), "CreateOrUpdateUser")
+	return m.UserRepository.CreateOrUpdateUser(user)
+}
+
+func (m meteredUserRepo) GetUserByID(userID string) *User {
+	defer dbDuration.Since(time.Now(), "GetUserByID")
+	return m.UserRepository.GetUserByID(userID)
+}
+
+func (m meteredUserRepo) AllUsers() []User {
+	defer dbDuration.Since(time.Now(), "AllUsers")
+	return m.UserRepository.AllUsers()
+}
+
+type meteredLinkRepo struct {
+	LinkRepository
+}
+
+func (m meteredLinkRepo) InsertLink(link Link) int64 {
+	defer dbDuration.Since(time.Now(), "InsertLink")
+	return m.LinkRepository.InsertLink(link)
+}
+
+func (m meteredLinkRepo) GetLinkByID(id int64) (*Link, error) {
+	defer dbDuration.Since(time.Now(), "GetLinkByID")
+	return m.LinkRepository.GetLinkByID(id)
+}
+
+func (m meteredLinkRepo) GetAllLinks(limit int64) []Link {
+	defer dbDuration.Since(time.Now(), "GetAllLinks")
+	return m.LinkRepository.GetAllLinks(limit)
+}
+
+func (m meteredLinkRepo) ListLinks(filter LinkFilter) (*LinkPage, error) {
+	defer dbDuration.Since(time.Now(), "ListLinks")
+	return m.LinkRepository.ListLinks(filter)
+}
+
+func (m meteredLinkRepo) GetLinksByUser(userID string) []Link {
+	defer dbDuration.Since(time.Now(), "GetLinksByUser")
+	return m.LinkRepository.GetLinksByUser(userID)
+}
+
+func (m meteredLinkRepo) AllLinks() []Link {
+	defer dbDuration.Since(time.Now(), "AllLinks")
+	return m.LinkRepository.AllLinks()
+}
+
+func (m meteredLinkRepo) FindLink(videoID, submittedBy string, createdAt int64) *Link {
+	defer dbDuration.Since(time.Now(), "FindLink")
+	return m.LinkRepository.FindLink(videoID, submittedBy, createdAt)
+}
+
+func (m meteredLinkRepo) FindArchivedLink(videoID, submittedBy string, createdAt int64) *Link {
+	defer dbDuration.Since(time.Now(), "FindArchivedLink")
+	return m.LinkRepository.FindArchivedLink(videoID, submittedBy, createdAt)
+}
+
+func (m meteredLinkRepo) UpdateLink(link Link) error {
+	defer dbDuration.Since(time.Now(), "UpdateLink")
+	return m.LinkRepository.UpdateLink(link)
+}
+
+func (m meteredLinkRepo) UpdateLinkIf(link Link, state LinkState) (bool, error) {
+	defer dbDuration.Since(time.Now(), "UpdateLinkIf")
+	return m.LinkRepository.UpdateLinkIf(link, state)
+}
+
+func (m meteredLinkRepo) GetVotesForUser(linkIDs []int64, userID string) map[int64]int64 {
+	defer dbDuration.Since(time.Now(), "GetVotesForUser")
+	return m.LinkRepository.GetVotesForUser(linkIDs, userID)
+}
+
+func (m meteredLinkRepo) StaleLinks(createdBefore int64, limit int64) []Link {
+	defer dbDuration.Since(time.Now(), "StaleLinks")
+	return m.LinkRepository.StaleLinks(createdBefore, limit)
+}
+
+func (m meteredLinkRepo) ArchivePlayedLinks(playedBefore int64) (int64, int64, error) {
+	defer dbDuration.Since(time.Now(), "ArchivePlayedLinks")
+	return m.LinkRepository.ArchivePlayedLinks(playedBefore)
+}
+
+type meteredVoteRepo struct {
+	VoteRepository
+}
+
+func (m meteredVoteRepo) MarkVote(linkID int64, userID string, score int64) error {
+	defer dbDuration.Since(time.Now(), "MarkVote")
+	return m.VoteRepository.MarkVote(linkID, userID, score)
+}
+
+func (m meteredVoteRepo) TotalVoteForLinks(linkIDs []int64) map[int64]int64 {
+	defer dbDuration.Since(time.Now(), "TotalVoteForLinks")
+	return m.VoteRepository.TotalVoteForLinks(linkIDs)
+}
+
+func (m meteredVoteRepo) AllVotes() []Vote {
+	defer dbDuration.Since(time.Now(), "AllVotes")
+	return m.VoteRepository.AllVotes()
+}
+
+func (m meteredVoteRepo) GetVote(linkID int64, userID string) *Vote {
+	defer dbDuration.Since(time.Now(), "GetVote")
+	return m.VoteRepository.GetVote(linkID, userID)
+}
+
+type meteredTestRepo struct {
+	TestRepository
+}
+
+func (m meteredTestRepo) NewTest(message string) error {
+	defer dbDuration.Since(time.Now(), "NewTest")
+	return m.TestRepository.NewTest(message)
+}
+
+type meteredAuditRepo struct {
+	AuditRepository
+}
+
+func (m meteredAuditRepo) AppendAudit(entry AuditEntry) error {
+	defer dbDuration.Since(time.Now(), "AppendAudit")
+	return m.AuditRepository.AppendAudit(entry)
+}
+
+func (m meteredAuditRepo) ListAudit(filter AuditFilter) ([]AuditEntry, error) {
+	defer dbDuration.Since(time.Now(), "ListAudit")
+	return m.AuditRepository.ListAudit(filter)
+}
+
+type meteredNotificationRepo struct {
+	NotificationRepository
+}
+
+func (m meteredNotificationRepo) AddNotification(n Notification) error {
+	defer dbDuration.Since(time.Now(), "AddNotification")
+	return m.NotificationRepository.AddNotification(n)
+}
+
+func (m meteredNotificationRepo) GetNotifications(userID string, limit int64) []Notification {
+	defer dbDuration.Since(time.Now(), "GetNotifications")
+	return m.NotificationRepository.GetNotifications(userID, limit)
+}
+
+func (m meteredNotificationRepo) MarkNotificationsRead(userID string, upTo int64) error {
+	defer dbDuration.Since(time.Now(), "MarkNotificationsRead")
+	return m.NotificationRepository.MarkNotificationsRead(userID, upTo)
+}
+
+type meteredRoleRepo struct {
+	RoleRepository
+}
+
+func (m meteredRoleRepo) GetRoles(userID string) []RoleGrant {
+	defer dbDuration.Since(time.Now(), "GetRoles")
+	return m.RoleRepository.GetRoles(userID)
+}
+
+func (m meteredRoleRepo) ListRoleHolders(role string) []RoleGrant {
+	defer dbDuration.Since(time.Now(), "ListRoleHolders")
+	return m.RoleRepository.ListRoleHolders(role)
+}
+
+func (m meteredRoleRepo) GrantRole(grant RoleGrant) error {
+	defer dbDuration.Since(time.Now(), "GrantRole")
+	return m.RoleRepository.GrantRole(grant)
+}
+
+func (m meteredRoleRepo) RevokeRole(userID, role string) error {
+	defer dbDuration.Since(time.Now(), "RevokeRole")
+	return m.RoleRepository.RevokeRole(userID, role)
+}
+
+type meteredTokenRepo struct {
+	TokenRepository
+}
+
+func (m meteredTokenRepo) InsertRefreshToken(t RefreshToken) error {
+	defer dbDuration.Since(time.Now(), "InsertRefreshToken")
+	return m.TokenRepository.InsertRefreshToken(t)
+}
+
+func (m meteredTokenRepo) GetRefreshToken(tokenHash string) *RefreshToken {
+	defer dbDuration.Since(time.Now(), "GetRefreshToken")
+	return m.TokenRepository.GetRefreshToken(tokenHash)
+}
+
+func (m meteredTokenRepo) UseRefreshToken(tokenHash string) (bool, error) {
+	defer dbDuration.Since(time.Now(), "UseRefreshToken")
+	return m.TokenRepository.UseRefreshToken(tokenHash)
+}
+
+func (m meteredTokenRepo) RevokeRefreshTokens(userID, sessionID string) error {
+	defer dbDuration.Since(time.Now(), "RevokeRefreshTokens")
+	return m.TokenRepository.RevokeRefreshTokens(userID, sessionID)
+}
+
+func (m meteredTokenRepo) AddRevocation(r Revocation) error {
+	defer dbDuration.Since(time.Now(), "AddRevocation")
+	return m.TokenRepository.AddRevocation(r)
+}
+
+func (m meteredTokenRepo) ActiveRevocations(now int64) []Revocation {
+	defer dbDuration.Since(time.Now(), "ActiveRevocations")
+	return m.TokenRepository.ActiveRevocations(now)
+}
+
+func (m meteredTokenRepo) DeleteExpiredTokens(now int64) error {
+	defer dbDuration.Since(time.Now(), "DeleteExpiredTokens")
+	return m.TokenRepository.DeleteExpiredTokens(now)
+}
+
+type meteredGuestRepo struct {
+	GuestRepository
+}
+
+func (m meteredGuestRepo) SetGuestVote(v GuestVote) error {
+	defer dbDuration.Since(time.Now(), "SetGuestVote")
+	return m.GuestRepository.SetGuestVote(v)
+}
+
+func (m meteredGuestRepo) GetGuestVote(linkID int64, userID string) *GuestVote {
+	defer dbDuration.Since(time.Now(), "GetGuestVote")
+	return m.GuestRepository.GetGuestVote(linkID, userID)
+}
+
+func (m meteredGuestRepo) GetGuestVotes(userID string) []GuestVote {
+	defer dbDuration.Since(time.Now(), "GetGuestVotes")
+	return m.GuestRepository.GetGuestVotes(userID)
+}
+
+func (m meteredGuestRepo) GuestVoteTotal(linkID int64) int64 {
+	defer dbDuration.Since(time.Now(), "GuestVoteTotal")
+	return m.GuestRepository.GuestVoteTotal(linkID)
+}
+
+func (m meteredGuestRepo) CountGuestVotesSince(userID string, since int64) int64 {
+	defer dbDuration.Since(time.Now(), "CountGuestVotesSince")
+	return m.GuestRepository.CountGuestVotesSince(userID, since)
+}
+
+func (m meteredGuestRepo) DeleteGuestVotes(userID string) error {
+	defer dbDuration.Since(time.Now(), "DeleteGuestVotes")
+	return m.GuestRepository.DeleteGuestVotes(userID)
+}
+
+type meteredRateLimitRepo struct {
+	RateLimitRepository
+}
+
+func (m meteredRateLimitRepo) TakeRateTokens(buckets map[string]RateRule, now int64) (int64, error) {
+	defer dbDuration.Since(time.Now(), "TakeRateTokens")
+	return m.RateLimitRepository.TakeRateTokens(buckets, now)
+}
+
+func (m meteredRateLimitRepo) DeleteIdleRateBuckets(before int64) error {
+	defer dbDuration.Since(time.Now(), "DeleteIdleRateBuckets")
+	return m.RateLimitRepository.DeleteIdleRateBuckets(before)
+}
+
+func (m meteredRateLimitRepo) GetRateRules() []RateRule {
+	defer dbDuration.Since(time.Now(), "GetRateRules")
+	return m.RateLimitRepository.GetRateRules()
+}
+
+func (m meteredRateLimitRepo) SetRateRule(rule RateRule) error {
+	defer dbDuration.Since(time.Now(), "SetRateRule")
+	return m.RateLimitRepository.SetRateRule(rule)
+}
+
+type meteredAccessTokenRepo struct {
+	AccessTokenRepository
+}
+
+func (m meteredAccessTokenRepo) CreateAccessToken(t AccessToken) (int64, error) {
+	defer dbDuration.Since(time.Now(), "CreateAccessToken")
+	return m.AccessTokenRepository.CreateAccessToken(t)
+}
+
+func (m meteredAccessTokenRepo) GetAccessTokenByHash(tokenHash string) *AccessToken {
+	defer dbDuration.Since(time.Now(), "GetAccessTokenByHash")
+	return m.AccessTokenRepository.GetAccessTokenByHash(tokenHash)
+}
+
+func (m meteredAccessTokenRepo) ListAccessTokens(userID string) []AccessToken {
+	defer dbDuration.Since(time.Now(), "ListAccessTokens")
+	return m.AccessTokenRepository.ListAccessTokens(userID)
+}
+
+func (m meteredAccessTokenRepo) RevokeAccessTokens(userID string, tokenID int64) (int64, error) {
+	defer dbDuration.Since(time.Now(), "RevokeAccessTokens")
+	return m.AccessTokenRepository.RevokeAccessTokens(userID, tokenID)
+}
+
+func (m meteredAccessTokenRepo) TouchAccessToken(tokenID, usedAt int64) error {
+	defer dbDuration.Since(time.Now(), "TouchAccessToken")
+	return m.AccessTokenRepository.TouchAccessToken(tokenID, usedAt)
+}
+
+type meteredSkipVoteRepo struct {
+	SkipVoteRepository
+}
+
+func (m meteredSkipVoteRepo) AddSkipVote(linkID int64, userID string, at int64) (bool, error) {
+	defer dbDuration.Since(time.Now(), "AddSkipVote")
+	return m.SkipVoteRepository.AddSkipVote(linkID, userID, at)
+}
+
+func (m meteredSkipVoteRepo) CountSkipVotes(linkID int64) int64 {
+	defer dbDuration.Since(time.Now(), "CountSkipVotes")
+	return m.SkipVoteRepository.CountSkipVotes(linkID)
+}
+
+func (m meteredSkipVoteRepo) DeleteSkipVotes(linkID int64) error {
+	defer dbDuration.Since(time.Now(), "DeleteSkipVotes")
+	return m.SkipVoteRepository.DeleteSkipVotes(linkID)
+}
+
+type meteredIdentityRepo struct {
+	IdentityRepository
+}
+
+func (m meteredIdentityRepo) GetIdentity(provider, subject string) *Identity {
+	defer dbDuration.Since(time.Now(), "GetIdentity")
+	return m.IdentityRepository.GetIdentity(provider, subject)
+}
+
+func (m meteredIdentityRepo) ListIdentities(userID string) []Identity {
+	defer dbDuration.Since(time.Now(), "ListIdentities")
+	return m.IdentityRepository.ListIdentities(userID)
+}
+
+func (m meteredIdentityRepo) AddIdentity(identity Identity) error {
+	defer dbDuration.Since(time.Now(), "AddIdentity")
+	return m.IdentityRepository.AddIdentity(identity)
+}
+
+type meteredWebhookRepo struct {
+	WebhookRepository
+}
+
+func (m meteredWebhookRepo) CreateWebhook(w Webhook) (int64, error) {
+	defer dbDuration.Since(time.Now(), "CreateWebhook")
+	return m.WebhookRepository.CreateWebhook(w)
+}
+
+func (m meteredWebhookRepo) GetWebhook(webhookID int64) *Webhook {
+	defer dbDuration.Since(time.Now(), "GetWebhook")
+	return m.WebhookRepository.GetWebhook(webhookID)
+}
+
+func (m meteredWebhookRepo) ListWebhooks() []Webhook {
+	defer dbDuration.Since(time.Now(), "ListWebhooks")
+	return m.WebhookRepository.ListWebhooks()
+}
+
+func (m meteredWebhookRepo) UpdateWebhook(w Webhook) error {
+	defer dbDuration.Since(time.Now(), "UpdateWebhook")
+	return m.WebhookRepository.UpdateWebhook(w)
+}
+
+func (m meteredWebhookRepo) DeleteWebhook(webhookID int64) error {
+	defer dbDuration.Since(time.Now(), "DeleteWebhook")
+	return m.WebhookRepository.DeleteWebhook(webhookID)
+}
+
+func (m meteredWebhookRepo) AddWebhookDelivery(d WebhookDelivery) (int64, error) {
+	defer dbDuration.Since(time.Now(), "AddWebhookDelivery")
+	return m.WebhookRepository.AddWebhookDelivery(d)
+}
+
+func (m meteredWebhookRepo) GetWebhookDelivery(deliveryID int64) *WebhookDelivery {
+	defer dbDuration.Since(time.Now(), "GetWebhookDelivery")
+	return m.WebhookRepository.GetWebhookDelivery(deliveryID)
+}
+
+func (m meteredWebhookRepo) ListWebhookDeliveries(filter WebhookDeliveryFilter) []WebhookDelivery {
+	defer dbDuration.Since(time.Now(), "ListWebhookDeliveries")
+	return m.WebhookRepository.ListWebhookDeliveries(filter)
+}
+
+func (m meteredWebhookRepo) DueWebhookDeliveries(now, limit int64) []WebhookDelivery {
+	defer dbDuration.Since(time.Now(), "DueWebhookDeliveries")
+	return m.WebhookRepository.DueWebhookDeliveries(now, limit)
+}
+
+func (m meteredWebhookRepo) UpdateWebhookDelivery(d WebhookDelivery) error {
+	defer dbDuration.Since(time.Now(), "UpdateWebhookDelivery")
+	return m.WebhookRepository.UpdateWebhookDelivery(d)
+}
+
+func (m meteredWebhookRepo) DeleteWebhookDeliveries(createdBefore int64) error {
+	defer dbDuration.Since(time.Now(), "DeleteWebhookDeliveries")
+	return m.WebhookRepository.DeleteWebhookDeliveries(createdBefore)
+}
+
+type meteredChatRepo struct {
+	ChatRepository
+}
+
+func (m meteredChatRepo) AddChatMessage(message ChatMessage) (int64, error) {
+	defer dbDuration.Since(time.Now(), "AddChatMessage")
+	return m.ChatRepository.AddChatMessage(message)
+}
+
+func (m meteredChatRepo) GetChatMessage(messageID int64) *ChatMessage {
+	defer dbDuration.Since(time.Now(), "GetChatMessage")
+	return m.ChatRepository.GetChatMessage(messageID)
+}
+
+func (m meteredChatRepo) ListChatMessages(filter ChatFilter) []ChatMessage {
+	defer dbDuration.Since(time.Now(), "ListChatMessages")
+	return m.ChatRepository.ListChatMessages(filter)
+}
+
+func (m meteredChatRepo) DeleteChatMessage(messageID int64) error {
+	defer dbDuration.Since(time.Now(), "DeleteChatMessage")
+	return m.ChatRepository.DeleteChatMessage(messageID)
+}
+
+func (m meteredChatRepo) DeleteChatMessages(createdBefore int64) error {
+	defer dbDuration.Since(time.Now(), "DeleteChatMessages")
+	return m.ChatRepository.DeleteChatMessages(createdBefore)
+}
+
+func (m meteredChatRepo) SetChatMute(mute ChatMute) error {
+	defer dbDuration.Since(time.Now(), "SetChatMute")
+	return m.ChatRepository.SetChatMute(mute)
+}
+
+func (m meteredChatRepo) GetChatMute(userID string) *ChatMute {
+	defer dbDuration.Since(time.Now(), "GetChatMute")
+	return m.ChatRepository.GetChatMute(userID)
+}
+
+func (m meteredChatRepo) ListChatMutes(now int64) []ChatMute {
+	defer dbDuration.Since(time.Now(), "ListChatMutes")
+	return m.ChatRepository.ListChatMutes(now)
+}
+
+func (m meteredChatRepo) DeleteChatMute(userID string) error {
+	defer dbDuration.Since(time.Now(), "DeleteChatMute")
+	return m.ChatRepository.DeleteChatMute(userID)
+}
+
+func (m meteredChatRepo) DeleteExpiredChatMutes(now int64) error {
+	defer dbDuration.Since(time.Now(), "DeleteExpiredChatMutes")
+	return m.ChatRepository.DeleteExpiredChatMutes(now)
+}
@@ -1,15 +1,19 @@
 package main
 
 import (
+	"database/sql"
 	"log"
 	"strings"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
 )
 
 type PostgresRepository struct {
-	db *sqlx.DB
+	// primary, takes all writes and reads which must see them
+	db       *sqlx.DB
+	replicas *pgReplicaPool
 }
 
 func (r *PostgresRepository) CreateOrUpdateUser(user User) error {
@@ -25,6 +29,7 @@ func (r *PostgresRepository) CreateOrUpdateUser(user User) error {
 	if err != nil {
 		log.Fatal(err)
 	}
+	r.replicas.wrote(user.UserID)
 	return err
 }
 
@@ -35,7 +40,10 @@ func (r *PostgresRepository) GetUserByID(userID string) *User {
 	  `
 
 	user := &User{}
-	err := r.db.QueryRow(query, userID).Scan(&user.UserID, &user.FirstName, &user.LastName, &user.Email)
+	err := r.readQueryRow(userID, query, userID).Scan(&user.UserID, &user.FirstName, &user.LastName, &user.Email)
+	if err == sql.ErrNoRows {
+		return nil
+	}
 	if err != nil {
 		log.Fatal("failed to find user", err)
 	}
@@ -43,51 +51,150 @@ func (r *PostgresRepository) GetUserByID(userID string) *User {
 	return user
 }
 
+func (r *PostgresRepository) AllUsers() []User {
+	query := `select user_id, firstname, lastname, email from users order by user_id;`
+
+	rows, err := r.db.Query(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	users := make([]User, 0)
+	for rows.Next() {
+		u := User{}
+		if err = rows.Scan(&u.UserID, &u.FirstName, &u.LastName, &u.Email); err != nil {
+			log.Fatal(err)
+		}
+		users = append(users, u)
+	}
+	return users
+}
+
 func (r *PostgresRepository) InsertLink(link Link) int64 {
 	query := `
 	  insert into links (url, video_id, title, channel_name, duration,
-						submitted_by, dedicated_to, is_expired, created_at)
-	  values ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+						submitted_by, dedicated_to, is_expired, state, state_reason, created_at, played_at)
+	  values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
       returning link_id;
     `
 
 	var linkId int64
 	err := r.db.QueryRow(query, link.URL, link.VideoID, link.Title, link.ChannelName,
-		link.Duration, link.SubmittedBy, link.DedicatedTo, link.IsExpired, link.CreatedAt,
+		link.Duration, link.SubmittedBy, link.DedicatedTo, link.IsExpired, link.State, link.StateReason,
+		link.CreatedAt, link.PlayedAt,
 	).Scan(&linkId)
 
 	if err != nil {
 		log.Fatal(err)
 	}
+	r.replicas.wrote(link.SubmittedBy)
 	return linkId
 }
 
 func (r *PostgresRepository) GetLinkByID(id int64) (*Link, error) {
 	query := `
 	  select l.link_id, l.video_id, l.url, l.title, l.channel_name, l.duration,
-		l.submitted_by, l.dedicated_to, l.is_expired, l.created_at,
+		l.submitted_by, l.dedicated_to, l.is_expired, l.state, l.state_reason, l.created_at, coalesce(l.played_at, 0),
 		(select coalesce(sum(score), 0) from votes as v where v.link_id = l.link_id)
 	  from links as l
 	  where l.link_id=$1;`
 
 	l := Link{LinkID: id}
 	err := r.db.QueryRow(query, l.LinkID).Scan(&l.LinkID, &l.VideoID, &l.URL, &l.Title, &l.ChannelName,
-		&l.Duration, &l.SubmittedBy, &l.DedicatedTo, &l.IsExpired, &l.CreatedAt, &l.TotalVotes)
+		&l.Duration, &l.SubmittedBy, &l.DedicatedTo, &l.IsExpired, &l.State, &l.StateReason, &l.CreatedAt, &l.PlayedAt, &l.TotalVotes)
 
 	return &l, err
 }
 
+func (r *PostgresRepository) AllLinks() []Link {
+	query := `
+	  select l.link_id, l.video_id, l.url, l.title, l.channel_name, l.duration,
+		l.submitted_by, l.dedicated_to, l.is_expired, l.state, l.state_reason, l.created_at, coalesce(l.played_at, 0)
+	  from links as l
+	  union all
+	  select a.link_id, a.video_id, a.url, a.title, a.channel_name, a.duration,
+		a.submitted_by, a.dedicated_to, true, a.state, a.state_reason, a.created_at, coalesce(a.played_at, 0)
+	  from links_archive as a
+	  order by 1;`
+
+	rows, err := r.db.Query(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	links := make([]Link, 0)
+	for rows.Next() {
+		l := Link{}
+		err = rows.Scan(&l.LinkID, &l.VideoID, &l.URL, &l.Title, &l.ChannelName,
+			&l.Duration, &l.SubmittedBy, &l.DedicatedTo, &l.IsExpired, &l.State, &l.StateReason, &l.CreatedAt,
+			&l.PlayedAt)
+		if err != nil {
+			log.Fatal(err)
+		}
+		links = append(links, l)
+	}
+	return links
+}
+
+// FindLink looks up a link by its natural key, which stays the same
+// when a link is moved between databases and gets a new link_id
+func (r *PostgresRepository) FindLink(videoID, submittedBy string, createdAt int64) *Link {
+	query := `
+	  select link_id from links
+	  where video_id=$1 and submitted_by=$2 and created_at=$3
+	  order by link_id
+	  limit 1;`
+
+	var linkID int64
+	err := r.db.QueryRow(query, videoID, submittedBy, createdAt).Scan(&linkID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	l, err := r.GetLinkByID(linkID)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return l
+}
+
+func (r *PostgresRepository) FindArchivedLink(videoID, submittedBy string, createdAt int64) *Link {
+	query := `
+	  select link_id, video_id, url, title, channel_name, duration,
+		submitted_by, dedicated_to, state, state_reason, created_at, coalesce(played_at, 0), total_votes
+	  from links_archive
+	  where video_id=$1 and submitted_by=$2 and created_at=$3
+	  order by link_id
+	  limit 1;`
+
+	l := Link{IsExpired: true}
+	err := r.db.QueryRow(query, videoID, submittedBy, createdAt).Scan(&l.LinkID, &l.VideoID, &l.URL, &l.Title,
+		&l.ChannelName, &l.Duration, &l.SubmittedBy, &l.DedicatedTo, &l.State, &l.StateReason, &l.CreatedAt,
+		&l.PlayedAt, &l.TotalVotes)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return &l
+}
+
 func (r *PostgresRepository) GetLinksByUser(userID string) []Link {
 	query := `
 	  select l.link_id, l.video_id, l.url, l.title, l.channel_name, l.duration,
-		l.submitted_by, l.dedicated_to, l.is_expired, l.created_at,
+		l.submitted_by, l.dedicated_to, l.is_expired, l.state, l.state_reason, l.created_at,
 		(select coalesce(sum(score), 0) from votes as v1 where v1.link_id = l.link_id),
 		(select coalesce(sum(score), 0) from votes as v2 where v2.link_id = l.link_id and v2.user_id = l.submitted_by)
 	  from links as l
       where l.is_expired=false and l.submitted_by=$1;
     `
 
-	rows, err := r.db.Query(query, userID)
+	rows, err := r.readQuery(userID, query, userID)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -96,7 +203,7 @@ func (r *PostgresRepository) GetLinksByUser(userID string) []Link {
 	for rows.Next() {
 		l := Link{}
 		err = rows.Scan(&l.LinkID, &l.VideoID, &l.URL, &l.Title, &l.ChannelName,
-			&l.Duration, &l.SubmittedBy, &l.DedicatedTo, &l.IsExpired, &l.CreatedAt,
+			&l.Duration, &l.SubmittedBy, &l.DedicatedTo, &l.IsExpired, &l.State, &l.StateReason, &l.CreatedAt,
 			&l.TotalVotes, &l.MyVote)
 		if err != nil {
 			log.Fatal(err)
@@ -111,11 +218,13 @@ func (r *PostgresRepository) UpdateLink(link Link) error {
 	query := `
 	  update links
 	  set url=$1, title=$2, channel_name=$3, duration=$4,
-		submitted_by=$5, dedicated_to=$6, is_expired=$7, created_at=$8
-	  where link_id=$9;`
+		submitted_by=$5, dedicated_to=$6, is_expired=$7, state=$8, state_reason=$9,
+		created_at=$10, played_at=$11
+	  where link_id=$12;`
 
 	_, err := r.db.Exec(query, link.URL, link.Title, link.ChannelName, link.Duration,
-		link.SubmittedBy, link.DedicatedTo, link.IsExpired, link.CreatedAt, link.LinkID)
+		link.SubmittedBy, link.DedicatedTo, link.IsExpired, link.State, link.StateReason,
+		link.CreatedAt, link.PlayedAt, link.LinkID)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -123,13 +232,31 @@ func (r *PostgresRepository) UpdateLink(link Link) error {
 	return nil
 }
 
+func (r *PostgresRepository) UpdateLinkIf(link Link, state LinkState) (bool, error) {
+	query := `
+	  update links
+	  set url=$1, title=$2, channel_name=$3, duration=$4,
+		submitted_by=$5, dedicated_to=$6, is_expired=$7, state=$8, state_reason=$9,
+		created_at=$10, played_at=$11
+	  where link_id=$12 and state=$13;`
+
+	res, err := r.db.Exec(query, link.URL, link.Title, link.ChannelName, link.Duration,
+		link.SubmittedBy, link.DedicatedTo, link.IsExpired, link.State, link.StateReason,
+		link.CreatedAt, link.PlayedAt, link.LinkID, state)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
 func (r *PostgresRepository) GetAllLinks(limit int64) []Link {
 	query := `
 	  select l.link_id, l.video_id, l.url, l.title, l.channel_name, l.duration,
-		l.submitted_by, l.dedicated_to, l.is_expired, l.created_at,
+		l.submitted_by, l.dedicated_to, l.is_expired, l.state, l.state_reason, l.created_at,
 		(select coalesce(sum(score), 0) from votes as v where v.link_id = l.link_id)
 	  from links as l
-      where l.is_expired=false
+      where l.state='queued'
       limit $1;`
 
 	rows, err := r.db.Query(query, limit)
@@ -142,7 +269,7 @@ func (r *PostgresRepository) GetAllLinks(limit int64) []Link {
 	for rows.Next() {
 		l := Link{}
 		err = rows.Scan(&l.LinkID, &l.VideoID, &l.URL, &l.Title, &l.ChannelName,
-			&l.Duration, &l.SubmittedBy, &l.DedicatedTo, &l.IsExpired, &l.CreatedAt,
+			&l.Duration, &l.SubmittedBy, &l.DedicatedTo, &l.IsExpired, &l.State, &l.StateReason, &l.CreatedAt,
 			&l.TotalVotes)
 		if err != nil {
 			log.Fatal(err)
@@ -153,6 +280,33 @@ func (r *PostgresRepository) GetAllLinks(limit int64) []Link {
 	return links
 }
 
+func (r *PostgresRepository) ListLinks(filter LinkFilter) (*LinkPage, error) {
+	query, args, err := buildLinkListQuery(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := r.readQuery("", r.db.Rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := make([]Link, 0)
+	for rows.Next() {
+		l := Link{}
+		err = rows.Scan(&l.LinkID, &l.VideoID, &l.URL, &l.Title, &l.ChannelName,
+			&l.Duration, &l.SubmittedBy, &l.DedicatedTo, &l.IsExpired, &l.State, &l.StateReason, &l.CreatedAt,
+			&l.PlayedAt, &l.TotalVotes)
+		if err != nil {
+			return nil, err
+		}
+
+		links = append(links, l)
+	}
+	return pageOfLinks(filter, links), rows.Err()
+}
+
 func (r *PostgresRepository) GetVotesForUser(linkIds []int64, userID string) map[int64]int64 {
 	if len(linkIds) == 0 {
 		return make(map[int64]int64)
@@ -162,7 +316,7 @@ func (r *PostgresRepository) GetVotesForUser(linkIds []int64, userID string) map
 		`select link_id, score from votes where user_id=$1 and link_id IN (?);`,
 		userID, linkIds)
 	query = r.db.Rebind(query)
-	rows, err := r.db.Query(query, args...)
+	rows, err := r.readQuery(userID, query, args...)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -189,9 +343,48 @@ func (r *PostgresRepository) MarkVote(linkID int64, userID string, score int64)
 	if err != nil {
 		log.Fatal(err)
 	}
+	r.replicas.wrote(userID)
 	return nil
 }
 
+func (r *PostgresRepository) AllVotes() []Vote {
+	query := `
+	  select link_id, user_id, score from votes
+	  union all
+	  select link_id, user_id, score from votes_archive
+	  order by 1, 2;`
+
+	rows, err := r.db.Query(query)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	votes := make([]Vote, 0)
+	for rows.Next() {
+		v := Vote{}
+		if err = rows.Scan(&v.LinkID, &v.UserID, &v.Score); err != nil {
+			log.Fatal(err)
+		}
+		votes = append(votes, v)
+	}
+	return votes
+}
+
+func (r *PostgresRepository) GetVote(linkID int64, userID string) *Vote {
+	query := `select link_id, user_id, score from votes where link_id=$1 and user_id=$2;`
+
+	v := &Vote{}
+	err := r.db.QueryRow(query, linkID, userID).Scan(&v.LinkID, &v.UserID, &v.Score)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return v
+}
+
 func (r *PostgresRepository) TotalVoteForLinks(linkIDs []int64) map[int64]int64 {
 	var query string
 	if len(linkIDs) > 0 {
@@ -225,74 +418,1077 @@ func (r *PostgresRepository) TotalVoteForLinks(linkIDs []int64) map[int64]int64
 	return result
 }
 
-func (r *PostgresRepository) NewTest(message string) error {
-	query := `INSERT INTO test (message) values ($1)`
-	res, err := r.db.Exec(query, message)
-	naff, _ := res.RowsAffected()
-	log.Println("new test ", naff, " rows affected")
+func (r *PostgresRepository) AppendAudit(e AuditEntry) error {
+	query := `
+	  insert into audit_log (actor, node_id, action, target, before, after, created_at)
+	  values ($1, $2, $3, $4, $5, $6, $7);`
+
+	_, err := r.db.Exec(query, e.Actor, e.NodeID, e.Action, e.Target,
+		string(e.Before), string(e.After), e.CreatedAt)
 	return err
 }
 
-func (r *PostgresRepository) close() {
-	r.db.Close()
+func (r *PostgresRepository) ListAudit(filter AuditFilter) ([]AuditEntry, error) {
+	query, args := buildAuditListQuery(filter)
+	rows, err := r.readQuery("", r.db.Rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanAuditRows(rows)
 }
 
-// func NewPostgresRepository(host, port, user, pass, dbname string) *PostgresRepository {
-func NewPostgresRepository(dbUrl string) *PostgresRepository {
+func (r *PostgresRepository) StaleLinks(createdBefore int64, limit int64) []Link {
+	query := `
+	  select l.link_id, l.video_id, l.url, l.title, l.channel_name, l.duration,
+		l.submitted_by, l.dedicated_to, l.is_expired, l.state, l.state_reason, l.created_at
+	  from links as l
+	  where l.state in ('pending', 'queued') and l.created_at < $1
+	  order by l.created_at, l.link_id
+	  limit $2;`
 
-	// psqlInfo := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-	// 	host, port, user, pass, dbname)
+	rows, err := r.db.Query(query, createdBefore, limit)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
 
-	// db, err := sqlx.Open("postgres", psqlInfo)
-	db, err := sqlx.Open("postgres", dbUrl)
+	links := make([]Link, 0)
+	for rows.Next() {
+		l := Link{}
+		err = rows.Scan(&l.LinkID, &l.VideoID, &l.URL, &l.Title, &l.ChannelName,
+			&l.Duration, &l.SubmittedBy, &l.DedicatedTo, &l.IsExpired, &l.State, &l.StateReason, &l.CreatedAt)
+		if err != nil {
+			log.Fatal(err)
+		}
+		links = append(links, l)
+	}
+	return links
+}
+
+func (r *PostgresRepository) ArchivePlayedLinks(playedBefore int64) (int64, int64, error) {
+	tx, err := r.db.Begin()
 	if err != nil {
-		return nil
+		return 0, 0, err
 	}
-	log.Println("connected to db. creating new tables")
+	defer tx.Rollback()
 
-	// make sure the required tables exist
-	// if not then create them
-	testTable := `
-	  create table if not exists test (
-		message text
-	  );`
-	usersTable := `
-	  create table if not exists users (
-		user_id text primary key,
-		firstname text,
-		lastname text,
-		email text
-	  );`
+	archivedAt := time.Now().Unix()
+	played := `select link_id from links where state = 'played' and played_at > 0 and played_at < $1`
 
-	linksTable := `
-		create table if not exists links (
-		link_id serial primary key,
-		url text not null,
-		video_id text not null,
-		title text,
-		channel_name text,
-		duration int,
-		submitted_by text,
-		dedicated_to text,
-		is_expired bool,
-		created_at int
-	  );`
-	votesTable := `
-		create table if not exists votes (
-		link_id integer not null,
-		user_id text not null,
-		score integer not null,
-		constraint unq UNIQUE(link_id, user_id)
-	  );`
+	res, err := tx.Exec(`
+	  insert into links_archive (link_id, url, video_id, title, channel_name, duration,
+		submitted_by, dedicated_to, state, state_reason, created_at, played_at, total_votes, archived_at)
+	  select l.link_id, l.url, l.video_id, l.title, l.channel_name, l.duration,
+		l.submitted_by, l.dedicated_to, l.state, l.state_reason, l.created_at, l.played_at,
+		(select coalesce(sum(score), 0) from votes as v where v.link_id = l.link_id), $2
+	  from links as l
+	  where l.link_id in (`+played+`)
+	  on conflict (link_id) do nothing;`, playedBefore, archivedAt)
+	if err != nil {
+		return 0, 0, err
+	}
+	nlinks, _ := res.RowsAffected()
 
-	tables := []string{testTable, usersTable, linksTable, votesTable}
+	res, err = tx.Exec(`
+	  insert into votes_archive (link_id, user_id, score, archived_at)
+	  select link_id, user_id, score, $2 from votes
+	  where link_id in (`+played+`)
+	  on conflict (link_id, user_id) do nothing;`, playedBefore, archivedAt)
+	if err != nil {
+		return 0, 0, err
+	}
+	nvotes, _ := res.RowsAffected()
 
-	for _, t := range tables {
-		if _, err = db.Exec(t); err != nil {
-			log.Fatal("failed to exec stmt ", err)
+	if _, err = tx.Exec(`delete from votes where link_id in (`+played+`);`, playedBefore); err != nil {
+		return 0, 0, err
+	}
+	if _, err = tx.Exec(`delete from links where link_id in (`+played+`);`, playedBefore); err != nil {
+		return 0, 0, err
+	}
+	return nlinks, nvotes, tx.Commit()
+}
+
+func (r *PostgresRepository) AddNotification(n Notification) error {
+	query := `
+	  insert into notifications (user_id, kind, link_id, message, is_read, created_at)
+	  values ($1, $2, $3, $4, $5, $6);`
+
+	_, err := r.db.Exec(query, n.UserID, n.Kind, n.LinkID, n.Message, n.Read, n.CreatedAt)
+	r.replicas.wrote(n.UserID)
+	return err
+}
+
+func (r *PostgresRepository) GetNotifications(userID string, limit int64) []Notification {
+	query := `
+	  select notification_id, user_id, kind, link_id, message, is_read, created_at
+	  from notifications
+	  where user_id=$1
+	  order by notification_id desc
+	  limit $2;`
+
+	rows, err := r.readQuery(userID, query, userID, limit)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	notifications := make([]Notification, 0)
+	for rows.Next() {
+		n := Notification{}
+		err = rows.Scan(&n.NotificationID, &n.UserID, &n.Kind, &n.LinkID, &n.Message, &n.Read, &n.CreatedAt)
+		if err != nil {
+			log.Fatal(err)
 		}
+		notifications = append(notifications, n)
+	}
+	return notifications
+}
+
+func (r *PostgresRepository) MarkNotificationsRead(userID string, upTo int64) error {
+	query := `update notifications set is_read=true where user_id=$1 and notification_id <= $2;`
+
+	_, err := r.db.Exec(query, userID, upTo)
+	r.replicas.wrote(userID)
+	return err
+}
+
+func (r *PostgresRepository) GetRoles(userID string) []RoleGrant {
+	return r.queryRoleGrants(`
+	  select user_id, role, granted_by, granted_at from user_roles
+	  where user_id=$1 order by role;`, userID)
+}
+
+func (r *PostgresRepository) ListRoleHolders(role string) []RoleGrant {
+	return r.queryRoleGrants(`
+	  select user_id, role, granted_by, granted_at from user_roles
+	  where role=$1 order by user_id;`, role)
+}
+
+// roles are read from the primary, a revoked role must not linger on a replica
+func (r *PostgresRepository) queryRoleGrants(query string, arg string) []RoleGrant {
+	rows, err := r.db.Query(query, arg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	grants := make([]RoleGrant, 0)
+	for rows.Next() {
+		g := RoleGrant{}
+		if err = rows.Scan(&g.UserID, &g.Role, &g.GrantedBy, &g.GrantedAt); err != nil {
+			log.Fatal(err)
+		}
+		grants = append(grants, g)
+	}
+	return grants
+}
+
+func (r *PostgresRepository) GrantRole(g RoleGrant) error {
+	query := `
+	  insert into user_roles (user_id, role, granted_by, granted_at)
+	  values ($1, $2, $3, $4)
+	  on conflict (user_id, role) do nothing;`
+
+	_, err := r.db.Exec(query, g.UserID, g.Role, g.GrantedBy, g.GrantedAt)
+	return err
+}
+
+func (r *PostgresRepository) RevokeRole(userID, role string) error {
+	_, err := r.db.Exec(`delete from user_roles where user_id=$1 and role=$2;`, userID, role)
+	return err
+}
+
+func (r *PostgresRepository) InsertRefreshToken(t RefreshToken) error {
+	query := `
+	  insert into refresh_tokens (token_hash, user_id, session_id, issued_at, expires_at, used, revoked)
+	  values ($1, $2, $3, $4, $5, $6, $7);`
+
+	_, err := r.db.Exec(query, t.TokenHash, t.UserID, t.SessionID, t.IssuedAt, t.ExpiresAt, t.Used, t.Revoked)
+	return err
+}
+
+func (r *PostgresRepository) GetRefreshToken(tokenHash string) *RefreshToken {
+	query := `
+	  select token_hash, user_id, session_id, issued_at, expires_at, used, revoked
+	  from refresh_tokens where token_hash=$1;`
+
+	t := &RefreshToken{}
+	err := r.db.QueryRow(query, tokenHash).Scan(&t.TokenHash, &t.UserID, &t.SessionID,
+		&t.IssuedAt, &t.ExpiresAt, &t.Used, &t.Revoked)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return t
+}
+
+func (r *PostgresRepository) UseRefreshToken(tokenHash string) (bool, error) {
+	res, err := r.db.Exec(`update refresh_tokens set used=true where token_hash=$1 and used=false;`, tokenHash)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (r *PostgresRepository) RevokeRefreshTokens(userID, sessionID string) error {
+	var err error
+	if sessionID == "" {
+		_, err = r.db.Exec(`update refresh_tokens set revoked=true where user_id=$1;`, userID)
+	} else {
+		_, err = r.db.Exec(`update refresh_tokens set revoked=true where user_id=$1 and session_id=$2;`,
+			userID, sessionID)
+	}
+	return err
+}
+
+func (r *PostgresRepository) AddRevocation(rev Revocation) error {
+	query := `
+	  insert into revocations (session_id, user_id, revoked_at, expires_at)
+	  values ($1, $2, $3, $4);`
+
+	_, err := r.db.Exec(query, rev.SessionID, rev.UserID, rev.RevokedAt, rev.ExpiresAt)
+	return err
+}
+
+func (r *PostgresRepository) ActiveRevocations(now int64) []Revocation {
+	query := `
+	  select session_id, user_id, revoked_at, expires_at
+	  from revocations where expires_at > $1;`
+
+	rows, err := r.db.Query(query, now)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	revocations := make([]Revocation, 0)
+	for rows.Next() {
+		rev := Revocation{}
+		if err = rows.Scan(&rev.SessionID, &rev.UserID, &rev.RevokedAt, &rev.ExpiresAt); err != nil {
+			log.Fatal(err)
+		}
+		revocations = append(revocations, rev)
+	}
+	return revocations
+}
+
+func (r *PostgresRepository) DeleteExpiredTokens(now int64) error {
+	if _, err := r.db.Exec(`delete from refresh_tokens where expires_at <= $1;`, now); err != nil {
+		return err
+	}
+	_, err := r.db.Exec(`delete from revocations where expires_at <= $1;`, now)
+	return err
+}
+
+func (r *PostgresRepository) SetGuestVote(v GuestVote) error {
+	query := `
+	  insert into guest_votes (link_id, user_id, score, created_at)
+	  values ($1, $2, $3, $4)
+	  on conflict(link_id, user_id) do update
+	     set score=excluded.score,
+	         created_at=excluded.created_at;`
+
+	_, err := r.db.Exec(query, v.LinkID, v.UserID, v.Score, v.CreatedAt)
+	return err
+}
+
+func (r *PostgresRepository) GetGuestVote(linkID int64, userID string) *GuestVote {
+	query := `select link_id, user_id, score, created_at from guest_votes where link_id=$1 and user_id=$2;`
+
+	v := &GuestVote{}
+	err := r.db.QueryRow(query, linkID, userID).Scan(&v.LinkID, &v.UserID, &v.Score, &v.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return v
+}
+
+func (r *PostgresRepository) GetGuestVotes(userID string) []GuestVote {
+	query := `select link_id, user_id, score, created_at from guest_votes where user_id=$1 order by link_id;`
+
+	rows, err := r.db.Query(query, userID)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	votes := make([]GuestVote, 0)
+	for rows.Next() {
+		v := GuestVote{}
+		if err = rows.Scan(&v.LinkID, &v.UserID, &v.Score, &v.CreatedAt); err != nil {
+			log.Fatal(err)
+		}
+		votes = append(votes, v)
+	}
+	return votes
+}
+
+func (r *PostgresRepository) GuestVoteTotal(linkID int64) int64 {
+	var total int64
+	err := r.db.QueryRow(`select coalesce(sum(score), 0) from guest_votes where link_id=$1;`, linkID).Scan(&total)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return total
+}
+
+func (r *PostgresRepository) CountGuestVotesSince(userID string, since int64) int64 {
+	var n int64
+	err := r.db.QueryRow(`select count(*) from guest_votes where user_id=$1 and created_at >= $2;`,
+		userID, since).Scan(&n)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return n
+}
+
+func (r *PostgresRepository) DeleteGuestVotes(userID string) error {
+	_, err := r.db.Exec(`delete from guest_votes where user_id=$1;`, userID)
+	return err
+}
+
+// TakeRateTokens locks the bucket rows, so nodes sharing the database share the
+// buckets. They are locked in key order, two requests can't wait on each other.
+func (r *PostgresRepository) TakeRateTokens(buckets map[string]RateRule, now int64) (int64, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	current := make([]RateBucket, 0, len(buckets))
+	for _, key := range rateBucketKeys(buckets) {
+		_, err = tx.Exec(`
+		  insert into rate_buckets (bucket_key, tokens, updated_at) values ($1, $2, $3)
+		  on conflict(bucket_key) do nothing;`, key, float64(buckets[key].Capacity), now)
+		if err != nil {
+			return 0, err
+		}
+		b := RateBucket{Key: key}
+		err = tx.QueryRow(`select tokens, updated_at from rate_buckets where bucket_key=$1 for update;`, key).
+			Scan(&b.Tokens, &b.UpdatedAt)
+		if err != nil {
+			return 0, err
+		}
+		current = append(current, b)
+	}
+	current, wait := takeTokens(current, buckets, now)
+	for _, b := range current {
+		_, err = tx.Exec(`update rate_buckets set tokens=$2, updated_at=$3 where bucket_key=$1;`,
+			b.Key, b.Tokens, b.UpdatedAt)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return wait, tx.Commit()
+}
+
+func (r *PostgresRepository) DeleteIdleRateBuckets(before int64) error {
+	_, err := r.db.Exec(`delete from rate_buckets where updated_at < $1;`, before)
+	return err
+}
+
+func (r *PostgresRepository) GetRateRules() []RateRule {
+	rows, err := r.db.Query(`select endpoint, scope, capacity, period from rate_rules order by endpoint, scope;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	rules := make([]RateRule, 0)
+	for rows.Next() {
+		rule := RateRule{}
+		if err = rows.Scan(&rule.Endpoint, &rule.Scope, &rule.Capacity, &rule.Period); err != nil {
+			log.Fatal(err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+func (r *PostgresRepository) SetRateRule(rule RateRule) error {
+	query := `
+	  insert into rate_rules (endpoint, scope, capacity, period)
+	  values ($1, $2, $3, $4)
+	  on conflict(endpoint, scope) do update
+	     set capacity=excluded.capacity,
+	         period=excluded.period;`
+
+	_, err := r.db.Exec(query, rule.Endpoint, rule.Scope, rule.Capacity, rule.Period)
+	return err
+}
+
+func (r *PostgresRepository) CreateAccessToken(t AccessToken) (int64, error) {
+	query := `
+	  insert into access_tokens (user_id, name, scopes, token_hash, created_at, expires_at)
+	  values ($1, $2, $3, $4, $5, $6)
+	  returning token_id;`
+
+	var tokenID int64
+	err := r.db.QueryRow(query, t.UserID, t.Name, strings.Join(t.Scopes, ","), t.TokenHash,
+		t.CreatedAt, t.ExpiresAt).Scan(&tokenID)
+	return tokenID, err
+}
+
+func (r *PostgresRepository) GetAccessTokenByHash(tokenHash string) *AccessToken {
+	query := `select ` + accessTokenColumns + ` from access_tokens where token_hash=$1;`
+
+	t, err := scanAccessToken(r.db.QueryRow(query, tokenHash))
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return t
+}
+
+func (r *PostgresRepository) ListAccessTokens(userID string) []AccessToken {
+	query := `select ` + accessTokenColumns + ` from access_tokens where user_id=$1 order by token_id;`
+
+	rows, err := r.db.Query(query, userID)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	tokens := make([]AccessToken, 0)
+	for rows.Next() {
+		t, err := scanAccessToken(rows)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tokens = append(tokens, *t)
+	}
+	return tokens
+}
+
+func (r *PostgresRepository) RevokeAccessTokens(userID string, tokenID int64) (int64, error) {
+	var (
+		res sql.Result
+		err error
+	)
+	if tokenID == 0 {
+		res, err = r.db.Exec(`update access_tokens set revoked=true where user_id=$1 and revoked=false;`, userID)
+	} else {
+		res, err = r.db.Exec(`update access_tokens set revoked=true where user_id=$1 and token_id=$2 and revoked=false;`,
+			userID, tokenID)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (r *PostgresRepository) TouchAccessToken(tokenID, usedAt int64) error {
+	_, err := r.db.Exec(`update access_tokens set last_used_at=$2 where token_id=$1;`, tokenID, usedAt)
+	return err
+}
+
+func (r *PostgresRepository) GetIdentity(provider, subject string) *Identity {
+	query := `
+	  select provider, subject, user_id, email, linked_at
+	  from user_identities where provider=$1 and subject=$2;`
+
+	i := &Identity{}
+	err := r.db.QueryRow(query, provider, subject).Scan(&i.Provider, &i.Subject, &i.UserID, &i.Email, &i.LinkedAt)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return i
+}
+
+func (r *PostgresRepository) ListIdentities(userID string) []Identity {
+	query := `
+	  select provider, subject, user_id, email, linked_at
+	  from user_identities where user_id=$1 order by provider, subject;`
+
+	rows, err := r.db.Query(query, userID)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	identities := make([]Identity, 0)
+	for rows.Next() {
+		i := Identity{}
+		if err = rows.Scan(&i.Provider, &i.Subject, &i.UserID, &i.Email, &i.LinkedAt); err != nil {
+			log.Fatal(err)
+		}
+		identities = append(identities, i)
+	}
+	return identities
+}
+
+func (r *PostgresRepository) AddIdentity(i Identity) error {
+	query := `
+	  insert into user_identities (provider, subject, user_id, email, linked_at)
+	  values ($1, $2, $3, $4, $5);`
+
+	_, err := r.db.Exec(query, i.Provider, i.Subject, i.UserID, i.Email, i.LinkedAt)
+	return err
+}
+
+func (r *PostgresRepository) AddSkipVote(linkID int64, userID string, at int64) (bool, error) {
+	query := `
+	  insert into skip_votes (link_id, user_id, created_at)
+	  values ($1, $2, $3)
+	  on conflict(link_id, user_id) do nothing;`
+
+	res, err := r.db.Exec(query, linkID, userID, at)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (r *PostgresRepository) CountSkipVotes(linkID int64) int64 {
+	var n int64
+	err := r.db.QueryRow(`select count(*) from skip_votes where link_id=$1;`, linkID).Scan(&n)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return n
+}
+
+func (r *PostgresRepository) DeleteSkipVotes(linkID int64) error {
+	_, err := r.db.Exec(`delete from skip_votes where link_id=$1;`, linkID)
+	return err
+}
+
+func (r *PostgresRepository) CreateWebhook(w Webhook) (int64, error) {
+	query := `
+	  insert into webhooks (url, events, secret, active, created_by, created_at)
+	  values ($1, $2, $3, $4, $5, $6)
+	  returning webhook_id;`
+
+	var webhookID int64
+	err := r.db.QueryRow(query, w.URL, strings.Join(w.Events, ","), w.Secret, w.Active,
+		w.CreatedBy, w.CreatedAt).Scan(&webhookID)
+	return webhookID, err
+}
+
+func (r *PostgresRepository) GetWebhook(webhookID int64) *Webhook {
+	query := `select ` + webhookColumns + ` from webhooks where webhook_id=$1;`
+
+	w, err := scanWebhook(r.db.QueryRow(query, webhookID))
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return w
+}
+
+func (r *PostgresRepository) ListWebhooks() []Webhook {
+	rows, err := r.db.Query(`select ` + webhookColumns + ` from webhooks order by webhook_id;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	webhooks := make([]Webhook, 0)
+	for rows.Next() {
+		w, err := scanWebhook(rows)
+		if err != nil {
+			log.Fatal(err)
+		}
+		webhooks = append(webhooks, *w)
+	}
+	return webhooks
+}
+
+func (r *PostgresRepository) UpdateWebhook(w Webhook) error {
+	_, err := r.db.Exec(`update webhooks set url=$2, events=$3, active=$4 where webhook_id=$1;`,
+		w.WebhookID, w.URL, strings.Join(w.Events, ","), w.Active)
+	return err
+}
+
+func (r *PostgresRepository) DeleteWebhook(webhookID int64) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(`delete from webhook_deliveries where webhook_id=$1;`, webhookID); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(`delete from webhooks where webhook_id=$1;`, webhookID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *PostgresRepository) AddWebhookDelivery(d WebhookDelivery) (int64, error) {
+	query := `
+	  insert into webhook_deliveries (webhook_id, event, payload, status, next_attempt_at, created_at)
+	  values ($1, $2, $3, $4, $5, $6)
+	  returning delivery_id;`
+
+	var deliveryID int64
+	err := r.db.QueryRow(query, d.WebhookID, d.Event, string(d.Payload), d.Status,
+		d.NextAttemptAt, d.CreatedAt).Scan(&deliveryID)
+	return deliveryID, err
+}
+
+func (r *PostgresRepository) GetWebhookDelivery(deliveryID int64) *WebhookDelivery {
+	query := `select ` + deliveryColumns + ` from webhook_deliveries where delivery_id=$1;`
+
+	d, err := scanWebhookDelivery(r.db.QueryRow(query, deliveryID))
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return d
+}
+
+func (r *PostgresRepository) ListWebhookDeliveries(filter WebhookDeliveryFilter) []WebhookDelivery {
+	query, args := buildDeliveryListQuery(filter)
+	rows, err := r.db.Query(r.db.Rebind(query), args...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return scanWebhookDeliveries(rows)
+}
+
+func (r *PostgresRepository) DueWebhookDeliveries(now, limit int64) []WebhookDelivery {
+	query := `
+	  select ` + deliveryColumns + ` from webhook_deliveries
+	  where status='pending' and next_attempt_at <= $1
+	  order by next_attempt_at, delivery_id
+	  limit $2;`
+
+	rows, err := r.db.Query(query, now, limit)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return scanWebhookDeliveries(rows)
+}
+
+func (r *PostgresRepository) UpdateWebhookDelivery(d WebhookDelivery) error {
+	query := `
+	  update webhook_deliveries
+	  set status=$2, attempts=$3, next_attempt_at=$4, last_attempt_at=$5,
+	      response_code=$6, last_error=$7, delivered_at=$8
+	  where delivery_id=$1;`
+
+	_, err := r.db.Exec(query, d.DeliveryID, d.Status, d.Attempts, d.NextAttemptAt, d.LastAttemptAt,
+		d.ResponseCode, d.LastError, d.DeliveredAt)
+	return err
+}
+
+func (r *PostgresRepository) DeleteWebhookDeliveries(createdBefore int64) error {
+	_, err := r.db.Exec(`delete from webhook_deliveries where status <> 'pending' and created_at < $1;`,
+		createdBefore)
+	return err
+}
+
+func (r *PostgresRepository) AddChatMessage(m ChatMessage) (int64, error) {
+	query := `
+	  insert into chat_messages (link_id, user_id, text, created_at)
+	  values ($1, $2, $3, $4)
+	  returning message_id;`
+
+	var messageID int64
+	err := r.db.QueryRow(query, m.LinkID, m.UserID, m.Text, m.CreatedAt).Scan(&messageID)
+	return messageID, err
+}
+
+func (r *PostgresRepository) GetChatMessage(messageID int64) *ChatMessage {
+	query := `select ` + chatColumns + ` from chat_messages where message_id=$1;`
+
+	m, err := scanChatMessage(r.db.QueryRow(query, messageID))
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return m
+}
+
+func (r *PostgresRepository) ListChatMessages(filter ChatFilter) []ChatMessage {
+	query, args := buildChatListQuery(filter)
+	rows, err := r.db.Query(r.db.Rebind(query), args...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return scanChatMessages(rows)
+}
+
+func (r *PostgresRepository) DeleteChatMessage(messageID int64) error {
+	_, err := r.db.Exec(`delete from chat_messages where message_id=$1;`, messageID)
+	return err
+}
+
+func (r *PostgresRepository) DeleteChatMessages(createdBefore int64) error {
+	_, err := r.db.Exec(`delete from chat_messages where created_at < $1;`, createdBefore)
+	return err
+}
+
+func (r *PostgresRepository) SetChatMute(m ChatMute) error {
+	query := `
+	  insert into chat_mutes (user_id, muted_by, reason, muted_at, expires_at)
+	  values ($1, $2, $3, $4, $5)
+	  on conflict(user_id) do update
+	     set muted_by=excluded.muted_by,
+	         reason=excluded.reason,
+	         muted_at=excluded.muted_at,
+	         expires_at=excluded.expires_at;`
+
+	_, err := r.db.Exec(query, m.UserID, m.MutedBy, m.Reason, m.MutedAt, m.ExpiresAt)
+	return err
+}
+
+func (r *PostgresRepository) GetChatMute(userID string) *ChatMute {
+	query := `select ` + chatMuteColumns + ` from chat_mutes where user_id=$1;`
+
+	m, err := scanChatMute(r.db.QueryRow(query, userID))
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return m
+}
+
+func (r *PostgresRepository) ListChatMutes(now int64) []ChatMute {
+	query := `
+	  select ` + chatMuteColumns + ` from chat_mutes
+	  where expires_at = 0 or expires_at > $1
+	  order by muted_at, user_id;`
+
+	rows, err := r.db.Query(query, now)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return scanChatMutes(rows)
+}
+
+func (r *PostgresRepository) DeleteChatMute(userID string) error {
+	_, err := r.db.Exec(`delete from chat_mutes where user_id=$1;`, userID)
+	return err
+}
+
+func (r *PostgresRepository) DeleteExpiredChatMutes(now int64) error {
+	_, err := r.db.Exec(`delete from chat_mutes where expires_at > 0 and expires_at <= $1;`, now)
+	return err
+}
+
+func (r *PostgresRepository) NewTest(message string) error {
+	query := `INSERT INTO test (message) values ($1)`
+	res, err := r.db.Exec(query, message)
+	naff, _ := res.RowsAffected()
+	log.Println("new test ", naff, " rows affected")
+	return err
+}
+
+func (r *PostgresRepository) close() {
+	r.replicas.close()
+	r.db.Close()
+}
+
+// func NewPostgresRepository(host, port, user, pass, dbname string) *PostgresRepository {
+// replicaUrls may be empty, in which case every query goes to dbUrl
+func NewPostgresRepository(dbUrl string, replicaUrls []string) *PostgresRepository {
+
+	// psqlInfo := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+	// 	host, port, user, pass, dbname)
+
+	// db, err := sqlx.Open("postgres", psqlInfo)
+	db, err := sqlx.Open("postgres", dbUrl)
+	if err != nil {
+		return nil
+	}
+	log.Println("connected to db. creating new tables")
+
+	// make sure the required tables exist
+	// if not then create them
+	testTable := `
+	  create table if not exists test (
+		message text
+	  );`
+	usersTable := `
+	  create table if not exists users (
+		user_id text primary key,
+		firstname text,
+		lastname text,
+		email text
+	  );`
+
+	linksTable := `
+		create table if not exists links (
+		link_id serial primary key,
+		url text not null,
+		video_id text not null,
+		title text,
+		channel_name text,
+		duration int,
+		submitted_by text,
+		dedicated_to text,
+		is_expired bool,
+		state text not null default 'queued',
+		state_reason text not null default '',
+		created_at int,
+		played_at int default 0
+	  );`
+	votesTable := `
+		create table if not exists votes (
+		link_id integer not null,
+		user_id text not null,
+		score integer not null,
+		constraint unq UNIQUE(link_id, user_id)
+	  );`
+
+	auditTable := `
+		create table if not exists audit_log (
+		audit_id bigserial primary key,
+		actor text not null,
+		node_id text not null,
+		action text not null,
+		target text not null,
+		before text not null,
+		after text not null,
+		created_at bigint not null
+	  );`
+	// played links and their votes end up here once they are old enough
+	linksArchiveTable := `
+		create table if not exists links_archive (
+		link_id integer primary key,
+		url text not null,
+		video_id text not null,
+		title text,
+		channel_name text,
+		duration int,
+		submitted_by text,
+		dedicated_to text,
+		state text not null,
+		state_reason text not null,
+		created_at int,
+		played_at int,
+		total_votes int not null,
+		archived_at bigint not null
+	  );`
+	votesArchiveTable := `
+		create table if not exists votes_archive (
+		link_id integer not null,
+		user_id text not null,
+		score integer not null,
+		archived_at bigint not null,
+		constraint votes_archive_unq UNIQUE(link_id, user_id)
+	  );`
+
+	notificationsTable := `
+		create table if not exists notifications (
+		notification_id bigserial primary key,
+		user_id text not null,
+		kind text not null,
+		link_id integer not null default 0,
+		message text not null,
+		is_read bool not null default false,
+		created_at bigint not null
+	  );`
+
+	rolesTable := `
+		create table if not exists user_roles (
+		user_id text not null,
+		role text not null,
+		granted_by text not null,
+		granted_at bigint not null,
+		primary key (user_id, role)
+	  );`
+
+	// refresh tokens are stored hashed
+	refreshTokensTable := `
+		create table if not exists refresh_tokens (
+		token_hash text primary key,
+		user_id text not null,
+		session_id text not null,
+		issued_at bigint not null,
+		expires_at bigint not null,
+		used bool not null default false,
+		revoked bool not null default false
+	  );`
+	revocationsTable := `
+		create table if not exists revocations (
+		revocation_id bigserial primary key,
+		session_id text not null default '',
+		user_id text not null,
+		revoked_at bigint not null,
+		expires_at bigint not null
+	  );`
+	guestVotesTable := `
+		create table if not exists guest_votes (
+		link_id integer not null,
+		user_id text not null,
+		score integer not null,
+		created_at bigint not null,
+		primary key (link_id, user_id)
+	  );`
+	// personal access tokens are stored hashed, scopes are comma separated
+	accessTokensTable := `
+		create table if not exists access_tokens (
+		token_id bigserial primary key,
+		user_id text not null,
+		name text not null,
+		scopes text not null,
+		token_hash text not null unique,
+		created_at bigint not null,
+		expires_at bigint not null default 0,
+		last_used_at bigint not null default 0,
+		revoked bool not null default false
+	  );`
+	// the secret signs deliveries so it is kept as is, events are comma separated
+	webhooksTable := `
+		create table if not exists webhooks (
+		webhook_id bigserial primary key,
+		url text not null,
+		events text not null,
+		secret text not null,
+		active bool not null default true,
+		created_by text not null,
+		created_at bigint not null
+	  );`
+	webhookDeliveriesTable := `
+		create table if not exists webhook_deliveries (
+		delivery_id bigserial primary key,
+		webhook_id bigint not null,
+		event text not null,
+		payload text not null,
+		status text not null,
+		attempts int not null default 0,
+		next_attempt_at bigint not null,
+		last_attempt_at bigint not null default 0,
+		response_code int not null default 0,
+		last_error text not null default '',
+		created_at bigint not null,
+		delivered_at bigint not null default 0
+	  );`
+	chatMessagesTable := `
+		create table if not exists chat_messages (
+		message_id bigserial primary key,
+		link_id integer not null,
+		user_id text not null,
+		text text not null,
+		created_at bigint not null
+	  );`
+	// expires_at is 0 for users muted until unmuted
+	chatMutesTable := `
+		create table if not exists chat_mutes (
+		user_id text primary key,
+		muted_by text not null,
+		reason text not null default '',
+		muted_at bigint not null,
+		expires_at bigint not null default 0
+	  );`
+	skipVotesTable := `
+		create table if not exists skip_votes (
+		link_id integer not null,
+		user_id text not null,
+		created_at bigint not null,
+		primary key (link_id, user_id)
+	  );`
+	identitiesTable := `
+		create table if not exists user_identities (
+		provider text not null,
+		subject text not null,
+		user_id text not null,
+		email text not null default '',
+		linked_at bigint not null,
+		primary key (provider, subject)
+	  );`
+	rateRulesTable := `
+		create table if not exists rate_rules (
+		endpoint text not null,
+		scope text not null,
+		capacity bigint not null,
+		period bigint not null,
+		primary key (endpoint, scope)
+	  );`
+	rateBucketsTable := `
+		create table if not exists rate_buckets (
+		bucket_key text primary key,
+		tokens double precision not null,
+		updated_at bigint not null
+	  );`
+
+	// the audit log is append-only
+	auditRules := []string{
+		`create or replace rule audit_log_no_update as on update to audit_log do instead nothing;`,
+		`create or replace rule audit_log_no_delete as on delete to audit_log do instead nothing;`,
+	}
+
+	// columns added after the first release
+	migrations := []string{
+		`alter table links add column if not exists played_at int default 0;`,
+		`alter table links add column if not exists state text not null default 'queued';`,
+		`alter table links add column if not exists state_reason text not null default '';`,
+		// links from before states existed only knew is_expired
+		`update links set state = case when played_at > 0 then 'played' else 'expired' end
+		  where is_expired = true and state = 'queued';`,
+	}
+
+	// indexes backing the link listing API
+	indexes := []string{
+		`create index if not exists links_submitted_by_idx on links (submitted_by, created_at, link_id);`,
+		`create index if not exists links_channel_name_idx on links (channel_name, created_at, link_id);`,
+		`create index if not exists links_is_expired_idx on links (is_expired, created_at, link_id);`,
+		`create index if not exists links_created_at_idx on links (created_at, link_id);`,
+		`create index if not exists links_state_idx on links (state, created_at, link_id);`,
+		`create index if not exists links_played_at_idx on links (state, played_at);`,
+		`create index if not exists votes_link_id_idx on votes (link_id);`,
+		`create index if not exists audit_log_actor_idx on audit_log (actor, audit_id);`,
+		`create index if not exists audit_log_action_idx on audit_log (action, audit_id);`,
+		`create index if not exists audit_log_target_idx on audit_log (target, audit_id);`,
+		`create index if not exists audit_log_created_at_idx on audit_log (created_at);`,
+		`create index if not exists links_archive_played_at_idx on links_archive (played_at);`,
+		`create index if not exists notifications_user_id_idx on notifications (user_id, notification_id);`,
+		`create index if not exists user_roles_role_idx on user_roles (role, user_id);`,
+		`create index if not exists refresh_tokens_user_id_idx on refresh_tokens (user_id, session_id);`,
+		`create index if not exists revocations_expires_at_idx on revocations (expires_at);`,
+		`create index if not exists guest_votes_user_id_idx on guest_votes (user_id, created_at);`,
+		`create index if not exists rate_buckets_updated_at_idx on rate_buckets (updated_at);`,
+		`create index if not exists access_tokens_user_id_idx on access_tokens (user_id, token_id);`,
+		`create index if not exists user_identities_user_id_idx on user_identities (user_id);`,
+		`create index if not exists webhook_deliveries_due_idx on webhook_deliveries (status, next_attempt_at);`,
+		`create index if not exists webhook_deliveries_webhook_id_idx on webhook_deliveries (webhook_id, delivery_id);`,
+		`create index if not exists chat_messages_link_id_idx on chat_messages (link_id, message_id);`,
+		`create index if not exists chat_messages_created_at_idx on chat_messages (created_at);`,
+	}
+
+	tables := []string{testTable, usersTable, linksTable, votesTable, auditTable,
+		linksArchiveTable, votesArchiveTable, notificationsTable, rolesTable,
+		refreshTokensTable, revocationsTable, guestVotesTable, rateRulesTable, rateBucketsTable,
+		accessTokensTable, identitiesTable, skipVotesTable, webhooksTable, webhookDeliveriesTable,
+		chatMessagesTable, chatMutesTable}
+	tables = append(tables, auditRules...)
+	tables = append(tables, migrations...)
+	tables = append(tables, indexes...)
+
+	for _, t := range tables {
+		if _, err = db.Exec(t); err != nil {
+			log.Fatal("failed to exec stmt ", err)
+		}
+	}
+	// check for possible errors and traps
+	log.Println("Connected to database", db)
+	return &PostgresRepository{
+		db:       db,
+		replicas: newPgReplicaPool(replicaUrls),
 	}
-	// check for possible errors and traps
-	log.Println("Connected to database", db)
-	return &PostgresRepository{db: db}
 }
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -44,6 +45,9 @@ func (r *SQLiteRepository) GetUserByID(userID string) *User {
 	user := &User{}
 	err = stmt.QueryRow(userID).Scan(&user.UserID, &user.FirstName, &user.LastName, &user.Email)
 	defer stmt.Close()
+	if err == sql.ErrNoRows {
+		return nil
+	}
 	if err != nil {
 		log.Fatal("failed to find user", err)
 	}
@@ -51,11 +55,29 @@ func (r *SQLiteRepository) GetUserByID(userID string) *User {
 	return user
 }
 
+func (r *SQLiteRepository) AllUsers() []User {
+	rows, err := r.db.Query(`select user_id, firstname, lastname, email from users order by user_id`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	users := make([]User, 0)
+	for rows.Next() {
+		u := User{}
+		if err = rows.Scan(&u.UserID, &u.FirstName, &u.LastName, &u.Email); err != nil {
+			log.Fatal(err)
+		}
+		users = append(users, u)
+	}
+	return users
+}
+
 func (r *SQLiteRepository) InsertLink(link Link) int64 {
 	stmt, err := r.db.Prepare(`
 	  insert into links (url, video_id, title, channel_name, duration,
-						submitted_by, dedicated_to, is_expired, created_at)
-	  values (?, ?, ?, ?, ?, ?, ?, ?, ?)
+						submitted_by, dedicated_to, is_expired, state, state_reason, created_at, played_at)
+	  values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`)
 	if err != nil {
 		log.Fatal(err)
@@ -63,7 +85,8 @@ func (r *SQLiteRepository) InsertLink(link Link) int64 {
 	defer stmt.Close()
 
 	res, err := stmt.Exec(link.URL, link.VideoID, link.Title, link.ChannelName, link.Duration,
-		link.SubmittedBy, link.DedicatedTo, link.IsExpired, link.CreatedAt)
+		link.SubmittedBy, link.DedicatedTo, link.IsExpired, link.State, link.StateReason,
+		link.CreatedAt, link.PlayedAt)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -75,7 +98,7 @@ func (r *SQLiteRepository) InsertLink(link Link) int64 {
 func (r *SQLiteRepository) GetLinkByID(id int64) (*Link, error) {
 	stmt, err := r.db.Prepare(`
 	  select l.link_id, l.video_id, l.url, l.title, l.channel_name, l.duration,
-		l.submitted_by, l.dedicated_to, l.is_expired, l.created_at,
+		l.submitted_by, l.dedicated_to, l.is_expired, l.state, l.state_reason, l.created_at, coalesce(l.played_at, 0),
 		(select coalesce(sum(score), 0) from votes as v where v.link_id = l.link_id)
 	  from links as l
       where l.link_id=?
@@ -87,16 +110,90 @@ func (r *SQLiteRepository) GetLinkByID(id int64) (*Link, error) {
 
 	l := Link{LinkID: id}
 	err = stmt.QueryRow(l.LinkID).Scan(&l.LinkID, &l.VideoID, &l.URL, &l.Title, &l.ChannelName,
-		&l.Duration, &l.SubmittedBy, &l.DedicatedTo, &l.IsExpired, &l.CreatedAt,
-		&l.TotalVotes)
+		&l.Duration, &l.SubmittedBy, &l.DedicatedTo, &l.IsExpired, &l.State, &l.StateReason, &l.CreatedAt,
+		&l.PlayedAt, &l.TotalVotes)
 
 	return &l, err
 }
 
+func (r *SQLiteRepository) AllLinks() []Link {
+	rows, err := r.db.Query(`
+	  select l.link_id, l.video_id, l.url, l.title, l.channel_name, l.duration,
+		l.submitted_by, l.dedicated_to, l.is_expired, l.state, l.state_reason, l.created_at, coalesce(l.played_at, 0)
+	  from links as l
+	  union all
+	  select a.link_id, a.video_id, a.url, a.title, a.channel_name, a.duration,
+		a.submitted_by, a.dedicated_to, true, a.state, a.state_reason, a.created_at, coalesce(a.played_at, 0)
+	  from links_archive as a
+	  order by 1
+	`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	links := make([]Link, 0)
+	for rows.Next() {
+		l := Link{}
+		err = rows.Scan(&l.LinkID, &l.VideoID, &l.URL, &l.Title, &l.ChannelName,
+			&l.Duration, &l.SubmittedBy, &l.DedicatedTo, &l.IsExpired, &l.State, &l.StateReason, &l.CreatedAt,
+			&l.PlayedAt)
+		if err != nil {
+			log.Fatal(err)
+		}
+		links = append(links, l)
+	}
+	return links
+}
+
+// FindLink looks up a link by its natural key, which stays the same
+// when a link is moved between databases and gets a new link_id
+func (r *SQLiteRepository) FindLink(videoID, submittedBy string, createdAt int64) *Link {
+	var linkID int64
+	err := r.db.QueryRow(`
+	  select link_id from links
+	  where video_id=? and submitted_by=? and created_at=?
+	  order by link_id
+	  limit 1
+	`, videoID, submittedBy, createdAt).Scan(&linkID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	l, err := r.GetLinkByID(linkID)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return l
+}
+
+func (r *SQLiteRepository) FindArchivedLink(videoID, submittedBy string, createdAt int64) *Link {
+	l := Link{IsExpired: true}
+	err := r.db.QueryRow(`
+	  select link_id, video_id, url, title, channel_name, duration,
+		submitted_by, dedicated_to, state, state_reason, created_at, coalesce(played_at, 0), total_votes
+	  from links_archive
+	  where video_id=? and submitted_by=? and created_at=?
+	  order by link_id
+	  limit 1
+	`, videoID, submittedBy, createdAt).Scan(&l.LinkID, &l.VideoID, &l.URL, &l.Title,
+		&l.ChannelName, &l.Duration, &l.SubmittedBy, &l.DedicatedTo, &l.State, &l.StateReason, &l.CreatedAt,
+		&l.PlayedAt, &l.TotalVotes)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return &l
+}
+
 func (r *SQLiteRepository) GetLinksByUser(userID string) []Link {
 	stmt, err := r.db.Prepare(`
 	  select l.link_id, l.video_id, l.url, l.title, l.channel_name, l.duration,
-		l.submitted_by, l.dedicated_to, l.is_expired, l.created_at,
+		l.submitted_by, l.dedicated_to, l.is_expired, l.state, l.state_reason, l.created_at,
 		(select coalesce(sum(score), 0) from votes as v1 where v1.link_id = l.link_id),
 		(select coalesce(sum(score), 0) from votes as v2 where v2.link_id = l.link_id and v2.user_id = l.submitted_by)
 	  from links as l
@@ -116,7 +213,7 @@ func (r *SQLiteRepository) GetLinksByUser(userID string) []Link {
 	for rows.Next() {
 		l := Link{}
 		err = rows.Scan(&l.LinkID, &l.VideoID, &l.URL, &l.Title, &l.ChannelName,
-			&l.Duration, &l.SubmittedBy, &l.DedicatedTo, &l.IsExpired, &l.CreatedAt,
+			&l.Duration, &l.SubmittedBy, &l.DedicatedTo, &l.IsExpired, &l.State, &l.StateReason, &l.CreatedAt,
 			&l.TotalVotes, &l.MyVote)
 		if err != nil {
 			log.Fatal(err)
@@ -131,7 +228,8 @@ func (r *SQLiteRepository) UpdateLink(link Link) error {
 	stmt, err := r.db.Prepare(`
 	  update links
 	  set url=?, title=?, channel_name=?, duration=?,
-		submitted_by=?, dedicated_to=?, is_expired=?, created_at=?
+		submitted_by=?, dedicated_to=?, is_expired=?, state=?, state_reason=?,
+		created_at=?, played_at=?
 	  where link_id=?
 	`)
 	if err != nil {
@@ -140,8 +238,8 @@ func (r *SQLiteRepository) UpdateLink(link Link) error {
 	defer stmt.Close()
 
 	_, err = stmt.Exec(link.URL, link.Title, link.ChannelName, link.Duration,
-		link.SubmittedBy, link.DedicatedTo, link.IsExpired, link.CreatedAt,
-		link.LinkID)
+		link.SubmittedBy, link.DedicatedTo, link.IsExpired, link.State, link.StateReason,
+		link.CreatedAt, link.PlayedAt, link.LinkID)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -149,13 +247,30 @@ func (r *SQLiteRepository) UpdateLink(link Link) error {
 	return nil
 }
 
+func (r *SQLiteRepository) UpdateLinkIf(link Link, state LinkState) (bool, error) {
+	res, err := r.db.Exec(`
+	  update links
+	  set url=?, title=?, channel_name=?, duration=?,
+		submitted_by=?, dedicated_to=?, is_expired=?, state=?, state_reason=?,
+		created_at=?, played_at=?
+	  where link_id=? and state=?
+	`, link.URL, link.Title, link.ChannelName, link.Duration,
+		link.SubmittedBy, link.DedicatedTo, link.IsExpired, link.State, link.StateReason,
+		link.CreatedAt, link.PlayedAt, link.LinkID, state)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
 func (r *SQLiteRepository) GetAllLinks(limit int64) []Link {
 	stmt, err := r.db.Prepare(`
 	  select l.link_id, l.video_id, l.url, l.title, l.channel_name, l.duration,
-		l.submitted_by, l.dedicated_to, l.is_expired, l.created_at,
+		l.submitted_by, l.dedicated_to, l.is_expired, l.state, l.state_reason, l.created_at,
 		(select coalesce(sum(score), 0) from votes as v where v.link_id = l.link_id)
 	  from links as l
-      where l.is_expired=false
+      where l.state='queued'
       limit ?
 	`)
 	if err != nil {
@@ -173,7 +288,7 @@ func (r *SQLiteRepository) GetAllLinks(limit int64) []Link {
 	for rows.Next() {
 		l := Link{}
 		err = rows.Scan(&l.LinkID, &l.VideoID, &l.URL, &l.Title, &l.ChannelName,
-			&l.Duration, &l.SubmittedBy, &l.DedicatedTo, &l.IsExpired, &l.CreatedAt,
+			&l.Duration, &l.SubmittedBy, &l.DedicatedTo, &l.IsExpired, &l.State, &l.StateReason, &l.CreatedAt,
 			&l.TotalVotes)
 		if err != nil {
 			log.Fatal(err)
@@ -184,6 +299,33 @@ func (r *SQLiteRepository) GetAllLinks(limit int64) []Link {
 	return links
 }
 
+func (r *SQLiteRepository) ListLinks(filter LinkFilter) (*LinkPage, error) {
+	query, args, err := buildLinkListQuery(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := make([]Link, 0)
+	for rows.Next() {
+		l := Link{}
+		err = rows.Scan(&l.LinkID, &l.VideoID, &l.URL, &l.Title, &l.ChannelName,
+			&l.Duration, &l.SubmittedBy, &l.DedicatedTo, &l.IsExpired, &l.State, &l.StateReason, &l.CreatedAt,
+			&l.PlayedAt, &l.TotalVotes)
+		if err != nil {
+			return nil, err
+		}
+
+		links = append(links, l)
+	}
+	return pageOfLinks(filter, links), rows.Err()
+}
+
 func (r *SQLiteRepository) GetVotesForUser(linkIds []int64, userID string) map[int64]int64 {
 	var query string
 	if len(linkIds) > 0 {
@@ -237,6 +379,42 @@ func (r *SQLiteRepository) MarkVote(linkID int64, userID string, score int64) er
 	return nil
 }
 
+func (r *SQLiteRepository) AllVotes() []Vote {
+	rows, err := r.db.Query(`
+	  select link_id, user_id, score from votes
+	  union all
+	  select link_id, user_id, score from votes_archive
+	  order by 1, 2
+	`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	votes := make([]Vote, 0)
+	for rows.Next() {
+		v := Vote{}
+		if err = rows.Scan(&v.LinkID, &v.UserID, &v.Score); err != nil {
+			log.Fatal(err)
+		}
+		votes = append(votes, v)
+	}
+	return votes
+}
+
+func (r *SQLiteRepository) GetVote(linkID int64, userID string) *Vote {
+	v := &Vote{}
+	err := r.db.QueryRow(`select link_id, user_id, score from votes where link_id=? and user_id=?`,
+		linkID, userID).Scan(&v.LinkID, &v.UserID, &v.Score)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return v
+}
+
 func (r *SQLiteRepository) TotalVoteForLinks(linkIDs []int64) map[int64]int64 {
 	var query string
 	if len(linkIDs) > 0 {
@@ -272,6 +450,735 @@ func (r *SQLiteRepository) TotalVoteForLinks(linkIDs []int64) map[int64]int64 {
 	return result
 }
 
+func (r *SQLiteRepository) AppendAudit(e AuditEntry) error {
+	_, err := r.db.Exec(`
+	  insert into audit_log (actor, node_id, action, target, before, after, created_at)
+	  values (?, ?, ?, ?, ?, ?, ?)
+	`, e.Actor, e.NodeID, e.Action, e.Target, string(e.Before), string(e.After), e.CreatedAt)
+	return err
+}
+
+func (r *SQLiteRepository) ListAudit(filter AuditFilter) ([]AuditEntry, error) {
+	query, args := buildAuditListQuery(filter)
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanAuditRows(rows)
+}
+
+func (r *SQLiteRepository) StaleLinks(createdBefore int64, limit int64) []Link {
+	rows, err := r.db.Query(`
+	  select l.link_id, l.video_id, l.url, l.title, l.channel_name, l.duration,
+		l.submitted_by, l.dedicated_to, l.is_expired, l.state, l.state_reason, l.created_at
+	  from links as l
+	  where l.state in ('pending', 'queued') and l.created_at < ?
+	  order by l.created_at, l.link_id
+	  limit ?
+	`, createdBefore, limit)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	links := make([]Link, 0)
+	for rows.Next() {
+		l := Link{}
+		err = rows.Scan(&l.LinkID, &l.VideoID, &l.URL, &l.Title, &l.ChannelName,
+			&l.Duration, &l.SubmittedBy, &l.DedicatedTo, &l.IsExpired, &l.State, &l.StateReason, &l.CreatedAt)
+		if err != nil {
+			log.Fatal(err)
+		}
+		links = append(links, l)
+	}
+	return links
+}
+
+func (r *SQLiteRepository) ArchivePlayedLinks(playedBefore int64) (int64, int64, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	archivedAt := time.Now().Unix()
+	played := `select link_id from links where state = 'played' and played_at > 0 and played_at < ?`
+
+	res, err := tx.Exec(`
+	  insert or ignore into links_archive (link_id, url, video_id, title, channel_name, duration,
+		submitted_by, dedicated_to, state, state_reason, created_at, played_at, total_votes, archived_at)
+	  select l.link_id, l.url, l.video_id, l.title, l.channel_name, l.duration,
+		l.submitted_by, l.dedicated_to, l.state, l.state_reason, l.created_at, l.played_at,
+		(select coalesce(sum(score), 0) from votes as v where v.link_id = l.link_id), ?
+	  from links as l
+	  where l.link_id in (`+played+`)
+	`, archivedAt, playedBefore)
+	if err != nil {
+		return 0, 0, err
+	}
+	nlinks, _ := res.RowsAffected()
+
+	res, err = tx.Exec(`
+	  insert or ignore into votes_archive (link_id, user_id, score, archived_at)
+	  select link_id, user_id, score, ? from votes
+	  where link_id in (`+played+`)
+	`, archivedAt, playedBefore)
+	if err != nil {
+		return 0, 0, err
+	}
+	nvotes, _ := res.RowsAffected()
+
+	if _, err = tx.Exec(`delete from votes where link_id in (`+played+`)`, playedBefore); err != nil {
+		return 0, 0, err
+	}
+	if _, err = tx.Exec(`delete from links where link_id in (`+played+`)`, playedBefore); err != nil {
+		return 0, 0, err
+	}
+	return nlinks, nvotes, tx.Commit()
+}
+
+func (r *SQLiteRepository) AddNotification(n Notification) error {
+	_, err := r.db.Exec(`
+	  insert into notifications (user_id, kind, link_id, message, is_read, created_at)
+	  values (?, ?, ?, ?, ?, ?)
+	`, n.UserID, n.Kind, n.LinkID, n.Message, n.Read, n.CreatedAt)
+	return err
+}
+
+func (r *SQLiteRepository) GetNotifications(userID string, limit int64) []Notification {
+	rows, err := r.db.Query(`
+	  select notification_id, user_id, kind, link_id, message, is_read, created_at
+	  from notifications
+	  where user_id = ?
+	  order by notification_id desc
+	  limit ?
+	`, userID, limit)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	notifications := make([]Notification, 0)
+	for rows.Next() {
+		n := Notification{}
+		err = rows.Scan(&n.NotificationID, &n.UserID, &n.Kind, &n.LinkID, &n.Message, &n.Read, &n.CreatedAt)
+		if err != nil {
+			log.Fatal(err)
+		}
+		notifications = append(notifications, n)
+	}
+	return notifications
+}
+
+func (r *SQLiteRepository) MarkNotificationsRead(userID string, upTo int64) error {
+	_, err := r.db.Exec(`update notifications set is_read = 1 where user_id = ? and notification_id <= ?`,
+		userID, upTo)
+	return err
+}
+
+func (r *SQLiteRepository) GetRoles(userID string) []RoleGrant {
+	return r.queryRoleGrants(`
+	  select user_id, role, granted_by, granted_at from user_roles
+	  where user_id = ? order by role
+	`, userID)
+}
+
+func (r *SQLiteRepository) ListRoleHolders(role string) []RoleGrant {
+	return r.queryRoleGrants(`
+	  select user_id, role, granted_by, granted_at from user_roles
+	  where role = ? order by user_id
+	`, role)
+}
+
+func (r *SQLiteRepository) queryRoleGrants(query string, arg string) []RoleGrant {
+	rows, err := r.db.Query(query, arg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	grants := make([]RoleGrant, 0)
+	for rows.Next() {
+		g := RoleGrant{}
+		if err = rows.Scan(&g.UserID, &g.Role, &g.GrantedBy, &g.GrantedAt); err != nil {
+			log.Fatal(err)
+		}
+		grants = append(grants, g)
+	}
+	return grants
+}
+
+func (r *SQLiteRepository) GrantRole(g RoleGrant) error {
+	_, err := r.db.Exec(`
+	  insert or ignore into user_roles (user_id, role, granted_by, granted_at)
+	  values (?, ?, ?, ?)
+	`, g.UserID, g.Role, g.GrantedBy, g.GrantedAt)
+	return err
+}
+
+func (r *SQLiteRepository) RevokeRole(userID, role string) error {
+	_, err := r.db.Exec(`delete from user_roles where user_id = ? and role = ?`, userID, role)
+	return err
+}
+
+func (r *SQLiteRepository) InsertRefreshToken(t RefreshToken) error {
+	_, err := r.db.Exec(`
+	  insert into refresh_tokens (token_hash, user_id, session_id, issued_at, expires_at, used, revoked)
+	  values (?, ?, ?, ?, ?, ?, ?)
+	`, t.TokenHash, t.UserID, t.SessionID, t.IssuedAt, t.ExpiresAt, t.Used, t.Revoked)
+	return err
+}
+
+func (r *SQLiteRepository) GetRefreshToken(tokenHash string) *RefreshToken {
+	t := &RefreshToken{}
+	err := r.db.QueryRow(`
+	  select token_hash, user_id, session_id, issued_at, expires_at, used, revoked
+	  from refresh_tokens where token_hash = ?
+	`, tokenHash).Scan(&t.TokenHash, &t.UserID, &t.SessionID, &t.IssuedAt, &t.ExpiresAt, &t.Used, &t.Revoked)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return t
+}
+
+func (r *SQLiteRepository) UseRefreshToken(tokenHash string) (bool, error) {
+	res, err := r.db.Exec(`update refresh_tokens set used = 1 where token_hash = ? and used = 0`, tokenHash)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (r *SQLiteRepository) RevokeRefreshTokens(userID, sessionID string) error {
+	var err error
+	if sessionID == "" {
+		_, err = r.db.Exec(`update refresh_tokens set revoked = 1 where user_id = ?`, userID)
+	} else {
+		_, err = r.db.Exec(`update refresh_tokens set revoked = 1 where user_id = ? and session_id = ?`,
+			userID, sessionID)
+	}
+	return err
+}
+
+func (r *SQLiteRepository) AddRevocation(rev Revocation) error {
+	_, err := r.db.Exec(`
+	  insert into revocations (session_id, user_id, revoked_at, expires_at)
+	  values (?, ?, ?, ?)
+	`, rev.SessionID, rev.UserID, rev.RevokedAt, rev.ExpiresAt)
+	return err
+}
+
+func (r *SQLiteRepository) ActiveRevocations(now int64) []Revocation {
+	rows, err := r.db.Query(`
+	  select session_id, user_id, revoked_at, expires_at
+	  from revocations where expires_at > ?
+	`, now)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	revocations := make([]Revocation, 0)
+	for rows.Next() {
+		rev := Revocation{}
+		if err = rows.Scan(&rev.SessionID, &rev.UserID, &rev.RevokedAt, &rev.ExpiresAt); err != nil {
+			log.Fatal(err)
+		}
+		revocations = append(revocations, rev)
+	}
+	return revocations
+}
+
+func (r *SQLiteRepository) DeleteExpiredTokens(now int64) error {
+	if _, err := r.db.Exec(`delete from refresh_tokens where expires_at <= ?`, now); err != nil {
+		return err
+	}
+	_, err := r.db.Exec(`delete from revocations where expires_at <= ?`, now)
+	return err
+}
+
+func (r *SQLiteRepository) SetGuestVote(v GuestVote) error {
+	_, err := r.db.Exec(`
+	  replace into guest_votes (link_id, user_id, score, created_at)
+	  values (?, ?, ?, ?)
+	`, v.LinkID, v.UserID, v.Score, v.CreatedAt)
+	return err
+}
+
+func (r *SQLiteRepository) GetGuestVote(linkID int64, userID string) *GuestVote {
+	v := &GuestVote{}
+	err := r.db.QueryRow(`select link_id, user_id, score, created_at from guest_votes where link_id = ? and user_id = ?`,
+		linkID, userID).Scan(&v.LinkID, &v.UserID, &v.Score, &v.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return v
+}
+
+func (r *SQLiteRepository) GetGuestVotes(userID string) []GuestVote {
+	rows, err := r.db.Query(`select link_id, user_id, score, created_at from guest_votes where user_id = ? order by link_id`,
+		userID)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	votes := make([]GuestVote, 0)
+	for rows.Next() {
+		v := GuestVote{}
+		if err = rows.Scan(&v.LinkID, &v.UserID, &v.Score, &v.CreatedAt); err != nil {
+			log.Fatal(err)
+		}
+		votes = append(votes, v)
+	}
+	return votes
+}
+
+func (r *SQLiteRepository) GuestVoteTotal(linkID int64) int64 {
+	var total int64
+	err := r.db.QueryRow(`select coalesce(sum(score), 0) from guest_votes where link_id = ?`, linkID).Scan(&total)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return total
+}
+
+func (r *SQLiteRepository) CountGuestVotesSince(userID string, since int64) int64 {
+	var n int64
+	err := r.db.QueryRow(`select count(*) from guest_votes where user_id = ? and created_at >= ?`,
+		userID, since).Scan(&n)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return n
+}
+
+func (r *SQLiteRepository) DeleteGuestVotes(userID string) error {
+	_, err := r.db.Exec(`delete from guest_votes where user_id = ?`, userID)
+	return err
+}
+
+func (r *SQLiteRepository) TakeRateTokens(buckets map[string]RateRule, now int64) (int64, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	current := make([]RateBucket, 0, len(buckets))
+	for _, key := range rateBucketKeys(buckets) {
+		// writing first takes the database's write lock, so the read below can't go stale
+		_, err = tx.Exec(`insert or ignore into rate_buckets (bucket_key, tokens, updated_at) values (?, ?, ?)`,
+			key, float64(buckets[key].Capacity), now)
+		if err != nil {
+			return 0, err
+		}
+		b := RateBucket{Key: key}
+		err = tx.QueryRow(`select tokens, updated_at from rate_buckets where bucket_key = ?`, key).
+			Scan(&b.Tokens, &b.UpdatedAt)
+		if err != nil {
+			return 0, err
+		}
+		current = append(current, b)
+	}
+	current, wait := takeTokens(current, buckets, now)
+	for _, b := range current {
+		_, err = tx.Exec(`update rate_buckets set tokens = ?, updated_at = ? where bucket_key = ?`,
+			b.Tokens, b.UpdatedAt, b.Key)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return wait, tx.Commit()
+}
+
+func (r *SQLiteRepository) DeleteIdleRateBuckets(before int64) error {
+	_, err := r.db.Exec(`delete from rate_buckets where updated_at < ?`, before)
+	return err
+}
+
+func (r *SQLiteRepository) GetRateRules() []RateRule {
+	rows, err := r.db.Query(`select endpoint, scope, capacity, period from rate_rules order by endpoint, scope`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	rules := make([]RateRule, 0)
+	for rows.Next() {
+		rule := RateRule{}
+		if err = rows.Scan(&rule.Endpoint, &rule.Scope, &rule.Capacity, &rule.Period); err != nil {
+			log.Fatal(err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+func (r *SQLiteRepository) SetRateRule(rule RateRule) error {
+	_, err := r.db.Exec(`
+	  replace into rate_rules (endpoint, scope, capacity, period)
+	  values (?, ?, ?, ?)
+	`, rule.Endpoint, rule.Scope, rule.Capacity, rule.Period)
+	return err
+}
+
+func (r *SQLiteRepository) CreateAccessToken(t AccessToken) (int64, error) {
+	res, err := r.db.Exec(`
+	  insert into access_tokens (user_id, name, scopes, token_hash, created_at, expires_at)
+	  values (?, ?, ?, ?, ?, ?)
+	`, t.UserID, t.Name, strings.Join(t.Scopes, ","), t.TokenHash, t.CreatedAt, t.ExpiresAt)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (r *SQLiteRepository) GetAccessTokenByHash(tokenHash string) *AccessToken {
+	t, err := scanAccessToken(r.db.QueryRow(`select `+accessTokenColumns+` from access_tokens where token_hash = ?`,
+		tokenHash))
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return t
+}
+
+func (r *SQLiteRepository) ListAccessTokens(userID string) []AccessToken {
+	rows, err := r.db.Query(`select `+accessTokenColumns+` from access_tokens where user_id = ? order by token_id`,
+		userID)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	tokens := make([]AccessToken, 0)
+	for rows.Next() {
+		t, err := scanAccessToken(rows)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tokens = append(tokens, *t)
+	}
+	return tokens
+}
+
+func (r *SQLiteRepository) RevokeAccessTokens(userID string, tokenID int64) (int64, error) {
+	var (
+		res sql.Result
+		err error
+	)
+	if tokenID == 0 {
+		res, err = r.db.Exec(`update access_tokens set revoked = 1 where user_id = ? and revoked = 0`, userID)
+	} else {
+		res, err = r.db.Exec(`update access_tokens set revoked = 1 where user_id = ? and token_id = ? and revoked = 0`,
+			userID, tokenID)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (r *SQLiteRepository) TouchAccessToken(tokenID, usedAt int64) error {
+	_, err := r.db.Exec(`update access_tokens set last_used_at = ? where token_id = ?`, usedAt, tokenID)
+	return err
+}
+
+func (r *SQLiteRepository) GetIdentity(provider, subject string) *Identity {
+	i := &Identity{}
+	err := r.db.QueryRow(`
+	  select provider, subject, user_id, email, linked_at
+	  from user_identities where provider = ? and subject = ?
+	`, provider, subject).Scan(&i.Provider, &i.Subject, &i.UserID, &i.Email, &i.LinkedAt)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return i
+}
+
+func (r *SQLiteRepository) ListIdentities(userID string) []Identity {
+	rows, err := r.db.Query(`
+	  select provider, subject, user_id, email, linked_at
+	  from user_identities where user_id = ? order by provider, subject
+	`, userID)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	identities := make([]Identity, 0)
+	for rows.Next() {
+		i := Identity{}
+		if err = rows.Scan(&i.Provider, &i.Subject, &i.UserID, &i.Email, &i.LinkedAt); err != nil {
+			log.Fatal(err)
+		}
+		identities = append(identities, i)
+	}
+	return identities
+}
+
+func (r *SQLiteRepository) AddIdentity(i Identity) error {
+	_, err := r.db.Exec(`
+	  insert into user_identities (provider, subject, user_id, email, linked_at)
+	  values (?, ?, ?, ?, ?)
+	`, i.Provider, i.Subject, i.UserID, i.Email, i.LinkedAt)
+	return err
+}
+
+func (r *SQLiteRepository) AddSkipVote(linkID int64, userID string, at int64) (bool, error) {
+	res, err := r.db.Exec(`
+	  insert or ignore into skip_votes (link_id, user_id, created_at)
+	  values (?, ?, ?)
+	`, linkID, userID, at)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (r *SQLiteRepository) CountSkipVotes(linkID int64) int64 {
+	var n int64
+	err := r.db.QueryRow(`select count(*) from skip_votes where link_id = ?`, linkID).Scan(&n)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return n
+}
+
+func (r *SQLiteRepository) DeleteSkipVotes(linkID int64) error {
+	_, err := r.db.Exec(`delete from skip_votes where link_id = ?`, linkID)
+	return err
+}
+
+func (r *SQLiteRepository) CreateWebhook(w Webhook) (int64, error) {
+	res, err := r.db.Exec(`
+	  insert into webhooks (url, events, secret, active, created_by, created_at)
+	  values (?, ?, ?, ?, ?, ?)
+	`, w.URL, strings.Join(w.Events, ","), w.Secret, w.Active, w.CreatedBy, w.CreatedAt)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (r *SQLiteRepository) GetWebhook(webhookID int64) *Webhook {
+	query := `select ` + webhookColumns + ` from webhooks where webhook_id = ?`
+
+	w, err := scanWebhook(r.db.QueryRow(query, webhookID))
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return w
+}
+
+func (r *SQLiteRepository) ListWebhooks() []Webhook {
+	rows, err := r.db.Query(`select ` + webhookColumns + ` from webhooks order by webhook_id`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	webhooks := make([]Webhook, 0)
+	for rows.Next() {
+		w, err := scanWebhook(rows)
+		if err != nil {
+			log.Fatal(err)
+		}
+		webhooks = append(webhooks, *w)
+	}
+	return webhooks
+}
+
+func (r *SQLiteRepository) UpdateWebhook(w Webhook) error {
+	_, err := r.db.Exec(`update webhooks set url = ?, events = ?, active = ? where webhook_id = ?`,
+		w.URL, strings.Join(w.Events, ","), w.Active, w.WebhookID)
+	return err
+}
+
+func (r *SQLiteRepository) DeleteWebhook(webhookID int64) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(`delete from webhook_deliveries where webhook_id = ?`, webhookID); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(`delete from webhooks where webhook_id = ?`, webhookID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *SQLiteRepository) AddWebhookDelivery(d WebhookDelivery) (int64, error) {
+	res, err := r.db.Exec(`
+	  insert into webhook_deliveries (webhook_id, event, payload, status, next_attempt_at, created_at)
+	  values (?, ?, ?, ?, ?, ?)
+	`, d.WebhookID, d.Event, string(d.Payload), d.Status, d.NextAttemptAt, d.CreatedAt)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (r *SQLiteRepository) GetWebhookDelivery(deliveryID int64) *WebhookDelivery {
+	query := `select ` + deliveryColumns + ` from webhook_deliveries where delivery_id = ?`
+
+	d, err := scanWebhookDelivery(r.db.QueryRow(query, deliveryID))
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return d
+}
+
+func (r *SQLiteRepository) ListWebhookDeliveries(filter WebhookDeliveryFilter) []WebhookDelivery {
+	query, args := buildDeliveryListQuery(filter)
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return scanWebhookDeliveries(rows)
+}
+
+func (r *SQLiteRepository) DueWebhookDeliveries(now, limit int64) []WebhookDelivery {
+	query := `
+	  select ` + deliveryColumns + ` from webhook_deliveries
+	  where status = 'pending' and next_attempt_at <= ?
+	  order by next_attempt_at, delivery_id
+	  limit ?`
+
+	rows, err := r.db.Query(query, now, limit)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return scanWebhookDeliveries(rows)
+}
+
+func (r *SQLiteRepository) UpdateWebhookDelivery(d WebhookDelivery) error {
+	query := `
+	  update webhook_deliveries
+	  set status = ?, attempts = ?, next_attempt_at = ?, last_attempt_at = ?,
+	      response_code = ?, last_error = ?, delivered_at = ?
+	  where delivery_id = ?`
+
+	_, err := r.db.Exec(query, d.Status, d.Attempts, d.NextAttemptAt, d.LastAttemptAt,
+		d.ResponseCode, d.LastError, d.DeliveredAt, d.DeliveryID)
+	return err
+}
+
+func (r *SQLiteRepository) DeleteWebhookDeliveries(createdBefore int64) error {
+	_, err := r.db.Exec(`delete from webhook_deliveries where status <> 'pending' and created_at < ?`,
+		createdBefore)
+	return err
+}
+
+func (r *SQLiteRepository) AddChatMessage(m ChatMessage) (int64, error) {
+	res, err := r.db.Exec(`
+	  insert into chat_messages (link_id, user_id, text, created_at)
+	  values (?, ?, ?, ?)
+	`, m.LinkID, m.UserID, m.Text, m.CreatedAt)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (r *SQLiteRepository) GetChatMessage(messageID int64) *ChatMessage {
+	query := `select ` + chatColumns + ` from chat_messages where message_id = ?`
+
+	m, err := scanChatMessage(r.db.QueryRow(query, messageID))
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return m
+}
+
+func (r *SQLiteRepository) ListChatMessages(filter ChatFilter) []ChatMessage {
+	query, args := buildChatListQuery(filter)
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return scanChatMessages(rows)
+}
+
+func (r *SQLiteRepository) DeleteChatMessage(messageID int64) error {
+	_, err := r.db.Exec(`delete from chat_messages where message_id = ?`, messageID)
+	return err
+}
+
+func (r *SQLiteRepository) DeleteChatMessages(createdBefore int64) error {
+	_, err := r.db.Exec(`delete from chat_messages where created_at < ?`, createdBefore)
+	return err
+}
+
+func (r *SQLiteRepository) SetChatMute(m ChatMute) error {
+	_, err := r.db.Exec(`
+	  replace into chat_mutes (user_id, muted_by, reason, muted_at, expires_at)
+	  values (?, ?, ?, ?, ?)
+	`, m.UserID, m.MutedBy, m.Reason, m.MutedAt, m.ExpiresAt)
+	return err
+}
+
+func (r *SQLiteRepository) GetChatMute(userID string) *ChatMute {
+	query := `select ` + chatMuteColumns + ` from chat_mutes where user_id = ?`
+
+	m, err := scanChatMute(r.db.QueryRow(query, userID))
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return m
+}
+
+func (r *SQLiteRepository) ListChatMutes(now int64) []ChatMute {
+	rows, err := r.db.Query(`
+	  select `+chatMuteColumns+` from chat_mutes
+	  where expires_at = 0 or expires_at > ?
+	  order by muted_at, user_id
+	`, now)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return scanChatMutes(rows)
+}
+
+func (r *SQLiteRepository) DeleteChatMute(userID string) error {
+	_, err := r.db.Exec(`delete from chat_mutes where user_id = ?`, userID)
+	return err
+}
+
+func (r *SQLiteRepository) DeleteExpiredChatMutes(now int64) error {
+	_, err := r.db.Exec(`delete from chat_mutes where expires_at > 0 and expires_at <= ?`, now)
+	return err
+}
+
 func (r *SQLiteRepository) NewTest(message string) error {
 	fmt.Println("performing query")
 	stmt, err := r.db.Prepare("INSERT INTO test(message) values(?)")
@@ -317,7 +1224,10 @@ func NewSQLiteRepository(filename string) *SQLiteRepository {
 		submitted_by text,
 		dedicated_to text,
 		is_expired bool,
-		created_at int
+		state text not null default 'queued',
+		state_reason text not null default '',
+		created_at int,
+		played_at int default 0
 	  )`
 	votesTable := `
 		create table if not exists votes (
@@ -327,7 +1237,220 @@ func NewSQLiteRepository(filename string) *SQLiteRepository {
 		constraint unq UNIQUE(link_id, user_id)
 	  )`
 
-	tables := []string{testTable, usersTable, linksTable, votesTable}
+	auditTable := `
+		create table if not exists audit_log (
+		audit_id integer primary key autoincrement,
+		actor text not null,
+		node_id text not null,
+		action text not null,
+		target text not null,
+		before text not null,
+		after text not null,
+		created_at int not null
+	  )`
+	// played links and their votes end up here once they are old enough
+	linksArchiveTable := `
+		create table if not exists links_archive (
+		link_id integer primary key,
+		url text not null,
+		video_id text not null,
+		title text,
+		channel_name text,
+		duration int,
+		submitted_by text,
+		dedicated_to text,
+		state text not null,
+		state_reason text not null,
+		created_at int,
+		played_at int,
+		total_votes int not null,
+		archived_at int not null
+	  )`
+	votesArchiveTable := `
+		create table if not exists votes_archive (
+		link_id integer not null,
+		user_id text not null,
+		score integer not null,
+		archived_at int not null,
+		constraint votes_archive_unq UNIQUE(link_id, user_id)
+	  )`
+
+	notificationsTable := `
+		create table if not exists notifications (
+		notification_id integer primary key autoincrement,
+		user_id text not null,
+		kind text not null,
+		link_id integer not null default 0,
+		message text not null,
+		is_read bool not null default 0,
+		created_at int not null
+	  )`
+
+	rolesTable := `
+		create table if not exists user_roles (
+		user_id text not null,
+		role text not null,
+		granted_by text not null,
+		granted_at int not null,
+		primary key (user_id, role)
+	  )`
+
+	// refresh tokens are stored hashed
+	refreshTokensTable := `
+		create table if not exists refresh_tokens (
+		token_hash text primary key,
+		user_id text not null,
+		session_id text not null,
+		issued_at int not null,
+		expires_at int not null,
+		used bool not null default 0,
+		revoked bool not null default 0
+	  )`
+	revocationsTable := `
+		create table if not exists revocations (
+		revocation_id integer primary key autoincrement,
+		session_id text not null default '',
+		user_id text not null,
+		revoked_at int not null,
+		expires_at int not null
+	  )`
+	guestVotesTable := `
+		create table if not exists guest_votes (
+		link_id integer not null,
+		user_id text not null,
+		score integer not null,
+		created_at int not null,
+		primary key (link_id, user_id)
+	  )`
+	// personal access tokens are stored hashed, scopes are comma separated
+	accessTokensTable := `
+		create table if not exists access_tokens (
+		token_id integer primary key autoincrement,
+		user_id text not null,
+		name text not null,
+		scopes text not null,
+		token_hash text not null unique,
+		created_at int not null,
+		expires_at int not null default 0,
+		last_used_at int not null default 0,
+		revoked bool not null default 0
+	  )`
+	// the secret signs deliveries so it is kept as is, events are comma separated
+	webhooksTable := `
+		create table if not exists webhooks (
+		webhook_id integer primary key autoincrement,
+		url text not null,
+		events text not null,
+		secret text not null,
+		active bool not null default 1,
+		created_by text not null,
+		created_at int not null
+	  )`
+	webhookDeliveriesTable := `
+		create table if not exists webhook_deliveries (
+		delivery_id integer primary key autoincrement,
+		webhook_id integer not null,
+		event text not null,
+		payload text not null,
+		status text not null,
+		attempts int not null default 0,
+		next_attempt_at int not null,
+		last_attempt_at int not null default 0,
+		response_code int not null default 0,
+		last_error text not null default '',
+		created_at int not null,
+		delivered_at int not null default 0
+	  )`
+	chatMessagesTable := `
+		create table if not exists chat_messages (
+		message_id integer primary key autoincrement,
+		link_id integer not null,
+		user_id text not null,
+		text text not null,
+		created_at int not null
+	  )`
+	// expires_at is 0 for users muted until unmuted
+	chatMutesTable := `
+		create table if not exists chat_mutes (
+		user_id text primary key,
+		muted_by text not null,
+		reason text not null default '',
+		muted_at int not null,
+		expires_at int not null default 0
+	  )`
+	skipVotesTable := `
+		create table if not exists skip_votes (
+		link_id integer not null,
+		user_id text not null,
+		created_at int not null,
+		primary key (link_id, user_id)
+	  )`
+	identitiesTable := `
+		create table if not exists user_identities (
+		provider text not null,
+		subject text not null,
+		user_id text not null,
+		email text not null default '',
+		linked_at int not null,
+		primary key (provider, subject)
+	  )`
+	rateRulesTable := `
+		create table if not exists rate_rules (
+		endpoint text not null,
+		scope text not null,
+		capacity int not null,
+		period int not null,
+		primary key (endpoint, scope)
+	  )`
+	rateBucketsTable := `
+		create table if not exists rate_buckets (
+		bucket_key text primary key,
+		tokens real not null,
+		updated_at int not null
+	  )`
+
+	// the audit log is append-only
+	auditTriggers := []string{
+		`create trigger if not exists audit_log_no_update before update on audit_log
+		  begin select raise(abort, 'audit log is append-only'); end`,
+		`create trigger if not exists audit_log_no_delete before delete on audit_log
+		  begin select raise(abort, 'audit log is append-only'); end`,
+	}
+
+	// indexes backing the link listing API
+	indexes := []string{
+		`create index if not exists links_submitted_by_idx on links (submitted_by, created_at, link_id)`,
+		`create index if not exists links_channel_name_idx on links (channel_name, created_at, link_id)`,
+		`create index if not exists links_is_expired_idx on links (is_expired, created_at, link_id)`,
+		`create index if not exists links_created_at_idx on links (created_at, link_id)`,
+		`create index if not exists links_state_idx on links (state, created_at, link_id)`,
+		`create index if not exists links_played_at_idx on links (state, played_at)`,
+		`create index if not exists votes_link_id_idx on votes (link_id)`,
+		`create index if not exists audit_log_actor_idx on audit_log (actor, audit_id)`,
+		`create index if not exists audit_log_action_idx on audit_log (action, audit_id)`,
+		`create index if not exists audit_log_target_idx on audit_log (target, audit_id)`,
+		`create index if not exists audit_log_created_at_idx on audit_log (created_at)`,
+		`create index if not exists links_archive_played_at_idx on links_archive (played_at)`,
+		`create index if not exists notifications_user_id_idx on notifications (user_id, notification_id)`,
+		`create index if not exists user_roles_role_idx on user_roles (role, user_id)`,
+		`create index if not exists refresh_tokens_user_id_idx on refresh_tokens (user_id, session_id)`,
+		`create index if not exists revocations_expires_at_idx on revocations (expires_at)`,
+		`create index if not exists guest_votes_user_id_idx on guest_votes (user_id, created_at)`,
+		`create index if not exists rate_buckets_updated_at_idx on rate_buckets (updated_at)`,
+		`create index if not exists access_tokens_user_id_idx on access_tokens (user_id, token_id)`,
+		`create index if not exists user_identities_user_id_idx on user_identities (user_id)`,
+		`create index if not exists webhook_deliveries_due_idx on webhook_deliveries (status, next_attempt_at)`,
+		`create index if not exists webhook_deliveries_webhook_id_idx on webhook_deliveries (webhook_id, delivery_id)`,
+		`create index if not exists chat_messages_link_id_idx on chat_messages (link_id, message_id)`,
+		`create index if not exists chat_messages_created_at_idx on chat_messages (created_at)`,
+	}
+
+	tables := []string{testTable, usersTable, linksTable, votesTable, auditTable,
+		linksArchiveTable, votesArchiveTable, notificationsTable, rolesTable,
+		refreshTokensTable, revocationsTable, guestVotesTable, rateRulesTable, rateBucketsTable,
+		accessTokensTable, identitiesTable, skipVotesTable, webhooksTable, webhookDeliveriesTable,
+		chatMessagesTable, chatMutesTable}
+	tables = append(tables, auditTriggers...)
 	var stmt *sql.Stmt
 
 	for _, t := range tables {
@@ -339,7 +1462,56 @@ func NewSQLiteRepository(filename string) *SQLiteRepository {
 			log.Fatal("failed to exec stmt", err)
 		}
 	}
+
+	// columns added after the first release
+	// sqlite has no "add column if not exists", so we only add what's missing
+	migrations := []struct{ column, stmt string }{
+		{"played_at", `alter table links add column played_at int default 0`},
+		{"state", `alter table links add column state text not null default 'queued'`},
+		{"state_reason", `alter table links add column state_reason text not null default ''`},
+	}
+	for _, m := range migrations {
+		if !sqliteHasColumn(db, "links", m.column) {
+			if _, err = db.Exec(m.stmt); err != nil {
+				log.Fatal("failed to migrate ", m.column, err)
+			}
+		}
+	}
+	// links from before states existed only knew is_expired
+	if _, err = db.Exec(`update links set state = case when played_at > 0 then 'played' else 'expired' end
+	  where is_expired = 1 and state = 'queued'`); err != nil {
+		log.Fatal("failed to backfill link states ", err)
+	}
+
+	for _, idx := range indexes {
+		if _, err = db.Exec(idx); err != nil {
+			log.Fatal("failed to create index ", err)
+		}
+	}
 	// check for possible errors and traps
 
 	return &SQLiteRepository{db: db}
 }
+
+func sqliteHasColumn(db *sql.DB, table, column string) bool {
+	rows, err := db.Query("pragma table_info(" + table + ")")
+	if err != nil {
+		log.Fatal("failed to inspect table ", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid, notnull, pk int
+			name, ctype      string
+			dflt             sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk); err != nil {
+			log.Fatal(err)
+		}
+		if name == column {
+			return true
+		}
+	}
+	return false
+}
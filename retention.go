@@ -0,0 +1,177 @@
+package main
+
+// this file keeps the live tables small
+//
+// links which sat in the queue (or waited for a moderator) for too long are
+// expired as stale and their submitter is notified. Played links older than
+// the archive horizon move to links_archive, with their votes in votes_archive,
+// so they are still around for stats. Expired refresh tokens and revocations,
+// idle rate limit buckets, finished webhook deliveries past the archive
+// horizon, expired chat mutes and chat messages past their own horizon are
+// deleted too. Only the leader runs the job.
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	staleReason             = "stale"
+	notificationLinkExpired = "link.expired"
+
+	staleBatchSize           int64 = 100
+	defaultNotificationsPage int64 = 50
+)
+
+type RetentionJob struct {
+	service Service
+	// zero disables the corresponding step
+	staleAfter   time.Duration
+	archiveAfter time.Duration
+	chatAfter    time.Duration
+	every        time.Duration
+
+	running   bool
+	interrupt chan interface{}
+}
+
+func NewRetentionJob(s Service, staleAfter, archiveAfter, chatAfter, every time.Duration) *RetentionJob {
+	return &RetentionJob{
+		service:      s,
+		staleAfter:   staleAfter,
+		archiveAfter: archiveAfter,
+		chatAfter:    chatAfter,
+		every:        every,
+		interrupt:    make(chan interface{}, 1),
+	}
+}
+
+// SwitchMode starts the job on the leader and stops it everywhere else
+func (j *RetentionJob) SwitchMode(isLeader bool) {
+	if isLeader && !j.running && j.every > 0 {
+		j.running = true
+		go j.run()
+	} else if !isLeader && j.running {
+		j.Shutdown()
+	}
+}
+
+func (j *RetentionJob) Shutdown() {
+	if j.running {
+		j.running = false
+		j.interrupt <- true
+	}
+}
+
+func (j *RetentionJob) run() {
+	ticker := time.NewTicker(j.every)
+	defer ticker.Stop()
+
+	j.runOnce(time.Now())
+	for {
+		select {
+		case t := <-ticker.C:
+			j.runOnce(t)
+		case <-j.interrupt:
+			return
+		}
+	}
+}
+
+func (j *RetentionJob) runOnce(now time.Time) {
+	if j.staleAfter > 0 {
+		if n := j.service.ExpireStaleLinks(now.Add(-j.staleAfter)); n > 0 {
+			log.Println("retention expired", n, "stale links")
+		}
+	}
+	if j.archiveAfter > 0 {
+		links, votes, err := j.service.ArchivePlayedLinks(now.Add(-j.archiveAfter))
+		if err != nil {
+			log.Println("retention failed to archive played links", err)
+		} else if links > 0 {
+			log.Println("retention archived", links, "links and", votes, "votes")
+		}
+		if err := j.service.PruneWebhookDeliveries(now.Add(-j.archiveAfter)); err != nil {
+			log.Println("retention failed to prune webhook deliveries", err)
+		}
+	}
+	if j.chatAfter > 0 {
+		if err := j.service.PruneChatMessages(now.Add(-j.chatAfter)); err != nil {
+			log.Println("retention failed to prune chat messages", err)
+		}
+	}
+	if err := j.service.PruneChatMutes(now); err != nil {
+		log.Println("retention failed to prune chat mutes", err)
+	}
+	if err := j.service.DeleteExpiredTokens(now); err != nil {
+		log.Println("retention failed to delete expired tokens", err)
+	}
+	if err := j.service.PruneRateBuckets(now); err != nil {
+		log.Println("retention failed to prune rate limit buckets", err)
+	}
+}
+
+// ExpireStaleLinks expires every pending or queued link created before createdBefore
+// and returns how many were expired
+func (s *ServiceImpl) ExpireStaleLinks(createdBefore time.Time) int {
+	expired := 0
+	for {
+		links := s.linkRepo.StaleLinks(createdBefore.Unix(), staleBatchSize)
+		moved := 0
+		for _, l := range links {
+			before := l
+			if err := l.Transition(linkExpired, staleReason); err != nil {
+				continue
+			}
+			if err := s.linkRepo.UpdateLink(l); err != nil {
+				log.Println("failed to expire link", l.LinkID, err)
+				continue
+			}
+			moved++
+			s.audit(auditActorSystem, auditLinkExpire, linkTarget(l.LinkID), before, l)
+			s.notify(Notification{
+				UserID:  l.SubmittedBy,
+				Kind:    notificationLinkExpired,
+				LinkID:  l.LinkID,
+				Message: fmt.Sprintf("%q expired before it made it to the top of the queue", l.Title),
+			})
+		}
+		expired += moved
+		// a short batch means there is nothing left, no progress means we'd loop forever
+		if int64(len(links)) < staleBatchSize || moved == 0 {
+			return expired
+		}
+	}
+}
+
+func (s *ServiceImpl) ArchivePlayedLinks(playedBefore time.Time) (int64, int64, error) {
+	links, votes, err := s.linkRepo.ArchivePlayedLinks(playedBefore.Unix())
+	if err != nil || links == 0 {
+		return links, votes, err
+	}
+	s.audit(auditActorSystem, auditLinkArchive, "links", nil, map[string]int64{
+		"links":         links,
+		"votes":         votes,
+		"played_before": playedBefore.Unix(),
+	})
+	return links, votes, nil
+}
+
+func (s *ServiceImpl) notify(n Notification) {
+	if s.notificationRepo == nil || n.UserID == "" {
+		return
+	}
+	n.CreatedAt = time.Now().Unix()
+	if err := s.notificationRepo.AddNotification(n); err != nil {
+		log.Println("failed to notify", n.UserID, "about", n.Kind, err)
+	}
+}
+
+func (s *ServiceImpl) GetNotifications(userID string) []Notification {
+	return s.notificationRepo.GetNotifications(userID, defaultNotificationsPage)
+}
+
+func (s *ServiceImpl) MarkNotificationsRead(userID string, upTo int64) error {
+	return s.notificationRepo.MarkNotificationsRead(userID, upTo)
+}
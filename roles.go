@@ -0,0 +1,146 @@
+package main
+
+// this file deals with roles
+//
+// every signed in user is a listener. Moderators can also moderate links,
+// and admins can do everything, including granting and revoking roles.
+// Roles are stored per user, and copied into every access token, where
+// requireRole checks them. There is a single station, so roles apply to it.
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+)
+
+const (
+	roleAdmin     = "admin"
+	roleModerator = "moderator"
+	roleListener  = "listener"
+
+	// granted_by of roles granted from flags on startup
+	roleGrantorConfig = "config"
+)
+
+var (
+	ErrInvalidRole    = errors.New("invalid role")
+	ErrLastAdmin      = errors.New("cannot revoke the last admin")
+	ErrRoleNotGranted = errors.New("role is not granted")
+)
+
+// grantableRoles are the roles stored in the database, listener is implicit
+var grantableRoles = map[string]bool{
+	roleAdmin:     true,
+	roleModerator: true,
+}
+
+// hasRole tells if a set of roles allows acting as want
+func hasRole(roles []string, want string) bool {
+	if want == roleListener {
+		return true
+	}
+	for _, r := range roles {
+		if r == want || r == roleAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// rolesFromContext reads the roles claim of the JWT
+func rolesFromContext(c echo.Context) []string {
+	claims := c.Get("user").(*jwt.Token).Claims.(jwt.MapClaims)
+	raw, _ := claims["roles"].([]interface{})
+	roles := make([]string, 0, len(raw))
+	for _, r := range raw {
+		if s, ok := r.(string); ok {
+			roles = append(roles, s)
+		}
+	}
+	return roles
+}
+
+// requireRole lets the request through if the JWT carries the role, or admin
+func requireRole(role string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !hasRole(rolesFromContext(c), role) {
+				return echo.NewHTTPError(http.StatusForbidden, "Only "+role+"s can do this")
+			}
+			return next(c)
+		}
+	}
+}
+
+func (s *ServiceImpl) GetRoles(userID string) []string {
+	roles := make([]string, 0)
+	for _, g := range s.roleRepo.GetRoles(userID) {
+		roles = append(roles, g.Role)
+	}
+	return roles
+}
+
+func (s *ServiceImpl) ListRoleHolders(role string) ([]RoleGrant, error) {
+	if !grantableRoles[role] {
+		return nil, ErrInvalidRole
+	}
+	return s.roleRepo.ListRoleHolders(role), nil
+}
+
+func (s *ServiceImpl) GrantRole(actor, userID, role string) error {
+	if !grantableRoles[role] {
+		return ErrInvalidRole
+	}
+	before := s.GetRoles(userID)
+	if hasExactRole(before, role) {
+		return nil
+	}
+	g := RoleGrant{UserID: userID, Role: role, GrantedBy: actor, GrantedAt: time.Now().Unix()}
+	if err := s.roleRepo.GrantRole(g); err != nil {
+		return err
+	}
+	s.audit(actor, auditRoleGrant, userTarget(userID), before, s.GetRoles(userID))
+	return nil
+}
+
+func (s *ServiceImpl) RevokeRole(actor, userID, role string) error {
+	if !grantableRoles[role] {
+		return ErrInvalidRole
+	}
+	before := s.GetRoles(userID)
+	if !hasExactRole(before, role) {
+		return ErrRoleNotGranted
+	}
+	if role == roleAdmin && len(s.roleRepo.ListRoleHolders(roleAdmin)) <= 1 {
+		return ErrLastAdmin
+	}
+	if err := s.roleRepo.RevokeRole(userID, role); err != nil {
+		return err
+	}
+	s.audit(actor, auditRoleRevoke, userTarget(userID), before, s.GetRoles(userID))
+	return nil
+}
+
+// BootstrapRoles grants roles named in config, so a fresh station has an admin
+func (s *ServiceImpl) BootstrapRoles(roles map[string][]string) {
+	for role, userIDs := range roles {
+		for _, userID := range userIDs {
+			if err := s.GrantRole(roleGrantorConfig, userID, role); err != nil {
+				log.Fatal("failed to grant ", role, " to ", userID, " ", err)
+			}
+		}
+	}
+}
+
+func hasExactRole(roles []string, role string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
@@ -1,34 +1,130 @@
 package main
 
 import (
+	"database/sql"
 	"fmt"
+	"log"
 	"time"
+
+	"github.com/dgrijalva/jwt-go"
 )
 
 type Service interface {
 	CreateOrUpdateUser(u User) error
 	SubmitLink(url, userid, dedicatedTo string) (*Link, error)
 	UpdateLink(link Link) error
-	Vote(linkID int64, userID string, score int64)
+	FinishPlaying(linkID int64, reason string) (bool, error)
+	RecoverPlayingLinks() int
+	Vote(linkID int64, userID string, score int64) error
+	SkipVote(linkID int64, userID string) (*SkipTally, error)
+	ShouldSkip(linkID int64) bool
+	ClearSkipVotes(linkID int64) error
 	Test(message string)
 	GetAllLinks(limit int64) []Link
+	ListLinks(filter LinkFilter) (*LinkPage, error)
 	GetLinkByID(linkID int64) (*Link, error)
 	GetLinksByUser(userID string) []Link
 	GetVotesForUser(links []Link, userID string) map[int64]int64
 	GetUserByID(userID string) *User
 	GetTotalVoteForLinks(linkIDs []int64) map[int64]int64
+	ApproveLink(linkID int64, moderatorID string) (*Link, error)
+	RejectLink(linkID int64, moderatorID, reason string) (*Link, error)
+	RemoveLink(linkID int64, moderatorID, reason string) (*Link, error)
+	CreateAccessToken(userID, name string, scopes []string, ttl time.Duration) (string, *AccessToken, error)
+	ListAccessTokens(userID string) []AccessToken
+	RevokeAccessTokens(actor, userID string, tokenID int64) error
+	AuthenticateAccessToken(raw string) (*AccessToken, error)
+	RateLimit(endpoint, userID, ip string) (time.Duration, error)
+	GetRateRules() []RateRule
+	SetRateRule(actor string, rule RateRule) error
+	PruneRateBuckets(now time.Time) error
+	CreateGuest() (string, string, string, error)
+	UpgradeGuest(guestID, userID string) error
+	CreateSession(userID string) (string, string, error)
+	RefreshSession(refreshToken string) (string, *RefreshToken, error)
+	Logout(userID, sessionID string) error
+	LogoutEverywhere(actor, userID string) error
+	IsTokenRevoked(claims jwt.MapClaims) bool
+	DeleteExpiredTokens(now time.Time) error
+	GetRoles(userID string) []string
+	ListRoleHolders(role string) ([]RoleGrant, error)
+	GrantRole(actor, userID, role string) error
+	RevokeRole(actor, userID, role string) error
+	Login(u User) error
+	LoginWithGoogle(idToken string) (*User, error)
+	OIDCProviders() []string
+	OIDCAuthURL(provider, state, nonce, verifier string) (string, error)
+	LoginWithOIDC(provider, code, verifier, nonce, linkTo string) (*User, error)
+	ListIdentities(userID string) []Identity
+	RecordLeaderChange(isLeader bool)
+	ListAudit(filter AuditFilter) ([]AuditEntry, error)
+	ExpireStaleLinks(createdBefore time.Time) int
+	ArchivePlayedLinks(playedBefore time.Time) (int64, int64, error)
+	GetNotifications(userID string) []Notification
+	MarkNotificationsRead(userID string, upTo int64) error
+	CreateWebhook(actor, url string, events []string) (string, *Webhook, error)
+	GetWebhook(webhookID int64) (*Webhook, error)
+	ListWebhooks() []Webhook
+	UpdateWebhook(actor string, webhookID int64, url string, events []string) (*Webhook, error)
+	SetWebhookActive(actor string, webhookID int64, active bool) (*Webhook, error)
+	DeleteWebhook(actor string, webhookID int64) error
+	ListWebhookDeliveries(filter WebhookDeliveryFilter) ([]WebhookDelivery, error)
+	RedeliverWebhook(actor string, deliveryID int64) (*WebhookDelivery, error)
+	DueWebhookDeliveries(now time.Time, limit int64) []WebhookDelivery
+	RecordWebhookAttempt(d WebhookDelivery) error
+	PruneWebhookDeliveries(createdBefore time.Time) error
+	QueueTopChanged(top Link)
+	PostChatMessage(userID string, linkID int64, text string) (*ChatMessage, error)
+	ListChatMessages(filter ChatFilter) []ChatMessage
+	DeleteChatMessage(actor string, messageID int64, reason string) (*ChatMessage, error)
+	MuteChatUser(actor, userID string, d time.Duration, reason string) (*ChatMute, error)
+	UnmuteChatUser(actor, userID string) error
+	ListChatMutes() []ChatMute
+	PruneChatMessages(createdBefore time.Time) error
+	PruneChatMutes(now time.Time) error
 	close()
 }
 
 type ServiceImpl struct {
-	linkRepo LinkRepository
-	userRepo UserRepository
-	voteRepo VoteRepository
-	testRepo TestRepository
+	linkRepo  LinkRepository
+	userRepo  UserRepository
+	voteRepo  VoteRepository
+	testRepo  TestRepository
+	auditRepo AuditRepository
+
+	notificationRepo NotificationRepository
+	roleRepo         RoleRepository
+	tokenRepo        TokenRepository
+	guestRepo        GuestRepository
+	rateLimitRepo    RateLimitRepository
+	accessTokenRepo  AccessTokenRepository
+	identityRepo     IdentityRepository
+	skipVoteRepo     SkipVoteRepository
+	webhookRepo      WebhookRepository
+	chatRepo         ChatRepository
+
+	revoked       *RevocationList
+	rateRuleCache *rateRuleCache
+
+	google *GoogleVerifier
+	oidc   map[string]*OIDCProvider
+
+	// ID of the cluster node this service runs on, for the audit log
+	nodeID string
+
+	// on moderated stations new links wait for a moderator's approval
+	moderated bool
+	guests    GuestPolicy
+	// listeners needed to skip a song, 0 turns skipping off
+	skipVotes int64
 }
 
 func (s *ServiceImpl) GetLinkByID(linkID int64) (*Link, error) {
-	return s.linkRepo.GetLinkByID(linkID)
+	l, err := s.linkRepo.GetLinkByID(linkID)
+	if err == sql.ErrNoRows {
+		return nil, ErrLinkNotFound
+	}
+	return l, err
 }
 
 func (s *ServiceImpl) GetUserByID(userID string) *User {
@@ -39,8 +135,77 @@ func (s *ServiceImpl) CreateOrUpdateUser(u User) error {
 	return s.userRepo.CreateOrUpdateUser(u)
 }
 
+// Login records a sign in, creating the user on their first visit
+func (s *ServiceImpl) Login(u User) error {
+	before := s.userRepo.GetUserByID(u.UserID)
+	if err := s.userRepo.CreateOrUpdateUser(u); err != nil {
+		return err
+	}
+	s.audit(u.UserID, auditUserLogin, userTarget(u.UserID), before, u)
+	return nil
+}
+
+// LoginWithGoogle verifies a Google ID token and logs in the user it belongs to
+func (s *ServiceImpl) LoginWithGoogle(idToken string) (*User, error) {
+	u, err := s.google.Verify(idToken)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.Login(*u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// UpdateLink is used by the radio engine as songs move through the queue
 func (s *ServiceImpl) UpdateLink(link Link) error {
-	return s.linkRepo.UpdateLink(link)
+	before, _ := s.linkRepo.GetLinkByID(link.LinkID)
+	if err := s.linkRepo.UpdateLink(link); err != nil {
+		return err
+	}
+	s.audit(auditActorSystem, auditLinkUpdate, linkTarget(link.LinkID), before, link)
+	if before != nil && before.State != link.State {
+		s.publishSong(link)
+	}
+	return nil
+}
+
+// FinishPlaying marks a song as played, unless it stopped playing meanwhile,
+// like when a moderator removed it. It tells whether it did.
+func (s *ServiceImpl) FinishPlaying(linkID int64, reason string) (bool, error) {
+	l, err := s.GetLinkByID(linkID)
+	if err != nil || l.State != linkPlaying {
+		return false, err
+	}
+	before := *l
+	if err = l.Transition(linkPlayed, reason); err != nil {
+		return false, err
+	}
+	if ok, err := s.linkRepo.UpdateLinkIf(*l, linkPlaying); !ok || err != nil {
+		return false, err
+	}
+	s.audit(auditActorSystem, auditLinkUpdate, linkTarget(linkID), before, l)
+	s.publishSong(*l)
+	return true, nil
+}
+
+// RecoverPlayingLinks finishes the songs a leader left playing when it went
+// away, a new leader starts with nothing playing. It returns how many there were.
+func (s *ServiceImpl) RecoverPlayingLinks() int {
+	page, err := s.linkRepo.ListLinks(LinkFilter{State: string(linkPlaying), Limit: maxLinkPageSize})
+	if err != nil {
+		log.Println("failed to list the links left playing", err)
+		return 0
+	}
+	recovered := 0
+	for _, l := range page.Links {
+		if ok, err := s.FinishPlaying(l.LinkID, interruptedByLeaderChange); err != nil {
+			log.Println("failed to finish link", l.LinkID, err)
+		} else if ok {
+			recovered++
+		}
+	}
+	return recovered
 }
 
 func (s *ServiceImpl) SubmitLink(url, userid, dedicatedTo string) (*Link, error) {
@@ -50,12 +215,18 @@ func (s *ServiceImpl) SubmitLink(url, userid, dedicatedTo string) (*Link, error)
 		SubmittedBy: userid,
 		DedicatedTo: dedicatedTo,
 		IsExpired:   false,
+		State:       linkQueued,
 		CreatedAt:   time.Now().Unix(),
 	}
+	if s.moderated {
+		link.State = linkPending
+	}
 	if err := FillYoutubeLinkMeta(&link); err != nil {
 		return nil, err
 	}
 	link.LinkID = s.linkRepo.InsertLink(link)
+	s.audit(userid, auditLinkSubmit, linkTarget(link.LinkID), nil, link)
+	s.publish(webhookLinkSubmitted, link)
 	return &link, nil
 }
 
@@ -63,15 +234,41 @@ func (s *ServiceImpl) GetAllLinks(limit int64) []Link {
 	return s.linkRepo.GetAllLinks(limit)
 }
 
+func (s *ServiceImpl) ListLinks(filter LinkFilter) (*LinkPage, error) {
+	return s.linkRepo.ListLinks(filter)
+}
+
 func (s *ServiceImpl) GetLinksByUser(userID string) []Link {
 	return s.linkRepo.GetLinksByUser(userID)
 }
 
-func (s *ServiceImpl) Vote(linkID int64, userID string, score int64) {
-	s.voteRepo.MarkVote(linkID, userID, score)
+func (s *ServiceImpl) Vote(linkID int64, userID string, score int64) error {
+	l, err := s.GetLinkByID(linkID)
+	if err != nil {
+		return err
+	}
+	if l.State.isFinal() {
+		return ErrLinkNotVotable
+	}
+	if isGuest(userID) {
+		return s.guestVote(linkID, userID, score)
+	}
+	before := s.voteRepo.GetVote(linkID, userID)
+	if before != nil && int64(before.Score) == score {
+		return nil
+	}
+	if err := s.voteRepo.MarkVote(linkID, userID, score); err != nil {
+		return err
+	}
+	s.audit(userID, auditVoteChange, linkTarget(linkID), before,
+		Vote{UserID: userID, LinkID: linkID, Score: int(score)})
+	return nil
 }
 
 func (s *ServiceImpl) GetVotesForUser(links []Link, userID string) map[int64]int64 {
+	if isGuest(userID) {
+		return s.guestVotesFor(links, userID)
+	}
 	linkIDs := make([]int64, len(links))
 	for i, l := range links {
 		linkIDs[i] = l.LinkID
@@ -83,12 +280,68 @@ func (s *ServiceImpl) GetTotalVoteForLinks(linkIDs []int64) map[int64]int64 {
 	return s.voteRepo.TotalVoteForLinks(linkIDs)
 }
 
+func (s *ServiceImpl) ApproveLink(linkID int64, moderatorID string) (*Link, error) {
+	return s.moveLink(linkID, moderatorID, auditLinkApprove, linkQueued, "approved by "+moderatorID)
+}
+
+func (s *ServiceImpl) RejectLink(linkID int64, moderatorID, reason string) (*Link, error) {
+	return s.moveLink(linkID, moderatorID, auditLinkReject, linkRejected, reason)
+}
+
+func (s *ServiceImpl) RemoveLink(linkID int64, moderatorID, reason string) (*Link, error) {
+	return s.moveLink(linkID, moderatorID, auditLinkRemove, linkRemoved, reason)
+}
+
+func (s *ServiceImpl) moveLink(linkID int64, actor, action string, to LinkState, reason string) (*Link, error) {
+	l, err := s.GetLinkByID(linkID)
+	if err != nil {
+		return nil, err
+	}
+	before := *l
+	if err = l.Transition(to, reason); err != nil {
+		return nil, err
+	}
+	// the radio may have moved it on since it was read
+	ok, err := s.linkRepo.UpdateLinkIf(*l, before.State)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrInvalidTransition
+	}
+	s.audit(actor, action, linkTarget(linkID), before, l)
+	return l, nil
+}
+
+func (s *ServiceImpl) RecordLeaderChange(isLeader bool) {
+	role := "follower"
+	if isLeader {
+		role = "leader"
+	}
+	s.audit(nodeTarget(s.nodeID), auditLeaderChange, nodeTarget(s.nodeID),
+		nil, map[string]string{"role": role})
+}
+
+func (s *ServiceImpl) ListAudit(filter AuditFilter) ([]AuditEntry, error) {
+	return s.auditRepo.ListAudit(filter)
+}
+
 func (s *ServiceImpl) Test(message string) {
 	fmt.Println("Testing message", message)
 	s.testRepo.NewTest(message)
 }
 
 func (s *ServiceImpl) close() {
+	s.webhookRepo.close()
+	s.skipVoteRepo.close()
+	s.identityRepo.close()
+	s.accessTokenRepo.close()
+	s.rateLimitRepo.close()
+	s.guestRepo.close()
+	s.tokenRepo.close()
+	s.roleRepo.close()
+	s.notificationRepo.close()
+	s.auditRepo.close()
 	s.voteRepo.close()
 	s.userRepo.close()
 	s.linkRepo.close()
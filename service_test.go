@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testService runs the service on a fresh sqlite database named db, which is
+// deleted when the test is over. It is also the service the handlers use.
+func testService(t *testing.T, db string) *ServiceImpl {
+	os.Setenv("DB_URL", "sqlite://"+db)
+	t.Cleanup(func() {
+		os.Unsetenv("DB_URL")
+		files, _ := filepath.Glob(db + "*")
+		for _, f := range files {
+			os.Remove(f)
+		}
+	})
+
+	s := prepareWebService()
+	t.Cleanup(s.close)
+	service = s
+	return s
+}
+
+// testLink adds a link to the database, in the given state
+func testLink(s *ServiceImpl, videoID string, state LinkState) Link {
+	l := Link{
+		VideoID:     videoID,
+		Title:       "song " + videoID,
+		SubmittedBy: "submitter",
+		State:       state,
+	}
+	l.LinkID = s.linkRepo.InsertLink(l)
+	return l
+}
+
+func TestVoteNeedsAVotableLink(t *testing.T) {
+	s := testService(t, "votetest.db")
+
+	if err := s.Vote(42, "alice", 1); err != ErrLinkNotFound {
+		t.Error("voting on a missing link gave", err)
+	}
+	if s.voteRepo.GetVote(42, "alice") != nil {
+		t.Error("the vote on a missing link was stored")
+	}
+	if entries, _ := s.ListAudit(AuditFilter{Action: auditVoteChange}); len(entries) > 0 {
+		t.Error("the vote on a missing link was audited", entries)
+	}
+
+	for _, state := range []LinkState{linkPlayed, linkRemoved, linkUnavailable} {
+		l := testLink(s, "aaaaaaaaaaa", state)
+		if err := s.Vote(l.LinkID, "alice", 1); err != ErrLinkNotVotable {
+			t.Error("voting on a", state, "link gave", err)
+		}
+	}
+	for _, state := range []LinkState{linkQueued, linkPlaying} {
+		l := testLink(s, "bbbbbbbbbbb", state)
+		if err := s.Vote(l.LinkID, "alice", 1); err != nil {
+			t.Error("voting on a", state, "link gave", err)
+		}
+	}
+}
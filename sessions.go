@@ -0,0 +1,256 @@
+package main
+
+// this file deals with sessions, refresh tokens and revocation
+//
+// login starts a session and hands out a short-lived access token (a JWT
+// carrying the session ID as "sid") and a refresh token. The refresh token is
+// random, stored hashed, and good for one use: refreshing returns a new pair
+// in the same session. Presenting a used refresh token again means it leaked,
+// so the whole session is revoked.
+//
+// Access tokens can't be taken back, so revoking a session or a user also
+// puts it on the revocation list, which requireJWT checks. The list is kept
+// in memory on every node: revocations are broadcast over the cluster mesh,
+// and reloaded from the database now and then in case a broadcast was missed.
+// Entries only live as long as the access tokens they cover.
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/google/uuid"
+)
+
+const (
+	accessTokenTTL        = time.Minute * 15
+	refreshTokenTTL       = time.Hour * 24 * 30
+	revocationReloadEvery = time.Second * 30
+
+	// cluster topic revocations are broadcast on
+	revocationTopic = "revocation"
+)
+
+var ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+
+// RevocationList is the in-memory copy of the revocations table
+type RevocationList struct {
+	// session ID to when the entry can be dropped
+	sessions map[string]int64
+	// user ID to revocation time, tokens issued before then are rejected
+	users map[string]Revocation
+	mutex *sync.RWMutex
+
+	// publish sends a new revocation to the other nodes, if set
+	publish func(r Revocation)
+}
+
+func NewRevocationList() *RevocationList {
+	return &RevocationList{
+		sessions: make(map[string]int64),
+		users:    make(map[string]Revocation),
+		mutex:    &sync.RWMutex{},
+	}
+}
+
+// Add applies a revocation made here or on another node
+func (l *RevocationList) Add(r Revocation) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if r.SessionID != "" {
+		if r.ExpiresAt > l.sessions[r.SessionID] {
+			l.sessions[r.SessionID] = r.ExpiresAt
+		}
+		return
+	}
+	if r.RevokedAt >= l.users[r.UserID].RevokedAt {
+		l.users[r.UserID] = r
+	}
+}
+
+// Load merges revocations read from the database, and drops the ones
+// whose access tokens have all expired by now
+func (l *RevocationList) Load(revocations []Revocation, now int64) {
+	for _, r := range revocations {
+		l.Add(r)
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for sessionID, expiresAt := range l.sessions {
+		if expiresAt <= now {
+			delete(l.sessions, sessionID)
+		}
+	}
+	for userID, r := range l.users {
+		if r.ExpiresAt <= now {
+			delete(l.users, userID)
+		}
+	}
+}
+
+// IsRevoked tells if a token of the session, issued at issuedAt in milliseconds, is revoked
+func (l *RevocationList) IsRevoked(userID, sessionID string, issuedAt int64) bool {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	if _, ok := l.sessions[sessionID]; ok {
+		return true
+	}
+	r, ok := l.users[userID]
+	return ok && issuedAt < r.RevokedAt
+}
+
+func hashToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+func newRandomToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// CreateSession starts a session for a user who just logged in,
+// and returns its refresh token and ID
+func (s *ServiceImpl) CreateSession(userID string) (string, string, error) {
+	u, _ := uuid.NewRandom()
+	sessionID := u.String()
+	raw, err := s.issueRefreshToken(userID, sessionID)
+	return raw, sessionID, err
+}
+
+func (s *ServiceImpl) issueRefreshToken(userID, sessionID string) (string, error) {
+	now := time.Now()
+	raw := newRandomToken()
+	err := s.tokenRepo.InsertRefreshToken(RefreshToken{
+		TokenHash: hashToken(raw),
+		UserID:    userID,
+		SessionID: sessionID,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(refreshTokenTTL).Unix(),
+	})
+	return raw, err
+}
+
+// RefreshSession trades a refresh token for a new one in the same session.
+// It returns the new token along with the old one, which says whose it is.
+func (s *ServiceImpl) RefreshSession(raw string) (string, *RefreshToken, error) {
+	t := s.tokenRepo.GetRefreshToken(hashToken(raw))
+	if t == nil || t.Revoked || t.ExpiresAt <= time.Now().Unix() {
+		return "", nil, ErrInvalidRefreshToken
+	}
+
+	fresh, err := s.tokenRepo.UseRefreshToken(t.TokenHash)
+	if err != nil {
+		return "", nil, err
+	}
+	if !fresh {
+		// somebody else has this token, end the session for both of them
+		log.Println("refresh token reused, revoking session", t.SessionID)
+		if err = s.revoke(t.UserID, t.SessionID); err != nil {
+			return "", nil, err
+		}
+		s.audit(auditActorSystem, auditTokenReuse, userTarget(t.UserID), nil,
+			map[string]string{"session_id": t.SessionID})
+		return "", nil, ErrInvalidRefreshToken
+	}
+
+	next, err := s.issueRefreshToken(t.UserID, t.SessionID)
+	if err != nil {
+		return "", nil, err
+	}
+	return next, t, nil
+}
+
+// Logout ends a single session
+func (s *ServiceImpl) Logout(userID, sessionID string) error {
+	if sessionID == "" {
+		return nil
+	}
+	if err := s.revoke(userID, sessionID); err != nil {
+		return err
+	}
+	s.audit(userID, auditUserLogout, userTarget(userID), nil,
+		map[string]string{"session_id": sessionID})
+	return nil
+}
+
+// LogoutEverywhere ends every session of a user, actor is either the user or an admin
+func (s *ServiceImpl) LogoutEverywhere(actor, userID string) error {
+	if err := s.revoke(userID, ""); err != nil {
+		return err
+	}
+	s.audit(actor, auditUserRevokeTokens, userTarget(userID), nil, nil)
+	return nil
+}
+
+// revoke kills the refresh tokens of a session, or every session when sessionID
+// is empty, and puts the access tokens already out there on the revocation list
+func (s *ServiceImpl) revoke(userID, sessionID string) error {
+	if err := s.tokenRepo.RevokeRefreshTokens(userID, sessionID); err != nil {
+		return err
+	}
+	now := time.Now()
+	r := Revocation{
+		SessionID: sessionID,
+		UserID:    userID,
+		RevokedAt: now.UnixNano() / int64(time.Millisecond),
+		ExpiresAt: now.Add(accessTokenTTL).Unix(),
+	}
+	if err := s.tokenRepo.AddRevocation(r); err != nil {
+		return err
+	}
+	s.revoked.Add(r)
+	if s.revoked.publish != nil {
+		// the mesh may be busy, the periodic reload covers a lost message
+		go s.revoked.publish(r)
+	}
+	return nil
+}
+
+// IsTokenRevoked tells if an access token was revoked before it expired
+func (s *ServiceImpl) IsTokenRevoked(claims jwt.MapClaims) bool {
+	userID, _ := claims["user_id"].(string)
+	sessionID, _ := claims["sid"].(string)
+	issuedAt, _ := claims["iat"].(float64)
+	if sessionID == "" {
+		// issued before sessions existed, or not by us
+		return true
+	}
+	return s.revoked.IsRevoked(userID, sessionID, int64(math.Round(issuedAt*1000)))
+}
+
+// issuedAt is the iat of a token. It has milliseconds, which JWTs allow,
+// so a revocation can tell apart the tokens of the second it was made in.
+func issuedAt(t time.Time) float64 {
+	return float64(t.UnixNano()/int64(time.Millisecond)) / 1000
+}
+
+// WatchRevocations loads the revocation list, and keeps reloading it
+func (s *ServiceImpl) WatchRevocations() {
+	now := time.Now().Unix()
+	s.revoked.Load(s.tokenRepo.ActiveRevocations(now), now)
+	go func() {
+		ticker := time.NewTicker(revocationReloadEvery)
+		defer ticker.Stop()
+		for t := range ticker.C {
+			s.revoked.Load(s.tokenRepo.ActiveRevocations(t.Unix()), t.Unix())
+		}
+	}()
+}
+
+func (s *ServiceImpl) DeleteExpiredTokens(now time.Time) error {
+	return s.tokenRepo.DeleteExpiredTokens(now.Unix())
+}
@@ -0,0 +1,79 @@
+package main
+
+// this file lets listeners vote to skip the song playing
+//
+// a vote to skip is for the link playing right now, and counts once per user.
+// The leader's radio checks the votes on every tick, and moves on to the next
+// song once -skipvotes listeners want to. Guests can't vote to skip.
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// the state_reason of songs the listeners skipped
+const skippedByListeners = "skipped by listeners"
+
+var (
+	ErrSkipVotingDisabled = errors.New("voting to skip is turned off on this station")
+	ErrNotPlaying         = errors.New("the link isn't playing")
+)
+
+// SkipVote records a vote to skip linkID, and returns how many want it skipped
+func (s *ServiceImpl) SkipVote(linkID int64, userID string) (*SkipTally, error) {
+	if s.skipVotes <= 0 {
+		return nil, ErrSkipVotingDisabled
+	}
+	l, err := s.GetLinkByID(linkID)
+	if err != nil {
+		return nil, err
+	}
+	if l.State != linkPlaying {
+		return nil, ErrNotPlaying
+	}
+
+	added, err := s.skipVoteRepo.AddSkipVote(linkID, userID, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	tally := &SkipTally{LinkID: linkID, Votes: s.skipVoteRepo.CountSkipVotes(linkID), Needed: s.skipVotes}
+	if added {
+		s.audit(userID, auditSkipVote, linkTarget(linkID), nil, tally)
+	}
+	return tally, nil
+}
+
+// ShouldSkip tells the radio whether enough listeners want linkID skipped
+func (s *ServiceImpl) ShouldSkip(linkID int64) bool {
+	return s.skipVotes > 0 && s.skipVoteRepo.CountSkipVotes(linkID) >= s.skipVotes
+}
+
+// ClearSkipVotes drops the votes on a link which stopped playing
+func (s *ServiceImpl) ClearSkipVotes(linkID int64) error {
+	return s.skipVoteRepo.DeleteSkipVotes(linkID)
+}
+
+func skipLinkHandler(c echo.Context) error {
+	form := struct {
+		LinkID int64 `form:"link_id" validate:"required"`
+	}{}
+	if err := c.Bind(&form); err != nil || form.LinkID == 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"message": "Missing link_id",
+		})
+	}
+
+	tally, err := service.SkipVote(form.LinkID, getUserIDFromContext(c))
+	if status := voteErrorStatus(err); status != 0 {
+		return c.JSON(status, echo.Map{
+			"message": err.Error(),
+		})
+	}
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, tally)
+}
@@ -0,0 +1,331 @@
+package main
+
+// this file serves /api/stream, all the live updates over one SSE connection
+//
+// events are named after their topic: nowPlaying, queue, playerTime,
+// dedication (who the song playing is dedicated to, or null) and myLinks.
+// The chat topic has two events, chat for a message and chatDeleted for one
+// a moderator took back, see chat_hub.go.
+// ?topics= picks some of them, the default is all there are for the listener.
+//
+// The StreamHub keeps the latest state of each radio topic, and numbers every
+// change. Events carry "<epoch>-<seq>" ids, so a reconnecting EventSource
+// sends the last one back as Last-Event-ID and gets only the topics which
+// changed since. A connection starts with the current state of everything
+// else, and comments keep it alive in between.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	dedicationTopic = "dedication"
+
+	streamHeartbeatEvery = time.Second * 15
+	// how long browsers wait before reconnecting
+	streamRetryMs = 3000
+)
+
+// streamTopics are the topics the hub keeps, myLinks is per user
+var streamTopics = []string{
+	string(nowPlayingHook), string(queueHook), string(playerTimeHook), dedicationTopic,
+}
+
+type streamState struct {
+	value interface{}
+	raw   []byte
+	seq   int64
+}
+
+type streamEvent struct {
+	topic string
+	value interface{}
+	seq   int64
+}
+
+// StreamHub follows the radio, and wakes the streams when something changes
+type StreamHub struct {
+	// tells ids from a previous run of the node apart
+	epoch string
+	seq   int64
+
+	states    map[string]*streamState
+	listeners map[chan struct{}]bool
+	mutex     *sync.Mutex
+}
+
+func NewStreamHub() *StreamHub {
+	return &StreamHub{
+		epoch:     strconv.FormatInt(time.Now().UnixNano(), 36),
+		states:    make(map[string]*streamState),
+		listeners: make(map[chan struct{}]bool),
+		mutex:     &sync.Mutex{},
+	}
+}
+
+// Watch starts following the radio's hooks
+func (h *StreamHub) Watch(r *Radio) {
+	for _, hookType := range []HookType{nowPlayingHook, queueHook, playerTimeHook} {
+		h.Publish(string(hookType), hookState(hookType))
+		go h.follow(r, hookType)
+	}
+}
+
+func (h *StreamHub) follow(r *Radio, hookType HookType) {
+	for {
+		id, hookChan := r.RegisterHook(hookType)
+		for state := range hookChan {
+			h.Publish(string(hookType), state)
+		}
+		// the radio closes its hooks when switching modes
+		r.DeregisterHook(hookType, id)
+	}
+}
+
+// Publish records the state of a topic, if it changed
+func (h *StreamHub) Publish(topic string, value interface{}) {
+	// the radio keeps changing its own copy
+	switch v := value.(type) {
+	case []Link:
+		value = append([]Link{}, v...)
+	case *Link:
+		if v != nil {
+			link := *v
+			value = &link
+		}
+	}
+	if !h.set(topic, value) {
+		return
+	}
+	if topic == string(nowPlayingHook) {
+		h.set(dedicationTopic, dedicationOf(value))
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for l := range h.listeners {
+		select {
+		case l <- struct{}{}:
+		default:
+			// already woken up
+		}
+	}
+}
+
+// set stores the state of a topic, and tells whether it changed
+func (h *StreamHub) set(topic string, value interface{}) bool {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		log.Println("failed to marshal", topic, "for streams", err)
+		return false
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if s, ok := h.states[topic]; ok && bytes.Equal(s.raw, raw) {
+		return false
+	}
+	h.seq++
+	h.states[topic] = &streamState{value: value, raw: raw, seq: h.seq}
+	return true
+}
+
+// Since returns the states of topics which changed after seq, oldest first
+func (h *StreamHub) Since(seq int64, topics map[string]bool) []streamEvent {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	events := make([]streamEvent, 0)
+	for _, topic := range streamTopics {
+		if s, ok := h.states[topic]; ok && topics[topic] && s.seq > seq {
+			events = append(events, streamEvent{topic: topic, value: s.value, seq: s.seq})
+		}
+	}
+	// in order, so the id a client saw last covers everything before it
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].seq < events[j].seq
+	})
+	return events
+}
+
+func (h *StreamHub) listen() chan struct{} {
+	l := make(chan struct{}, 1)
+	h.mutex.Lock()
+	h.listeners[l] = true
+	h.mutex.Unlock()
+	return l
+}
+
+func (h *StreamHub) unlisten(l chan struct{}) {
+	h.mutex.Lock()
+	delete(h.listeners, l)
+	h.mutex.Unlock()
+}
+
+func (h *StreamHub) eventID(seq int64) string {
+	return h.epoch + "-" + strconv.FormatInt(seq, 10)
+}
+
+// resumeFrom returns the seq a Last-Event-ID stands for, 0 when it is from another run or node
+func (h *StreamHub) resumeFrom(lastEventID string) int64 {
+	parts := strings.SplitN(lastEventID, "-", 2)
+	if len(parts) != 2 || parts[0] != h.epoch {
+		return 0
+	}
+	seq, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || seq < 0 {
+		return 0
+	}
+	return seq
+}
+
+func streamHandler(c echo.Context) error {
+	userID := streamUserID(c)
+
+	topics := make(map[string]bool)
+	if list := splitList(c.QueryParam("topics")); len(list) > 0 {
+		for _, topic := range list {
+			topics[topic] = true
+		}
+	} else {
+		for _, topic := range streamTopics {
+			topics[topic] = true
+		}
+		topics[myLinksTopic] = userID != ""
+		topics[chatTopic] = true
+	}
+	for topic := range topics {
+		known := topic == myLinksTopic || topic == dedicationTopic || topic == chatTopic ||
+			IsValidHookType(HookType(topic))
+		if !known {
+			return c.JSON(http.StatusBadRequest, echo.Map{
+				"message": "Invalid topic " + topic,
+			})
+		}
+	}
+	if topics[myLinksTopic] && userID == "" {
+		return c.JSON(http.StatusUnauthorized, echo.Map{
+			"message": "Sign in to stream your links",
+		})
+	}
+
+	w := c.Response()
+	f, ok := w.Writer.(http.Flusher)
+	if !ok {
+		return c.String(http.StatusInternalServerError, "Streaming unsupported")
+	}
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", streamRetryMs)
+
+	// EventSource sends the header, ?last_event_id= is for clients which can't
+	lastEventID := c.Request().Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.QueryParam("last_event_id")
+	}
+	seq := streams.resumeFrom(lastEventID)
+
+	for topic, on := range topics {
+		if on {
+			sseSubscribers.Inc("stream", topic)
+			defer sseSubscribers.Add(-1, "stream", topic)
+		}
+	}
+
+	wake := streams.listen()
+	defer streams.unlisten(wake)
+	chatWake := chats.listen()
+	defer chats.unlisten(chatWake)
+	heartbeat := time.NewTicker(streamHeartbeatEvery)
+	defer heartbeat.Stop()
+	myLinks := time.NewTicker(myLinksEvery)
+	defer myLinks.Stop()
+	var lastMyLinks []byte
+
+	sendChanges := func() {
+		for _, e := range streams.Since(seq, topics) {
+			value := e.value
+			switch e.topic {
+			case string(queueHook):
+				value = queueWithVotes(value.([]Link), userID)
+			case string(nowPlayingHook):
+				value = describeNowPlaying(value.(*Link), userID)
+			}
+			writeStreamEvent(w, streams.eventID(e.seq), e.topic, value)
+			seq = e.seq
+		}
+		f.Flush()
+	}
+	// my links have no id, they are sent again after reconnecting
+	sendMyLinks := func() {
+		raw, err := json.Marshal(service.GetLinksByUser(userID))
+		if err != nil || bytes.Equal(raw, lastMyLinks) {
+			return
+		}
+		lastMyLinks = raw
+		fmt.Fprint(w, "event: ", myLinksTopic, "\ndata: ", string(raw), "\n\n")
+		f.Flush()
+	}
+
+	backlog, chatSeq := chats.Backlog()
+	sendChat := func() {
+		for _, e := range chats.Since(chatSeq) {
+			writeChatEvent(w, e.Kind, e.data())
+			chatSeq = e.seq
+		}
+		f.Flush()
+	}
+
+	sendChanges()
+	if topics[myLinksTopic] {
+		sendMyLinks()
+	}
+	if topics[chatTopic] {
+		for _, m := range backlog {
+			writeChatEvent(w, chatTopic, m)
+		}
+		// anything said since the backlog was taken
+		sendChat()
+	}
+	for {
+		select {
+		case <-wake:
+			sendChanges()
+		case <-chatWake:
+			if topics[chatTopic] {
+				sendChat()
+			}
+		case <-myLinks.C:
+			if topics[myLinksTopic] {
+				sendMyLinks()
+			}
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			f.Flush()
+		case <-c.Request().Context().Done():
+			return nil
+		}
+	}
+}
+
+func writeStreamEvent(w http.ResponseWriter, id, topic string, value interface{}) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		log.Println("failed to marshal", topic, "for a stream", err)
+		return
+	}
+	fmt.Fprint(w, "id: ", id, "\nevent: ", topic, "\ndata: ", string(raw), "\n\n")
+}
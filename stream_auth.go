@@ -0,0 +1,110 @@
+package main
+
+// this file authenticates the SSE endpoints
+//
+// EventSource can't send an Authorization header, so a stream accepts our JWT
+// from one of two places:
+//   - the HttpOnly cookie set on login
+//   - a short-lived stream ticket from POST /api/stream_ticket, passed as ?ticket=
+// A ticket is a JWT too, but only good for opening streams.
+// Streams without either are anonymous and only get what everyone can see.
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+)
+
+const (
+	authCookieName  = "upnext_token"
+	streamTicketTTL = time.Minute
+
+	// value of the "typ" claim on stream tickets
+	streamTicketType = "stream"
+)
+
+// setAuthCookie hands the browser the same token it gets in the login response
+func setAuthCookie(c echo.Context, token string, expires time.Time) {
+	c.SetCookie(&http.Cookie{
+		Name:     authCookieName,
+		Value:    token,
+		Path:     "/api",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   c.IsTLS(),
+	})
+}
+
+// clearAuthCookie removes the cookie on logout
+func clearAuthCookie(c echo.Context) {
+	c.SetCookie(&http.Cookie{
+		Name:     authCookieName,
+		Path:     "/api",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   c.IsTLS(),
+	})
+}
+
+func streamTicketHandler(c echo.Context) error {
+	now := time.Now()
+	expires := now.Add(streamTicketTTL)
+	claims := c.Get("user").(*jwt.Token).Claims.(jwt.MapClaims)
+	// tickets belong to the session they were asked for in, and die with it
+	ticket, err := keyring.Sign(jwt.MapClaims{
+		"user_id": getUserIDFromContext(c),
+		"sid":     claims["sid"],
+		"typ":     streamTicketType,
+		"iat":     issuedAt(now),
+		"exp":     expires.Unix(),
+	})
+	if err == ErrCannotSign {
+		return c.JSON(http.StatusServiceUnavailable, echo.Map{
+			"message": err.Error(),
+		})
+	}
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"ticket":     ticket,
+		"expires_at": expires.Unix(),
+	})
+}
+
+// isStreamTicket tells tickets apart from login tokens
+func isStreamTicket(token *jwt.Token) bool {
+	typ, _ := token.Claims.(jwt.MapClaims)["typ"].(string)
+	return typ == streamTicketType
+}
+
+// streamUserID returns the user a stream is opened by, or "" for anonymous listeners
+func streamUserID(c echo.Context) string {
+	userID, _ := streamClaims(c)["user_id"].(string)
+	return userID
+}
+
+// streamClaims returns the claims of the cookie or ticket a stream is opened with, if any
+func streamClaims(c echo.Context) jwt.MapClaims {
+	var raw string
+	ticket := c.QueryParam("ticket") != ""
+	if ticket {
+		raw = c.QueryParam("ticket")
+	} else if cookie, err := c.Cookie(authCookieName); err == nil {
+		raw = cookie.Value
+	} else {
+		return nil
+	}
+
+	token, err := keyring.Parse(raw)
+	if err != nil || !token.Valid || isStreamTicket(token) != ticket {
+		return nil
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	if service.IsTokenRevoked(claims) {
+		return nil
+	}
+	return claims
+}
@@ -0,0 +1,961 @@
+package main
+
+// this file serves /api/v2
+//
+// v2 has the routes of v1 under the same names, except the streams and the
+// stream tickets they take, the browser redirects of OpenID Connect, and
+// /isLeader which load balancers read by its status code. Unlike v1:
+//   - request bodies can be JSON, forms still work
+//   - requests are checked against their `validate` tags, see validate.go
+//   - every response is an envelope, {"data": ...} on success and
+//     {"error": {"code", "message", "details"}} otherwise
+//   - a missing link is a 404, a change its state doesn't allow a 409,
+//     and a request which doesn't validate a 422 naming the fields at fault
+// v1 stays as it is for the current frontend.
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+)
+
+const v2Prefix = "/api/v2"
+
+// apiError is what went wrong with a v2 request
+type apiError struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+type v2ErrorKind struct {
+	status int
+	code   string
+}
+
+// v2Errors are the errors of the service a client can do something about,
+// anything else is answered with a 500
+var v2Errors = map[error]v2ErrorKind{
+	ErrLinkNotFound:            {http.StatusNotFound, "link_not_found"},
+	ErrAccessTokenNotFound:     {http.StatusNotFound, "access_token_not_found"},
+	ErrWebhookNotFound:         {http.StatusNotFound, "webhook_not_found"},
+	ErrWebhookDeliveryNotFound: {http.StatusNotFound, "webhook_delivery_not_found"},
+	ErrRoleNotGranted:          {http.StatusNotFound, "role_not_granted"},
+	ErrChatMessageNotFound:     {http.StatusNotFound, "chat_message_not_found"},
+	ErrChatMuteNotFound:        {http.StatusNotFound, "mute_not_found"},
+	ErrInvalidTransition:       {http.StatusConflict, "invalid_transition"},
+	ErrNotPlaying:              {http.StatusConflict, "not_playing"},
+	ErrLinkNotVotable:          {http.StatusConflict, "link_not_votable"},
+	ErrLastAdmin:               {http.StatusConflict, "last_admin"},
+	ErrIdentityLinked:          {http.StatusConflict, "identity_linked"},
+	ErrNothingPlaying:          {http.StatusConflict, "nothing_playing"},
+	ErrInvalidCursor:           {http.StatusUnprocessableEntity, "invalid_cursor"},
+	ErrInvalidFilter:           {http.StatusUnprocessableEntity, "invalid_filter"},
+	ErrInvalidScopes:           {http.StatusUnprocessableEntity, "invalid_scopes"},
+	ErrInvalidRole:             {http.StatusUnprocessableEntity, "invalid_role"},
+	ErrInvalidRateRule:         {http.StatusUnprocessableEntity, "invalid_rate_rule"},
+	ErrInvalidWebhookURL:       {http.StatusUnprocessableEntity, "invalid_webhook_url"},
+	ErrInvalidWebhookEvents:    {http.StatusUnprocessableEntity, "invalid_webhook_events"},
+	ErrInvalidChatMessage:      {http.StatusUnprocessableEntity, "invalid_chat_message"},
+	ErrInvalidMuteDuration:     {http.StatusUnprocessableEntity, "invalid_mute_duration"},
+	ErrGuestVotingDisabled:     {http.StatusForbidden, "guest_voting_disabled"},
+	ErrSkipVotingDisabled:      {http.StatusForbidden, "skip_voting_disabled"},
+	ErrMuted:                   {http.StatusForbidden, "muted"},
+	ErrGuestVoteCapReached:     {http.StatusTooManyRequests, "guest_vote_cap_reached"},
+	ErrInvalidIDToken:          {http.StatusUnauthorized, "invalid_id_token"},
+	ErrInvalidRefreshToken:     {http.StatusUnauthorized, "invalid_refresh_token"},
+	ErrGoogleLoginDisabled:     {http.StatusServiceUnavailable, "login_disabled"},
+	ErrCannotSign:              {http.StatusServiceUnavailable, "cannot_sign"},
+}
+
+// codes of errors raised by echo and the middlewares, which only have a status
+var v2StatusCodes = map[int]string{
+	http.StatusBadRequest:            "bad_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusConflict:              "conflict",
+	http.StatusRequestEntityTooLarge: "too_large",
+	http.StatusUnsupportedMediaType:  "unsupported_media_type",
+	http.StatusUnprocessableEntity:   "validation_failed",
+	http.StatusTooManyRequests:       "rate_limited",
+	http.StatusBadGateway:            "bad_gateway",
+	http.StatusServiceUnavailable:    "unavailable",
+}
+
+func v2Fail(status int, code, message string, details interface{}) error {
+	return &echo.HTTPError{
+		Code:    status,
+		Message: &apiError{Code: code, Message: message, Details: details},
+	}
+}
+
+// v2Err answers with the error of the service, if the client can do something about it
+func v2Err(err error) error {
+	if kind, ok := v2Errors[err]; ok {
+		return v2Fail(kind.status, kind.code, err.Error(), nil)
+	}
+	return err
+}
+
+func v2Data(c echo.Context, data interface{}) error {
+	return c.JSON(http.StatusOK, echo.Map{
+		"data": data,
+	})
+}
+
+// v2Bind reads a request into req and validates it. Requests without
+// a body are only validated, so missing fields come back as a 422.
+func v2Bind(c echo.Context, req interface{}) error {
+	r := c.Request()
+	if r.ContentLength != 0 || r.Method == http.MethodGet {
+		if err := c.Bind(req); err != nil {
+			if he, ok := err.(*echo.HTTPError); ok && he.Code == http.StatusUnsupportedMediaType {
+				return v2Fail(he.Code, "unsupported_media_type", "Send JSON or a form", nil)
+			}
+			return v2Fail(http.StatusBadRequest, "bad_request", "Malformed request", nil)
+		}
+	}
+	if err := c.Validate(req); err != nil {
+		if errs, ok := err.(ValidationErrors); ok {
+			return v2Fail(http.StatusUnprocessableEntity, "validation_failed", "Invalid request", errs)
+		}
+		return err
+	}
+	return nil
+}
+
+// httpErrorHandler answers v2 requests with an error envelope, and the rest like echo always has
+func httpErrorHandler(e *echo.Echo) echo.HTTPErrorHandler {
+	return func(err error, c echo.Context) {
+		if !strings.HasPrefix(c.Request().URL.Path, v2Prefix+"/") {
+			e.DefaultHTTPErrorHandler(err, c)
+			return
+		}
+
+		status := http.StatusInternalServerError
+		body := &apiError{Code: "internal", Message: http.StatusText(status)}
+		if he, ok := err.(*echo.HTTPError); ok {
+			status = he.Code
+			body = v2ErrorBody(he)
+		} else {
+			log.Println("failed to serve", c.Request().Method, c.Path(), err)
+		}
+
+		if c.Response().Committed {
+			return
+		}
+		if c.Request().Method == http.MethodHead {
+			err = c.NoContent(status)
+		} else {
+			err = c.JSON(status, echo.Map{
+				"error": body,
+			})
+		}
+		if err != nil {
+			e.Logger.Error(err)
+		}
+	}
+}
+
+func v2ErrorBody(he *echo.HTTPError) *apiError {
+	code, ok := v2StatusCodes[he.Code]
+	if !ok {
+		code = "internal"
+	}
+	switch m := he.Message.(type) {
+	case *apiError:
+		return m
+	case string:
+		return &apiError{Code: code, Message: m}
+	case echo.Map:
+		// the rate limiter tells when to retry next to the message
+		body := &apiError{Code: code}
+		details := make(echo.Map)
+		for k, v := range m {
+			if k == "message" {
+				body.Message, _ = v.(string)
+			} else {
+				details[k] = v
+			}
+		}
+		if len(details) > 0 {
+			body.Details = details
+		}
+		return body
+	}
+	return &apiError{Code: code, Message: http.StatusText(he.Code)}
+}
+
+// v2Requests are the requests v2Bind validates, their tags are checked when the router is built
+var v2Requests = []interface{}{
+	v2LoginRequest{}, v2RefreshTokenRequest{},
+	v2ListLinksRequest{}, v2NewLinkRequest{}, v2LinkRequest{},
+	v2ChatRequest{}, v2SayInChatRequest{}, v2DeleteChatMessageRequest{}, v2MuteChatUserRequest{}, v2UserRequest{},
+	v2CreateAccessTokenRequest{}, v2RevokeAccessTokenRequest{},
+	v2ReadNotificationsRequest{},
+	v2PendingLinksRequest{}, v2ModerationRequest{},
+	v2AuditLogRequest{}, v2RolesRequest{}, v2RoleRequest{}, v2SetRateLimitRequest{},
+	v2CreateWebhookRequest{}, v2UpdateWebhookRequest{}, v2WebhookRequest{},
+	v2WebhookDeliveriesRequest{}, v2RedeliverWebhookRequest{},
+}
+
+// registerV2 adds the v2 routes, with the same middlewares as their v1 counterparts
+func registerV2(r *echo.Echo) {
+	validator, err := newTagValidator(v2Requests...)
+	if err != nil {
+		log.Fatal("bad validate tag, ", err)
+	}
+	r.Validator = validator
+
+	v2 := r.Group(v2Prefix)
+	v2.GET("/health", v2HealthHandler)
+	v2.GET("/cluster", v2ClusterHandler)
+	v2.POST("/login", v2LoginHandler)
+	v2.POST("/guest", v2GuestHandler, rateLimit(rateEndpointGuest))
+	v2.POST("/token/refresh", v2RefreshTokenHandler)
+	v2.POST("/logout", v2LogoutHandler, requireJWT)
+	v2.POST("/logout/everywhere", v2LogoutEverywhereHandler, requireJWT)
+	v2.GET("/oidc/providers", v2OIDCProvidersHandler)
+	v2.GET("/identities", v2IdentitiesHandler, requireJWT, requireAccount)
+
+	v2.GET("/links", v2ListLinksHandler, requireJWT)
+	v2.GET("/link/:id", v2LinkByIDHandler, requireJWT)
+	v2.POST("/link/new", v2NewLinkHandler, requireJWT, requireAccount, rateLimit(rateEndpointSubmit))
+	v2.POST("/link/upvote", v2UpvoteLinkHandler, requireJWT, rateLimit(rateEndpointVote))
+	v2.POST("/link/downvote", v2DownvoteLinkHandler, requireJWT, rateLimit(rateEndpointVote))
+	v2.POST("/link/skip", v2SkipLinkHandler, requireJWT, requireAccount, rateLimit(rateEndpointVote))
+
+	v2.GET("/radio/now_playing", v2NowPlayingHandler, requireJWT)
+	v2.GET("/radio/queue", v2QueueHandler, requireJWT)
+
+	v2.GET("/chat", v2ChatHandler, requireJWT)
+	v2.POST("/chat", v2SayInChatHandler, requireJWT, requireAccount, rateLimit(rateEndpointChat))
+
+	v2.GET("/tokens", v2AccessTokensHandler, requireJWT, requireAccount)
+	v2.POST("/tokens", v2CreateAccessTokenHandler, requireJWT, requireAccount)
+	v2.POST("/tokens/revoke", v2RevokeAccessTokenHandler, requireJWT, requireAccount)
+
+	v2.GET("/notifications", v2NotificationsHandler, requireJWT, requireAccount)
+	v2.POST("/notifications/read", v2ReadNotificationsHandler, requireJWT, requireAccount)
+
+	moderator := []echo.MiddlewareFunc{requireJWT, requireRole(roleModerator)}
+	v2.GET("/moderation/pending", v2PendingLinksHandler, moderator...)
+	v2.POST("/moderation/approve", v2ApproveLinkHandler, moderator...)
+	v2.POST("/moderation/reject", v2RejectLinkHandler, moderator...)
+	v2.POST("/moderation/remove", v2RemoveLinkHandler, moderator...)
+	v2.GET("/moderation/chat/mutes", v2ChatMutesHandler, moderator...)
+	v2.POST("/moderation/chat/delete", v2DeleteChatMessageHandler, moderator...)
+	v2.POST("/moderation/chat/mute", v2MuteChatUserHandler, moderator...)
+	v2.POST("/moderation/chat/unmute", v2UnmuteChatUserHandler, moderator...)
+
+	admin := []echo.MiddlewareFunc{requireJWT, requireRole(roleAdmin)}
+	v2.GET("/admin/audit", v2AuditLogHandler, admin...)
+	v2.GET("/admin/roles", v2RolesHandler, admin...)
+	v2.POST("/admin/roles/grant", v2GrantRoleHandler, admin...)
+	v2.POST("/admin/roles/revoke", v2RevokeRoleHandler, admin...)
+	v2.POST("/admin/users/revoke_tokens", v2RevokeUserTokensHandler, admin...)
+	v2.GET("/admin/rate_limits", v2RateLimitsHandler, admin...)
+	v2.POST("/admin/rate_limits", v2SetRateLimitHandler, admin...)
+	v2.GET("/admin/webhooks", v2WebhooksHandler, admin...)
+	v2.POST("/admin/webhooks", v2CreateWebhookHandler, admin...)
+	v2.POST("/admin/webhooks/update", v2UpdateWebhookHandler, admin...)
+	v2.POST("/admin/webhooks/pause", v2PauseWebhookHandler, admin...)
+	v2.POST("/admin/webhooks/resume", v2ResumeWebhookHandler, admin...)
+	v2.POST("/admin/webhooks/delete", v2DeleteWebhookHandler, admin...)
+	v2.GET("/admin/webhooks/deliveries", v2WebhookDeliveriesHandler, admin...)
+	v2.POST("/admin/webhooks/redeliver", v2RedeliverWebhookHandler, admin...)
+}
+
+func v2HealthHandler(c echo.Context) error {
+	return v2Data(c, echo.Map{
+		"status":  "up",
+		"node_id": nodeID,
+	})
+}
+
+func v2ClusterHandler(c echo.Context) error {
+	return v2Data(c, clusterStatusJSON(clusterStatus()))
+}
+
+// auth
+
+type v2LoginRequest struct {
+	IDToken string `json:"id_token" form:"id_token" validate:"required"`
+}
+
+func v2LoginHandler(c echo.Context) error {
+	var req v2LoginRequest
+	if err := v2Bind(c, &req); err != nil {
+		return err
+	}
+	u, err := service.LoginWithGoogle(req.IDToken)
+	if err != nil {
+		return v2Err(err)
+	}
+	upgradeGuest(c, u.UserID)
+	refreshToken, sessionID, err := service.CreateSession(u.UserID)
+	if err != nil {
+		return err
+	}
+	return v2Tokens(c, u.UserID, sessionID, refreshToken)
+}
+
+func v2GuestHandler(c echo.Context) error {
+	guestID, refreshToken, sessionID, err := service.CreateGuest()
+	if err != nil {
+		return err
+	}
+	return v2Tokens(c, guestID, sessionID, refreshToken)
+}
+
+type v2RefreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token" form:"refresh_token" validate:"required"`
+}
+
+func v2RefreshTokenHandler(c echo.Context) error {
+	var req v2RefreshTokenRequest
+	if err := v2Bind(c, &req); err != nil {
+		return err
+	}
+	next, old, err := service.RefreshSession(req.RefreshToken)
+	if err != nil {
+		return v2Err(err)
+	}
+	return v2Tokens(c, old.UserID, old.SessionID, next)
+}
+
+func v2Tokens(c echo.Context, userID, sessionID, refreshToken string) error {
+	tokens, err := newTokens(c, userID, sessionID, refreshToken)
+	if err != nil {
+		return v2Err(err)
+	}
+	return v2Data(c, tokens)
+}
+
+func v2LogoutHandler(c echo.Context) error {
+	claims := c.Get("user").(*jwt.Token).Claims.(jwt.MapClaims)
+	sessionID, _ := claims["sid"].(string)
+	if err := service.Logout(getUserIDFromContext(c), sessionID); err != nil {
+		return err
+	}
+	clearAuthCookie(c)
+	return v2Data(c, nil)
+}
+
+func v2LogoutEverywhereHandler(c echo.Context) error {
+	userID := getUserIDFromContext(c)
+	if err := service.LogoutEverywhere(userID, userID); err != nil {
+		return err
+	}
+	clearAuthCookie(c)
+	return v2Data(c, nil)
+}
+
+func v2OIDCProvidersHandler(c echo.Context) error {
+	return v2Data(c, service.OIDCProviders())
+}
+
+func v2IdentitiesHandler(c echo.Context) error {
+	return v2Data(c, service.ListIdentities(getUserIDFromContext(c)))
+}
+
+// links
+
+type v2ListLinksRequest struct {
+	SubmittedBy string `query:"submitted_by"`
+	Channel     string `query:"channel"`
+	State       string `query:"state" validate:"oneof=pending queued playing played removed rejected unavailable expired"`
+	Sort        string `query:"sort" validate:"oneof=newest oldest votes"`
+	Cursor      string `query:"cursor"`
+	From        int64  `query:"from" validate:"min=0"`
+	To          int64  `query:"to" validate:"min=0"`
+	MinVotes    int64  `query:"min_votes"`
+	Limit       int64  `query:"limit" validate:"min=1,max=100"`
+}
+
+func v2ListLinksHandler(c echo.Context) error {
+	var req v2ListLinksRequest
+	if err := v2Bind(c, &req); err != nil {
+		return err
+	}
+	page, err := service.ListLinks(LinkFilter{
+		SubmittedBy:   req.SubmittedBy,
+		ChannelName:   req.Channel,
+		State:         req.State,
+		Sort:          req.Sort,
+		Cursor:        req.Cursor,
+		CreatedAfter:  req.From,
+		CreatedBefore: req.To,
+		MinVotes:      req.MinVotes,
+		Limit:         req.Limit,
+	})
+	if err != nil {
+		return v2Err(err)
+	}
+	return v2Data(c, page)
+}
+
+func v2LinkByIDHandler(c echo.Context) error {
+	linkID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || linkID <= 0 {
+		return v2Fail(http.StatusUnprocessableEntity, "validation_failed", "Invalid request",
+			ValidationErrors{"id": "must be a link_id"})
+	}
+	link, err := service.GetLinkByID(linkID)
+	if err != nil {
+		return v2Err(err)
+	}
+	return v2Data(c, link)
+}
+
+type v2NewLinkRequest struct {
+	URL         string `json:"url" form:"url" validate:"required,url"`
+	DedicatedTo string `json:"dedicated_to" form:"dedicated_to" validate:"max=100"`
+}
+
+func v2NewLinkHandler(c echo.Context) error {
+	var req v2NewLinkRequest
+	if err := v2Bind(c, &req); err != nil {
+		return err
+	}
+	link, err := service.SubmitLink(req.URL, getUserIDFromContext(c), req.DedicatedTo)
+	if err != nil {
+		// the link couldn't be looked up on YouTube
+		return v2Fail(http.StatusUnprocessableEntity, "invalid_link", err.Error(), nil)
+	}
+	return v2Data(c, link)
+}
+
+type v2LinkRequest struct {
+	LinkID int64 `json:"link_id" form:"link_id" validate:"required,min=1"`
+}
+
+func v2UpvoteLinkHandler(c echo.Context) error {
+	return v2Vote(c, +1)
+}
+
+func v2DownvoteLinkHandler(c echo.Context) error {
+	return v2Vote(c, -1)
+}
+
+// v2Vote votes and responds with the link and its new tally. Vote checks the
+// link can be voted on, so a vote on a missing one is a 404 which changed nothing.
+func v2Vote(c echo.Context, score int64) error {
+	var req v2LinkRequest
+	if err := v2Bind(c, &req); err != nil {
+		return err
+	}
+	if err := service.Vote(req.LinkID, getUserIDFromContext(c), score); err != nil {
+		return v2Err(err)
+	}
+	link, err := service.GetLinkByID(req.LinkID)
+	if err != nil {
+		return v2Err(err)
+	}
+	link.MyVote = score
+	return v2Data(c, link)
+}
+
+func v2SkipLinkHandler(c echo.Context) error {
+	var req v2LinkRequest
+	if err := v2Bind(c, &req); err != nil {
+		return err
+	}
+	tally, err := service.SkipVote(req.LinkID, getUserIDFromContext(c))
+	if err != nil {
+		return v2Err(err)
+	}
+	return v2Data(c, tally)
+}
+
+// radio
+
+func v2NowPlayingHandler(c echo.Context) error {
+	return v2Data(c, nowPlayingWithVotes(getUserIDFromContext(c)))
+}
+
+func v2QueueHandler(c echo.Context) error {
+	return v2Data(c, queueWithVotes(radio.state().queue, getUserIDFromContext(c)))
+}
+
+// chat
+
+type v2ChatRequest struct {
+	LinkID int64 `query:"link_id" validate:"min=1"`
+	Before int64 `query:"before" validate:"min=1"`
+	Limit  int64 `query:"limit" validate:"min=1,max=200"`
+}
+
+func v2ChatHandler(c echo.Context) error {
+	var req v2ChatRequest
+	if err := v2Bind(c, &req); err != nil {
+		return err
+	}
+	return v2Data(c, withAuthors(service.ListChatMessages(ChatFilter{
+		LinkID: req.LinkID,
+		Before: req.Before,
+		Limit:  req.Limit,
+	})))
+}
+
+type v2SayInChatRequest struct {
+	Text string `json:"text" form:"text" validate:"required,max=500"`
+}
+
+func v2SayInChatHandler(c echo.Context) error {
+	var req v2SayInChatRequest
+	if err := v2Bind(c, &req); err != nil {
+		return err
+	}
+	m, err := sayInChat(getUserIDFromContext(c), req.Text)
+	if err != nil {
+		return v2Err(err)
+	}
+	return v2Data(c, m)
+}
+
+func v2ChatMutesHandler(c echo.Context) error {
+	return v2Data(c, service.ListChatMutes())
+}
+
+type v2DeleteChatMessageRequest struct {
+	MessageID int64  `json:"message_id" form:"message_id" validate:"required,min=1"`
+	Reason    string `json:"reason" form:"reason" validate:"max=500"`
+}
+
+func v2DeleteChatMessageHandler(c echo.Context) error {
+	var req v2DeleteChatMessageRequest
+	if err := v2Bind(c, &req); err != nil {
+		return err
+	}
+	if err := deleteFromChat(getUserIDFromContext(c), req.MessageID, req.Reason); err != nil {
+		return v2Err(err)
+	}
+	return v2Data(c, nil)
+}
+
+type v2MuteChatUserRequest struct {
+	UserID string `json:"user_id" form:"user_id" validate:"required"`
+	// seconds, until unmuted when missing
+	Duration int64  `json:"duration" form:"duration" validate:"min=0"`
+	Reason   string `json:"reason" form:"reason" validate:"max=500"`
+}
+
+func v2MuteChatUserHandler(c echo.Context) error {
+	var req v2MuteChatUserRequest
+	if err := v2Bind(c, &req); err != nil {
+		return err
+	}
+	mute, err := service.MuteChatUser(getUserIDFromContext(c), req.UserID,
+		time.Duration(req.Duration)*time.Second, req.Reason)
+	if err != nil {
+		return v2Err(err)
+	}
+	return v2Data(c, mute)
+}
+
+type v2UserRequest struct {
+	UserID string `json:"user_id" form:"user_id" validate:"required"`
+}
+
+func v2UnmuteChatUserHandler(c echo.Context) error {
+	var req v2UserRequest
+	if err := v2Bind(c, &req); err != nil {
+		return err
+	}
+	if err := service.UnmuteChatUser(getUserIDFromContext(c), req.UserID); err != nil {
+		return v2Err(err)
+	}
+	return v2Data(c, nil)
+}
+
+// tokens
+
+func v2AccessTokensHandler(c echo.Context) error {
+	return v2Data(c, service.ListAccessTokens(getUserIDFromContext(c)))
+}
+
+type v2CreateAccessTokenRequest struct {
+	Name string `json:"name" form:"name" validate:"required,max=100"`
+	// a list, or a comma separated string like v1 takes
+	Scopes    []string `json:"scopes" form:"scopes" validate:"required"`
+	ExpiresIn int64    `json:"expires_in" form:"expires_in" validate:"min=0"`
+}
+
+func v2CreateAccessTokenHandler(c echo.Context) error {
+	var req v2CreateAccessTokenRequest
+	if err := v2Bind(c, &req); err != nil {
+		return err
+	}
+	scopes := splitList(strings.Join(req.Scopes, ","))
+	raw, t, err := service.CreateAccessToken(getUserIDFromContext(c), req.Name,
+		scopes, time.Duration(req.ExpiresIn)*time.Second)
+	if err != nil {
+		return v2Err(err)
+	}
+	return v2Data(c, echo.Map{
+		"token":   raw,
+		"details": t,
+	})
+}
+
+type v2RevokeAccessTokenRequest struct {
+	TokenID int64 `json:"token_id" form:"token_id" validate:"required,min=1"`
+}
+
+func v2RevokeAccessTokenHandler(c echo.Context) error {
+	var req v2RevokeAccessTokenRequest
+	if err := v2Bind(c, &req); err != nil {
+		return err
+	}
+	userID := getUserIDFromContext(c)
+	if err := service.RevokeAccessTokens(userID, userID, req.TokenID); err != nil {
+		return v2Err(err)
+	}
+	return v2Data(c, nil)
+}
+
+// notifications
+
+func v2NotificationsHandler(c echo.Context) error {
+	return v2Data(c, service.GetNotifications(getUserIDFromContext(c)))
+}
+
+type v2ReadNotificationsRequest struct {
+	// all of them when missing
+	UpTo int64 `json:"up_to" form:"up_to" validate:"min=1"`
+}
+
+func v2ReadNotificationsHandler(c echo.Context) error {
+	var req v2ReadNotificationsRequest
+	if err := v2Bind(c, &req); err != nil {
+		return err
+	}
+	if req.UpTo == 0 {
+		req.UpTo = math.MaxInt64
+	}
+	if err := service.MarkNotificationsRead(getUserIDFromContext(c), req.UpTo); err != nil {
+		return err
+	}
+	return v2Data(c, nil)
+}
+
+// moderation
+
+type v2PendingLinksRequest struct {
+	Cursor string `query:"cursor"`
+}
+
+func v2PendingLinksHandler(c echo.Context) error {
+	var req v2PendingLinksRequest
+	if err := v2Bind(c, &req); err != nil {
+		return err
+	}
+	page, err := service.ListLinks(LinkFilter{
+		State:  string(linkPending),
+		Sort:   linkSortOldest,
+		Cursor: req.Cursor,
+	})
+	if err != nil {
+		return v2Err(err)
+	}
+	return v2Data(c, page)
+}
+
+type v2ModerationRequest struct {
+	LinkID int64  `json:"link_id" form:"link_id" validate:"required,min=1"`
+	Reason string `json:"reason" form:"reason" validate:"max=500"`
+}
+
+func v2ApproveLinkHandler(c echo.Context) error {
+	var req v2ModerationRequest
+	if err := v2Bind(c, &req); err != nil {
+		return err
+	}
+	return v2Moderated(c)(service.ApproveLink(req.LinkID, getUserIDFromContext(c)))
+}
+
+func v2RejectLinkHandler(c echo.Context) error {
+	return v2ModerateWithReason(c, service.RejectLink)
+}
+
+func v2RemoveLinkHandler(c echo.Context) error {
+	return v2ModerateWithReason(c, service.RemoveLink)
+}
+
+func v2ModerateWithReason(c echo.Context, action func(linkID int64, moderatorID, reason string) (*Link, error)) error {
+	var req v2ModerationRequest
+	if err := v2Bind(c, &req); err != nil {
+		return err
+	}
+	if req.Reason == "" {
+		return v2Fail(http.StatusUnprocessableEntity, "validation_failed", "Invalid request",
+			ValidationErrors{"reason": "is required"})
+	}
+	return v2Moderated(c)(action(req.LinkID, getUserIDFromContext(c), req.Reason))
+}
+
+func v2Moderated(c echo.Context) func(*Link, error) error {
+	return func(link *Link, err error) error {
+		if err != nil {
+			return v2Err(err)
+		}
+		return v2Data(c, link)
+	}
+}
+
+// admin
+
+type v2AuditLogRequest struct {
+	Actor  string `query:"actor"`
+	Action string `query:"action"`
+	Target string `query:"target"`
+	From   int64  `query:"from" validate:"min=0"`
+	To     int64  `query:"to" validate:"min=0"`
+	Before int64  `query:"before" validate:"min=1"`
+	Limit  int64  `query:"limit" validate:"min=1,max=500"`
+}
+
+func v2AuditLogHandler(c echo.Context) error {
+	var req v2AuditLogRequest
+	if err := v2Bind(c, &req); err != nil {
+		return err
+	}
+	entries, err := service.ListAudit(AuditFilter{
+		Actor:  req.Actor,
+		Action: req.Action,
+		Target: req.Target,
+		Since:  req.From,
+		Until:  req.To,
+		Before: req.Before,
+		Limit:  req.Limit,
+	})
+	if err != nil {
+		return err
+	}
+	return v2Data(c, entries)
+}
+
+// v2RolesHandler lists the roles of user_id, or the holders of role
+type v2RolesRequest struct {
+	UserID string `query:"user_id"`
+	Role   string `query:"role" validate:"oneof=admin moderator"`
+}
+
+func v2RolesHandler(c echo.Context) error {
+	var req v2RolesRequest
+	if err := v2Bind(c, &req); err != nil {
+		return err
+	}
+	if req.UserID != "" {
+		return v2Data(c, echo.Map{
+			"user_id": req.UserID,
+			"roles":   service.GetRoles(req.UserID),
+		})
+	}
+	if req.Role == "" {
+		return v2Fail(http.StatusUnprocessableEntity, "validation_failed", "Pass user_id or role",
+			ValidationErrors{"user_id": "is required without role", "role": "is required without user_id"})
+	}
+	grants, err := service.ListRoleHolders(req.Role)
+	if err != nil {
+		return v2Err(err)
+	}
+	return v2Data(c, grants)
+}
+
+func v2GrantRoleHandler(c echo.Context) error {
+	return v2ChangeRole(c, service.GrantRole)
+}
+
+func v2RevokeRoleHandler(c echo.Context) error {
+	return v2ChangeRole(c, service.RevokeRole)
+}
+
+type v2RoleRequest struct {
+	UserID string `json:"user_id" form:"user_id" validate:"required"`
+	Role   string `json:"role" form:"role" validate:"required,oneof=admin moderator"`
+}
+
+func v2ChangeRole(c echo.Context, action func(actor, userID, role string) error) error {
+	var req v2RoleRequest
+	if err := v2Bind(c, &req); err != nil {
+		return err
+	}
+	if err := action(getUserIDFromContext(c), req.UserID, req.Role); err != nil {
+		return v2Err(err)
+	}
+	return v2Data(c, echo.Map{
+		"user_id": req.UserID,
+		"roles":   service.GetRoles(req.UserID),
+	})
+}
+
+func v2RevokeUserTokensHandler(c echo.Context) error {
+	var req v2UserRequest
+	if err := v2Bind(c, &req); err != nil {
+		return err
+	}
+	actor := getUserIDFromContext(c)
+	if err := service.LogoutEverywhere(actor, req.UserID); err != nil {
+		return err
+	}
+	if err := service.RevokeAccessTokens(actor, req.UserID, 0); err != nil {
+		return err
+	}
+	return v2Data(c, nil)
+}
+
+func v2RateLimitsHandler(c echo.Context) error {
+	return v2Data(c, service.GetRateRules())
+}
+
+type v2SetRateLimitRequest struct {
+	Endpoint string `json:"endpoint" form:"endpoint" validate:"required,oneof=link.new link.vote guest.new"`
+	Scope    string `json:"scope" form:"scope" validate:"required,oneof=user ip global"`
+	Capacity int64  `json:"capacity" form:"capacity" validate:"min=0"`
+	Period   int64  `json:"period" form:"period" validate:"min=0"`
+}
+
+func v2SetRateLimitHandler(c echo.Context) error {
+	var req v2SetRateLimitRequest
+	if err := v2Bind(c, &req); err != nil {
+		return err
+	}
+	rule := RateRule{Endpoint: req.Endpoint, Scope: req.Scope, Capacity: req.Capacity, Period: req.Period}
+	if err := service.SetRateRule(getUserIDFromContext(c), rule); err != nil {
+		return v2Err(err)
+	}
+	return v2Data(c, rule)
+}
+
+// webhooks
+
+func v2WebhooksHandler(c echo.Context) error {
+	return v2Data(c, service.ListWebhooks())
+}
+
+type v2CreateWebhookRequest struct {
+	URL string `json:"url" form:"url" validate:"required,url"`
+	// a list, or a comma separated string like v1 takes
+	Events []string `json:"events" form:"events" validate:"required"`
+}
+
+func v2CreateWebhookHandler(c echo.Context) error {
+	var req v2CreateWebhookRequest
+	if err := v2Bind(c, &req); err != nil {
+		return err
+	}
+	events := splitList(strings.Join(req.Events, ","))
+	secret, w, err := service.CreateWebhook(getUserIDFromContext(c), req.URL, events)
+	if err != nil {
+		return v2Err(err)
+	}
+	return v2Data(c, echo.Map{
+		"secret":  secret,
+		"details": w,
+	})
+}
+
+type v2UpdateWebhookRequest struct {
+	WebhookID int64 `json:"webhook_id" form:"webhook_id" validate:"required,min=1"`
+	// both keep their current value when missing
+	URL    string   `json:"url" form:"url" validate:"url"`
+	Events []string `json:"events" form:"events"`
+}
+
+func v2UpdateWebhookHandler(c echo.Context) error {
+	var req v2UpdateWebhookRequest
+	if err := v2Bind(c, &req); err != nil {
+		return err
+	}
+	events := splitList(strings.Join(req.Events, ","))
+	w, err := service.UpdateWebhook(getUserIDFromContext(c), req.WebhookID, req.URL, events)
+	if err != nil {
+		return v2Err(err)
+	}
+	return v2Data(c, w)
+}
+
+func v2PauseWebhookHandler(c echo.Context) error {
+	return v2SetWebhookActive(c, false)
+}
+
+func v2ResumeWebhookHandler(c echo.Context) error {
+	return v2SetWebhookActive(c, true)
+}
+
+type v2WebhookRequest struct {
+	WebhookID int64 `json:"webhook_id" form:"webhook_id" validate:"required,min=1"`
+}
+
+func v2SetWebhookActive(c echo.Context, active bool) error {
+	var req v2WebhookRequest
+	if err := v2Bind(c, &req); err != nil {
+		return err
+	}
+	w, err := service.SetWebhookActive(getUserIDFromContext(c), req.WebhookID, active)
+	if err != nil {
+		return v2Err(err)
+	}
+	return v2Data(c, w)
+}
+
+func v2DeleteWebhookHandler(c echo.Context) error {
+	var req v2WebhookRequest
+	if err := v2Bind(c, &req); err != nil {
+		return err
+	}
+	if err := service.DeleteWebhook(getUserIDFromContext(c), req.WebhookID); err != nil {
+		return v2Err(err)
+	}
+	return v2Data(c, nil)
+}
+
+type v2WebhookDeliveriesRequest struct {
+	WebhookID int64  `query:"webhook_id" validate:"min=1"`
+	Status    string `query:"status" validate:"oneof=pending delivered failed"`
+	Before    int64  `query:"before" validate:"min=1"`
+	Limit     int64  `query:"limit" validate:"min=1,max=500"`
+}
+
+func v2WebhookDeliveriesHandler(c echo.Context) error {
+	var req v2WebhookDeliveriesRequest
+	if err := v2Bind(c, &req); err != nil {
+		return err
+	}
+	deliveries, err := service.ListWebhookDeliveries(WebhookDeliveryFilter{
+		WebhookID: req.WebhookID,
+		Status:    req.Status,
+		Before:    req.Before,
+		Limit:     req.Limit,
+	})
+	if err != nil {
+		return v2Err(err)
+	}
+	return v2Data(c, deliveries)
+}
+
+type v2RedeliverWebhookRequest struct {
+	DeliveryID int64 `json:"delivery_id" form:"delivery_id" validate:"required,min=1"`
+}
+
+func v2RedeliverWebhookHandler(c echo.Context) error {
+	var req v2RedeliverWebhookRequest
+	if err := v2Bind(c, &req); err != nil {
+		return err
+	}
+	d, err := service.RedeliverWebhook(getUserIDFromContext(c), req.DeliveryID)
+	if err != nil {
+		return v2Err(err)
+	}
+	return v2Data(c, d)
+}
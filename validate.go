@@ -0,0 +1,239 @@
+package main
+
+// this file checks the `validate` tags of request structs, for c.Validate
+//
+// the tags are comma separated rules:
+//   required   not the zero value
+//   min=N      numbers at least N, strings at least N characters long
+//   max=N      numbers at most N, strings at most N characters long
+//   oneof=a b  one of the values, separated by spaces
+//   url        an absolute http or https URL
+// Empty values only fail `required`, so optional fields can have rules too.
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// ValidationErrors maps the fields of a request which failed to what is wrong with them
+type ValidationErrors map[string]string
+
+func (v ValidationErrors) Error() string {
+	fields := make([]string, 0, len(v))
+	for field, problem := range v {
+		fields = append(fields, field+" "+problem)
+	}
+	return strings.Join(fields, ", ")
+}
+
+// tagValidator checks requests against the rules of their tags. The tags are
+// parsed by newTagValidator, so a mistake in them stops the router from being
+// built instead of failing requests.
+type tagValidator struct {
+	fields map[reflect.Type][]fieldRules
+}
+
+type fieldRules struct {
+	index int
+	name  string
+	rules []rule
+}
+
+type rule struct {
+	name    string
+	arg     string
+	limit   float64
+	allowed []string
+}
+
+// newTagValidator parses the tags of the requests it will be asked to check
+func newTagValidator(requests ...interface{}) (*tagValidator, error) {
+	v := &tagValidator{fields: make(map[reflect.Type][]fieldRules)}
+	for _, req := range requests {
+		t := reflect.Indirect(reflect.ValueOf(req)).Type()
+		if t.Kind() != reflect.Struct {
+			return nil, fmt.Errorf("can't validate a %s", t)
+		}
+		var fields []fieldRules
+		for n := 0; n < t.NumField(); n++ {
+			tag := t.Field(n).Tag.Get("validate")
+			if tag == "" {
+				continue
+			}
+			rules, err := parseRules(t.Field(n).Type, strings.Split(tag, ","))
+			if err != nil {
+				return nil, fmt.Errorf("%s.%s: %v", t, t.Field(n).Name, err)
+			}
+			fields = append(fields, fieldRules{index: n, name: fieldName(t.Field(n)), rules: rules})
+		}
+		v.fields[t] = fields
+	}
+	return v, nil
+}
+
+func (tv *tagValidator) Validate(i interface{}) error {
+	v := reflect.Indirect(reflect.ValueOf(i))
+	fields, ok := tv.fields[v.Type()]
+	if !ok {
+		return fmt.Errorf("%s isn't known to the validator", v.Type())
+	}
+
+	errs := make(ValidationErrors)
+	for _, f := range fields {
+		if problem := checkRules(v.Field(f.index), f.rules); problem != "" {
+			errs[f.name] = problem
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// fieldName is the name clients know a field by
+func fieldName(f reflect.StructField) string {
+	for _, key := range []string{"json", "form", "query"} {
+		if name := strings.Split(f.Tag.Get(key), ",")[0]; name != "" && name != "-" {
+			return name
+		}
+	}
+	return f.Name
+}
+
+// parseRules reads the rules of a tag, and makes sure they apply to fields of type t
+func parseRules(t reflect.Type, tags []string) ([]rule, error) {
+	rules := make([]rule, 0, len(tags))
+	for _, tag := range tags {
+		r := rule{name: tag}
+		if i := strings.Index(tag, "="); i >= 0 {
+			r.name, r.arg = tag[:i], tag[i+1:]
+		}
+
+		switch r.name {
+		case "required":
+		case "min", "max":
+			limit, err := strconv.ParseFloat(r.arg, 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad %s rule %q", r.name, tag)
+			}
+			if _, measurable := measure(reflect.Zero(t)); !measurable {
+				return nil, fmt.Errorf("%s doesn't apply to a %s", r.name, t)
+			}
+			r.limit = limit
+		case "oneof":
+			r.allowed = strings.Fields(r.arg)
+			if len(r.allowed) == 0 {
+				return nil, fmt.Errorf("bad oneof rule %q", tag)
+			}
+			if t.Kind() != reflect.String && !isInteger(t.Kind()) {
+				return nil, fmt.Errorf("oneof doesn't apply to a %s", t)
+			}
+		case "url":
+			if t.Kind() != reflect.String {
+				return nil, fmt.Errorf("url doesn't apply to a %s", t)
+			}
+		default:
+			return nil, fmt.Errorf("unknown rule %q", tag)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// checkRules returns what is wrong with a value, or "" when nothing is
+func checkRules(v reflect.Value, rules []rule) string {
+	empty := isZero(v)
+	for _, r := range rules {
+		if r.name == "required" {
+			if empty {
+				return "is required"
+			}
+			continue
+		}
+		if empty {
+			continue
+		}
+
+		switch r.name {
+		case "min", "max":
+			size, _ := measure(v)
+			if r.name == "min" && size < r.limit {
+				return fmt.Sprintf("must be at least %s%s", r.arg, unitOf(v))
+			}
+			if r.name == "max" && size > r.limit {
+				return fmt.Sprintf("must be at most %s%s", r.arg, unitOf(v))
+			}
+		case "oneof":
+			if !contains(r.allowed, fmt.Sprint(v.Interface())) {
+				return "must be one of " + strings.Join(r.allowed, ", ")
+			}
+		case "url":
+			u, err := url.Parse(v.String())
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return "must be an http or https URL"
+			}
+		}
+	}
+	return ""
+}
+
+// measure returns what min and max compare against, and false for the kinds
+// they don't apply to
+func measure(v reflect.Value) (float64, bool) {
+	switch v.Kind() {
+	case reflect.String:
+		return float64(utf8.RuneCountInString(v.String())), true
+	case reflect.Slice, reflect.Map:
+		return float64(v.Len()), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	}
+	return 0, false
+}
+
+// unitOf is what min and max count a value in
+func unitOf(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.String:
+		return " characters long"
+	case reflect.Slice, reflect.Map:
+		return " items"
+	}
+	return ""
+}
+
+func isInteger(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+func isZero(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+	return v.Interface() == reflect.Zero(v.Type()).Interface()
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,202 @@
+package main
+
+// this file sends webhook deliveries, on the leader only
+//
+// every few seconds the leader picks the deliveries which are due and POSTs
+// them, one at a time to each webhook and to every webhook at once. A delivery is
+// retried with exponential backoff until it gets a 2xx, up to
+// webhookMaxAttempts times. Receivers should check the signature:
+//
+//	X-Upnext-Signature: sha256=hex(HMAC-SHA256(secret, X-Upnext-Timestamp + "." + body))
+//
+// A delivery can be sent twice when the leader changes while sending it,
+// the delivery_id in the body tells them apart.
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	webhookMaxAttempts int64 = 8
+	webhookBatchSize   int64 = 50
+	// the first retry waits this long, every later one twice as long as the one before
+	webhookRetryAfter    = time.Second * 30
+	webhookMaxRetryAfter = time.Hour
+	webhookTimeout       = time.Second * 10
+)
+
+// webhookBody is what a webhook receives
+type webhookBody struct {
+	DeliveryID int64           `json:"delivery_id"`
+	Event      string          `json:"event"`
+	CreatedAt  int64           `json:"created_at"`
+	Data       json.RawMessage `json:"data"`
+}
+
+type WebhookDispatcher struct {
+	service Service
+	client  *http.Client
+	every   time.Duration
+
+	running   bool
+	interrupt chan interface{}
+}
+
+func NewWebhookDispatcher(s Service, every time.Duration) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		service:   s,
+		client:    &http.Client{Timeout: webhookTimeout},
+		every:     every,
+		interrupt: make(chan interface{}, 1),
+	}
+}
+
+// SwitchMode starts sending on the leader and stops everywhere else
+func (d *WebhookDispatcher) SwitchMode(isLeader bool) {
+	if isLeader && !d.running && d.every > 0 {
+		d.running = true
+		go d.run()
+	} else if !isLeader && d.running {
+		d.Shutdown()
+	}
+}
+
+func (d *WebhookDispatcher) Shutdown() {
+	if d.running {
+		d.running = false
+		d.interrupt <- true
+	}
+}
+
+func (d *WebhookDispatcher) run() {
+	ticker := time.NewTicker(d.every)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.runOnce()
+		case <-d.interrupt:
+			return
+		}
+	}
+}
+
+func (d *WebhookDispatcher) runOnce() {
+	byWebhook := make(map[int64][]WebhookDelivery)
+	for _, delivery := range d.service.DueWebhookDeliveries(time.Now(), webhookBatchSize) {
+		byWebhook[delivery.WebhookID] = append(byWebhook[delivery.WebhookID], delivery)
+	}
+
+	wg := sync.WaitGroup{}
+	for webhookID, deliveries := range byWebhook {
+		wg.Add(1)
+		go func(webhookID int64, deliveries []WebhookDelivery) {
+			defer wg.Done()
+			w, err := d.service.GetWebhook(webhookID)
+			for _, delivery := range deliveries {
+				d.deliver(w, err, delivery)
+			}
+		}(webhookID, deliveries)
+	}
+	wg.Wait()
+}
+
+func (d *WebhookDispatcher) deliver(w *Webhook, err error, delivery WebhookDelivery) {
+	now := time.Now()
+	delivery.Attempts++
+	delivery.LastAttemptAt = now.Unix()
+	delivery.ResponseCode = 0
+
+	if err == nil && !w.Active {
+		err = errors.New("the webhook is paused")
+	}
+	if err == nil {
+		delivery.ResponseCode, err = d.send(w, delivery, now)
+	}
+
+	switch {
+	case err == nil:
+		delivery.Status = deliveryDelivered
+		delivery.DeliveredAt = now.Unix()
+		delivery.LastError = ""
+	case delivery.Attempts >= webhookMaxAttempts || w == nil || !w.Active:
+		delivery.Status = deliveryFailed
+		delivery.LastError = err.Error()
+	default:
+		delivery.NextAttemptAt = now.Add(webhookBackoff(delivery.Attempts)).Unix()
+		delivery.LastError = err.Error()
+	}
+	if err = d.service.RecordWebhookAttempt(delivery); err != nil {
+		log.Println("failed to record webhook delivery", delivery.DeliveryID, err)
+	}
+}
+
+// send POSTs a delivery, and returns the status code of the response
+func (d *WebhookDispatcher) send(w *Webhook, delivery WebhookDelivery, now time.Time) (int64, error) {
+	body, err := json.Marshal(webhookBody{
+		DeliveryID: delivery.DeliveryID,
+		Event:      delivery.Event,
+		CreatedAt:  delivery.CreatedAt,
+		Data:       delivery.Payload,
+	})
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "upnext-webhooks")
+	req.Header.Set("X-Upnext-Event", delivery.Event)
+	req.Header.Set("X-Upnext-Delivery", strconv.FormatInt(delivery.DeliveryID, 10))
+	req.Header.Set("X-Upnext-Timestamp", timestamp)
+	req.Header.Set("X-Upnext-Signature", "sha256="+signWebhook(w.Secret, timestamp, body))
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	// drain some of it so the connection can be reused
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64<<10))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return int64(res.StatusCode), errors.New("unexpected response " + res.Status)
+	}
+	return int64(res.StatusCode), nil
+}
+
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBackoff is how long to wait after the attempt-th failed attempt
+func webhookBackoff(attempt int64) time.Duration {
+	wait := webhookRetryAfter
+	for i := int64(1); i < attempt && wait < webhookMaxRetryAfter; i++ {
+		wait *= 2
+	}
+	if wait > webhookMaxRetryAfter {
+		wait = webhookMaxRetryAfter
+	}
+	return wait
+}
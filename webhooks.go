@@ -0,0 +1,464 @@
+package main
+
+// this file lets other systems follow the station through webhooks
+//
+// admins subscribe a URL to some of webhookEvents. When one of them happens,
+// on whichever node, a delivery is queued for every active webhook which
+// wants it. Only the leader sends them, see webhook_dispatcher.go, so each
+// event goes out once however many nodes there are. The deliveries stay
+// around as a log, and a failed one can be sent again.
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	webhookSongStarted    = "song.started"
+	webhookSongEnded      = "song.ended"
+	webhookSongSkipped    = "song.skipped"
+	webhookLinkSubmitted  = "link.submitted"
+	webhookQueueTopChange = "queue.top_changed"
+
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+
+	webhookSecretPrefix = "whsec_"
+
+	defaultDeliveriesPage int64 = 50
+	maxDeliveriesPage     int64 = 500
+
+	webhookColumns  = `webhook_id, url, events, secret, active, created_by, created_at`
+	deliveryColumns = `delivery_id, webhook_id, event, payload, status, attempts, next_attempt_at,
+	  last_attempt_at, response_code, last_error, created_at, delivered_at`
+)
+
+var (
+	ErrWebhookNotFound         = errors.New("webhook not found")
+	ErrWebhookDeliveryNotFound = errors.New("webhook delivery not found")
+	ErrInvalidWebhookURL       = errors.New("webhook url must be an absolute http or https URL")
+	ErrInvalidWebhookEvents    = errors.New("events must be some of song.started, song.ended, song.skipped, link.submitted and queue.top_changed")
+
+	webhookEvents = map[string]bool{
+		webhookSongStarted:    true,
+		webhookSongEnded:      true,
+		webhookSongSkipped:    true,
+		webhookLinkSubmitted:  true,
+		webhookQueueTopChange: true,
+	}
+
+	deliveryStatuses = map[string]bool{
+		deliveryPending:   true,
+		deliveryDelivered: true,
+		deliveryFailed:    true,
+	}
+)
+
+// scanWebhook reads a row of webhookColumns
+func scanWebhook(row interface{ Scan(...interface{}) error }) (*Webhook, error) {
+	w := &Webhook{}
+	var events string
+	err := row.Scan(&w.WebhookID, &w.URL, &events, &w.Secret, &w.Active, &w.CreatedBy, &w.CreatedAt)
+	w.Events = splitList(events)
+	return w, err
+}
+
+// scanWebhookDelivery reads a row of deliveryColumns
+func scanWebhookDelivery(row interface{ Scan(...interface{}) error }) (*WebhookDelivery, error) {
+	d := &WebhookDelivery{}
+	var payload string
+	err := row.Scan(&d.DeliveryID, &d.WebhookID, &d.Event, &payload, &d.Status, &d.Attempts, &d.NextAttemptAt,
+		&d.LastAttemptAt, &d.ResponseCode, &d.LastError, &d.CreatedAt, &d.DeliveredAt)
+	d.Payload = json.RawMessage(payload)
+	return d, err
+}
+
+func scanWebhookDeliveries(rows *sql.Rows) []WebhookDelivery {
+	defer rows.Close()
+
+	deliveries := make([]WebhookDelivery, 0)
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows)
+		if err != nil {
+			log.Fatal(err)
+		}
+		deliveries = append(deliveries, *d)
+	}
+	return deliveries
+}
+
+// buildDeliveryListQuery returns the query and its arguments for a filter,
+// written with `?` placeholders like buildAuditListQuery
+func buildDeliveryListQuery(f WebhookDeliveryFilter) (string, []interface{}) {
+	where := make([]string, 0)
+	args := make([]interface{}, 0)
+
+	if f.WebhookID > 0 {
+		where = append(where, "webhook_id = ?")
+		args = append(args, f.WebhookID)
+	}
+	if f.Status != "" {
+		where = append(where, "status = ?")
+		args = append(args, f.Status)
+	}
+	if f.Before > 0 {
+		where = append(where, "delivery_id < ?")
+		args = append(args, f.Before)
+	}
+	args = append(args, f.Limit)
+
+	query := `select ` + deliveryColumns + ` from webhook_deliveries`
+	if len(where) > 0 {
+		query += "\n\t  where " + strings.Join(where, " and ")
+	}
+	query += "\n\t  order by delivery_id desc\n\t  limit ?"
+	return query, args
+}
+
+func checkWebhook(rawURL string, events []string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ErrInvalidWebhookURL
+	}
+	if len(events) == 0 {
+		return ErrInvalidWebhookEvents
+	}
+	for _, event := range events {
+		if !webhookEvents[event] {
+			return ErrInvalidWebhookEvents
+		}
+	}
+	return nil
+}
+
+// CreateWebhook returns the secret deliveries are signed with, which is never
+// shown again, and the new webhook
+func (s *ServiceImpl) CreateWebhook(actor, rawURL string, events []string) (string, *Webhook, error) {
+	if err := checkWebhook(rawURL, events); err != nil {
+		return "", nil, err
+	}
+	w := &Webhook{
+		URL:       rawURL,
+		Events:    events,
+		Secret:    webhookSecretPrefix + newRandomToken(),
+		Active:    true,
+		CreatedBy: actor,
+		CreatedAt: time.Now().Unix(),
+	}
+	webhookID, err := s.webhookRepo.CreateWebhook(*w)
+	if err != nil {
+		return "", nil, err
+	}
+	w.WebhookID = webhookID
+	s.audit(actor, auditWebhookCreate, webhookTarget(webhookID), nil, w)
+	return w.Secret, w, nil
+}
+
+func (s *ServiceImpl) GetWebhook(webhookID int64) (*Webhook, error) {
+	w := s.webhookRepo.GetWebhook(webhookID)
+	if w == nil {
+		return nil, ErrWebhookNotFound
+	}
+	return w, nil
+}
+
+func (s *ServiceImpl) ListWebhooks() []Webhook {
+	return s.webhookRepo.ListWebhooks()
+}
+
+// UpdateWebhook changes where a webhook goes and what it gets,
+// an empty url or events keeps the current one
+func (s *ServiceImpl) UpdateWebhook(actor string, webhookID int64, rawURL string, events []string) (*Webhook, error) {
+	return s.changeWebhook(actor, webhookID, func(w *Webhook) error {
+		if rawURL != "" {
+			w.URL = rawURL
+		}
+		if len(events) > 0 {
+			w.Events = events
+		}
+		return checkWebhook(w.URL, w.Events)
+	})
+}
+
+// SetWebhookActive pauses or resumes a webhook, nothing is queued for it while it is paused
+func (s *ServiceImpl) SetWebhookActive(actor string, webhookID int64, active bool) (*Webhook, error) {
+	return s.changeWebhook(actor, webhookID, func(w *Webhook) error {
+		w.Active = active
+		return nil
+	})
+}
+
+func (s *ServiceImpl) changeWebhook(actor string, webhookID int64, change func(w *Webhook) error) (*Webhook, error) {
+	w, err := s.GetWebhook(webhookID)
+	if err != nil {
+		return nil, err
+	}
+	before := *w
+	if err = change(w); err != nil {
+		return nil, err
+	}
+	if err = s.webhookRepo.UpdateWebhook(*w); err != nil {
+		return nil, err
+	}
+	s.audit(actor, auditWebhookUpdate, webhookTarget(webhookID), before, w)
+	return w, nil
+}
+
+func (s *ServiceImpl) DeleteWebhook(actor string, webhookID int64) error {
+	w, err := s.GetWebhook(webhookID)
+	if err != nil {
+		return err
+	}
+	if err = s.webhookRepo.DeleteWebhook(webhookID); err != nil {
+		return err
+	}
+	s.audit(actor, auditWebhookDelete, webhookTarget(webhookID), w, nil)
+	return nil
+}
+
+func (s *ServiceImpl) ListWebhookDeliveries(filter WebhookDeliveryFilter) ([]WebhookDelivery, error) {
+	if filter.Status != "" && !deliveryStatuses[filter.Status] {
+		return nil, ErrInvalidFilter
+	}
+	if filter.Limit <= 0 {
+		filter.Limit = defaultDeliveriesPage
+	}
+	if filter.Limit > maxDeliveriesPage {
+		filter.Limit = maxDeliveriesPage
+	}
+	return s.webhookRepo.ListWebhookDeliveries(filter), nil
+}
+
+// RedeliverWebhook queues a delivery again, with a fresh set of attempts
+func (s *ServiceImpl) RedeliverWebhook(actor string, deliveryID int64) (*WebhookDelivery, error) {
+	d := s.webhookRepo.GetWebhookDelivery(deliveryID)
+	if d == nil {
+		return nil, ErrWebhookDeliveryNotFound
+	}
+	d.Status = deliveryPending
+	d.Attempts = 0
+	d.NextAttemptAt = time.Now().Unix()
+	if err := s.webhookRepo.UpdateWebhookDelivery(*d); err != nil {
+		return nil, err
+	}
+	s.audit(actor, auditWebhookRedeliver, webhookTarget(d.WebhookID), nil,
+		map[string]int64{"delivery_id": deliveryID})
+	return d, nil
+}
+
+func (s *ServiceImpl) DueWebhookDeliveries(now time.Time, limit int64) []WebhookDelivery {
+	return s.webhookRepo.DueWebhookDeliveries(now.Unix(), limit)
+}
+
+// RecordWebhookAttempt saves how an attempt to deliver went
+func (s *ServiceImpl) RecordWebhookAttempt(d WebhookDelivery) error {
+	return s.webhookRepo.UpdateWebhookDelivery(d)
+}
+
+func (s *ServiceImpl) PruneWebhookDeliveries(createdBefore time.Time) error {
+	return s.webhookRepo.DeleteWebhookDeliveries(createdBefore.Unix())
+}
+
+// QueueTopChanged is called by the leader's radio when another link leads the queue
+func (s *ServiceImpl) QueueTopChanged(top Link) {
+	s.publish(webhookQueueTopChange, top)
+}
+
+// publishSong tells webhooks about a link which started or stopped playing
+func (s *ServiceImpl) publishSong(l Link) {
+	switch {
+	case l.State == linkPlaying:
+		s.publish(webhookSongStarted, l)
+	case l.State == linkPlayed && l.StateReason == skippedByListeners:
+		s.publish(webhookSongSkipped, l)
+	case l.State == linkPlayed:
+		s.publish(webhookSongEnded, l)
+	}
+}
+
+// publish queues a delivery of event to every active webhook which wants it
+func (s *ServiceImpl) publish(event string, data interface{}) {
+	if s.webhookRepo == nil {
+		return
+	}
+	now := time.Now().Unix()
+	payload := snapshot(data)
+	for _, w := range s.webhookRepo.ListWebhooks() {
+		if !w.Active || !contains(w.Events, event) {
+			continue
+		}
+		_, err := s.webhookRepo.AddWebhookDelivery(WebhookDelivery{
+			WebhookID:     w.WebhookID,
+			Event:         event,
+			Payload:       payload,
+			Status:        deliveryPending,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+		})
+		if err != nil {
+			log.Println("failed to queue", event, "for webhook", w.WebhookID, err)
+		}
+	}
+}
+
+func webhooksHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, echo.Map{
+		"webhooks": service.ListWebhooks(),
+	})
+}
+
+func createWebhookHandler(c echo.Context) error {
+	form := struct {
+		URL    string `form:"url"`
+		Events string `form:"events"`
+	}{}
+	if err := c.Bind(&form); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"message": "Missing form data",
+		})
+	}
+
+	secret, w, err := service.CreateWebhook(getUserIDFromContext(c), form.URL, splitList(form.Events))
+	if err == ErrInvalidWebhookURL || err == ErrInvalidWebhookEvents {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"message": err.Error(),
+		})
+	}
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"secret":  secret,
+		"details": w,
+	})
+}
+
+func updateWebhookHandler(c echo.Context) error {
+	return changeWebhook(c, func(actor string, webhookID int64) (*Webhook, error) {
+		return service.UpdateWebhook(actor, webhookID, c.FormValue("url"), splitList(c.FormValue("events")))
+	})
+}
+
+func pauseWebhookHandler(c echo.Context) error {
+	return changeWebhook(c, func(actor string, webhookID int64) (*Webhook, error) {
+		return service.SetWebhookActive(actor, webhookID, false)
+	})
+}
+
+func resumeWebhookHandler(c echo.Context) error {
+	return changeWebhook(c, func(actor string, webhookID int64) (*Webhook, error) {
+		return service.SetWebhookActive(actor, webhookID, true)
+	})
+}
+
+func changeWebhook(c echo.Context, action func(actor string, webhookID int64) (*Webhook, error)) error {
+	webhookID, err := strconv.ParseInt(c.FormValue("webhook_id"), 10, 64)
+	if err != nil || webhookID <= 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"message": "Missing webhook_id",
+		})
+	}
+
+	w, err := action(getUserIDFromContext(c), webhookID)
+	switch err {
+	case nil:
+		return c.JSON(http.StatusOK, w)
+	case ErrInvalidWebhookURL, ErrInvalidWebhookEvents:
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"message": err.Error(),
+		})
+	case ErrWebhookNotFound:
+		return c.JSON(http.StatusNotFound, echo.Map{
+			"message": err.Error(),
+		})
+	}
+	return err
+}
+
+func deleteWebhookHandler(c echo.Context) error {
+	webhookID, err := strconv.ParseInt(c.FormValue("webhook_id"), 10, 64)
+	if err != nil || webhookID <= 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"message": "Missing webhook_id",
+		})
+	}
+
+	err = service.DeleteWebhook(getUserIDFromContext(c), webhookID)
+	if err == ErrWebhookNotFound {
+		return c.JSON(http.StatusNotFound, echo.Map{
+			"message": err.Error(),
+		})
+	}
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"message": "Done",
+	})
+}
+
+func webhookDeliveriesHandler(c echo.Context) error {
+	filter := WebhookDeliveryFilter{
+		Status: c.QueryParam("status"),
+	}
+
+	intParams := map[string]*int64{
+		"webhook_id": &filter.WebhookID,
+		"before":     &filter.Before,
+		"limit":      &filter.Limit,
+	}
+	for name, dst := range intParams {
+		if v := c.QueryParam(name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, echo.Map{
+					"message": "Invalid " + name,
+				})
+			}
+			*dst = n
+		}
+	}
+
+	deliveries, err := service.ListWebhookDeliveries(filter)
+	if err == ErrInvalidFilter {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"message": "Invalid status",
+		})
+	}
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"deliveries": deliveries,
+	})
+}
+
+func redeliverWebhookHandler(c echo.Context) error {
+	deliveryID, err := strconv.ParseInt(c.FormValue("delivery_id"), 10, 64)
+	if err != nil || deliveryID <= 0 {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"message": "Missing delivery_id",
+		})
+	}
+
+	d, err := service.RedeliverWebhook(getUserIDFromContext(c), deliveryID)
+	if err == ErrWebhookDeliveryNotFound {
+		return c.JSON(http.StatusNotFound, echo.Map{
+			"message": err.Error(),
+		})
+	}
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, d)
+}
@@ -0,0 +1,534 @@
+package main
+
+// this file serves the WebSocket API at /api/ws
+//
+// one socket carries what used to take an SSE connection per hook type, and
+// the votes, submissions and chat messages made over REST. Clients send commands:
+//
+//   {"id": "1", "type": "subscribe", "topics": ["nowPlaying", "queue", "playerTime", "myLinks", "chat"]}
+//   {"id": "2", "type": "unsubscribe", "topics": ["playerTime"]}
+//   {"id": "3", "type": "vote", "link_id": 7, "vote": 1}
+//   {"id": "4", "type": "submit", "url": "https://youtu.be/...", "dedicated_to": "..."}
+//   {"id": "5", "type": "skip_vote", "link_id": 7}
+//   {"id": "6", "type": "auth", "token": "<access token>"}
+//   {"id": "7", "type": "chat", "text": "what a song"}
+//   {"id": "8", "type": "ping"}
+//
+// and get an acknowledgement for each, with the same id:
+//
+//   {"type": "ack", "id": "3", "ok": true, "data": ...}
+//   {"type": "ack", "id": "3", "ok": false, "status": 429, "message": "...", "retry_after": 12}
+//
+// Subscribed topics arrive as {"type": "event", "topic": "queue", "data": ...},
+// with the same data the SSE endpoints send. The chat topic starts with the
+// backlog, and has chat and chatDeleted events like /api/stream. The socket authenticates like
+// them, with the cookie or a stream ticket, or later with an auth command.
+// Commands are checked like the REST routes they stand for: the session must
+// not be revoked, guests can't submit or skip, and the same rate limits apply.
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo"
+)
+
+const (
+	wsWriteWait  = time.Second * 10
+	wsPongWait   = time.Second * 60
+	wsPingEvery  = wsPongWait * 9 / 10
+	wsMaxMessage = 4096
+	// events wait here for a slow client, and are dropped once it is full
+	wsSendBuffer = 64
+
+	myLinksTopic = "myLinks"
+	// my links are polled, like the SSE endpoint does
+	myLinksEvery = time.Second * 2
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     wsCheckOrigin,
+}
+
+// wsCheckOrigin lets in pages from this host and from FRONTEND_URL,
+// since the socket may be authenticated by a cookie
+func wsCheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if u.Host == r.Host {
+		return true
+	}
+	frontend, err := url.Parse(os.Getenv("FRONTEND_URL"))
+	return err == nil && frontend.Host != "" && frontend.Scheme == u.Scheme && frontend.Host == u.Host
+}
+
+type wsCommand struct {
+	ID          string   `json:"id"`
+	Type        string   `json:"type"`
+	Topics      []string `json:"topics"`
+	LinkID      int64    `json:"link_id"`
+	Vote        int64    `json:"vote"`
+	URL         string   `json:"url"`
+	DedicatedTo string   `json:"dedicated_to"`
+	Token       string   `json:"token"`
+	Text        string   `json:"text"`
+}
+
+// wsError fails a command with the status its REST route would answer with
+type wsError struct {
+	status     int
+	message    string
+	retryAfter int64
+}
+
+type wsClient struct {
+	conn *websocket.Conn
+	ip   string
+	send chan interface{}
+	done chan struct{}
+
+	// nil for anonymous listeners
+	claims jwt.MapClaims
+	// topic -> closed to stop sending it
+	subs  map[string]chan struct{}
+	mutex *sync.Mutex
+}
+
+func wsHandler(c echo.Context) error {
+	claims := streamClaims(c)
+	conn, err := wsUpgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		// the upgrader has answered already
+		log.Println("websocket upgrade failed", err)
+		return nil
+	}
+
+	client := &wsClient{
+		conn:   conn,
+		ip:     clientIP(c.Request()),
+		send:   make(chan interface{}, wsSendBuffer),
+		done:   make(chan struct{}),
+		claims: claims,
+		subs:   make(map[string]chan struct{}),
+		mutex:  &sync.Mutex{},
+	}
+	log.Println("websocket connected for", client.userID())
+	go client.writeLoop()
+	client.readLoop()
+	log.Println("websocket closed for", client.userID())
+	return nil
+}
+
+func (w *wsClient) userID() string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	userID, _ := w.claims["user_id"].(string)
+	return userID
+}
+
+// push queues a message for the client, dropping it if the client can't keep up
+func (w *wsClient) push(msg interface{}) {
+	select {
+	case w.send <- msg:
+	case <-w.done:
+	default:
+		log.Println("websocket client is too slow, dropped a message for", w.userID())
+	}
+}
+
+func (w *wsClient) writeLoop() {
+	ticker := time.NewTicker(wsPingEvery)
+	defer ticker.Stop()
+	defer w.conn.Close()
+
+	for {
+		select {
+		case msg := <-w.send:
+			w.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := w.conn.WriteJSON(msg); err != nil {
+				return
+			}
+		case <-ticker.C:
+			w.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := w.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-w.done:
+			w.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			w.conn.WriteMessage(websocket.CloseMessage, []byte{})
+			return
+		}
+	}
+}
+
+func (w *wsClient) readLoop() {
+	defer w.close()
+	w.conn.SetReadLimit(wsMaxMessage)
+	w.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	w.conn.SetPongHandler(func(string) error {
+		return w.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		_, raw, err := w.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		w.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+
+		var cmd wsCommand
+		if err = json.Unmarshal(raw, &cmd); err != nil {
+			w.ack(cmd.ID, nil, &wsError{status: http.StatusBadRequest, message: "Invalid command"})
+			continue
+		}
+		data, cmdErr := w.handle(cmd)
+		w.ack(cmd.ID, data, cmdErr)
+	}
+}
+
+// close stops every subscription, and the writer
+func (w *wsClient) close() {
+	w.mutex.Lock()
+	for topic, stop := range w.subs {
+		close(stop)
+		delete(w.subs, topic)
+	}
+	w.mutex.Unlock()
+	close(w.done)
+}
+
+func (w *wsClient) ack(id string, data interface{}, err *wsError) {
+	if err != nil {
+		msg := echo.Map{
+			"type":    "ack",
+			"id":      id,
+			"ok":      false,
+			"status":  err.status,
+			"message": err.message,
+		}
+		if err.retryAfter > 0 {
+			msg["retry_after"] = err.retryAfter
+		}
+		w.push(msg)
+		return
+	}
+	w.push(echo.Map{
+		"type": "ack",
+		"id":   id,
+		"ok":   true,
+		"data": data,
+	})
+}
+
+func (w *wsClient) event(topic string, data interface{}) {
+	w.push(echo.Map{
+		"type":  "event",
+		"topic": topic,
+		"data":  data,
+	})
+}
+
+func (w *wsClient) handle(cmd wsCommand) (interface{}, *wsError) {
+	switch cmd.Type {
+	case "ping":
+		return "pong", nil
+	case "auth":
+		return w.authenticate(cmd.Token)
+	case "subscribe":
+		return w.subscribe(cmd.Topics)
+	case "unsubscribe":
+		return w.unsubscribe(cmd.Topics)
+	case "vote":
+		return w.vote(cmd.LinkID, cmd.Vote)
+	case "submit":
+		return w.submit(cmd.URL, cmd.DedicatedTo)
+	case "skip_vote":
+		return w.skipVote(cmd.LinkID)
+	case "chat":
+		return w.chat(cmd.Text)
+	}
+	return nil, &wsError{status: http.StatusBadRequest, message: "Unknown command " + cmd.Type}
+}
+
+// authenticate switches the socket to the user of an access token from login
+func (w *wsClient) authenticate(raw string) (interface{}, *wsError) {
+	claims := parseAccessToken(raw)
+	if claims == nil {
+		return nil, &wsError{status: http.StatusUnauthorized, message: "Missing or invalid token"}
+	}
+	w.mutex.Lock()
+	w.claims = claims
+	w.mutex.Unlock()
+	return echo.Map{"user_id": claims["user_id"]}, nil
+}
+
+// authorize checks the socket's session is still good for a command,
+// and returns who it is made by
+func (w *wsClient) authorize(needsAccount bool) (string, *wsError) {
+	w.mutex.Lock()
+	claims := w.claims
+	w.mutex.Unlock()
+
+	userID, _ := claims["user_id"].(string)
+	if userID == "" {
+		return "", &wsError{status: http.StatusUnauthorized, message: "Missing or invalid token"}
+	}
+	if service.IsTokenRevoked(claims) {
+		return "", &wsError{status: http.StatusUnauthorized, message: "Your session has ended, sign in again"}
+	}
+	if needsAccount && isGuest(userID) {
+		return "", &wsError{status: http.StatusForbidden, message: "Sign in to do this"}
+	}
+	return userID, nil
+}
+
+func (w *wsClient) rateLimit(endpoint, userID string) *wsError {
+	if seconds := retryAfter(endpoint, userID, w.ip); seconds > 0 {
+		return &wsError{
+			status:     http.StatusTooManyRequests,
+			message:    "Too many requests, try again later",
+			retryAfter: seconds,
+		}
+	}
+	return nil
+}
+
+func (w *wsClient) vote(linkID, vote int64) (interface{}, *wsError) {
+	if linkID == 0 || (vote != 1 && vote != -1) {
+		return nil, &wsError{status: http.StatusBadRequest, message: "Missing link_id, or vote isn't 1 or -1"}
+	}
+	userID, wsErr := w.authorize(false)
+	if wsErr != nil {
+		return nil, wsErr
+	}
+	if wsErr = w.rateLimit(rateEndpointVote, userID); wsErr != nil {
+		return nil, wsErr
+	}
+	if err := service.Vote(linkID, userID, vote); err != nil {
+		return nil, voteError(err)
+	}
+	return "Done", nil
+}
+
+func (w *wsClient) skipVote(linkID int64) (interface{}, *wsError) {
+	if linkID == 0 {
+		return nil, &wsError{status: http.StatusBadRequest, message: "Missing link_id"}
+	}
+	userID, wsErr := w.authorize(true)
+	if wsErr != nil {
+		return nil, wsErr
+	}
+	if wsErr = w.rateLimit(rateEndpointVote, userID); wsErr != nil {
+		return nil, wsErr
+	}
+	tally, err := service.SkipVote(linkID, userID)
+	if err != nil {
+		return nil, voteError(err)
+	}
+	return tally, nil
+}
+
+func voteError(err error) *wsError {
+	status := voteErrorStatus(err)
+	if status == 0 {
+		log.Println("websocket vote failed", err)
+		return &wsError{status: http.StatusInternalServerError, message: "Internal Server Error"}
+	}
+	return &wsError{status: status, message: err.Error()}
+}
+
+func (w *wsClient) submit(link, dedicatedTo string) (interface{}, *wsError) {
+	if link == "" {
+		return nil, &wsError{status: http.StatusBadRequest, message: "Missing url"}
+	}
+	userID, wsErr := w.authorize(true)
+	if wsErr != nil {
+		return nil, wsErr
+	}
+	if wsErr = w.rateLimit(rateEndpointSubmit, userID); wsErr != nil {
+		return nil, wsErr
+	}
+	l, err := service.SubmitLink(link, userID, dedicatedTo)
+	if err != nil {
+		return nil, &wsError{status: http.StatusBadRequest, message: err.Error()}
+	}
+	return l, nil
+}
+
+func (w *wsClient) chat(text string) (interface{}, *wsError) {
+	if text == "" {
+		return nil, &wsError{status: http.StatusBadRequest, message: "Missing text"}
+	}
+	userID, wsErr := w.authorize(true)
+	if wsErr != nil {
+		return nil, wsErr
+	}
+	if wsErr = w.rateLimit(rateEndpointChat, userID); wsErr != nil {
+		return nil, wsErr
+	}
+	m, err := sayInChat(userID, text)
+	if err != nil {
+		status := chatErrorStatus(err)
+		if status == 0 {
+			log.Println("websocket chat failed", err)
+			return nil, &wsError{status: http.StatusInternalServerError, message: "Internal Server Error"}
+		}
+		return nil, &wsError{status: status, message: err.Error()}
+	}
+	return m, nil
+}
+
+func (w *wsClient) subscribe(topics []string) (interface{}, *wsError) {
+	for _, topic := range topics {
+		if topic == myLinksTopic {
+			if _, wsErr := w.authorize(false); wsErr != nil {
+				return nil, wsErr
+			}
+		} else if topic != chatTopic && !IsValidHookType(HookType(topic)) {
+			return nil, &wsError{status: http.StatusBadRequest, message: "Invalid topic " + topic}
+		}
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for _, topic := range topics {
+		if _, ok := w.subs[topic]; ok {
+			continue
+		}
+		stop := make(chan struct{})
+		w.subs[topic] = stop
+		if topic == myLinksTopic {
+			go w.pollMyLinks(stop)
+		} else if topic == chatTopic {
+			go w.forwardChat(stop)
+		} else {
+			go w.forwardHook(HookType(topic), stop)
+		}
+	}
+	return echo.Map{"topics": w.topics()}, nil
+}
+
+func (w *wsClient) unsubscribe(topics []string) (interface{}, *wsError) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for _, topic := range topics {
+		if stop, ok := w.subs[topic]; ok {
+			close(stop)
+			delete(w.subs, topic)
+		}
+	}
+	return echo.Map{"topics": w.topics()}, nil
+}
+
+// topics lists the subscriptions, the mutex must be held
+func (w *wsClient) topics() []string {
+	topics := make([]string, 0, len(w.subs))
+	for topic := range w.subs {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// hookState is the current state of a hook, sent on subscribing so clients
+// don't wait for the next tick
+func hookState(hookType HookType) interface{} {
+	s := radio.state()
+	switch hookType {
+	case nowPlayingHook:
+		return s.nowPlaying
+	case playerTimeHook:
+		return s.playerTime
+	}
+	return s.queue
+}
+
+// forwardHook sends the radio's updates of a hook until stopped
+func (w *wsClient) forwardHook(hookType HookType, stop chan struct{}) {
+	id, hookChan := radio.RegisterHook(hookType)
+	defer radio.ReleaseHook(hookType, id, hookChan)
+
+	feed := &nowPlayingFeed{}
+	w.sendHookState(hookType, hookState(hookType), feed)
+	for {
+		select {
+		case state, open := <-hookChan:
+			if !open {
+				// the radio is switching modes, like SSE streams the socket ends
+				w.conn.Close()
+				return
+			}
+			w.sendHookState(hookType, state, feed)
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (w *wsClient) sendHookState(hookType HookType, state interface{}, feed *nowPlayingFeed) {
+	switch hookType {
+	case queueHook:
+		state = queueWithVotes(state.([]Link), w.userID())
+	case nowPlayingHook:
+		state = feed.describe(state.(*Link), w.userID())
+	}
+	w.event(string(hookType), state)
+}
+
+// pollMyLinks sends the user's links until stopped
+func (w *wsClient) pollMyLinks(stop chan struct{}) {
+	ticker := time.NewTicker(myLinksEvery)
+	defer ticker.Stop()
+	for {
+		userID, wsErr := w.authorize(false)
+		if wsErr != nil {
+			return
+		}
+		w.event(myLinksTopic, service.GetLinksByUser(userID))
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// forwardChat sends the backlog, then everything said or deleted until stopped
+func (w *wsClient) forwardChat(stop chan struct{}) {
+	wake := chats.listen()
+	defer chats.unlisten(wake)
+
+	backlog, seq := chats.Backlog()
+	for _, m := range backlog {
+		w.event(chatTopic, m)
+	}
+	for {
+		for _, e := range chats.Since(seq) {
+			w.event(e.Kind, e.data())
+			seq = e.seq
+		}
+
+		select {
+		case <-wake:
+		case <-stop:
+			return
+		}
+	}
+}
@@ -22,7 +22,12 @@ func FillYoutubeLinkMeta(link *Link) error {
 	if videoID == "" {
 		return errors.New("Invalid Link")
 	}
-	return fillVideoDetails(link, videoID)
+	youtubeRequests.Inc("videos.list")
+	err = fillVideoDetails(link, videoID)
+	if err != nil {
+		youtubeErrors.Inc("videos.list")
+	}
+	return err
 }
 
 func fillVideoDetails(link *Link, videoID string) error {